@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"jiangfengwhu/nagi-bot-go/database"
+)
+
+// compileInjectionPatterns 编译配置中的提示注入规则，配置校验时已经检查过
+func compileInjectionPatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		compiled = append(compiled, regexp.MustCompile(pattern))
+	}
+	return compiled
+}
+
+// checkAbuse 检查发言是否疑似提示注入或刷屏，违规时记录一次并返回提示，短时间内多次违规自动临时封禁
+// text 为玩家的原始发言，turn 为写入历史的发言（带角色名前缀），管理员不受限制
+// generated 表示发言由系统代玩家生成（如语音消息的固定提示），与过短的发言一样不统计重复
+func (b *Bot) checkAbuse(ctx context.Context, user *database.User, text string, turn string, generated bool) string {
+	if slices.Contains(b.config.Bot.AdminIds, user.TgId) {
+		return ""
+	}
+	abuse := b.config.Abuse
+	kind := ""
+	for _, pattern := range b.injectionPatterns {
+		if pattern.MatchString(text) {
+			kind = database.AbuseKindInjection
+			break
+		}
+	}
+	if kind == "" && !generated && utf8.RuneCountInString(text) >= abuse.RepeatMinRunes {
+		since := time.Now().Add(-time.Duration(abuse.RepeatWindowMinutes) * time.Minute)
+		repeated, err := b.db.CountRepeatedMessages(ctx, user.ID, turn, since)
+		if err != nil {
+			log.Printf("统计用户 %d 的重复发言失败: %v", user.ID, err)
+			return ""
+		}
+		if repeated+1 >= abuse.RepeatLimit {
+			kind = database.AbuseKindSpam
+		}
+	}
+	if kind == "" {
+		return ""
+	}
+
+	reason := "检测到疑似篡改天道设定的发言"
+	if kind == database.AbuseKindSpam {
+		reason = "请勿重复发送相同的内容"
+	}
+	since := time.Now().Add(-time.Duration(abuse.StrikeWindowMinutes) * time.Minute)
+	strikes, err := b.db.AddAbuseStrike(ctx, user.ID, kind, text, since)
+	if err != nil {
+		log.Printf("记录用户 %d 的违规失败: %v", user.ID, err)
+		return reason + "，本次发言已被拦截"
+	}
+	if strikes < abuse.MaxStrikes {
+		return fmt.Sprintf("%s，本次发言已被拦截（警告 %d/%d）", reason, strikes, abuse.MaxStrikes)
+	}
+
+	until := time.Now().Add(time.Duration(abuse.BanMinutes) * time.Minute)
+	banReason := fmt.Sprintf("%d 分钟内违规 %d 次，自动封禁", abuse.StrikeWindowMinutes, strikes)
+	if err := b.db.BanUser(ctx, user.ID, until, false, banReason); err != nil {
+		log.Printf("自动封禁用户 %d 失败: %v", user.ID, err)
+		return reason + "，本次发言已被拦截"
+	}
+	log.Printf("用户 %d 因%s被自动封禁至 %s", user.ID, banReason, until.Format("2006-01-02 15:04"))
+	return fmt.Sprintf("%s，多次违规，已被封禁至 %s", reason, until.Format("2006-01-02 15:04"))
+}
@@ -0,0 +1,453 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	"google.golang.org/genai"
+	tele "gopkg.in/telebot.v4"
+)
+
+const (
+	adminDefaultMessages = 10  // /admin msgs 默认查看的消息条数
+	adminMaxMessages     = 30  // /admin msgs 最多查看的消息条数
+	adminMessageRunes    = 150 // 查看消息时每段内容最多展示的字数
+	adminAuditListSize   = 20  // /admin audit 展示的操作条数
+)
+
+const adminUsage = `请输入正确的命令，格式为:
+/admin user <用户> 查看用户、角色和灵石
+/admin inv <用户> 查看当前角色的背包
+/admin set <用户> <属性JSON> 修改当前角色的属性
+/admin items <用户> <物品JSON数组> 增减当前角色的背包物品，数量为负数时扣除
+/admin msgs <用户> [条数] 查看最近的消息
+/admin reset <用户> 清空用户的对话历史
+/admin ban <用户> [原因] 永久封禁用户
+/admin tempban <用户> <小时> [原因] 临时封禁用户
+/admin shadowban <用户> [原因] 影子封禁，静默忽略用户的消息
+/admin unban <用户> 解封用户
+/admin bans 查看封禁中的用户
+/admin allow|disallow <@用户名|Telegram ID> 加入或移出邀请名单
+/admin allowlist 查看邀请名单
+/admin audit [用户] 查看管理操作记录
+/admin stats|export [开始日期] [结束日期] 查看或导出运营数据
+/admin broadcast <all|active:天数|realm:境界|location:地点> [at:2006-01-02T15:04] <内容> 预览并发送公告
+/admin broadcast cancel <公告ID> 取消定时或发送中的公告
+/admin broadcasts 查看公告和发送进度
+<用户> 为 @用户名 或 Telegram ID`
+
+// handleAdmin 处理 /admin 管理命令，所有操作都会写入审计日志
+func (b *Bot) handleAdmin(c tele.Context) error {
+	admin := c.Get("db_user").(*database.User)
+	if !slices.Contains(b.config.Bot.AdminIds, admin.TgId) {
+		return c.Reply("您没有权限使用此命令")
+	}
+
+	action, payload, _ := strings.Cut(strings.TrimSpace(c.Message().Payload), " ")
+	payload = strings.TrimSpace(payload)
+	switch action {
+	case "stats", "export":
+		return b.adminReport(c, admin, action, strings.Fields(payload))
+	case "audit":
+		return b.adminAudit(c, admin, payload)
+	case "broadcast":
+		return b.adminBroadcast(c, admin, payload)
+	case "broadcasts":
+		return b.adminShowBroadcasts(c, admin)
+	case "bans":
+		return b.adminShowBans(c, admin)
+	case "allow", "disallow", "allowlist":
+		return b.adminAllowlist(c, admin, action, payload)
+	case "user", "inv", "set", "items", "msgs", "reset", "ban", "tempban", "shadowban", "unban":
+	default:
+		return c.Reply(adminUsage)
+	}
+
+	ref, args, _ := strings.Cut(payload, " ")
+	args = strings.TrimSpace(args)
+	if ref == "" {
+		return c.Reply(adminUsage)
+	}
+	target, err := b.findUser(context.Background(), ref)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取用户失败: %v", err))
+	}
+	if target == nil {
+		return c.Reply(fmt.Sprintf("用户 %s 不存在", ref))
+	}
+
+	switch action {
+	case "user":
+		return b.adminShowUser(c, admin, target)
+	case "inv":
+		return b.adminShowInventory(c, admin, target)
+	case "set":
+		return b.adminSetStats(c, admin, target, args)
+	case "items":
+		return b.adminEditItems(c, admin, target, args)
+	case "msgs":
+		return b.adminShowMessages(c, admin, target, args)
+	case "reset":
+		if err := b.db.ClearUserMessages(context.Background(), target.ID); err != nil {
+			return c.Reply(fmt.Sprintf("清空对话历史失败: %v", err))
+		}
+		b.auditAdmin(admin, action, target, "")
+		return c.Reply(fmt.Sprintf("已清空 @%s 的对话历史", target.Username))
+	case "ban", "tempban", "shadowban":
+		return b.adminBan(c, admin, target, action, args)
+	case "unban":
+		if err := b.db.UnbanUser(context.Background(), target.ID); err != nil {
+			return c.Reply(fmt.Sprintf("解封失败: %v", err))
+		}
+		b.auditAdmin(admin, action, target, "")
+		return c.Reply(fmt.Sprintf("已解封 @%s", target.Username))
+	}
+	return nil
+}
+
+// findUser 按 @用户名 或 Telegram ID 查找用户，不存在时返回 nil
+func (b *Bot) findUser(ctx context.Context, ref string) (*database.User, error) {
+	if tgID, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return b.db.GetUser(ctx, tgID)
+	}
+	return b.db.GetUserByUsername(ctx, strings.TrimPrefix(ref, "@"))
+}
+
+// auditAdmin 把管理员操作写入审计日志，target 为 nil 表示不针对具体用户
+func (b *Bot) auditAdmin(admin *database.User, action string, target *database.User, detail string) {
+	entry := &database.AdminAuditLog{AdminTgID: admin.TgId, Action: action, Detail: detail}
+	if target != nil {
+		entry.TargetUserID = target.ID
+	}
+	if err := b.db.AddAdminAuditLog(context.Background(), entry); err != nil {
+		log.Printf("记录管理员 %d 的操作 %s 失败: %v", admin.TgId, action, err)
+	}
+}
+
+func (b *Bot) adminShowUser(c tele.Context, admin *database.User, target *database.User) error {
+	ctx := context.Background()
+	characters, err := b.db.GetUserCharacters(ctx, target.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取角色失败: %v", err))
+	}
+	b.auditAdmin(admin, "user", target, "")
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("👤 @%s（用户 #%d，TG %d）\n", target.Username, target.ID, target.TgId))
+	sb.WriteString(fmt.Sprintf("注册时间: %s\n", target.CreatedAt.Format("2006-01-02 15:04")))
+	sb.WriteString(fmt.Sprintf("灵石: %d（充值 %d，消耗 %d）\n", target.TotalRechargedToken-target.TotalUsedToken, target.TotalRechargedToken, target.TotalUsedToken))
+	if target.IsBanned() {
+		sb.WriteString(fmt.Sprintf("⛔ %s\n", formatBanInfo(target)))
+	}
+	sb.WriteString("\n角色：\n")
+	if len(characters) == 0 {
+		sb.WriteString("- 无\n")
+	}
+	var active *database.CharacterStats
+	for _, character := range characters {
+		mark := ""
+		if character.ID == target.ActiveCharacterID {
+			mark = "（当前）"
+			active = character
+		}
+		sb.WriteString(fmt.Sprintf("- #%d %s，第%d世，%s%d层，%s%s\n", character.ID, character.Name, character.Generation, character.Realm, character.RealmLevel, character.Status, mark))
+	}
+	if active != nil {
+		equipment, buffs, err := b.getCharacterBonuses(ctx, active.ID)
+		if err != nil {
+			return c.Reply(err.Error())
+		}
+		sb.WriteString("\n" + formatPlayerInfo(active, equipment, buffs))
+	}
+	return c.Reply(sb.String())
+}
+
+// adminActiveCharacter 获取目标用户的当前角色，没有角色时回复管理员并返回 nil
+func (b *Bot) adminActiveCharacter(c tele.Context, target *database.User) *database.CharacterStats {
+	player, err := b.db.GetActiveCharacter(context.Background(), target.ID)
+	if err != nil {
+		c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+		return nil
+	}
+	if player == nil {
+		c.Reply(fmt.Sprintf("@%s 还没有角色", target.Username))
+	}
+	return player
+}
+
+func (b *Bot) adminShowInventory(c tele.Context, admin *database.User, target *database.User) error {
+	player := b.adminActiveCharacter(c, target)
+	if player == nil {
+		return nil
+	}
+	ctx := context.Background()
+	inventory, err := b.db.GetCharacterInventory(ctx, player.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取背包物品失败: %v", err))
+	}
+	capacity, err := b.db.GetInventoryCapacity(ctx, player.ID, b.config.Game.InventoryCapacity)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取背包容量失败: %v", err))
+	}
+	b.auditAdmin(admin, "inv", target, player.Name)
+	return c.Reply(fmt.Sprintf("🎒 「%s」的背包（已用容量 %s）：\n%s", player.Name, capacity, formatInventoryBrief(inventory)))
+}
+
+func (b *Bot) adminSetStats(c tele.Context, admin *database.User, target *database.User, payload string) error {
+	var args map[string]any
+	if err := json.Unmarshal([]byte(payload), &args); err != nil || len(args) == 0 {
+		return c.Reply(`请输入正确的属性JSON，如: /admin set @用户名 {"realm":"筑基期","realm_level":1}`)
+	}
+	player := b.adminActiveCharacter(c, target)
+	if player == nil {
+		return nil
+	}
+	result, err := llm.UpdatePlayer(b.db, player.ID, args)
+	if err != nil {
+		return c.Reply(err.Error())
+	}
+	b.auditAdmin(admin, "set", target, fmt.Sprintf("角色 #%d %s", player.ID, payload))
+	return c.Reply(fmt.Sprintf("「%s」%s", player.Name, result))
+}
+
+func (b *Bot) adminEditItems(c tele.Context, admin *database.User, target *database.User, payload string) error {
+	var items []*database.InventoryItem
+	if err := json.Unmarshal([]byte(payload), &items); err != nil || len(items) == 0 {
+		return c.Reply(`请输入正确的物品JSON数组，如: /admin items @用户名 [{"item_name":"筑基丹","item_type":"丹药","quality":"稀有","quantity":1}]`)
+	}
+	player := b.adminActiveCharacter(c, target)
+	if player == nil {
+		return nil
+	}
+	for _, item := range items {
+		if item.ItemName == "" || item.Quantity == 0 {
+			return c.Reply("物品必须设置 item_name，且 quantity 不为0")
+		}
+		if item.ObtainedFrom == "" {
+			item.ObtainedFrom = "管理员发放"
+		}
+	}
+	if err := b.db.GrantInventoryItems(context.Background(), player.ID, database.GrantSourceAdmin, items); err != nil {
+		return c.Reply(fmt.Sprintf("修改背包物品失败: %v", err))
+	}
+	b.auditAdmin(admin, "items", target, fmt.Sprintf("角色 #%d %s", player.ID, payload))
+	changes := []string{}
+	for _, item := range items {
+		changes = append(changes, fmt.Sprintf("%s %+d", item.ItemName, item.Quantity))
+	}
+	return c.Reply(fmt.Sprintf("已修改「%s」的背包：%s", player.Name, strings.Join(changes, "，")))
+}
+
+func (b *Bot) adminShowMessages(c tele.Context, admin *database.User, target *database.User, args string) error {
+	limit := adminDefaultMessages
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n <= 0 || n > adminMaxMessages {
+			return c.Reply(fmt.Sprintf("条数必须在 1 到 %d 之间", adminMaxMessages))
+		}
+		limit = n
+	}
+	messages, err := b.db.GetRecentUserMessages(context.Background(), target.ID, limit)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取消息失败: %v", err))
+	}
+	b.auditAdmin(admin, "msgs", target, strconv.Itoa(limit))
+	if len(messages) == 0 {
+		return c.Reply(fmt.Sprintf("@%s 没有消息", target.Username))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("💬 @%s 最近的 %d 条消息：\n", target.Username, len(messages)))
+	for _, msg := range messages {
+		sb.WriteString(fmt.Sprintf("\n[%s] %s（角色 #%d）：\n", msg.CreatedAt.Format("01-02 15:04"), msg.Role, msg.CharacterID))
+		for _, part := range msg.Content.([]*genai.Part) {
+			switch {
+			case part.Text != "":
+				sb.WriteString(truncateRunes(part.Text, adminMessageRunes) + "\n")
+			case part.FunctionCall != nil:
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				sb.WriteString(fmt.Sprintf("🔧 %s %s\n", part.FunctionCall.Name, truncateRunes(string(args), adminMessageRunes)))
+			case part.FunctionResponse != nil:
+				response, _ := json.Marshal(part.FunctionResponse.Response)
+				sb.WriteString(fmt.Sprintf("↩️ %s %s\n", part.FunctionResponse.Name, truncateRunes(string(response), adminMessageRunes)))
+			}
+		}
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) adminBan(c tele.Context, admin *database.User, target *database.User, action string, args string) error {
+	if slices.Contains(b.config.Bot.AdminIds, target.TgId) {
+		return c.Reply("不能封禁管理员")
+	}
+	var until time.Time
+	reason := args
+	if action == "tempban" {
+		hours, rest, _ := strings.Cut(args, " ")
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			return c.Reply("请输入正确的命令，格式为: /admin tempban <用户> <小时> [原因]")
+		}
+		until = time.Now().Add(time.Duration(n) * time.Hour)
+		reason = strings.TrimSpace(rest)
+	}
+	if err := b.db.BanUser(context.Background(), target.ID, until, action == "shadowban", reason); err != nil {
+		return c.Reply(fmt.Sprintf("封禁失败: %v", err))
+	}
+	b.auditAdmin(admin, action, target, args)
+	switch {
+	case action == "shadowban":
+		return c.Reply(fmt.Sprintf("已影子封禁 @%s，其消息将被静默忽略", target.Username))
+	case !until.IsZero():
+		return c.Reply(fmt.Sprintf("已封禁 @%s 至 %s", target.Username, until.Format("2006-01-02 15:04")))
+	}
+	return c.Reply(fmt.Sprintf("已封禁 @%s", target.Username))
+}
+
+func (b *Bot) adminShowBans(c tele.Context, admin *database.User) error {
+	users, err := b.db.GetBannedUsers(context.Background())
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取封禁用户失败: %v", err))
+	}
+	b.auditAdmin(admin, "bans", nil, "")
+	if len(users) == 0 {
+		return c.Reply("没有封禁中的用户")
+	}
+	var sb strings.Builder
+	sb.WriteString("⛔ 封禁中的用户：\n")
+	for _, user := range users {
+		sb.WriteString(fmt.Sprintf("- @%s（TG %d）%s\n", user.Username, user.TgId, formatBanInfo(user)))
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) adminAllowlist(c tele.Context, admin *database.User, action string, ref string) error {
+	ctx := context.Background()
+	if action == "allowlist" {
+		entries, err := b.db.GetAllowlist(ctx)
+		if err != nil {
+			return c.Reply(fmt.Sprintf("获取邀请名单失败: %v", err))
+		}
+		b.auditAdmin(admin, action, nil, "")
+		mode := "未开启仅邀请模式"
+		if b.config.Access.InviteOnly {
+			mode = "已开启仅邀请模式"
+		}
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("📜 邀请名单（%s）：\n", mode))
+		for _, tgID := range b.config.Access.Allowlist {
+			sb.WriteString(fmt.Sprintf("- TG %d（配置文件）\n", tgID))
+		}
+		for _, entry := range entries {
+			if entry.TgID != 0 {
+				sb.WriteString(fmt.Sprintf("- TG %d\n", entry.TgID))
+			} else {
+				sb.WriteString(fmt.Sprintf("- @%s\n", entry.Username))
+			}
+		}
+		if len(entries) == 0 && len(b.config.Access.Allowlist) == 0 {
+			sb.WriteString("- 无\n")
+		}
+		return c.Reply(sb.String())
+	}
+
+	if ref == "" || strings.Contains(ref, " ") {
+		return c.Reply(fmt.Sprintf("请输入正确的命令，格式为: /admin %s <@用户名|Telegram ID>", action))
+	}
+	tgID, err := strconv.ParseInt(ref, 10, 64)
+	username := ""
+	if err != nil {
+		tgID, username = 0, ref
+	}
+	if action == "allow" {
+		if err := b.db.AddAllowlistEntry(ctx, tgID, username, admin.TgId); err != nil {
+			return c.Reply(fmt.Sprintf("加入邀请名单失败: %v", err))
+		}
+		b.auditAdmin(admin, action, nil, ref)
+		return c.Reply(fmt.Sprintf("已将 %s 加入邀请名单", ref))
+	}
+	removed, err := b.db.RemoveAllowlistEntry(ctx, tgID, username)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("移出邀请名单失败: %v", err))
+	}
+	if !removed {
+		return c.Reply(fmt.Sprintf("%s 不在邀请名单中", ref))
+	}
+	b.auditAdmin(admin, action, nil, ref)
+	return c.Reply(fmt.Sprintf("已将 %s 移出邀请名单，已创建的账号不受影响", ref))
+}
+
+// formatBanInfo 管理员查看的封禁信息
+func formatBanInfo(user *database.User) string {
+	text := user.BannedAt.Format("2006-01-02 15:04") + " "
+	switch {
+	case user.ShadowBanned:
+		text += "影子封禁"
+	case user.BannedUntil.IsZero():
+		text += "永久封禁"
+	default:
+		text += "封禁至 " + user.BannedUntil.Format("2006-01-02 15:04")
+	}
+	if user.BanReason != "" {
+		text += "，原因: " + user.BanReason
+	}
+	return text
+}
+
+func (b *Bot) adminAudit(c tele.Context, admin *database.User, ref string) error {
+	ctx := context.Background()
+	var target *database.User
+	if ref != "" {
+		var err error
+		target, err = b.findUser(ctx, ref)
+		if err != nil {
+			return c.Reply(fmt.Sprintf("获取用户失败: %v", err))
+		}
+		if target == nil {
+			return c.Reply(fmt.Sprintf("用户 %s 不存在", ref))
+		}
+	}
+	targetID := 0
+	if target != nil {
+		targetID = target.ID
+	}
+	logs, err := b.db.GetAdminAuditLogs(ctx, targetID, adminAuditListSize)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取操作记录失败: %v", err))
+	}
+	b.auditAdmin(admin, "audit", target, "")
+	if len(logs) == 0 {
+		return c.Reply("没有操作记录")
+	}
+	var sb strings.Builder
+	sb.WriteString("📋 管理操作记录：\n")
+	for _, entry := range logs {
+		sb.WriteString(fmt.Sprintf("- %s 管理员 %d：%s", entry.CreatedAt.Format("01-02 15:04"), entry.AdminTgID, entry.Action))
+		if entry.TargetUserID != 0 {
+			sb.WriteString(fmt.Sprintf(" @%s（用户 #%d）", entry.TargetUsername, entry.TargetUserID))
+		}
+		if entry.Detail != "" {
+			sb.WriteString(" " + truncateRunes(entry.Detail, adminMessageRunes))
+		}
+		sb.WriteString("\n")
+	}
+	return c.Reply(sb.String())
+}
+
+// truncateRunes 按字数截断过长的文本
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "…"
+}
@@ -2,14 +2,18 @@ package bot
 
 import (
 	"context"
+	"fmt"
+	"jiangfengwhu/nagi-bot-go/config"
 	"jiangfengwhu/nagi-bot-go/database"
+	"log"
+	"slices"
 	"strings"
 	"time"
 
 	tele "gopkg.in/telebot.v4"
 )
 
-func Auth(db *database.DB, b *tele.Bot) tele.MiddlewareFunc {
+func Auth(db *database.DB, b *tele.Bot, cfg *config.Config) tele.MiddlewareFunc {
 	return func(next tele.HandlerFunc) tele.HandlerFunc {
 		return func(c tele.Context) error {
 			userId := c.Sender().ID
@@ -18,19 +22,51 @@ func Auth(db *database.DB, b *tele.Bot) tele.MiddlewareFunc {
 				return c.Send("获取用户信息失败" + err.Error())
 			}
 			if user == nil {
+				// 仅邀请模式下，只有邀请名单中的用户和管理员可以创建账号
+				if cfg.Access.InviteOnly && !slices.Contains(cfg.Bot.AdminIds, userId) && !slices.Contains(cfg.Access.Allowlist, userId) {
+					allowed, err := db.IsAllowlisted(context.Background(), userId, c.Sender().Username)
+					if err != nil {
+						return c.Send("获取用户信息失败" + err.Error())
+					}
+					if !allowed {
+						return c.Send("《凡尘仙途》目前仅对受邀道友开放，请联系管理员获取邀请")
+					}
+				}
 				user = &database.User{
 					TgId:                userId,
 					Username:            c.Sender().Username,
 					CreatedAt:           time.Now(),
-					TotalRechargedToken: 100000,
+					TotalRechargedToken: *cfg.Access.StartingGrant,
 					TotalUsedToken:      0,
 					SystemPrompt:        "",
 				}
-				db.CreateUser(context.Background(), user)
-				c.Send("欢迎来到《凡尘仙途》。您已获得1000000个灵石，请使用/reg 角色名 注册之后进行游戏")
+				if err := db.CreateUser(context.Background(), user); err != nil {
+					return c.Send("创建用户失败" + err.Error())
+				}
+				if user.TotalRechargedToken > 0 {
+					c.Send(fmt.Sprintf("欢迎来到《凡尘仙途》。您已获得%d个灵石，请使用/reg 角色名 注册之后进行游戏", user.TotalRechargedToken))
+				} else {
+					c.Send("欢迎来到《凡尘仙途》。请使用/reg 角色名 注册之后进行游戏，/buy 购买灵石")
+				}
+			}
+			// 用户修改过 Telegram 用户名时同步更新，按 @用户名 查找时才能找到
+			if user.Username != c.Sender().Username {
+				if err := db.UpdateUsername(context.Background(), user.ID, c.Sender().Username); err != nil {
+					log.Printf("更新用户 %d 的用户名失败: %v", user.ID, err)
+				} else {
+					user.Username = c.Sender().Username
+				}
 			}
 			c.Set("db_user", user)
-			if c.Message().Chat.Type != "private" {
+			// 屏蔽过机器人的用户重新发消息，说明已经解除屏蔽，可以继续接收公告
+			if !user.BlockedAt.IsZero() {
+				if err := db.SetUserBlocked(context.Background(), user.ID, false); err != nil {
+					log.Printf("清除用户 %d 的屏蔽标记失败: %v", user.ID, err)
+				}
+			}
+			// 按钮回调不需要@机器人，群里付款的账单也会把付款和退款通知发到群里，同样不需要
+			payment := c.Message() != nil && (c.Message().Payment != nil || c.Message().RefundedPayment != nil)
+			if c.Callback() == nil && !payment && c.Message().Chat.Type != "private" {
 				isMention := false
 				msg := c.Message()
 				for _, entity := range msg.Entities {
@@ -48,7 +84,27 @@ func Auth(db *database.DB, b *tele.Bot) tele.MiddlewareFunc {
 					return nil
 				}
 			}
+			// 被封禁的用户不能继续游戏，付款和退款通知仍然放行，避免已付的款项无法入账
+			if user.IsBanned() && !payment {
+				if user.ShadowBanned {
+					// 影子封禁：静默忽略，不提示用户
+					return nil
+				}
+				return c.Send(formatBan(user))
+			}
 			return next(c)
 		}
 	}
 }
+
+// formatBan 告知用户的封禁信息
+func formatBan(user *database.User) string {
+	text := "您已被封禁"
+	if !user.BannedUntil.IsZero() {
+		text += "至 " + user.BannedUntil.Format("2006-01-02 15:04")
+	}
+	if user.BanReason != "" {
+		text += "，原因: " + user.BanReason
+	}
+	return text
+}
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"jiangfengwhu/nagi-bot-go/config"
 	"jiangfengwhu/nagi-bot-go/database"
 	"jiangfengwhu/nagi-bot-go/llm"
+	"jiangfengwhu/nagi-bot-go/ratelimit"
 
 	"google.golang.org/genai"
 	tele "gopkg.in/telebot.v4"
@@ -24,6 +27,12 @@ type Bot struct {
 	config     *config.Config
 	db         *database.DB
 	llmService *llm.LLMService
+
+	pendingOrders     sync.Map         // 订单ID -> chan *orderOutcome，等待玩家确认的购买订单
+	injectionPatterns []*regexp.Regexp // 疑似提示注入的发言
+	rateLimitStore    *ratelimit.MemoryStore
+	rateLimiter       *ratelimit.Limiter
+	broadcastWake     chan struct{} // 通知 broadcastLoop 有公告需要立即发送
 }
 
 // New 创建新的 bot 实例
@@ -56,11 +65,17 @@ func New(cfg *config.Config, db *database.DB, llmService *llm.LLMService) (*Bot,
 		return nil, fmt.Errorf("创建 bot 失败: %v", err)
 	}
 
+	rateLimitStore := ratelimit.NewMemoryStore()
 	bot := &Bot{
 		Bot:        b,
 		config:     cfg,
 		db:         db,
 		llmService: llmService,
+
+		injectionPatterns: compileInjectionPatterns(cfg.Abuse.InjectionPatterns),
+		rateLimitStore:    rateLimitStore,
+		rateLimiter:       newRateLimiter(cfg, rateLimitStore),
+		broadcastWake:     make(chan struct{}, 1),
 	}
 
 	bot.setupHandlers()
@@ -69,26 +84,51 @@ func New(cfg *config.Config, db *database.DB, llmService *llm.LLMService) (*Bot,
 
 // setupHandlers 设置处理器
 func (b *Bot) setupHandlers() {
+	b.Handle(tele.OnCheckout, b.handleCheckout)
 	needAuth := b.Group()
-	needAuth.Use(Auth(b.db, b.Bot))
+	needAuth.Use(Auth(b.db, b.Bot, b.config), RateLimit(b.rateLimiter, b.config.Bot.AdminIds))
 	needAuth.Handle("/start", b.handleStart)
 	needAuth.Handle("/pack", b.handleInventory)
+	needAuth.Handle("/use", b.handleUse)
+	needAuth.Handle("/craft", b.handleCraft)
+	needAuth.Handle("/shop", b.handleShop)
+	needAuth.Handle("/orders", b.handleOrders)
+	needAuth.Handle("/redeem", b.handleRedeem)
+	needAuth.Handle("/codes", b.handleCodes)
+	needAuth.Handle("/buy", b.handleBuy)
+	needAuth.Handle("/pricing", b.handlePricing)
+	needAuth.Handle("/limit", b.handleLimit)
+	needAuth.Handle("/admin", b.handleAdmin)
+	needAuth.Handle(tele.OnPayment, b.handlePayment)
+	needAuth.Handle(tele.OnRefund, b.handleRefund)
 	needAuth.Handle(tele.OnText, b.handleChat)
 	needAuth.Handle(tele.OnPhoto, b.handleFile)
 	needAuth.Handle(tele.OnAudio, b.handleFile)
 	needAuth.Handle(tele.OnVoice, b.handleFile)
 	needAuth.Handle(tele.OnDocument, b.handleFile)
 	needAuth.Handle("/c", b.handleRecharge)
+	needAuth.Handle("/loot", b.handleLoot)
+	needAuth.Handle("/recipe", b.handleRecipe)
 	needAuth.Handle("/reg", b.handleRegister)
-}
-
-func (b *Bot) handleInventory(c tele.Context) error {
-	user := c.Get("db_user").(*database.User)
-	inventory, err := b.db.GetUserInventory(context.Background(), user.ID)
-	if err != nil {
-		return c.Reply(fmt.Sprintf("获取背包物品失败: %v", err))
-	}
-	return c.Reply(formatInventoryInfo(inventory))
+	needAuth.Handle("/chars", b.handleCharacters)
+	needAuth.Handle("/switch", b.handleSwitch)
+	needAuth.Handle("/reincarnate", b.handleReincarnate)
+	needAuth.Handle("/retreat", b.handleRetreat)
+	needAuth.Handle("/duel", b.handleDuel)
+	needAuth.Handle(&btnDuelAccept, b.handleDuelAccept)
+	needAuth.Handle(&btnDuelDecline, b.handleDuelDecline)
+	needAuth.Handle(&btnPackPage, b.handlePackPage)
+	needAuth.Handle(&btnPackFilter, b.handlePackFilter)
+	needAuth.Handle(&btnPackItem, b.handlePackItem)
+	needAuth.Handle(&btnPackUse, b.handlePackUse)
+	needAuth.Handle(&btnPackEquip, b.handlePackEquip)
+	needAuth.Handle(&btnPackDiscard, b.handlePackDiscard)
+	needAuth.Handle(&btnPackDiscardConfirm, b.handlePackDiscardConfirm)
+	needAuth.Handle(&btnOrderConfirm, b.handleOrderConfirm)
+	needAuth.Handle(&btnOrderCancel, b.handleOrderCancel)
+	needAuth.Handle(&btnBuyPackage, b.handleBuyPackage)
+	needAuth.Handle(&btnBroadcastSend, b.handleBroadcastSend)
+	needAuth.Handle(&btnBroadcastCancel, b.handleBroadcastCancel)
 }
 
 func (b *Bot) handleRecharge(c tele.Context) error {
@@ -112,21 +152,39 @@ func (b *Bot) handleRecharge(c tele.Context) error {
 	if err != nil {
 		return c.Reply(fmt.Sprintf("充值失败: %v", err))
 	}
+	target, _ := b.db.GetUserByID(context.Background(), int(id))
+	b.auditAdmin(user, "recharge", target, strconv.FormatInt(amount, 10))
 	return c.Reply(fmt.Sprintf("充值成功，充值金额为%d个token", amount))
 }
 
 // handleStart 处理 /start 命令
 func (b *Bot) handleStart(c tele.Context) error {
 	user := c.Get("db_user").(*database.User)
-	player, err := b.db.GetCharacterStats(context.Background(), user.ID)
+	player, err := b.db.GetActiveCharacter(context.Background(), user.ID)
 	if err != nil {
 		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
 	}
 	if player == nil {
 		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
-	} else {
-		return c.Reply(fmt.Sprintf("欢迎回来：\n\n灵石: %d\n\n角色信息: %s", user.TotalRechargedToken-user.TotalUsedToken, formatPlayerInfo(player)))
 	}
+	equipment, buffs, err := b.getCharacterBonuses(context.Background(), player.ID)
+	if err != nil {
+		return c.Reply(err.Error())
+	}
+	return c.Reply(fmt.Sprintf("欢迎回来：\n\n灵石: %d\n\n角色信息: %s", user.TotalRechargedToken-user.TotalUsedToken, formatPlayerInfo(player, equipment, buffs)))
+}
+
+// getCharacterBonuses 获取角色的装备和尚未过期的增益
+func (b *Bot) getCharacterBonuses(ctx context.Context, characterID int) ([]*database.Equipment, []*database.Buff, error) {
+	equipment, err := b.db.GetCharacterEquipment(ctx, characterID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("获取玩家装备失败: %v", err)
+	}
+	buffs, err := b.db.GetActiveBuffs(ctx, characterID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("获取玩家增益失败: %v", err)
+	}
+	return equipment, buffs, nil
 }
 
 func (b *Bot) handleFile(c tele.Context) error {
@@ -147,6 +205,10 @@ func (b *Bot) handleFile(c tele.Context) error {
 	}
 	if file != nil {
 		user := c.Get("db_user").(*database.User)
+		player, _ := b.db.GetActiveCharacter(context.Background(), user.ID)
+		if player == nil {
+			return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+		}
 		message, err := b.Reply(c.Message(), "正在下载...")
 		if err != nil {
 			return c.Reply(fmt.Sprintf("发送消息失败: %v", err))
@@ -166,10 +228,11 @@ func (b *Bot) handleFile(c tele.Context) error {
 		if err != nil {
 			return c.Reply(fmt.Sprintf("上传到LLM失败: %v", err))
 		}
-		b.db.AddMessage(ctx, user.ID, "user", []*genai.Part{genai.NewPartFromURI(uploadedFile.URI, uploadedFile.MIMEType)})
+		b.db.AddMessage(ctx, player.ID, "user", []*genai.Part{genai.NewPartFromURI(uploadedFile.URI, uploadedFile.MIMEType)})
 		if c.Message().Voice != nil {
 			b.Edit(message, "上传成功")
 			c.Message().Text = "请回复这条语音消息"
+			c.Set("generated_turn", true)
 			b.handleChat(c)
 		} else {
 			_, err = b.Edit(message, "上传成功，请继续您的对话")
@@ -181,27 +244,64 @@ func (b *Bot) handleFile(c tele.Context) error {
 
 func (b *Bot) handleChat(c tele.Context) error {
 	user := c.Get("db_user").(*database.User)
-	player, _ := b.db.GetCharacterStats(context.Background(), user.ID)
+	player, _ := b.db.GetActiveCharacter(context.Background(), user.ID)
 	if player == nil {
 		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
 	}
+	if player.IsDead() {
+		return c.Reply(fmt.Sprintf("角色「%s」已经陨落，请使用 /reincarnate <新角色名> [传家宝] 转世，或 /switch 切换角色", player.Name))
+	}
+	if player.Status == database.CharacterStatusRetreat {
+		return c.Reply(fmt.Sprintf("角色「%s」正在闭关，/retreat 查看出关时间，/retreat stop 强行出关", player.Name))
+	}
+	username := "[" + player.Name + "]"
+	text := fmt.Sprintf("%s: %s", username, c.Message().Text)
+	generated, _ := c.Get("generated_turn").(bool)
+	if reason := b.checkAbuse(context.Background(), user, c.Message().Text, text, generated); reason != "" {
+		return c.Reply(reason)
+	}
+	dailySpent, err := b.db.GetUsageCostSince(context.Background(), user.ID, startOfDay(time.Now()))
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取今日消耗失败: %v", err))
+	}
+	if reason := b.spendingLimitReason(user, dailySpent, 0, 0); reason != "" {
+		return c.Reply(reason)
+	}
 	message, err := b.Reply(c.Message(), "正在思考...")
 	if err != nil {
 		return c.Reply(fmt.Sprintf("发送消息失败: %v", err))
 	}
-	if user.TotalRechargedToken-user.TotalUsedToken <= 0 {
-		return c.Reply("您的灵石不足，请先充值")
+	equipment, buffs, err := b.getCharacterBonuses(context.Background(), player.ID)
+	if err != nil {
+		return c.Reply(err.Error())
+	}
+	inventory, err := b.db.GetCharacterInventory(context.Background(), player.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取背包物品失败: %v", err))
+	}
+	capacity, err := b.db.GetInventoryCapacity(context.Background(), player.ID, b.config.Game.InventoryCapacity)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取背包容量失败: %v", err))
 	}
-	systemPrompt := b.config.Prompts["system_prompt"] + fmt.Sprintf("\n\n玩家%s的信息如下：\n\n%s\n\n", player.Name, player)
+	shopItems, err := b.db.GetShopItems(context.Background(), true)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取商店目录失败: %v", err))
+	}
+	systemPrompt := b.config.Prompts["system_prompt"] + fmt.Sprintf("\n\n玩家%s的信息如下：\n\n%s\n\n", player.Name, player) +
+		fmt.Sprintf("玩家当前装备：\n%s\n玩家当前增益：\n%s\n%s\n\n", formatEquipmentInfo(equipment), formatBuffInfo(buffs), formatEffectiveStats(player.Effective(equipment, buffs))) +
+		fmt.Sprintf("玩家背包（#后为物品ID，已用容量 %s）：\n%s\n", capacity, formatInventoryBrief(inventory)) +
+		fmt.Sprintf("商店目录（#后为商品ID，价格为每份灵石数）：\n%s\n", formatShopCatalog(shopItems))
 	history := []*genai.Content{
 		genai.NewContentFromText(systemPrompt, genai.RoleUser),
 	}
-	username := "[" + player.Name + "]"
-	text := fmt.Sprintf("%s: %s", username, c.Message().Text)
 	nextParts := []*genai.Part{genai.NewPartFromText(text)}
 	llmResult := ""
-	promptToken := int32(0)
-	totalToken := int32(0)
+	// 每次模型调用的用量都记入同一个累加器，无论本轮如何结束都按实际用量扣费
+	meter := &llm.Meter{}
+	defer func() {
+		charged := b.chargeUsage(user.ID, player.ID, database.UsageKindChat, meter)
+		b.warnLowBalance(c, user, charged)
+	}()
 
 	// === start llm ====
 	ctx := context.Background()
@@ -210,7 +310,7 @@ func (b *Bot) handleChat(c tele.Context) error {
 		return c.Reply(fmt.Sprintf("创建LLMClient失败: %v", err))
 	}
 
-	historyMsgs, err := b.db.GetRecentMessages(ctx, user.ID, 10)
+	historyMsgs, err := b.db.GetRecentMessages(ctx, player.ID, 10)
 	if err != nil {
 		c.Reply(fmt.Sprintf("获取消息失败: %v", err))
 	}
@@ -218,11 +318,18 @@ func (b *Bot) handleChat(c tele.Context) error {
 		history = append(history, genai.NewContentFromParts(msg.Content.([]*genai.Part), genai.Role(msg.Role)))
 	}
 
-	chatClient, err := b.llmService.CreateConversation(ctx, client, "gemini-2.5-flash", history)
+	chatClient, err := b.llmService.CreateConversation(ctx, client, llm.ChatModel, history)
 	if err != nil {
 		return c.Reply(fmt.Sprintf("创建聊天失败: %v", err))
 	}
-	for len(nextParts) > 0 {
+	for calls := 0; len(nextParts) > 0; calls++ {
+		// 每次调用模型前检查余额和消耗上限，再调用一次会超出时结束本轮
+		if reason := b.spendingLimitReason(user, dailySpent, meter.Cost(b.config, time.Now()), calls); reason != "" {
+			// 保存未发送的工具结果，保持历史中的调用和结果成对
+			b.db.AddMessage(ctx, player.ID, "user", nextParts)
+			b.Edit(message, llmResult+"\n\n"+reason)
+			break
+		}
 		streamID, err := b.llmService.Chat(ctx, chatClient, nextParts)
 		defer b.llmService.DeleteStream(streamID)
 		if err != nil {
@@ -234,18 +341,23 @@ func (b *Bot) handleChat(c tele.Context) error {
 			return c.Reply(fmt.Sprintf("获取流失败: %v", err))
 		}
 
-		b.db.AddMessage(ctx, user.ID, "user", nextParts)
+		b.db.AddMessage(ctx, player.ID, "user", nextParts)
 
 		toolCalls := []*genai.FunctionCall{}
 		nextParts = []*genai.Part{}
 		tmpResult := ""
 		thoughtSignature := []byte{}
+		var metadata *genai.GenerateContentResponseUsageMetadata
 
 		for chunk, err := range stream.Stream {
 			if err != nil {
 				c.Reply(fmt.Sprintf("获取流失败: %v", err))
 				continue
 			}
+			// 流式返回的用量是累计值，以最后一次为准；最后的分块可能没有内容，需要在检查内容前读取
+			if chunk.UsageMetadata != nil {
+				metadata = chunk.UsageMetadata
+			}
 
 			// 安全检查：确保Candidates数组不为空
 			if len(chunk.Candidates) == 0 {
@@ -264,30 +376,28 @@ func (b *Bot) handleChat(c tele.Context) error {
 				b.Edit(message, llmResult+ConvertMarkdownToTelegramMarkdownV2(tmpResult), tele.ModeMarkdownV2)
 			}
 			toolCalls = append(toolCalls, chunk.FunctionCalls()...)
-			promptToken = chunk.UsageMetadata.PromptTokenCount + chunk.UsageMetadata.ThoughtsTokenCount
-			totalToken += (chunk.UsageMetadata.CandidatesTokenCount + chunk.UsageMetadata.ToolUsePromptTokenCount)
 		}
+		meter.Record(llm.UsageFromMetadata(llm.ChatModel, metadata))
 		if tmpResult != "" {
 			llmResult += tmpResult
 			part := genai.NewPartFromText(tmpResult)
 			if len(thoughtSignature) > 0 {
 				part.ThoughtSignature = thoughtSignature
 			}
-			b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{part})
+			b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{part})
 		}
-		totalToken += promptToken
 		for _, tool := range toolCalls {
 			if tool.Name == string(llm.ToolGenerateImage) {
 				b.Edit(message, llmResult+"\n\n正在生成图片："+tool.Args["prompt"].(string))
-				image, token, err := b.llmService.GenerateImage(tool.Args["prompt"].(string))
-				totalToken += token
+				image, imageUsage, err := b.llmService.GenerateImage(tool.Args["prompt"].(string))
+				meter.Record(imageUsage)
 				if err != nil {
 					b.Edit(message, fmt.Sprintf("生成图片失败: %v", err))
 					return nil
 				}
 				b.Edit(message, llmResult+"\n\n图片生成完毕，正在发送图片...")
 				c.Reply(&tele.Photo{File: tele.FromReader(bytes.NewReader(image)), Caption: tool.Args["prompt"].(string)})
-				b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
 				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
 					"text": "图片生成成功",
 				})
@@ -295,7 +405,7 @@ func (b *Bot) handleChat(c tele.Context) error {
 			} else if tool.Name == string(llm.ToolGetTime) {
 				b.Edit(message, llmResult+"\n\n正在获取时间")
 				time := b.llmService.GetTime()
-				b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
 				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
 					"text": time,
 				})
@@ -308,46 +418,135 @@ func (b *Bot) handleChat(c tele.Context) error {
 					return nil
 				}
 				b.Edit(message, llmResult+"\n\nGoogle搜索结果："+searchResult)
-				b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
 				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
 					"text": searchResult,
 				})
 				nextParts = append(nextParts, nextPart)
 			} else if tool.Name == string(llm.ToolUpdatePlayer) {
 				b.Edit(message, llmResult+"\n\n正在更新玩家信息...")
-				searchResult, err := llm.UpdatePlayer(b.db, user.ID, tool.Args)
+				searchResult, err := llm.UpdatePlayer(b.db, player.ID, tool.Args)
 				if err != nil {
 					b.Edit(message, llmResult+fmt.Sprintf("更新玩家信息失败: %v", err))
 					return nil
 				}
 				b.Edit(message, llmResult+"\n\n玩家信息更新成功："+searchResult)
-				b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
 				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
 					"text": searchResult,
 				})
 				nextParts = append(nextParts, nextPart)
 			} else if tool.Name == string(llm.ToolUpdateInventory) {
 				b.Edit(message, llmResult+"\n\n正在更新背包物品...")
-				searchResult, err := llm.UpdateInventory(b.db, user.ID, tool.Args)
+				searchResult, err := llm.UpdateInventory(b.db, player.ID, b.config.Game.InventoryCapacity, tool.Args)
+				if response, ok := inventoryFullResponse(err); ok {
+					b.Edit(message, llmResult+"\n\n"+err.Error())
+					b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+					nextParts = append(nextParts, genai.NewPartFromFunctionResponse(tool.Name, response))
+					continue
+				}
 				if err != nil {
 					b.Edit(message, llmResult+fmt.Sprintf("更新背包物品失败: %v", err))
 					return nil
 				}
 				b.Edit(message, llmResult+"\n\n背包物品更新成功："+searchResult)
-				b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
 				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
 					"text": searchResult,
 				})
 				nextParts = append(nextParts, nextPart)
 			} else if tool.Name == string(llm.ToolInAppPurchase) {
-				b.Edit(message, llmResult+"\n\n正在购买物品...")
-				searchResult, err := llm.InAppPurchase(b.db, user.ID, tool.Args)
+				b.Edit(message, llmResult+"\n\n等待玩家确认购买...")
+				outcome, err := b.requestPurchase(c, user, player, tool.Args)
 				if err != nil {
 					b.Edit(message, llmResult+fmt.Sprintf("购买物品失败: %v", err))
 					return nil
 				}
-				b.Edit(message, llmResult+"\n\n物品购买成功："+searchResult)
-				b.db.AddMessage(ctx, user.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				// 玩家确认购买后已扣除灵石，下一次调用模型前按最新余额检查
+				b.refreshBalance(ctx, user)
+				b.Edit(message, llmResult+"\n\n"+outcome.Summary)
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				nextParts = append(nextParts, genai.NewPartFromFunctionResponse(tool.Name, outcome.Response))
+			} else if tool.Name == string(llm.ToolStartCombat) {
+				b.Edit(message, llmResult+"\n\n正在战斗...")
+				searchResult, err := llm.StartCombat(b.db, player.ID, b.config.Game.InventoryCapacity, b.lootSettings(), tool.Args)
+				if err != nil {
+					b.Edit(message, llmResult+fmt.Sprintf("战斗失败: %v", err))
+					return nil
+				}
+				b.Edit(message, llmResult+"\n\n战斗结束，天道正在推演...")
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
+					"text": searchResult,
+				})
+				nextParts = append(nextParts, nextPart)
+			} else if tool.Name == string(llm.ToolEquipItem) {
+				b.Edit(message, llmResult+"\n\n正在穿戴装备...")
+				searchResult, err := llm.EquipItem(b.db, player.ID, b.config.Game.InventoryCapacity, tool.Args)
+				if err != nil {
+					b.Edit(message, llmResult+fmt.Sprintf("穿戴装备失败: %v", err))
+					return nil
+				}
+				b.Edit(message, llmResult+"\n\n"+searchResult)
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
+					"text": searchResult,
+				})
+				nextParts = append(nextParts, nextPart)
+			} else if tool.Name == string(llm.ToolUseItem) {
+				b.Edit(message, llmResult+"\n\n正在使用物品...")
+				searchResult, err := llm.UseItem(b.db, player.ID, tool.Args)
+				if err != nil {
+					b.Edit(message, llmResult+fmt.Sprintf("使用物品失败: %v", err))
+					return nil
+				}
+				b.Edit(message, llmResult+"\n\n"+searchResult)
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
+					"text": searchResult,
+				})
+				nextParts = append(nextParts, nextPart)
+			} else if tool.Name == string(llm.ToolAlchemy) {
+				b.Edit(message, llmResult+"\n\n正在开炉...")
+				searchResult, err := llm.Alchemy(b.db, player.ID, tool.Args)
+				if err != nil {
+					b.Edit(message, llmResult+fmt.Sprintf("炼制失败: %v", err))
+					return nil
+				}
+				b.Edit(message, llmResult+"\n\n"+searchResult)
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
+					"text": searchResult,
+				})
+				nextParts = append(nextParts, nextPart)
+			} else if tool.Name == string(llm.ToolRollLoot) {
+				b.Edit(message, llmResult+"\n\n正在掷骰掉落...")
+				searchResult, err := llm.RollLoot(b.db, player.ID, b.config.Game.InventoryCapacity, b.lootSettings(), tool.Args)
+				if response, ok := inventoryFullResponse(err); ok {
+					b.Edit(message, llmResult+"\n\n"+err.Error())
+					b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+					nextParts = append(nextParts, genai.NewPartFromFunctionResponse(tool.Name, response))
+					continue
+				}
+				if err != nil {
+					b.Edit(message, llmResult+fmt.Sprintf("掉落失败: %v", err))
+					return nil
+				}
+				b.Edit(message, llmResult+"\n\n"+searchResult)
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
+				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
+					"text": searchResult,
+				})
+				nextParts = append(nextParts, nextPart)
+			} else if tool.Name == string(llm.ToolUnequipItem) {
+				b.Edit(message, llmResult+"\n\n正在卸下装备...")
+				searchResult, err := llm.UnequipItem(b.db, player.ID, b.config.Game.InventoryCapacity, tool.Args)
+				if err != nil {
+					b.Edit(message, llmResult+fmt.Sprintf("卸下装备失败: %v", err))
+					return nil
+				}
+				b.Edit(message, llmResult+"\n\n"+searchResult)
+				b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromFunctionCall(tool.Name, tool.Args)})
 				nextPart := genai.NewPartFromFunctionResponse(tool.Name, map[string]any{
 					"text": searchResult,
 				})
@@ -355,8 +554,6 @@ func (b *Bot) handleChat(c tele.Context) error {
 			}
 		}
 	}
-	b.db.UpdateUserTotalUsedToken(ctx, user.ID, int64(totalToken))
-
 	return nil
 }
 
@@ -369,5 +566,11 @@ func (b *Bot) Run() {
 	} else {
 		log.Println("Bot 开始运行 (长轮询模式)...")
 	}
+	go b.retreatLoop()
+	go b.duelLoop()
+	go b.craftLoop()
+	go b.orderLoop()
+	go b.rateLimitLoop()
+	go b.broadcastLoop()
 	b.Start()
 }
@@ -0,0 +1,373 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+const (
+	broadcastMaxRunes     = 3500 // 公告内容最多字数，留出标题的长度，不超过 Telegram 单条消息上限
+	broadcastListSize     = 10   // /admin broadcasts 展示的公告条数
+	broadcastCheckEvery   = 20   // 每发送多少条检查一次公告是否被取消
+	broadcastFloodRetries = 3    // 被 Telegram 限流时最多重试的次数
+	broadcastTimeLayout   = "2006-01-02T15:04"
+)
+
+var (
+	btnBroadcastSend   = tele.Btn{Unique: "broadcast_send"}
+	btnBroadcastCancel = tele.Btn{Unique: "broadcast_cancel"}
+)
+
+var broadcastStatusNames = map[string]string{
+	database.BroadcastStatusDraft:     "待确认",
+	database.BroadcastStatusScheduled: "定时中",
+	database.BroadcastStatusSending:   "发送中",
+	database.BroadcastStatusSent:      "已发送",
+	database.BroadcastStatusCancelled: "已取消",
+}
+
+// adminBroadcast 处理 /admin broadcast，创建公告草稿并预览，管理员确认后才会发送
+func (b *Bot) adminBroadcast(c tele.Context, admin *database.User, payload string) error {
+	ctx := context.Background()
+	target, rest := cutField(payload)
+	if target == "cancel" {
+		return b.adminCancelBroadcast(c, admin, rest)
+	}
+
+	broadcast := &database.Broadcast{CreatedBy: admin.TgId}
+	kind, value, _ := strings.Cut(target, ":")
+	switch kind {
+	case database.BroadcastTargetAll:
+	case database.BroadcastTargetActive:
+		if days, err := strconv.Atoi(value); err != nil || days <= 0 {
+			return c.Reply("活跃天数必须是正整数，例如 active:7")
+		}
+	case database.BroadcastTargetRealm, database.BroadcastTargetLocation:
+		if value == "" {
+			return c.Reply("请指定境界或地点，例如 realm:筑基期、location:青云山")
+		}
+	default:
+		return c.Reply(adminUsage)
+	}
+	broadcast.Target, broadcast.TargetValue = kind, value
+
+	if field, text := cutField(rest); strings.HasPrefix(field, "at:") {
+		scheduledAt, err := time.ParseInLocation(broadcastTimeLayout, strings.TrimPrefix(field, "at:"), time.Local)
+		if err != nil {
+			return c.Reply("定时格式错误，例如 at:2025-01-01T20:00")
+		}
+		if !scheduledAt.After(time.Now()) {
+			return c.Reply("定时发送的时间必须晚于现在")
+		}
+		broadcast.ScheduledAt, rest = scheduledAt, text
+	}
+	broadcast.Text = strings.TrimSpace(rest)
+	if broadcast.Text == "" {
+		return c.Reply(adminUsage)
+	}
+	if utf8.RuneCountInString(broadcast.Text) > broadcastMaxRunes {
+		return c.Reply(fmt.Sprintf("公告内容不能超过%d字", broadcastMaxRunes))
+	}
+
+	recipients, err := b.broadcastRecipients(ctx, broadcast)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取公告对象失败: %v", err))
+	}
+	if err := b.db.CreateBroadcast(ctx, broadcast); err != nil {
+		return c.Reply(fmt.Sprintf("创建公告失败: %v", err))
+	}
+	b.auditAdmin(admin, "broadcast", nil, fmt.Sprintf("公告 #%d %s", broadcast.ID, formatBroadcastTarget(broadcast)))
+
+	id := strconv.Itoa(broadcast.ID)
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data("📢 确认发送", btnBroadcastSend.Unique, id),
+		markup.Data("❌ 取消", btnBroadcastCancel.Unique, id),
+	))
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("公告 #%d 预览\n", broadcast.ID))
+	sb.WriteString(fmt.Sprintf("对象: %s，当前共 %d 人\n", formatBroadcastTarget(broadcast), len(recipients)))
+	if !broadcast.ScheduledAt.IsZero() {
+		sb.WriteString(fmt.Sprintf("定时: %s\n", broadcast.ScheduledAt.Format("2006-01-02 15:04")))
+	}
+	sb.WriteString("\n" + formatBroadcastMessage(broadcast))
+	return c.Reply(sb.String(), markup)
+}
+
+// handleBroadcastSend 管理员确认发送公告
+func (b *Bot) handleBroadcastSend(c tele.Context) error {
+	admin := c.Get("db_user").(*database.User)
+	if !slices.Contains(b.config.Bot.AdminIds, admin.TgId) {
+		return c.Respond(&tele.CallbackResponse{Text: "您没有权限使用此命令"})
+	}
+	id, err := strconv.Atoi(c.Data())
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: "无效的公告"})
+	}
+
+	broadcast, err := b.db.ConfirmBroadcast(context.Background(), id)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("确认公告失败: %v", err), ShowAlert: true})
+	}
+	if broadcast == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "该公告已失效"})
+	}
+	b.auditAdmin(admin, "broadcast_send", nil, fmt.Sprintf("公告 #%d", broadcast.ID))
+
+	c.Respond()
+	if broadcast.Status == database.BroadcastStatusScheduled {
+		return c.Edit(fmt.Sprintf("⏰ 公告 #%d 将于 %s 发送，可使用 /admin broadcast cancel %d 取消",
+			broadcast.ID, broadcast.ScheduledAt.Format("2006-01-02 15:04"), broadcast.ID))
+	}
+	b.wakeBroadcasts()
+	return c.Edit(fmt.Sprintf("📢 公告 #%d 开始发送，完成后会通知您，可使用 /admin broadcast cancel %d 停止", broadcast.ID, broadcast.ID))
+}
+
+// handleBroadcastCancel 管理员在预览时取消公告
+func (b *Bot) handleBroadcastCancel(c tele.Context) error {
+	admin := c.Get("db_user").(*database.User)
+	if !slices.Contains(b.config.Bot.AdminIds, admin.TgId) {
+		return c.Respond(&tele.CallbackResponse{Text: "您没有权限使用此命令"})
+	}
+	id, err := strconv.Atoi(c.Data())
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: "无效的公告"})
+	}
+
+	cancelled, err := b.db.CancelBroadcast(context.Background(), id)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("取消公告失败: %v", err), ShowAlert: true})
+	}
+	if !cancelled {
+		return c.Respond(&tele.CallbackResponse{Text: "该公告已失效"})
+	}
+	b.auditAdmin(admin, "broadcast_cancel", nil, fmt.Sprintf("公告 #%d", id))
+	c.Respond()
+	return c.Edit(fmt.Sprintf("公告 #%d 已取消", id))
+}
+
+// adminCancelBroadcast 处理 /admin broadcast cancel，取消定时中或停止发送中的公告
+func (b *Bot) adminCancelBroadcast(c tele.Context, admin *database.User, args string) error {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+	if err != nil {
+		return c.Reply("请输入公告ID，例如 /admin broadcast cancel 3")
+	}
+	cancelled, err := b.db.CancelBroadcast(context.Background(), id)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("取消公告失败: %v", err))
+	}
+	if !cancelled {
+		return c.Reply("该公告不存在或已经结束")
+	}
+	b.auditAdmin(admin, "broadcast_cancel", nil, fmt.Sprintf("公告 #%d", id))
+	return c.Reply(fmt.Sprintf("公告 #%d 已取消，发送中的公告会在片刻后停止", id))
+}
+
+// adminShowBroadcasts 处理 /admin broadcasts，查看最近的公告和发送进度
+func (b *Bot) adminShowBroadcasts(c tele.Context, admin *database.User) error {
+	broadcasts, err := b.db.GetBroadcasts(context.Background(), broadcastListSize)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取公告失败: %v", err))
+	}
+	b.auditAdmin(admin, "broadcasts", nil, "")
+	if len(broadcasts) == 0 {
+		return c.Reply("还没有公告")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("📢 最近的公告：\n")
+	for _, broadcast := range broadcasts {
+		sb.WriteString(fmt.Sprintf("\n#%d [%s] %s，%s\n", broadcast.ID, broadcastStatusNames[broadcast.Status],
+			formatBroadcastTarget(broadcast), broadcast.CreatedAt.Format("01-02 15:04")))
+		if broadcast.Status == database.BroadcastStatusScheduled {
+			sb.WriteString(fmt.Sprintf("定时: %s\n", broadcast.ScheduledAt.Format("2006-01-02 15:04")))
+		}
+		if !broadcast.StartedAt.IsZero() {
+			sb.WriteString(fmt.Sprintf("送达 %d，失败 %d，已屏蔽 %d\n", broadcast.Sent, broadcast.Failed, broadcast.Blocked))
+		}
+		sb.WriteString(truncateRunes(broadcast.Text, adminMessageRunes) + "\n")
+	}
+	return c.Reply(sb.String())
+}
+
+// broadcastRecipients 获取公告尚未发送的对象，跳过已封禁和屏蔽了机器人的用户
+func (b *Bot) broadcastRecipients(ctx context.Context, broadcast *database.Broadcast) ([]*database.User, error) {
+	var activeSince time.Time
+	var userIDs []int
+	switch broadcast.Target {
+	case database.BroadcastTargetActive:
+		days, _ := strconv.Atoi(broadcast.TargetValue)
+		// 以开始发送的时间为准，重启后继续发送时对象不变
+		since := broadcast.StartedAt
+		if since.IsZero() {
+			since = time.Now()
+		}
+		activeSince = since.AddDate(0, 0, -days)
+	case database.BroadcastTargetRealm, database.BroadcastTargetLocation:
+		var characters []*database.CharacterStats
+		var err error
+		if broadcast.Target == database.BroadcastTargetRealm {
+			characters, err = b.db.GetCharactersByRealm(ctx, broadcast.TargetValue)
+		} else {
+			characters, err = b.db.GetCharactersByLocation(ctx, broadcast.TargetValue)
+		}
+		if err != nil {
+			return nil, err
+		}
+		userIDs = []int{}
+		for _, character := range characters {
+			if !character.IsDead() && !slices.Contains(userIDs, character.UserID) {
+				userIDs = append(userIDs, character.UserID)
+			}
+		}
+	}
+	return b.db.GetReachableUsers(ctx, activeSince, userIDs, broadcast.CursorUserID)
+}
+
+// broadcastLoop 定时发送到期的公告，并继续发送重启前没有发完的公告
+// 公告逐条依次发送，保证总体速度不超过 Telegram 的限制
+func (b *Bot) broadcastLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		b.sendDueBroadcasts()
+		select {
+		case <-ticker.C:
+		case <-b.broadcastWake:
+		}
+	}
+}
+
+// wakeBroadcasts 让 broadcastLoop 立即检查待发送的公告
+func (b *Bot) wakeBroadcasts() {
+	select {
+	case b.broadcastWake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Bot) sendDueBroadcasts() {
+	broadcasts, err := b.db.StartDueBroadcasts(context.Background(), time.Now())
+	if err != nil {
+		log.Printf("获取待发送的公告失败: %v", err)
+		return
+	}
+	for _, broadcast := range broadcasts {
+		b.deliverBroadcast(broadcast)
+	}
+}
+
+// deliverBroadcast 按配置的速度发送公告，每条发送后保存进度，重启后从中断处继续
+func (b *Bot) deliverBroadcast(broadcast *database.Broadcast) {
+	ctx := context.Background()
+	recipients, err := b.broadcastRecipients(ctx, broadcast)
+	if err != nil {
+		log.Printf("获取公告 %d 的对象失败: %v", broadcast.ID, err)
+		return
+	}
+
+	text := formatBroadcastMessage(broadcast)
+	ticker := time.NewTicker(time.Second / time.Duration(b.config.Broadcast.MessagesPerSecond))
+	defer ticker.Stop()
+	for i, user := range recipients {
+		if i%broadcastCheckEvery == 0 {
+			status, err := b.db.GetBroadcastStatus(ctx, broadcast.ID)
+			if err != nil {
+				log.Printf("获取公告 %d 的状态失败: %v", broadcast.ID, err)
+				return
+			}
+			if status != database.BroadcastStatusSending {
+				log.Printf("公告 %d 已取消，停止发送", broadcast.ID)
+				return
+			}
+		}
+		<-ticker.C
+
+		err := b.sendBroadcastMessage(user.TgId, text)
+		switch {
+		case err == nil:
+			broadcast.Sent++
+		case isBlockedError(err):
+			broadcast.Blocked++
+			if err := b.db.SetUserBlocked(ctx, user.ID, true); err != nil {
+				log.Printf("标记用户 %d 屏蔽机器人失败: %v", user.ID, err)
+			}
+		default:
+			broadcast.Failed++
+			log.Printf("发送公告 %d 给用户 %d 失败: %v", broadcast.ID, user.ID, err)
+		}
+		broadcast.CursorUserID = user.ID
+		if err := b.db.UpdateBroadcastProgress(ctx, broadcast); err != nil {
+			log.Printf("保存公告 %d 的进度失败: %v", broadcast.ID, err)
+		}
+	}
+
+	if err := b.db.FinishBroadcast(ctx, broadcast); err != nil {
+		log.Printf("完成公告 %d 失败: %v", broadcast.ID, err)
+		return
+	}
+	if broadcast.Status != database.BroadcastStatusSent {
+		return
+	}
+	report := fmt.Sprintf("📢 公告 #%d 发送完毕：送达 %d，失败 %d，已屏蔽 %d", broadcast.ID, broadcast.Sent, broadcast.Failed, broadcast.Blocked)
+	if _, err := b.Send(tele.ChatID(broadcast.CreatedBy), report); err != nil {
+		log.Printf("通知管理员 %d 公告 %d 的结果失败: %v", broadcast.CreatedBy, broadcast.ID, err)
+	}
+}
+
+// sendBroadcastMessage 发送一条公告，被限流时按 Telegram 要求的时间等待后重试
+func (b *Bot) sendBroadcastMessage(tgID int64, text string) error {
+	for attempt := 0; ; attempt++ {
+		_, err := b.Send(tele.ChatID(tgID), text)
+		var flood tele.FloodError
+		if !errors.As(err, &flood) || attempt >= broadcastFloodRetries {
+			return err
+		}
+		time.Sleep(time.Duration(flood.RetryAfter) * time.Second)
+	}
+}
+
+// isBlockedError 是否因为用户屏蔽了机器人或账号不可用而无法发送
+func isBlockedError(err error) bool {
+	return errors.Is(err, tele.ErrBlockedByUser) || errors.Is(err, tele.ErrUserIsDeactivated) ||
+		errors.Is(err, tele.ErrNotStartedByUser) || errors.Is(err, tele.ErrChatNotFound)
+}
+
+func formatBroadcastMessage(broadcast *database.Broadcast) string {
+	return "📢 天道公告\n\n" + broadcast.Text
+}
+
+func formatBroadcastTarget(broadcast *database.Broadcast) string {
+	switch broadcast.Target {
+	case database.BroadcastTargetActive:
+		return fmt.Sprintf("最近 %s 天活跃的用户", broadcast.TargetValue)
+	case database.BroadcastTargetRealm:
+		return fmt.Sprintf("境界为「%s」的用户", broadcast.TargetValue)
+	case database.BroadcastTargetLocation:
+		return fmt.Sprintf("位于「%s」的用户", broadcast.TargetValue)
+	default:
+		return "所有用户"
+	}
+}
+
+// cutField 切出第一个空白字符之前的内容，其余部分保留原有的换行
+func cutField(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+}
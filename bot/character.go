@@ -0,0 +1,199 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleCharacters 处理 /chars 命令，列出用户的所有角色
+func (b *Bot) handleCharacters(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	characters, err := b.db.GetUserCharacters(context.Background(), user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取角色列表失败: %v", err))
+	}
+	if len(characters) == 0 {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+	return c.Reply(formatCharacterList(characters, user.ActiveCharacterID, b.config.Game.MaxCharacterSlots))
+}
+
+// handleSwitch 处理 /switch 命令，切换当前角色
+func (b *Bot) handleSwitch(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	args := c.Args()
+	if len(args) != 1 {
+		return c.Reply("请输入正确的命令，格式为: /switch <角色ID>，/chars 查看角色ID")
+	}
+	characterID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return c.Reply("请输入正确的角色ID")
+	}
+	err = b.db.SetActiveCharacter(context.Background(), user.ID, characterID)
+	if err != nil {
+		return c.Reply("切换角色失败，请确认角色ID属于您，/chars 查看角色ID")
+	}
+	player, err := b.db.GetCharacterStats(context.Background(), characterID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	return c.Reply(fmt.Sprintf("已切换到角色「%s」", player.Name))
+}
+
+// handleReincarnate 处理 /reincarnate 命令，为陨落的当前角色转世
+// 不指定传家宝时继承前世一定比例的属性，指定时把该物品带入来世
+func (b *Bot) handleReincarnate(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	args := c.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return c.Reply("请输入正确的命令，格式为: /reincarnate <新角色名> [传家宝物品名]")
+	}
+	name := args[0]
+	if len(name) > 20 {
+		return c.Reply("角色名长度不超过10个字符")
+	}
+	heirloom := ""
+	if len(args) == 2 {
+		heirloom = args[1]
+	}
+
+	ctx := context.Background()
+	previous, err := b.db.GetActiveCharacter(ctx, user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if previous == nil {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+	if !previous.IsDead() {
+		return c.Reply(fmt.Sprintf("角色「%s」尚未陨落，无法转世", previous.Name))
+	}
+	// 提前检查避免白白生成角色，并发的转世由 ReincarnatePlayer 在事务内拦截
+	reincarnated, err := b.db.HasReincarnated(ctx, previous.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if reincarnated {
+		return c.Reply(fmt.Sprintf("角色「%s」已经转世过了", previous.Name))
+	}
+	if heirloom != "" {
+		item, err := b.db.GetInventoryItemByName(ctx, previous.ID, heirloom)
+		if err != nil {
+			return c.Reply(fmt.Sprintf("获取背包物品失败: %v", err))
+		}
+		if item == nil {
+			return c.Reply(fmt.Sprintf("前世背包中没有「%s」", heirloom))
+		}
+	}
+	exists, err := b.db.NameExists(ctx, name)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if exists {
+		return c.Reply("该角色名已存在，请重新输入")
+	}
+
+	message, _ := b.Reply(c.Message(), "轮回开启，正在转世...")
+	prompt := fmt.Sprintf("创建一个修仙者角色，角色名称为: %s，现在时间是: %s。该角色是「%s」陨落后的转世之身，前世经历如下：\n%s",
+		name, time.Now().Format("2006-01-02 15:04:05"), previous.Name, previous.Stories)
+	meter := &llm.Meter{}
+	result, err := b.generateCharacter(ctx, prompt, meter)
+	b.chargeUsage(previous.UserID, previous.ID, database.UsageKindReincarnate, meter)
+	if err != nil {
+		b.Edit(message, fmt.Sprintf("转世失败: %v", err))
+		return err
+	}
+	player, inventory, err := ReincarnatePlayer(b.db, previous, result, heirloom, b.config.Game.ReincarnationInherit)
+	if errors.Is(err, database.ErrNameExists) || errors.Is(err, database.ErrAlreadyReincarnated) {
+		b.Edit(message, err.Error())
+		return nil
+	}
+	if err != nil {
+		b.Edit(message, fmt.Sprintf("转世失败: %v", err))
+		return err
+	}
+	b.Edit(message, fmt.Sprintf("转世成功，第%d世: \n%s\n初始背包物品: \n%s\n", player.Generation, formatPlayerInfo(player, nil, nil), formatInventoryInfo(inventory)))
+	return nil
+}
+
+// ReincarnatePlayer 为陨落的角色创建转世之身，继承传家宝或前世属性，并切换为当前角色
+func ReincarnatePlayer(db *database.DB, previous *database.CharacterStats, args string, heirloom string, inheritRatio float64) (*database.CharacterStats, []*database.InventoryItem, error) {
+	ctx := context.Background()
+
+	stats, inventory, err := buildPlayer(previous.UserID, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.Generation = previous.Generation + 1
+	stats.PreviousCharacterID = previous.ID
+	if heirloom == "" {
+		inheritAttributes(stats, previous, inheritRatio)
+	}
+
+	tx, err := db.GetPool().Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := db.LockReincarnationInTx(ctx, tx, previous.ID); err != nil {
+		return nil, nil, err
+	}
+	if err := createPlayerInTx(ctx, db, tx, stats, inventory); err != nil {
+		return nil, nil, err
+	}
+
+	if heirloom != "" {
+		item, err := db.MoveInventoryItemInTx(ctx, tx, previous.ID, stats.ID, heirloom)
+		if err != nil {
+			return nil, nil, fmt.Errorf("传承物品失败: %v", err)
+		}
+		item.ObtainedFrom = fmt.Sprintf("前世「%s」传承", previous.Name)
+		inventory = append(inventory, item)
+	}
+
+	return stats, inventory, tx.Commit(ctx)
+}
+
+// inheritAttributes 按比例把前世的基础属性叠加到转世之身上
+func inheritAttributes(stats *database.CharacterStats, previous *database.CharacterStats, ratio float64) {
+	inherit := func(value int) int {
+		return int(float64(value) * ratio)
+	}
+	stats.SpiritSense += inherit(previous.SpiritSense)
+	stats.Physique += inherit(previous.Physique)
+	stats.Comprehension += inherit(previous.Comprehension)
+	stats.Luck += inherit(previous.Luck)
+	stats.Attack += inherit(previous.Attack)
+	stats.Defense += inherit(previous.Defense)
+	stats.Speed += inherit(previous.Speed)
+}
+
+func formatCharacterList(characters []*database.CharacterStats, activeCharacterID int, maxSlots int) string {
+	alive := 0
+	var sb strings.Builder
+	for _, character := range characters {
+		marker := "  "
+		if character.ID == activeCharacterID {
+			marker = "👉"
+		}
+		state := "🟢"
+		if character.IsDead() {
+			state = "🪦"
+		} else {
+			alive++
+		}
+		sb.WriteString(fmt.Sprintf("%s %s [%d] %s · 第%d世 · %s%d层 · %s\n",
+			marker, state, character.ID, character.Name, character.Generation, character.Realm, character.RealmLevel, character.Location))
+	}
+	return fmt.Sprintf("角色栏位: %d/%d\n\n%s\n/switch <角色ID> 切换角色，/reincarnate <新角色名> [传家宝] 为陨落的角色转世", alive, maxSlots, sb.String())
+}
@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/crafting"
+	"jiangfengwhu/nagi-bot-go/database"
+
+	"google.golang.org/genai"
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleCraft 处理 /craft 命令，/craft 查看配方和炉中情况，/craft <配方名> 开炉炼制
+func (b *Bot) handleCraft(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	ctx := context.Background()
+	player, err := b.db.GetActiveCharacter(ctx, user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if player == nil {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+
+	recipeName := strings.TrimSpace(c.Message().Payload)
+	if recipeName == "" {
+		return b.showCrafting(c, player)
+	}
+	if player.IsDead() {
+		return c.Reply(fmt.Sprintf("角色「%s」已经陨落，无法炼制", player.Name))
+	}
+	if player.Status == database.CharacterStatusRetreat {
+		return c.Reply(fmt.Sprintf("角色「%s」正在闭关，无法炼制", player.Name))
+	}
+
+	recipe, err := b.db.GetRecipe(ctx, player.ID, recipeName)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取配方失败: %v", err))
+	}
+	if recipe == nil {
+		return c.Reply(fmt.Sprintf("您尚未掌握配方「%s」，/craft 查看已掌握的配方", recipeName))
+	}
+	craft, err := crafting.Start(ctx, b.db, player, recipe)
+	if err != nil {
+		var unmet *crafting.RequirementError
+		var insufficient *database.InsufficientItemError
+		switch {
+		case errors.As(err, &unmet):
+			return c.Reply(unmet.Error())
+		case errors.As(err, &insufficient):
+			return c.Reply(fmt.Sprintf("材料不足: %v", insufficient))
+		case errors.Is(err, database.ErrCraftInProgress):
+			return c.Reply(err.Error())
+		}
+		return c.Reply(fmt.Sprintf("开始炼制失败: %v", err))
+	}
+
+	result := crafting.FormatStart(craft)
+	b.db.AddMessage(ctx, player.ID, "user", []*genai.Part{genai.NewPartFromText(fmt.Sprintf("[%s]: %s", player.Name, result))})
+	return c.Reply(fmt.Sprintf("「%s」%s", player.Name, result))
+}
+
+// showCrafting 展示已掌握的配方和炉中正在炼制的物品
+func (b *Bot) showCrafting(c tele.Context, player *database.CharacterStats) error {
+	ctx := context.Background()
+	recipes, err := b.db.GetCharacterRecipes(ctx, player.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取配方失败: %v", err))
+	}
+	craft, err := b.db.GetOngoingCraft(ctx, player.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取炼制信息失败: %v", err))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📜 「%s」掌握的配方：\n", player.Name))
+	for _, recipe := range recipes {
+		sb.WriteString("- " + crafting.FormatRecipe(recipe) + "\n")
+	}
+	if len(recipes) == 0 {
+		sb.WriteString("尚未掌握任何配方，可以在冒险中寻找丹方和器方\n")
+	}
+	if craft != nil {
+		sb.WriteString(fmt.Sprintf("\n🔥 炉中正在炼制「%s」，成功率%d%%，预计 %s 出炉\n", craft.RecipeName, craft.SuccessRate, craft.EndsAt.Format("2006-01-02 15:04")))
+	}
+	sb.WriteString("\n/craft <配方名> 开炉炼制")
+	return c.Reply(sb.String())
+}
+
+// craftLoop 定时结算到期的炼制
+func (b *Bot) craftLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		b.settleDueCrafts()
+		<-ticker.C
+	}
+}
+
+func (b *Bot) settleDueCrafts() {
+	ctx := context.Background()
+	crafts, err := b.db.GetDueCrafts(ctx, time.Now())
+	if err != nil {
+		log.Printf("获取到期炼制失败: %v", err)
+		return
+	}
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	for _, craft := range crafts {
+		b.finishCraft(ctx, craft, rng)
+	}
+}
+
+// finishCraft 掷骰结算炼制，把产出放入背包，并通知玩家和天道
+func (b *Bot) finishCraft(ctx context.Context, craft *database.Craft, rng *rand.Rand) {
+	result, success := crafting.Roll(craft.Recipe, craft.SuccessRate, rng)
+	craft.Result = result
+	craft.FinishedAt = time.Now()
+	craft.Status = database.CraftStatusFailed
+	if success {
+		craft.Status = database.CraftStatusSucceeded
+	}
+
+	finished, err := b.db.FinishCraft(ctx, craft)
+	if err != nil {
+		log.Printf("结束炼制 %d 失败: %v", craft.ID, err)
+		return
+	}
+	if !finished {
+		return
+	}
+
+	craftName := database.CraftTypeNames[craft.Recipe.CraftType]
+	text := fmt.Sprintf("%s「%s」失败，只得到%s x%d", craftName, craft.RecipeName, result.ItemName, result.Quantity)
+	if success {
+		text = fmt.Sprintf("%s「%s」成功，炼成%s x%d（%s）", craftName, craft.RecipeName, result.ItemName, result.Quantity, result.Quality)
+	}
+	text += "，物品已放入背包"
+	if notice := b.overCapacityNotice(ctx, craft.CharacterID); notice != "" {
+		text += "。" + notice
+	}
+	b.db.AddSystemMessage(ctx, craft.CharacterID, text)
+	if _, err := b.Send(tele.ChatID(craft.TgID), "🔥 "+text); err != nil {
+		log.Printf("发送炼制 %d 结果失败: %v", craft.ID, err)
+	}
+}
@@ -0,0 +1,377 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/combat"
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// duelTimeout 切磋邀请的有效期，过期后退还赌注
+const duelTimeout = 10 * time.Minute
+
+var (
+	btnDuelAccept  = tele.Btn{Unique: "duel_accept"}
+	btnDuelDecline = tele.Btn{Unique: "duel_decline"}
+)
+
+// handleDuel 处理 /duel 命令
+// /duel 列出同一地点的玩家，/duel <@用户名|角色名> [赌注物品] [数量] 发起切磋
+func (b *Bot) handleDuel(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	ctx := context.Background()
+	challenger, err := b.db.GetActiveCharacter(ctx, user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if challenger == nil {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+	if reason := duelUnavailable(challenger); reason != "" {
+		return c.Reply(reason)
+	}
+
+	nearby, err := b.db.GetCharactersByLocation(ctx, challenger.Location)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取附近玩家失败: %v", err))
+	}
+
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Reply(formatNearbyPlayers(challenger, nearby))
+	}
+	if len(args) > 3 {
+		return c.Reply("请输入正确的命令，格式为: /duel <@用户名|角色名> [赌注物品] [数量]")
+	}
+
+	defender, err := b.findDuelTarget(ctx, args[0])
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取对手信息失败: %v", err))
+	}
+	if defender == nil {
+		return c.Reply("没有找到该玩家，/duel 查看附近的玩家")
+	}
+	if defender.UserID == challenger.UserID {
+		return c.Reply("不能与自己的角色切磋")
+	}
+	if !containsCharacter(nearby, defender.ID) {
+		return c.Reply(fmt.Sprintf("「%s」不在%s，无法切磋", defender.Name, challenger.Location))
+	}
+	if reason := duelUnavailable(defender); reason != "" {
+		return c.Reply(fmt.Sprintf("对手%s", reason))
+	}
+	for _, character := range []*database.CharacterStats{challenger, defender} {
+		if wait, err := b.duelCooldown(ctx, character.ID); err != nil {
+			return c.Reply(fmt.Sprintf("获取切磋记录失败: %v", err))
+		} else if wait > 0 {
+			return c.Reply(fmt.Sprintf("「%s」刚切磋过，需调息%d分钟后才能再次切磋", character.Name, int(wait.Minutes())+1))
+		}
+	}
+
+	duel := &database.Duel{ChallengerID: challenger.ID, DefenderID: defender.ID}
+	if len(args) >= 2 {
+		duel.StakeItemName = args[1]
+		duel.StakeQuantity = 1
+		if len(args) == 3 {
+			duel.StakeQuantity, err = strconv.Atoi(args[2])
+			if err != nil || duel.StakeQuantity <= 0 {
+				return c.Reply("请输入正确的赌注数量")
+			}
+		}
+	}
+	if err := b.db.CreateDuel(ctx, duel); err != nil {
+		var insufficient *database.InsufficientItemError
+		if errors.As(err, &insufficient) {
+			return c.Reply(fmt.Sprintf("赌注不足: %v", insufficient))
+		}
+		var unstackable *database.UnstackableQuantityError
+		if errors.As(err, &unstackable) {
+			return c.Reply(fmt.Sprintf("%v，请把赌注数量设为1", unstackable))
+		}
+		return c.Reply(fmt.Sprintf("发起切磋失败: %v", err))
+	}
+
+	created, err := b.db.GetDuel(ctx, duel.ID)
+	if err != nil || created == nil {
+		return c.Reply(fmt.Sprintf("获取切磋失败: %v", err))
+	}
+	markup := &tele.ReplyMarkup{}
+	id := strconv.Itoa(duel.ID)
+	markup.Inline(markup.Row(
+		markup.Data("⚔️ 应战", btnDuelAccept.Unique, id),
+		markup.Data("🏳️ 拒绝", btnDuelDecline.Unique, id),
+	))
+	invitation := fmt.Sprintf("「%s」（%s%d层）在%s向你的角色「%s」发起切磋%s，%d分钟内有效",
+		challenger.Name, challenger.Realm, challenger.RealmLevel, challenger.Location, defender.Name, formatDuelStake(duel), int(duelTimeout.Minutes()))
+	if _, err := b.Send(tele.ChatID(created.DefenderTgID), invitation, markup); err != nil {
+		b.db.CancelDuel(ctx, duel.ID, database.DuelStatusExpired)
+		return c.Reply(fmt.Sprintf("无法通知对手，切磋已取消: %v", err))
+	}
+	return c.Reply(fmt.Sprintf("已向「%s」发起切磋%s，等待对方应战", defender.Name, formatDuelStake(duel)))
+}
+
+// handleDuelAccept 应战，通过战斗引擎结算切磋
+func (b *Bot) handleDuelAccept(c tele.Context) error {
+	ctx := context.Background()
+	duel, err := b.pendingDuelForDefender(c)
+	if err != nil || duel == nil {
+		return err
+	}
+
+	challenger, err := b.db.GetCharacterStats(ctx, duel.ChallengerID)
+	if err != nil || challenger == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "获取对手信息失败"})
+	}
+	defender, err := b.db.GetCharacterStats(ctx, duel.DefenderID)
+	if err != nil || defender == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "获取玩家信息失败"})
+	}
+	for _, character := range []*database.CharacterStats{challenger, defender} {
+		if reason := duelUnavailable(character); reason != "" {
+			return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("「%s」%s", character.Name, reason), ShowAlert: true})
+		}
+	}
+	if challenger.Location != defender.Location {
+		return c.Respond(&tele.CallbackResponse{Text: "双方已不在同一地点，无法切磋", ShowAlert: true})
+	}
+
+	resolved, err := b.db.ResolveDuel(ctx, duel.ID, func(duel *database.Duel) (int, string, []*database.InventoryItem, error) {
+		a, err := b.duelCombatant(ctx, challenger, duel.StakeItemName)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		d, err := b.duelCombatant(ctx, defender, duel.StakeItemName)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		result := combat.Simulate(a, d, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+
+		consumed := []*database.InventoryItem{}
+		for characterID, combatant := range map[int]*combat.Combatant{challenger.ID: a, defender.ID: d} {
+			for itemName, quantity := range combatant.Used {
+				consumed = append(consumed, &database.InventoryItem{CharacterID: characterID, ItemName: itemName, Quantity: -quantity})
+			}
+		}
+		winnerID := defender.ID
+		if result.AWon {
+			winnerID = challenger.ID
+		}
+		return winnerID, result.Log(), consumed, nil
+	})
+	if err != nil {
+		var insufficient *database.InsufficientItemError
+		if errors.As(err, &insufficient) {
+			return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("赌注不足: %v", insufficient), ShowAlert: true})
+		}
+		var unstackable *database.UnstackableQuantityError
+		if errors.As(err, &unstackable) {
+			return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("无法押上赌注: %v", unstackable), ShowAlert: true})
+		}
+		return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("切磋失败: %v", err), ShowAlert: true})
+	}
+	if resolved == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "该切磋已失效"})
+	}
+
+	winner, loser := challenger, defender
+	if resolved.WinnerID == defender.ID {
+		winner, loser = defender, challenger
+	}
+	b.recordDuelStory(ctx, winner, loser, resolved)
+
+	report := fmt.Sprintf("⚔️ 「%s」与「%s」的切磋结束\n\n%s\n\n🏆 胜者：%s", challenger.Name, defender.Name, resolved.Log, winner.Name)
+	if resolved.StakeItemName != "" {
+		report += fmt.Sprintf("，赢得赌注 %s x%d", resolved.StakeItemName, resolved.StakeQuantity*2)
+		if notice := b.overCapacityNotice(ctx, winner.ID); notice != "" {
+			report += fmt.Sprintf("\n「%s」的%s", winner.Name, notice)
+		}
+	}
+	c.Respond()
+	c.Edit(fmt.Sprintf("你接受了「%s」的切磋", challenger.Name))
+	b.Send(tele.ChatID(resolved.ChallengerTgID), report)
+	_, err = b.Send(tele.ChatID(resolved.DefenderTgID), report)
+	return err
+}
+
+// handleDuelDecline 拒绝切磋，退还发起方赌注
+func (b *Bot) handleDuelDecline(c tele.Context) error {
+	duel, err := b.pendingDuelForDefender(c)
+	if err != nil || duel == nil {
+		return err
+	}
+	cancelled, err := b.db.CancelDuel(context.Background(), duel.ID, database.DuelStatusDeclined)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("拒绝切磋失败: %v", err), ShowAlert: true})
+	}
+	if cancelled == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "该切磋已失效"})
+	}
+	c.Respond()
+	c.Edit("你拒绝了这次切磋")
+	_, err = b.Send(tele.ChatID(cancelled.ChallengerTgID), "对方拒绝了你的切磋邀请，赌注已退还")
+	return err
+}
+
+// pendingDuelForDefender 获取按钮对应的待应战切磋，并确认点击者是应战方
+// 切磋无效时已回复点击者，返回 nil
+func (b *Bot) pendingDuelForDefender(c tele.Context) (*database.Duel, error) {
+	user := c.Get("db_user").(*database.User)
+	id, err := strconv.Atoi(c.Callback().Data)
+	if err != nil {
+		return nil, c.Respond(&tele.CallbackResponse{Text: "无效的切磋"})
+	}
+	duel, err := b.db.GetDuel(context.Background(), id)
+	if err != nil {
+		return nil, c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("获取切磋失败: %v", err)})
+	}
+	if duel == nil || duel.DefenderTgID != user.TgId {
+		return nil, c.Respond(&tele.CallbackResponse{Text: "这不是发给你的切磋"})
+	}
+	if duel.Status != database.DuelStatusPending {
+		return nil, c.Respond(&tele.CallbackResponse{Text: "该切磋已失效"})
+	}
+	return duel, nil
+}
+
+// duelLoop 定时取消过期的切磋邀请并退还赌注
+func (b *Bot) duelLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		b.expireDuels()
+		<-ticker.C
+	}
+}
+
+func (b *Bot) expireDuels() {
+	ctx := context.Background()
+	duels, err := b.db.GetExpiredDuels(ctx, time.Now().Add(-duelTimeout))
+	if err != nil {
+		log.Printf("获取过期切磋失败: %v", err)
+		return
+	}
+	for _, duel := range duels {
+		cancelled, err := b.db.CancelDuel(ctx, duel.ID, database.DuelStatusExpired)
+		if err != nil {
+			log.Printf("取消过期切磋 %d 失败: %v", duel.ID, err)
+			continue
+		}
+		if cancelled != nil {
+			b.Send(tele.ChatID(cancelled.ChallengerTgID), "对方未在规定时间内应战，切磋已取消，赌注已退还")
+		}
+	}
+}
+
+// duelCooldown 角色距离下一次可以切磋还需等待的时间
+func (b *Bot) duelCooldown(ctx context.Context, characterID int) (time.Duration, error) {
+	last, err := b.db.GetLastDuelTime(ctx, characterID)
+	if err != nil || last.IsZero() {
+		return 0, err
+	}
+	cooldown := time.Duration(b.config.Game.DuelCooldownMinutes) * time.Minute
+	return time.Until(last.Add(cooldown)), nil
+}
+
+// duelCombatant 构造切磋中的参战者，赌注物品已被托管，不会在战斗中被服用
+func (b *Bot) duelCombatant(ctx context.Context, stats *database.CharacterStats, stakeItemName string) (*combat.Combatant, error) {
+	techniques, err := b.db.GetCharacterCultivationTechniques(ctx, stats.ID)
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := b.db.GetCharacterInventory(ctx, stats.ID)
+	if err != nil {
+		return nil, err
+	}
+	equipment, buffs, err := b.getCharacterBonuses(ctx, stats.ID)
+	if err != nil {
+		return nil, err
+	}
+	usable := []*database.InventoryItem{}
+	for _, item := range inventory {
+		if item.ItemName != stakeItemName {
+			usable = append(usable, item)
+		}
+	}
+	return combat.NewCharacterCombatant(stats.Effective(equipment, buffs), techniques, usable), nil
+}
+
+// recordDuelStory 把切磋结果写入双方的成长经历
+func (b *Bot) recordDuelStory(ctx context.Context, winner *database.CharacterStats, loser *database.CharacterStats, duel *database.Duel) {
+	stake := ""
+	if duel.StakeItemName != "" {
+		stake = fmt.Sprintf("，赌注为%s x%d", duel.StakeItemName, duel.StakeQuantity)
+	}
+	at := time.Now().Format("2006-01-02 15:04")
+	stories := map[int]string{
+		winner.ID: fmt.Sprintf("%s 于%s与「%s」切磋获胜%s", at, winner.Location, loser.Name, stake),
+		loser.ID:  fmt.Sprintf("%s 于%s与「%s」切磋落败%s", at, loser.Location, winner.Name, stake),
+	}
+	for characterID, story := range stories {
+		err := b.db.UpdateCharacterStatsPartial(ctx, &database.CharacterStatsUpdate{CharacterID: characterID, Stories: &story})
+		if err != nil {
+			log.Printf("记录切磋 %d 结果失败: %v", duel.ID, err)
+		}
+	}
+}
+
+// findDuelTarget 根据 @用户名 或角色名查找对手角色
+func (b *Bot) findDuelTarget(ctx context.Context, target string) (*database.CharacterStats, error) {
+	if username, ok := strings.CutPrefix(target, "@"); ok {
+		user, err := b.db.GetUserByUsername(ctx, username)
+		if err != nil || user == nil {
+			return nil, err
+		}
+		return b.db.GetActiveCharacter(ctx, user.ID)
+	}
+	return b.db.GetCharacterByName(ctx, target)
+}
+
+// duelUnavailable 角色无法切磋的原因，可以切磋时返回空字符串
+func duelUnavailable(character *database.CharacterStats) string {
+	switch character.Status {
+	case database.CharacterStatusDead:
+		return "已经陨落，无法切磋"
+	case database.CharacterStatusRetreat:
+		return "正在闭关，无法切磋"
+	}
+	return ""
+}
+
+func containsCharacter(characters []*database.CharacterStats, characterID int) bool {
+	for _, character := range characters {
+		if character.ID == characterID {
+			return true
+		}
+	}
+	return false
+}
+
+func formatDuelStake(duel *database.Duel) string {
+	if duel.StakeItemName == "" {
+		return ""
+	}
+	return fmt.Sprintf("，双方各押上 %s x%d，胜者全得", duel.StakeItemName, duel.StakeQuantity)
+}
+
+func formatNearbyPlayers(self *database.CharacterStats, nearby []*database.CharacterStats) string {
+	var sb strings.Builder
+	for _, character := range nearby {
+		if character.UserID == self.UserID || duelUnavailable(character) != "" {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("⚔️ %s · %s%d层\n", character.Name, character.Realm, character.RealmLevel))
+	}
+	if sb.Len() == 0 {
+		return fmt.Sprintf("%s附近没有可以切磋的玩家", self.Location)
+	}
+	return fmt.Sprintf("%s附近的玩家：\n\n%s\n/duel <@用户名|角色名> [赌注物品] [数量] 发起切磋", self.Location, sb.String())
+}
@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"jiangfengwhu/nagi-bot-go/database"
+
+	"google.golang.org/genai"
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleUse 处理 /use 命令，/use <物品> [数量] 使用背包中的消耗品
+func (b *Bot) handleUse(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	ctx := context.Background()
+	player, err := b.db.GetActiveCharacter(ctx, user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if player == nil {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+	if player.IsDead() {
+		return c.Reply(fmt.Sprintf("角色「%s」已经陨落，无法使用物品", player.Name))
+	}
+	if player.Status == database.CharacterStatusRetreat {
+		return c.Reply(fmt.Sprintf("角色「%s」正在闭关，无法使用物品", player.Name))
+	}
+
+	args := c.Args()
+	if len(args) == 0 || len(args) > 2 {
+		return c.Reply("请输入正确的命令，格式为: /use <物品|#物品ID> [数量]")
+	}
+	quantity := 1
+	if len(args) == 2 {
+		quantity, err = strconv.Atoi(args[1])
+		if err != nil || quantity <= 0 {
+			return c.Reply("请输入正确的数量")
+		}
+	}
+
+	itemID, itemName := parseItemRef(args[0])
+	return b.useItem(c, player, itemID, itemName, quantity)
+}
+
+// useItem 使用物品并把结果记入对话历史，让天道知晓
+func (b *Bot) useItem(c tele.Context, player *database.CharacterStats, itemID int, itemName string, quantity int) error {
+	ctx := context.Background()
+	usage, err := b.db.UseItem(ctx, player.ID, itemID, itemName, quantity)
+	if err != nil {
+		var insufficient *database.InsufficientItemError
+		if errors.As(err, &insufficient) {
+			return c.Reply(fmt.Sprintf("物品不足: %v", insufficient))
+		}
+		if errors.Is(err, database.ErrItemNotUsable) {
+			return c.Reply(fmt.Sprintf("「%s」%v", itemName, err))
+		}
+		return c.Reply(fmt.Sprintf("使用物品失败: %v", err))
+	}
+
+	result := fmt.Sprintf("[%s]: %s", player.Name, usage)
+	b.db.AddMessage(ctx, player.ID, "user", []*genai.Part{genai.NewPartFromText(result)})
+	return c.Reply(fmt.Sprintf("「%s」%s", player.Name, usage))
+}
+
+// parseItemRef 解析命令中的物品，#12 表示物品ID，其余视为物品名称
+func parseItemRef(arg string) (int, string) {
+	if idText, ok := strings.CutPrefix(arg, "#"); ok {
+		if id, err := strconv.Atoi(idText); err == nil {
+			return id, ""
+		}
+	}
+	return 0, arg
+}
+
+// inventoryFullResponse 背包容量不足时生成返回给天道的结构化错误，其他错误返回 false
+func inventoryFullResponse(err error) (map[string]any, bool) {
+	var full *database.InventoryFullError
+	if !errors.As(err, &full) {
+		return nil, false
+	}
+	return map[string]any{
+		"error":    "inventory_full",
+		"text":     full.Error() + "，本次物品变动未生效，请让玩家丢弃物品或装备更大的储物袋",
+		"used":     full.Used,
+		"capacity": full.Capacity,
+	}, true
+}
+
+// overCapacityNotice 炼制产出、赢得赌注等结算使背包超出容量时的提醒，未超出时返回空字符串
+func (b *Bot) overCapacityNotice(ctx context.Context, characterID int) string {
+	capacity, err := b.db.GetInventoryCapacity(ctx, characterID, b.config.Game.InventoryCapacity)
+	if err != nil || capacity.Free() >= 0 {
+		return ""
+	}
+	return fmt.Sprintf("背包已超出容量（%s），在丢弃物品或装备更大的储物袋之前无法获得新的物品", capacity)
+}
@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/loot"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// lootAuditLimit 掉落审计最多展示的角色数
+const lootAuditLimit = 30
+
+// lootSettings 掉落的全局配置
+func (b *Bot) lootSettings() loot.Settings {
+	return loot.Settings{
+		QualityWeights: b.config.Game.LootQualityWeights,
+		LuckFactor:     b.config.Game.LootLuckFactor,
+	}
+}
+
+// handleLoot 处理 /loot 管理命令
+// /loot 列出掉落表，/loot set <JSON> 新增或覆盖掉落表，/loot del <名称> 删除掉落表，/loot audit [天数] 查看发放审计
+func (b *Bot) handleLoot(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	if !slices.Contains(b.config.Bot.AdminIds, user.TgId) {
+		return c.Reply("您没有权限使用此命令")
+	}
+
+	action, payload, _ := strings.Cut(strings.TrimSpace(c.Message().Payload), " ")
+	payload = strings.TrimSpace(payload)
+	switch action {
+	case "", "list":
+		return b.listLootTables(c)
+	case "set":
+		return b.saveLootTable(c, user, payload)
+	case "del":
+		if payload == "" {
+			return c.Reply("请输入正确的命令，格式为: /loot del <名称>")
+		}
+		deleted, err := b.db.DeleteLootTable(context.Background(), payload)
+		if err != nil {
+			return c.Reply(fmt.Sprintf("删除掉落表失败: %v", err))
+		}
+		if !deleted {
+			return c.Reply(fmt.Sprintf("掉落表「%s」不存在", payload))
+		}
+		b.auditAdmin(user, "loot_del", nil, payload)
+		return c.Reply(fmt.Sprintf("已删除掉落表「%s」", payload))
+	case "audit":
+		return b.auditLoot(c, payload)
+	}
+	return c.Reply("请输入正确的命令，格式为: /loot [list|set <JSON>|del <名称>|audit [天数]]")
+}
+
+func (b *Bot) listLootTables(c tele.Context) error {
+	tables, err := b.db.GetLootTables(context.Background())
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取掉落表失败: %v", err))
+	}
+	if len(tables) == 0 {
+		return c.Reply("还没有设定掉落表，/loot set <JSON> 新增掉落表")
+	}
+	var sb strings.Builder
+	sb.WriteString("🎲 掉落表：\n")
+	for _, table := range tables {
+		sb.WriteString("- " + loot.FormatTable(table, b.lootSettings()) + "\n")
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) saveLootTable(c tele.Context, admin *database.User, payload string) error {
+	var table database.LootTable
+	if err := json.Unmarshal([]byte(payload), &table); err != nil {
+		return c.Reply(fmt.Sprintf("解析掉落表失败: %v\n格式示例: /loot set {\"name\":\"青云山妖兽\",\"location\":\"青云山\",\"enemy_tier\":1,\"rolls\":2,\"entries\":[{\"item\":{\"item_name\":\"妖兽内丹\",\"item_type\":\"材料\",\"quality\":\"高级\"},\"max_quantity\":2},{\"weight\":50}]}", err))
+	}
+	if err := loot.Validate(&table); err != nil {
+		return c.Reply(err.Error())
+	}
+	if err := b.db.SaveLootTable(context.Background(), &table); err != nil {
+		return c.Reply(fmt.Sprintf("保存掉落表失败: %v", err))
+	}
+	b.auditAdmin(admin, "loot_set", nil, payload)
+	return c.Reply("已保存掉落表：" + loot.FormatTable(&table, b.lootSettings()))
+}
+
+func (b *Bot) auditLoot(c tele.Context, payload string) error {
+	days := 7
+	if payload != "" {
+		var err error
+		days, err = strconv.Atoi(payload)
+		if err != nil || days <= 0 {
+			return c.Reply("请输入正确的天数")
+		}
+	}
+	audits, err := b.db.GetGrantAudit(context.Background(), time.Now().AddDate(0, 0, -days), lootAuditLimit)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取发放记录失败: %v", err))
+	}
+	if len(audits) == 0 {
+		return c.Reply(fmt.Sprintf("最近%d天没有物品发放记录", days))
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📋 最近%d天物品发放审计（掷出/掉落实发，天道直发，战斗，购买，炼制）：\n", days))
+	for _, audit := range audits {
+		sb.WriteString(fmt.Sprintf("- %s（#%d）：%d/%d，%d，%d，%d，%d\n",
+			audit.Name, audit.CharacterID, audit.Rolled, audit.Looted, audit.GMGranted, audit.Combat, audit.Purchased, audit.Crafted))
+	}
+	return c.Reply(sb.String())
+}
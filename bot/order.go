@@ -0,0 +1,351 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// orderTimeout 购买订单等待玩家确认的时间，过期后订单作废
+const orderTimeout = 2 * time.Minute
+
+// orderListLimit /orders 最多展示的订单数
+const orderListLimit = 10
+
+var (
+	btnOrderConfirm = tele.Btn{Unique: "order_confirm"}
+	btnOrderCancel  = tele.Btn{Unique: "order_cancel"}
+)
+
+// orderOutcome 订单的处理结果，Response 作为 in_app_purchase 的函数返回交给天道
+type orderOutcome struct {
+	Response map[string]any
+	Summary  string
+}
+
+// requestPurchase 创建待确认订单并发送确认按钮，阻塞直到玩家确认、取消或订单过期
+func (b *Bot) requestPurchase(c tele.Context, user *database.User, player *database.CharacterStats, args map[string]any) (*orderOutcome, error) {
+	ctx := context.Background()
+	order, err := llm.InAppPurchase(b.db, user.ID, player.ID, c.Message().ID, c.Message().Text, args)
+	if err != nil {
+		var unavailable *database.ShopItemUnavailableError
+		var insufficient *database.InsufficientBalanceError
+		if errors.As(err, &unavailable) || errors.As(err, &insufficient) {
+			text := "购买失败：" + err.Error()
+			return &orderOutcome{Response: map[string]any{"text": text}, Summary: text}, nil
+		}
+		return nil, err
+	}
+
+	done := make(chan *orderOutcome, 1)
+	b.pendingOrders.Store(order.ID, done)
+	defer b.pendingOrders.Delete(order.ID)
+
+	markup := &tele.ReplyMarkup{}
+	id := strconv.Itoa(order.ID)
+	markup.Inline(markup.Row(
+		markup.Data("✅ 确认购买", btnOrderConfirm.Unique, id),
+		markup.Data("❌ 取消", btnOrderCancel.Unique, id),
+	))
+	prompt, err := b.Reply(c.Message(), fmt.Sprintf("🛒 「%s」的购买订单 #%d\n%s\n%d分钟内确认有效", player.Name, order.ID, formatOrder(order), int(orderTimeout.Minutes())), markup)
+	if err != nil {
+		b.db.ResolveOrder(ctx, order.ID, database.OrderStatusCancelled, "无法发送确认消息")
+		return nil, fmt.Errorf("发送购买确认失败: %v", err)
+	}
+
+	select {
+	case outcome := <-done:
+		return outcome, nil
+	case <-time.After(orderTimeout):
+	}
+	expired, err := b.db.ResolveOrder(ctx, order.ID, database.OrderStatusExpired, "玩家未确认")
+	if err != nil {
+		return nil, fmt.Errorf("取消过期订单失败: %v", err)
+	}
+	if expired == nil {
+		// 超时的同时玩家点击了按钮，以按钮的结果为准
+		return <-done, nil
+	}
+	b.Edit(prompt, fmt.Sprintf("⌛ 订单 #%d 已过期，未扣除灵石\n%s", order.ID, formatOrder(order)))
+	text := fmt.Sprintf("玩家未在%d分钟内确认，订单已过期，没有扣除灵石，也没有获得物品", int(orderTimeout.Minutes()))
+	return &orderOutcome{Response: map[string]any{"text": text}, Summary: text}, nil
+}
+
+// handleOrderConfirm 玩家确认订单，扣除灵石并放入背包
+func (b *Bot) handleOrderConfirm(c tele.Context) error {
+	ctx := context.Background()
+	order, err := b.pendingOrderForUser(c)
+	if err != nil || order == nil {
+		return err
+	}
+	if time.Since(order.CreatedAt) > orderTimeout {
+		if expired, _ := b.db.ResolveOrder(ctx, order.ID, database.OrderStatusExpired, "玩家未确认"); expired != nil {
+			b.finishOrder(ctx, expired, &orderOutcome{
+				Response: map[string]any{"text": "订单已过期，没有扣除灵石，也没有获得物品"},
+				Summary:  "订单已过期，没有扣除灵石",
+			})
+		}
+		return c.Respond(&tele.CallbackResponse{Text: "该订单已过期"})
+	}
+
+	confirmed, purchase, err := b.db.ConfirmOrder(ctx, order.ID, b.config.Game.InventoryCapacity)
+	var outcome *orderOutcome
+	var unavailable *database.ShopItemUnavailableError
+	var insufficient *database.InsufficientBalanceError
+	switch {
+	case errors.As(err, &unavailable), errors.As(err, &insufficient):
+		text := "购买失败：" + err.Error()
+		outcome = &orderOutcome{Response: map[string]any{"text": text}, Summary: text}
+	case err != nil:
+		response, ok := inventoryFullResponse(err)
+		if !ok {
+			return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("购买失败: %v", err), ShowAlert: true})
+		}
+		outcome = &orderOutcome{Response: response, Summary: err.Error()}
+	case confirmed == nil:
+		return c.Respond(&tele.CallbackResponse{Text: "该订单已失效"})
+	default:
+		text := fmt.Sprintf("玩家已确认购买，获得%s，花费灵石 %d，剩余灵石 %d，背包容量 %s", formatOrderItems(purchase.Items), purchase.Cost, purchase.Balance, purchase.Capacity)
+		outcome = &orderOutcome{Response: map[string]any{"text": text}, Summary: fmt.Sprintf("购买成功，花费灵石 %d，剩余灵石 %d", purchase.Cost, purchase.Balance)}
+	}
+
+	c.Respond()
+	icon := "✅"
+	if purchase == nil {
+		icon = "⚠️"
+	}
+	c.Edit(fmt.Sprintf("%s 订单 #%d：%s\n%s", icon, order.ID, outcome.Summary, formatOrder(order)))
+	b.finishOrder(ctx, order, outcome)
+	return nil
+}
+
+// handleOrderCancel 玩家取消订单
+func (b *Bot) handleOrderCancel(c tele.Context) error {
+	ctx := context.Background()
+	order, err := b.pendingOrderForUser(c)
+	if err != nil || order == nil {
+		return err
+	}
+	cancelled, err := b.db.ResolveOrder(ctx, order.ID, database.OrderStatusCancelled, "玩家取消")
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("取消订单失败: %v", err), ShowAlert: true})
+	}
+	if cancelled == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "该订单已失效"})
+	}
+	c.Respond()
+	c.Edit(fmt.Sprintf("❌ 订单 #%d 已取消，未扣除灵石\n%s", order.ID, formatOrder(order)))
+	b.finishOrder(ctx, cancelled, &orderOutcome{
+		Response: map[string]any{"text": "玩家取消了购买，没有扣除灵石，也没有获得物品"},
+		Summary:  "玩家取消了购买",
+	})
+	return nil
+}
+
+// finishOrder 把订单结果交给等待中的对话；对话已经结束时（如重启后）记入历史，供天道下次参考
+func (b *Bot) finishOrder(ctx context.Context, order *database.Order, outcome *orderOutcome) {
+	if done, ok := b.pendingOrders.Load(order.ID); ok {
+		done.(chan *orderOutcome) <- outcome
+		return
+	}
+	text := fmt.Sprintf("购买订单 #%d：%s", order.ID, outcome.Response["text"])
+	if err := b.db.AddSystemMessage(ctx, order.CharacterID, text); err != nil {
+		log.Printf("记录订单 %d 结果失败: %v", order.ID, err)
+	}
+}
+
+// pendingOrderForUser 获取按钮对应的待确认订单，并确认点击者是下单的玩家
+// 订单无效时已回复点击者，返回 nil
+func (b *Bot) pendingOrderForUser(c tele.Context) (*database.Order, error) {
+	user := c.Get("db_user").(*database.User)
+	id, err := strconv.Atoi(c.Callback().Data)
+	if err != nil {
+		return nil, c.Respond(&tele.CallbackResponse{Text: "无效的订单"})
+	}
+	order, err := b.db.GetOrder(context.Background(), id)
+	if err != nil {
+		return nil, c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("获取订单失败: %v", err)})
+	}
+	if order == nil || order.UserID != user.ID {
+		return nil, c.Respond(&tele.CallbackResponse{Text: "这不是你的订单"})
+	}
+	if order.Status != database.OrderStatusPending {
+		return nil, c.Respond(&tele.CallbackResponse{Text: "该订单已失效"})
+	}
+	return order, nil
+}
+
+// handleOrders 处理 /orders 命令，/orders 查看最近的订单，/orders <订单ID> 查看订单回执
+// 管理员可用 /orders refund <订单ID> [原因] 退款，退还灵石并收回物品
+func (b *Bot) handleOrders(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	ctx := context.Background()
+	args := c.Args()
+	isAdmin := slices.Contains(b.config.Bot.AdminIds, user.TgId)
+
+	if len(args) == 0 {
+		orders, err := b.db.GetUserOrders(ctx, user.ID, orderListLimit)
+		if err != nil {
+			return c.Reply(fmt.Sprintf("获取订单失败: %v", err))
+		}
+		if len(orders) == 0 {
+			return c.Reply("您还没有购买记录")
+		}
+		var sb strings.Builder
+		sb.WriteString("🧾 最近的订单：\n")
+		for _, order := range orders {
+			sb.WriteString(fmt.Sprintf("- #%d %s「%s」%s，合计 %d 灵石\n", order.ID, order.CreatedAt.Format("01-02 15:04"),
+				order.CharacterName, database.OrderStatusNames[order.Status], order.Total))
+		}
+		sb.WriteString("\n/orders <订单ID> 查看订单回执")
+		return c.Reply(sb.String())
+	}
+
+	if args[0] == "refund" {
+		if !isAdmin {
+			return c.Reply("您没有权限使用此命令")
+		}
+		if len(args) < 2 {
+			return c.Reply("请输入正确的命令，格式为: /orders refund <订单ID> [原因]")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return c.Reply("请输入正确的订单ID")
+		}
+		return b.refundOrder(c, user, id, strings.Join(args[2:], " "))
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return c.Reply("请输入正确的命令，格式为: /orders [订单ID]")
+	}
+	order, err := b.db.GetOrder(ctx, id)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取订单失败: %v", err))
+	}
+	if order == nil || (order.UserID != user.ID && !isAdmin) {
+		return c.Reply(fmt.Sprintf("订单 #%d 不存在", id))
+	}
+	return c.Reply(formatReceipt(order))
+}
+
+// refundOrder 退款一笔已成交的订单，并通知玩家和天道
+func (b *Bot) refundOrder(c tele.Context, admin *database.User, id int, reason string) error {
+	ctx := context.Background()
+	if reason == "" {
+		reason = "管理员退款"
+	}
+	order, err := b.db.RefundOrder(ctx, id, reason)
+	if err != nil {
+		var insufficient *database.InsufficientItemError
+		switch {
+		case errors.Is(err, database.ErrOrderNotRefundable):
+			return c.Reply(err.Error())
+		case errors.As(err, &insufficient):
+			return c.Reply(fmt.Sprintf("无法收回物品，退款失败: %v", insufficient))
+		}
+		return c.Reply(fmt.Sprintf("退款失败: %v", err))
+	}
+	if order == nil {
+		return c.Reply(fmt.Sprintf("订单 #%d 不存在", id))
+	}
+
+	refund := order.BalanceBefore - order.BalanceAfter
+	b.auditAdmin(admin, "order_refund", &database.User{ID: order.UserID}, fmt.Sprintf("订单 #%d 退还灵石 %d，%s", order.ID, refund, reason))
+	text := fmt.Sprintf("购买订单 #%d 已退款（%s），退还灵石 %d，收回%s", order.ID, reason, refund, formatOrderItems(order.Items))
+	if err := b.db.AddSystemMessage(ctx, order.CharacterID, text); err != nil {
+		log.Printf("记录订单 %d 退款失败: %v", order.ID, err)
+	}
+	if _, err := b.Send(tele.ChatID(order.TgID), "💰 "+text); err != nil {
+		log.Printf("通知订单 %d 退款失败: %v", order.ID, err)
+	}
+	return c.Reply("已退款：" + text)
+}
+
+// orderLoop 定时作废过期未确认的订单，处理重启前遗留的订单
+func (b *Bot) orderLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		b.expireOrders()
+		<-ticker.C
+	}
+}
+
+func (b *Bot) expireOrders() {
+	ctx := context.Background()
+	orders, err := b.db.GetExpiredOrders(ctx, time.Now().Add(-orderTimeout))
+	if err != nil {
+		log.Printf("获取过期订单失败: %v", err)
+		return
+	}
+	for _, order := range orders {
+		if _, ok := b.pendingOrders.Load(order.ID); ok {
+			// 仍在等待中的对话会自行作废订单
+			continue
+		}
+		expired, err := b.db.ResolveOrder(ctx, order.ID, database.OrderStatusExpired, "玩家未确认")
+		if err != nil {
+			log.Printf("作废过期订单 %d 失败: %v", order.ID, err)
+			continue
+		}
+		if expired != nil {
+			b.finishOrder(ctx, expired, &orderOutcome{Response: map[string]any{"text": "订单已过期，没有扣除灵石，也没有获得物品"}})
+		}
+	}
+}
+
+// formatOrder 订单明细
+func formatOrder(order *database.Order) string {
+	var sb strings.Builder
+	for _, line := range order.Lines {
+		sb.WriteString(fmt.Sprintf("- #%d %s x%d 份，每份 %d 灵石\n", line.ShopItemID, line.ItemName, line.Quantity, line.UnitPrice))
+	}
+	sb.WriteString(fmt.Sprintf("合计：%d 灵石", order.Total))
+	return sb.String()
+}
+
+// formatOrderItems 订单成交物品的简要说明
+func formatOrderItems(items []*database.InventoryItem) string {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, fmt.Sprintf("%s x%d", item.ItemName, item.Quantity))
+	}
+	return strings.Join(names, "、")
+}
+
+// formatReceipt 订单回执
+func formatReceipt(order *database.Order) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🧾 订单 #%d（%s）\n", order.ID, database.OrderStatusNames[order.Status]))
+	sb.WriteString(fmt.Sprintf("角色：%s\n", order.CharacterName))
+	sb.WriteString(fmt.Sprintf("下单时间：%s\n", order.CreatedAt.Format("2006-01-02 15:04:05")))
+	if order.Turn != "" {
+		sb.WriteString(fmt.Sprintf("起因：%s\n", order.Turn))
+	}
+	sb.WriteString(formatOrder(order) + "\n")
+	if len(order.Items) > 0 {
+		sb.WriteString(fmt.Sprintf("获得物品：%s\n", formatOrderItems(order.Items)))
+		sb.WriteString(fmt.Sprintf("灵石余额：%d → %d\n", order.BalanceBefore, order.BalanceAfter))
+	}
+	if !order.ResolvedAt.IsZero() {
+		sb.WriteString(fmt.Sprintf("结算时间：%s\n", order.ResolvedAt.Format("2006-01-02 15:04:05")))
+	}
+	if !order.RefundedAt.IsZero() {
+		sb.WriteString(fmt.Sprintf("退款时间：%s\n", order.RefundedAt.Format("2006-01-02 15:04:05")))
+	}
+	if order.Result != "" {
+		sb.WriteString(fmt.Sprintf("备注：%s\n", order.Result))
+	}
+	return sb.String()
+}
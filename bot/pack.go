@@ -0,0 +1,426 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/genai"
+	tele "gopkg.in/telebot.v4"
+)
+
+// packPageSize 背包每页展示的物品数量
+const packPageSize = 8
+
+// packMaxKeyword 背包搜索关键字的最大长度，受限于按钮回调数据的 64 字节上限
+const packMaxKeyword = 8
+
+// packCallbackLimit Telegram 按钮回调数据的字节上限
+const packCallbackLimit = 64
+
+// 背包列表的筛选方式
+const (
+	packFilterAll     = "all"
+	packFilterType    = "type"
+	packFilterQuality = "quality"
+	packFilterSearch  = "search"
+)
+
+var (
+	btnPackPage           = tele.Btn{Unique: "pack_page"}
+	btnPackFilter         = tele.Btn{Unique: "pack_filter"}
+	btnPackItem           = tele.Btn{Unique: "pack_item"}
+	btnPackUse            = tele.Btn{Unique: "pack_use"}
+	btnPackEquip          = tele.Btn{Unique: "pack_equip"}
+	btnPackDiscard        = tele.Btn{Unique: "pack_discard"}
+	btnPackDiscardConfirm = tele.Btn{Unique: "pack_discard_ok"}
+)
+
+// packView 背包列表的筛选条件和页码，编码在按钮回调数据中
+type packView struct {
+	Filter string
+	Value  string
+	Page   int
+}
+
+func (v packView) data() []string {
+	return []string{v.Filter, v.Value, strconv.Itoa(v.Page)}
+}
+
+// fits 按最长的按钮标识、最大的物品ID和四位页码估算完整的回调数据（\f标识|物品ID|筛选方式|筛选值|页码）
+// 是否超出上限，筛选值过长时不生成对应按钮
+func (v packView) fits() bool {
+	data := []string{"\f" + btnPackDiscardConfirm.Unique, strconv.Itoa(math.MaxInt32), v.Filter, v.Value, "9999"}
+	return len(strings.Join(data, "|")) <= packCallbackLimit
+}
+
+func (v packView) String() string {
+	switch v.Filter {
+	case packFilterType:
+		return "类型：" + v.Value
+	case packFilterQuality:
+		return "品质：" + v.Value
+	case packFilterSearch:
+		return "搜索：" + v.Value
+	}
+	return "全部物品"
+}
+
+// parsePackView 解析回调数据中的筛选条件，无法解析时返回全部物品的第一页
+func parsePackView(args []string) packView {
+	if len(args) < 3 {
+		return packView{Filter: packFilterAll}
+	}
+	page, _ := strconv.Atoi(args[2])
+	return packView{Filter: args[0], Value: args[1], Page: max(page, 0)}
+}
+
+// parsePackItemArgs 解析物品按钮的回调数据：物品ID|筛选方式|筛选值|页码
+func parsePackItemArgs(args []string) (int, packView) {
+	if len(args) == 0 {
+		return 0, packView{Filter: packFilterAll}
+	}
+	itemID, _ := strconv.Atoi(args[0])
+	return itemID, parsePackView(args[1:])
+}
+
+// handleInventory 处理 /pack 命令，/pack [关键字] 分页展示背包，可按关键字搜索
+func (b *Bot) handleInventory(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	player, err := b.db.GetActiveCharacter(context.Background(), user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if player == nil {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+
+	view := packView{Filter: packFilterAll}
+	if keyword := strings.TrimSpace(c.Message().Payload); keyword != "" {
+		view = packView{Filter: packFilterSearch, Value: keyword}
+		if utf8.RuneCountInString(keyword) > packMaxKeyword || !view.fits() {
+			return c.Reply(fmt.Sprintf("搜索关键字不能超过%d个字", packMaxKeyword))
+		}
+	}
+	text, markup, err := b.renderPackList(context.Background(), player, view)
+	if err != nil {
+		return c.Reply(err.Error())
+	}
+	return c.Reply(text, markup)
+}
+
+// packPlayer 获取点击背包按钮的玩家当前角色，只有发起 /pack 的玩家可以操作
+func (b *Bot) packPlayer(c tele.Context) (*database.CharacterStats, error) {
+	if message := c.Callback().Message; message != nil && message.ReplyTo != nil && message.ReplyTo.Sender != nil && message.ReplyTo.Sender.ID != c.Sender().ID {
+		return nil, errors.New("这不是你的背包")
+	}
+	user := c.Get("db_user").(*database.User)
+	player, err := b.db.GetActiveCharacter(context.Background(), user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("获取玩家信息失败: %v", err)
+	}
+	if player == nil {
+		return nil, errors.New("您还没有注册角色")
+	}
+	return player, nil
+}
+
+// packItemUnavailable 角色当前无法操作背包物品的原因，可以操作时返回空字符串
+func packItemUnavailable(player *database.CharacterStats) string {
+	if player.IsDead() {
+		return fmt.Sprintf("角色「%s」已经陨落，无法操作物品", player.Name)
+	}
+	if player.Status == database.CharacterStatusRetreat {
+		return fmt.Sprintf("角色「%s」正在闭关，无法操作物品", player.Name)
+	}
+	return ""
+}
+
+// packItems 按筛选条件获取背包物品
+func (b *Bot) packItems(ctx context.Context, characterID int, view packView) ([]*database.InventoryItem, error) {
+	switch view.Filter {
+	case packFilterType:
+		return b.db.GetInventoryByType(ctx, characterID, view.Value)
+	case packFilterQuality:
+		return b.db.GetInventoryByQuality(ctx, characterID, view.Value)
+	case packFilterSearch:
+		return b.db.SearchInventoryByName(ctx, characterID, view.Value)
+	}
+	return b.db.GetCharacterInventory(ctx, characterID)
+}
+
+// renderPackList 生成背包列表页的文本和按钮
+func (b *Bot) renderPackList(ctx context.Context, player *database.CharacterStats, view packView) (string, *tele.ReplyMarkup, error) {
+	items, err := b.packItems(ctx, player.ID, view)
+	if err != nil {
+		return "", nil, fmt.Errorf("获取背包物品失败: %v", err)
+	}
+	capacity, err := b.db.GetInventoryCapacity(ctx, player.ID, b.config.Game.InventoryCapacity)
+	if err != nil {
+		return "", nil, fmt.Errorf("获取背包容量失败: %v", err)
+	}
+
+	pages := max((len(items)+packPageSize-1)/packPageSize, 1)
+	view.Page = min(view.Page, pages-1)
+	pageItems := items[min(view.Page*packPageSize, len(items)):min((view.Page+1)*packPageSize, len(items))]
+
+	text := fmt.Sprintf("🎒 「%s」的背包（容量 %s）\n🔍 %s，第 %d/%d 页\n\n", player.Name, capacity, view, view.Page+1, pages)
+	if len(pageItems) == 0 {
+		text += "没有符合条件的物品"
+	}
+	for _, item := range pageItems {
+		text += fmt.Sprintf("#%d %s x%d（%s·%s）\n", item.ID, item.ItemName, item.Quantity, item.ItemType, item.Quality)
+	}
+
+	markup := &tele.ReplyMarkup{}
+	rows := []tele.Row{}
+	var row tele.Row
+	for _, item := range pageItems {
+		data := append([]string{strconv.Itoa(item.ID)}, view.data()...)
+		row = append(row, markup.Data(fmt.Sprintf("%s x%d", item.ItemName, item.Quantity), btnPackItem.Unique, data...))
+		if len(row) == 2 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	var nav tele.Row
+	if view.Page > 0 {
+		prev := view
+		prev.Page--
+		nav = append(nav, markup.Data("⬅️ 上一页", btnPackPage.Unique, prev.data()...))
+	}
+	if view.Page < pages-1 {
+		next := view
+		next.Page++
+		nav = append(nav, markup.Data("下一页 ➡️", btnPackPage.Unique, next.data()...))
+	}
+	if len(nav) > 0 {
+		rows = append(rows, nav)
+	}
+	filterRow := tele.Row{markup.Data("🔍 筛选", btnPackFilter.Unique)}
+	if view.Filter != packFilterAll {
+		filterRow = append(filterRow, markup.Data("📦 全部物品", btnPackPage.Unique, packView{Filter: packFilterAll}.data()...))
+	}
+	rows = append(rows, filterRow)
+	markup.Inline(rows...)
+	return text, markup, nil
+}
+
+// renderPackFilter 生成按类型和品质筛选的按钮，选项来自背包中已有的物品
+func (b *Bot) renderPackFilter(ctx context.Context, player *database.CharacterStats) (string, *tele.ReplyMarkup, error) {
+	items, err := b.db.GetCharacterInventory(ctx, player.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("获取背包物品失败: %v", err)
+	}
+
+	markup := &tele.ReplyMarkup{}
+	rows := []tele.Row{}
+	for _, filter := range []struct {
+		name  string
+		value func(*database.InventoryItem) string
+	}{
+		{packFilterType, func(item *database.InventoryItem) string { return item.ItemType }},
+		{packFilterQuality, func(item *database.InventoryItem) string { return item.Quality }},
+	} {
+		seen := make(map[string]bool)
+		var row tele.Row
+		for _, item := range items {
+			view := packView{Filter: filter.name, Value: filter.value(item)}
+			if view.Value == "" || seen[view.Value] || !view.fits() {
+				continue
+			}
+			seen[view.Value] = true
+			row = append(row, markup.Data(view.String(), btnPackPage.Unique, view.data()...))
+			if len(row) == 3 {
+				rows = append(rows, row)
+				row = nil
+			}
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	rows = append(rows, tele.Row{markup.Data("📦 全部物品", btnPackPage.Unique, packView{Filter: packFilterAll}.data()...)})
+	markup.Inline(rows...)
+	return fmt.Sprintf("🔍 筛选「%s」的背包物品，也可以使用 /pack <关键字> 搜索", player.Name), markup, nil
+}
+
+// renderPackItem 生成物品详情页的文本和操作按钮
+func renderPackItem(item *database.InventoryItem, view packView) (string, *tele.ReplyMarkup) {
+	data := append([]string{strconv.Itoa(item.ID)}, view.data()...)
+	markup := &tele.ReplyMarkup{}
+	var actions tele.Row
+	if item.Properties != nil && item.Properties.Effect != nil {
+		actions = append(actions, markup.Data("💊 使用", btnPackUse.Unique, data...))
+	}
+	if database.EquipSlotForItemType(item.ItemType) != "" {
+		actions = append(actions, markup.Data("⚔️ 装备", btnPackEquip.Unique, data...))
+	}
+	actions = append(actions, markup.Data("🗑️ 丢弃", btnPackDiscard.Unique, data...))
+	markup.Inline(actions, tele.Row{markup.Data("↩️ 返回", btnPackPage.Unique, view.data()...)})
+	return formatInventoryInfo([]*database.InventoryItem{item}), markup
+}
+
+// handlePackPage 翻页或切换筛选条件
+func (b *Bot) handlePackPage(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	text, markup, err := b.renderPackList(context.Background(), player, parsePackView(c.Args()))
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error(), ShowAlert: true})
+	}
+	c.Respond()
+	return c.Edit(text, markup)
+}
+
+// handlePackFilter 展示筛选选项
+func (b *Bot) handlePackFilter(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	text, markup, err := b.renderPackFilter(context.Background(), player)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error(), ShowAlert: true})
+	}
+	c.Respond()
+	return c.Edit(text, markup)
+}
+
+// packItem 获取按钮对应的物品，物品已不在背包时刷新列表
+func (b *Bot) packItem(c tele.Context, player *database.CharacterStats) (*database.InventoryItem, packView, error) {
+	itemID, view := parsePackItemArgs(c.Args())
+	item, err := b.db.GetInventoryItem(context.Background(), player.ID, itemID)
+	if err != nil {
+		return nil, view, c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("获取物品失败: %v", err)})
+	}
+	if item == nil {
+		c.Respond(&tele.CallbackResponse{Text: "该物品已不在背包中"})
+		return nil, view, b.refreshPackList(c, player, view)
+	}
+	return item, view, nil
+}
+
+// refreshPackList 操作物品后回到背包列表
+func (b *Bot) refreshPackList(c tele.Context, player *database.CharacterStats, view packView) error {
+	text, markup, err := b.renderPackList(context.Background(), player, view)
+	if err != nil {
+		return c.Edit(err.Error())
+	}
+	return c.Edit(text, markup)
+}
+
+// handlePackItem 展示物品详情
+func (b *Bot) handlePackItem(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	item, view, err := b.packItem(c, player)
+	if item == nil {
+		return err
+	}
+	c.Respond()
+	text, markup := renderPackItem(item, view)
+	return c.Edit(text, markup)
+}
+
+// handlePackUse 使用一件物品，结果记入对话历史
+func (b *Bot) handlePackUse(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	if reason := packItemUnavailable(player); reason != "" {
+		return c.Respond(&tele.CallbackResponse{Text: reason, ShowAlert: true})
+	}
+	item, view, err := b.packItem(c, player)
+	if item == nil {
+		return err
+	}
+	c.Respond()
+	if err := b.useItem(c, player, item.ID, item.ItemName, 1); err != nil {
+		return err
+	}
+	return b.refreshPackList(c, player, view)
+}
+
+// handlePackEquip 装备一件物品，结果记入对话历史
+func (b *Bot) handlePackEquip(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	if reason := packItemUnavailable(player); reason != "" {
+		return c.Respond(&tele.CallbackResponse{Text: reason, ShowAlert: true})
+	}
+	item, view, err := b.packItem(c, player)
+	if item == nil {
+		return err
+	}
+	result, err := llm.EquipItem(b.db, player.ID, b.config.Game.InventoryCapacity, map[string]any{"item_id": item.ID, "item_name": item.ItemName})
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error(), ShowAlert: true})
+	}
+	c.Respond(&tele.CallbackResponse{Text: result, ShowAlert: true})
+	b.db.AddMessage(context.Background(), player.ID, "user", []*genai.Part{genai.NewPartFromText(fmt.Sprintf("[%s]: %s", player.Name, result))})
+	return b.refreshPackList(c, player, view)
+}
+
+// handlePackDiscard 丢弃前要求确认
+func (b *Bot) handlePackDiscard(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	item, view, err := b.packItem(c, player)
+	if item == nil {
+		return err
+	}
+	c.Respond()
+	data := append([]string{strconv.Itoa(item.ID)}, view.data()...)
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data("✅ 确认丢弃", btnPackDiscardConfirm.Unique, data...),
+		markup.Data("↩️ 取消", btnPackItem.Unique, data...),
+	))
+	return c.Edit(fmt.Sprintf("确定要丢弃「%s」x%d 吗？丢弃后无法找回。", item.ItemName, item.Quantity), markup)
+}
+
+// handlePackDiscardConfirm 丢弃整组物品，结果记入对话历史
+func (b *Bot) handlePackDiscardConfirm(c tele.Context) error {
+	player, err := b.packPlayer(c)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: err.Error()})
+	}
+	if reason := packItemUnavailable(player); reason != "" {
+		return c.Respond(&tele.CallbackResponse{Text: reason, ShowAlert: true})
+	}
+	itemID, view := parsePackItemArgs(c.Args())
+	item, err := b.db.DiscardInventoryItem(context.Background(), player.ID, itemID, 0)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.Respond(&tele.CallbackResponse{Text: "该物品已不在背包中"})
+			return b.refreshPackList(c, player, view)
+		}
+		return c.Respond(&tele.CallbackResponse{Text: fmt.Sprintf("丢弃物品失败: %v", err), ShowAlert: true})
+	}
+	result := fmt.Sprintf("丢弃了「%s」x%d", item.ItemName, item.Quantity)
+	c.Respond(&tele.CallbackResponse{Text: result})
+	b.db.AddMessage(context.Background(), player.ID, "user", []*genai.Part{genai.NewPartFromText(fmt.Sprintf("[%s]: %s", player.Name, result))})
+	return b.refreshPackList(c, player, view)
+}
@@ -0,0 +1,49 @@
+package bot
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/config"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// handlePricing 处理 /pricing 命令，展示各模型每千 token 消耗的灵石和当前促销
+func (b *Bot) handlePricing(c tele.Context) error {
+	now := time.Now()
+	discount := llm.Discount(b.config, now)
+
+	var sb strings.Builder
+	sb.WriteString("💰 每千 token 消耗的灵石（输入/输出/思考/缓存/图片）：\n")
+	models := []string{}
+	for model := range b.config.Pricing.Models {
+		models = append(models, model)
+	}
+	slices.Sort(models)
+	for _, model := range models {
+		sb.WriteString(fmt.Sprintf("- %s：%s\n", model, b.formatModelPrice(b.config.Pricing.Models[model], discount)))
+	}
+	sb.WriteString(fmt.Sprintf("- 其他模型：%s\n", b.formatModelPrice(b.config.Pricing.Default, discount)))
+	if discount < 1 {
+		sb.WriteString(fmt.Sprintf("\n🎉 限时优惠：%.1f 折", discount*10))
+		if end := b.config.Pricing.DiscountEnd; !end.IsZero() {
+			sb.WriteString(fmt.Sprintf("，%s 结束", end.Local().Format("2006-01-02 15:04")))
+		}
+		sb.WriteString("，以上价格已按折扣计算")
+	}
+	return c.Reply(sb.String())
+}
+
+// formatModelPrice 把每百万 token 的美元价格换算为每千 token 的灵石
+func (b *Bot) formatModelPrice(price config.ModelPrice, discount float64) string {
+	rate := b.config.Pricing.ExchangeRate * discount / 1000
+	prices := []string{}
+	for _, dollars := range []float64{price.Input, price.Output, price.Thinking, price.Cached, price.Image} {
+		prices = append(prices, fmt.Sprintf("%.4g", dollars*rate))
+	}
+	return strings.Join(prices, "/")
+}
@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/config"
+	"jiangfengwhu/nagi-bot-go/ratelimit"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// 限流类别
+const (
+	rateCategoryChat     = "chat"     // 与天道对话
+	rateCategoryUpload   = "upload"   // 上传图片、语音和文件
+	rateCategoryRegister = "register" // 创建角色和转世
+	rateCategoryCommand  = "command"  // 其他命令和按钮
+)
+
+// rateLimitPruneAfter 超过这么久没有请求的令牌桶会被清理，按配置的速率早已补满
+const rateLimitPruneAfter = 24 * time.Hour
+
+// newRateLimiter 按配置创建各类别的限流器
+func newRateLimiter(cfg *config.Config, store ratelimit.Store) *ratelimit.Limiter {
+	rule := func(r config.RateRule) ratelimit.Rule {
+		return ratelimit.Rule{Burst: r.Burst, PerMinute: r.PerMinute}
+	}
+	return ratelimit.New(store, map[string]ratelimit.Rule{
+		rateCategoryChat:     rule(cfg.RateLimit.Chat),
+		rateCategoryUpload:   rule(cfg.RateLimit.Upload),
+		rateCategoryRegister: rule(cfg.RateLimit.Register),
+		rateCategoryCommand:  rule(cfg.RateLimit.Command),
+	})
+}
+
+// RateLimit 按用户和类别限流的中间件，需要放在 Auth 之后，管理员和付款通知不受限制
+// 被限流时提示需要等待的时间，同一冷却期内只提示一次，避免刷屏时反复回复
+func RateLimit(limiter *ratelimit.Limiter, adminIds []int64) tele.MiddlewareFunc {
+	var notified sync.Map // 用户和类别 -> 冷却结束时间，冷却期内不再重复提示
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			userId := c.Sender().ID
+			if slices.Contains(adminIds, userId) {
+				return next(c)
+			}
+			category := rateCategory(c)
+			if category == "" {
+				return next(c)
+			}
+
+			now := time.Now()
+			key := strconv.FormatInt(userId, 10)
+			allowed, wait, err := limiter.Allow(key, category, now)
+			if err != nil {
+				log.Printf("用户 %d 限流失败: %v", userId, err)
+			}
+			if allowed {
+				return next(c)
+			}
+
+			noticeKey := category + ":" + key
+			if until, ok := notified.Load(noticeKey); ok && now.Before(until.(time.Time)) {
+				return nil
+			}
+			notified.Store(noticeKey, now.Add(wait))
+			text := fmt.Sprintf("道友操之过急，请 %d 秒后再试", int(math.Ceil(wait.Seconds())))
+			if c.Callback() != nil {
+				return c.Respond(&tele.CallbackResponse{Text: text})
+			}
+			return c.Reply(text)
+		}
+	}
+}
+
+// rateCategory 判断请求的限流类别，返回空字符串表示不限流
+func rateCategory(c tele.Context) string {
+	if c.Callback() != nil {
+		return rateCategoryCommand
+	}
+	msg := c.Message()
+	switch {
+	case msg.Payment != nil || msg.RefundedPayment != nil:
+		// 付款和退款通知必须处理，不能限流
+		return ""
+	case msg.Photo != nil || msg.Audio != nil || msg.Voice != nil || msg.Document != nil:
+		return rateCategoryUpload
+	case strings.HasPrefix(msg.Text, "/"):
+		command, _, _ := strings.Cut(strings.Fields(msg.Text)[0], "@")
+		if command == "/reg" || command == "/reincarnate" {
+			return rateCategoryRegister
+		}
+		return rateCategoryCommand
+	}
+	return rateCategoryChat
+}
+
+// rateLimitLoop 定期清理长时间没有请求的令牌桶
+func (b *Bot) rateLimitLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.rateLimitStore.Prune(time.Now().Add(-rateLimitPruneAfter))
+	}
+}
@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"jiangfengwhu/nagi-bot-go/crafting"
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+const recipeUsage = "请输入正确的命令，格式为: /recipe [list|set <JSON>|del <名称>]"
+
+// handleRecipe 处理 /recipe 管理命令，维护配方名录，天道只能让玩家学习名录中的配方
+// /recipe 列出配方，/recipe set <JSON> 新增或覆盖配方，/recipe del <名称> 删除配方
+func (b *Bot) handleRecipe(c tele.Context) error {
+	admin := c.Get("db_user").(*database.User)
+	if !slices.Contains(b.config.Bot.AdminIds, admin.TgId) {
+		return c.Reply("您没有权限使用此命令")
+	}
+
+	action, payload, _ := strings.Cut(strings.TrimSpace(c.Message().Payload), " ")
+	payload = strings.TrimSpace(payload)
+	switch action {
+	case "", "list":
+		return b.listCatalogRecipes(c)
+	case "set":
+		return b.saveCatalogRecipe(c, admin, payload)
+	case "del":
+		if payload == "" {
+			return c.Reply("请输入正确的命令，格式为: /recipe del <名称>")
+		}
+		deleted, err := b.db.DeleteCatalogRecipe(context.Background(), payload)
+		if err != nil {
+			return c.Reply(fmt.Sprintf("删除配方失败: %v", err))
+		}
+		if !deleted {
+			return c.Reply(fmt.Sprintf("配方「%s」不存在", payload))
+		}
+		b.auditAdmin(admin, "recipe_del", nil, payload)
+		return c.Reply(fmt.Sprintf("已删除配方「%s」，已学会的角色不受影响", payload))
+	}
+	return c.Reply(recipeUsage)
+}
+
+func (b *Bot) listCatalogRecipes(c tele.Context) error {
+	recipes, err := b.db.GetCatalogRecipes(context.Background())
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取配方失败: %v", err))
+	}
+	if len(recipes) == 0 {
+		return c.Reply("配方名录为空，/recipe set <JSON> 新增配方")
+	}
+	var sb strings.Builder
+	sb.WriteString("📜 配方名录：\n")
+	for _, recipe := range recipes {
+		sb.WriteString("- " + crafting.FormatRecipe(recipe) + "\n")
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) saveCatalogRecipe(c tele.Context, admin *database.User, payload string) error {
+	var recipe database.Recipe
+	if err := json.Unmarshal([]byte(payload), &recipe); err != nil {
+		return c.Reply(fmt.Sprintf("解析配方失败: %v\n格式示例: /recipe set {\"recipe_name\":\"筑基丹\",\"craft_type\":\"alchemy\",\"ingredients\":[{\"item_name\":\"百年灵芝\",\"quantity\":2}],\"output\":{\"item_name\":\"筑基丹\",\"item_type\":\"丹药\",\"quality\":\"高级\"},\"required_realm\":\"炼气期\",\"success_rate\":40,\"minutes\":120}", err))
+	}
+	if err := crafting.Normalize(&recipe); err != nil {
+		return c.Reply(err.Error())
+	}
+	if err := b.db.SaveCatalogRecipe(context.Background(), &recipe); err != nil {
+		return c.Reply(fmt.Sprintf("保存配方失败: %v", err))
+	}
+	b.auditAdmin(admin, "recipe_set", nil, payload)
+	return c.Reply("已保存配方：" + crafting.FormatRecipe(&recipe))
+}
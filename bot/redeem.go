@@ -0,0 +1,184 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+const (
+	redeemCodeLength   = 12  // 兑换码长度
+	redeemCodeMaxBatch = 100 // 每批最多生成的兑换码数
+	redeemCodeListSize = 30  // /codes list 最多展示的兑换码数
+)
+
+// redeemCodeAlphabet 兑换码字符集，去掉了容易混淆的 0、O、1、I
+const redeemCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// handleRedeem 处理 /redeem <兑换码> 命令
+func (b *Bot) handleRedeem(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	code := strings.ToUpper(strings.TrimSpace(c.Message().Payload))
+	if code == "" {
+		return c.Reply("请输入正确的命令，格式为: /redeem <兑换码>")
+	}
+
+	redemption, err := b.db.Redeem(context.Background(), user.ID, code)
+	if err != nil {
+		for _, invalid := range []error{database.ErrRedeemCodeNotFound, database.ErrRedeemCodeExpired, database.ErrRedeemCodeUsedUp, database.ErrRedeemCodeRedeemed} {
+			if errors.Is(err, invalid) {
+				return c.Reply(err.Error())
+			}
+		}
+		return c.Reply(fmt.Sprintf("兑换失败: %v", err))
+	}
+	balance := user.TotalRechargedToken - user.TotalUsedToken + redemption.Amount
+	return c.Reply(fmt.Sprintf("兑换成功，获得灵石 %d，当前灵石 %d", redemption.Amount, balance))
+}
+
+// handleCodes 处理 /codes 管理命令
+// /codes new <数量> <灵石> [可用人数] [有效天数] [批次名] 批量生成兑换码，/codes list [批次名] 查看兑换码，/codes used <兑换码> 查看使用记录
+func (b *Bot) handleCodes(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	if !slices.Contains(b.config.Bot.AdminIds, user.TgId) {
+		return c.Reply("您没有权限使用此命令")
+	}
+
+	args := c.Args()
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "new":
+		return b.createRedeemCodes(c, user, args[1:])
+	case "list":
+		batch := ""
+		if len(args) > 1 {
+			batch = args[1]
+		}
+		return b.listRedeemCodes(c, batch)
+	case "used":
+		if len(args) != 2 {
+			return c.Reply("请输入正确的命令，格式为: /codes used <兑换码>")
+		}
+		return b.listRedemptions(c, strings.ToUpper(args[1]))
+	}
+	return c.Reply("请输入正确的命令，格式为: /codes [new <数量> <灵石> [可用人数] [有效天数] [批次名]|list [批次名]|used <兑换码>]")
+}
+
+func (b *Bot) createRedeemCodes(c tele.Context, user *database.User, args []string) error {
+	if len(args) < 2 || len(args) > 5 {
+		return c.Reply("请输入正确的命令，格式为: /codes new <数量> <灵石> [可用人数] [有效天数] [批次名]，有效天数为 0 表示永不过期")
+	}
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count <= 0 || count > redeemCodeMaxBatch {
+		return c.Reply(fmt.Sprintf("数量必须在 1 到 %d 之间", redeemCodeMaxBatch))
+	}
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return c.Reply("灵石必须是正整数")
+	}
+	maxUses := 1
+	if len(args) > 2 {
+		maxUses, err = strconv.Atoi(args[2])
+		if err != nil || maxUses <= 0 {
+			return c.Reply("可用人数必须是正整数")
+		}
+	}
+	var expiresAt time.Time
+	if len(args) > 3 {
+		days, err := strconv.Atoi(args[3])
+		if err != nil || days < 0 {
+			return c.Reply("有效天数必须是非负整数")
+		}
+		if days > 0 {
+			expiresAt = time.Now().AddDate(0, 0, days)
+		}
+	}
+	batch := time.Now().Format("20060102150405")
+	if len(args) > 4 {
+		batch = args[4]
+	}
+
+	codes := make([]*database.RedeemCode, count)
+	for i := range codes {
+		codes[i] = &database.RedeemCode{
+			Code:      generateRedeemCode(),
+			Batch:     batch,
+			Amount:    amount,
+			MaxUses:   maxUses,
+			ExpiresAt: expiresAt,
+			CreatedBy: user.TgId,
+		}
+	}
+	if err := b.db.CreateRedeemCodes(context.Background(), codes); err != nil {
+		return c.Reply(fmt.Sprintf("生成兑换码失败: %v", err))
+	}
+	b.auditAdmin(user, "codes_new", nil, fmt.Sprintf("批次「%s」%d 个，每个 %d 灵石，可用 %d 人，%s", batch, count, amount, maxUses, formatRedeemExpiry(expiresAt)))
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🎫 已生成批次「%s」的 %d 个兑换码，每个 %d 灵石，可用 %d 人，%s：\n", batch, count, amount, maxUses, formatRedeemExpiry(expiresAt)))
+	for _, code := range codes {
+		sb.WriteString(code.Code + "\n")
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) listRedeemCodes(c tele.Context, batch string) error {
+	codes, err := b.db.GetRedeemCodes(context.Background(), batch, redeemCodeListSize)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取兑换码失败: %v", err))
+	}
+	if len(codes) == 0 {
+		return c.Reply("没有兑换码，/codes new 生成兑换码")
+	}
+	var sb strings.Builder
+	sb.WriteString("🎫 兑换码：\n")
+	for _, code := range codes {
+		sb.WriteString(fmt.Sprintf("- %s「%s」%d 灵石，已用 %d/%d，%s\n", code.Code, code.Batch, code.Amount, code.UsedCount, code.MaxUses, formatRedeemExpiry(code.ExpiresAt)))
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) listRedemptions(c tele.Context, code string) error {
+	redemptions, err := b.db.GetRedemptions(context.Background(), code)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取兑换记录失败: %v", err))
+	}
+	if len(redemptions) == 0 {
+		return c.Reply(fmt.Sprintf("兑换码 %s 还没有被使用", code))
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📋 兑换码 %s 的使用记录：\n", code))
+	for _, redemption := range redemptions {
+		sb.WriteString(fmt.Sprintf("- %s @%s（用户 #%d，TG %d）获得 %d 灵石\n", redemption.CreatedAt.Format("2006-01-02 15:04"),
+			redemption.Username, redemption.UserID, redemption.TgID, redemption.Amount))
+	}
+	return c.Reply(sb.String())
+}
+
+// generateRedeemCode 生成随机兑换码
+func generateRedeemCode() string {
+	buf := make([]byte, redeemCodeLength)
+	rand.Read(buf)
+	for i := range buf {
+		buf[i] = redeemCodeAlphabet[int(buf[i])%len(redeemCodeAlphabet)]
+	}
+	return string(buf)
+}
+
+func formatRedeemExpiry(expiresAt time.Time) string {
+	if expiresAt.IsZero() {
+		return "永不过期"
+	}
+	return expiresAt.Format("2006-01-02 15:04") + " 过期"
+}
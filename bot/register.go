@@ -2,6 +2,7 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -10,10 +11,83 @@ import (
 	"jiangfengwhu/nagi-bot-go/database"
 	"jiangfengwhu/nagi-bot-go/llm"
 
+	"github.com/jackc/pgx/v5"
 	"google.golang.org/genai"
 	tele "gopkg.in/telebot.v4"
 )
 
+// characterSchema 角色生成的结构化输出格式
+var characterSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"player_name": {
+			Type:        genai.TypeString,
+			Description: "修仙者的姓名",
+		},
+		"spiritual_roots": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type:        genai.TypeObject,
+				Description: "单个灵根的键值对",
+				Properties: map[string]*genai.Schema{
+					"root_name": {
+						Type:        genai.TypeString,
+						Description: "灵根的名称 (常见灵根：'金', '木', '水', '火', '土'，特殊灵根：冰、雷、风、暗、光、空间、时间、混沌等指定灵根，比较罕见)",
+					},
+					"affinity": {
+						Type:        genai.TypeInteger,
+						Description: "该灵根的资质数值 (0-100)，越大越罕见",
+					},
+				},
+				Required: []string{"root_name", "affinity"},
+			},
+			Description: "灵根属性列表，每个元素包含灵根名称和其对应的资质。",
+		},
+		"physique": {
+			Type:        genai.TypeInteger,
+			Description: "根骨/体魄，影响生命值、攻击力、防御力",
+		},
+		"comprehension": {
+			Type:        genai.TypeInteger,
+			Description: "悟性，影响修炼速度和功法领悟",
+		},
+		"luck": {
+			Type:        genai.TypeInteger,
+			Description: "幸运值，影响奇遇概率",
+		},
+		"spirit_sense": {
+			Type:        genai.TypeInteger,
+			Description: "神识强度，根据灵根（特别是精神系灵根如空间、时间）和悟性计算。影响感知能力和法术威力",
+		},
+		"attack": {
+			Type:        genai.TypeInteger,
+			Description: "攻击力，主要基于金灵根、根骨，攻击型特殊灵根（雷、火）有加成",
+		},
+		"defense": {
+			Type:        genai.TypeInteger,
+			Description: "防御力，主要基于土灵根、根骨，防御型特殊灵根（冰、暗）有加成",
+		},
+		"speed": {
+			Type:        genai.TypeInteger,
+			Description: "速度，主要基于木灵根，风灵根有巨大加成，雷灵根也有提升",
+		},
+		"lifespan": {
+			Type:        genai.TypeInteger,
+			Description: "寿命（100-200），基于灵根品质和特殊灵根计算。时间灵根、混沌灵根等顶级灵根大幅延长寿命",
+		},
+		"background_story": {
+			Type:        genai.TypeString,
+			Description: "背景故事，要结合灵根特点描述角色的出身和修仙机缘",
+		},
+		"init_inventory": {
+			Type:        genai.TypeArray,
+			Items:       llm.InventoryItemSchema,
+			Description: "初始背包物品列表，每个元素包含物品名称，数量，类型，品质，等级，属性，描述等，列表是根据角色的命格生成，有好有坏，全凭命理（不包含灵石）",
+		},
+	},
+	Required: []string{"player_name", "spiritual_roots", "physique", "comprehension", "luck", "spirit_sense", "attack", "defense", "speed", "lifespan", "background_story", "init_inventory"},
+}
+
 func (b *Bot) handleRegister(c tele.Context) error {
 	user := c.Get("db_user").(*database.User)
 	name := strings.TrimSpace(strings.TrimPrefix(c.Message().Text, "/reg"))
@@ -23,12 +97,13 @@ func (b *Bot) handleRegister(c tele.Context) error {
 	if len(name) > 20 {
 		return c.Reply("角色名长度不超过10个字符")
 	}
-	dbPlayer, err := b.db.GetCharacterStats(context.Background(), user.ID)
+	// 提前检查以免白白生成角色，创建时还会在事务中重新检查
+	count, err := b.db.CountAliveCharacters(context.Background(), user.ID)
 	if err != nil {
 		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
 	}
-	if dbPlayer != nil {
-		return c.Reply("您已经注册了角色，/start查看角色信息")
+	if count >= b.config.Game.MaxCharacterSlots {
+		return c.Reply(fmt.Sprintf("您的角色栏位已满（%d/%d），/chars 查看已有角色", count, b.config.Game.MaxCharacterSlots))
 	}
 	exists, err := b.db.NameExists(context.Background(), name)
 	if err != nil {
@@ -37,110 +112,75 @@ func (b *Bot) handleRegister(c tele.Context) error {
 	if exists {
 		return c.Reply("该角色名已存在，请重新输入")
 	}
-	ctx := context.Background()
-	client, err := b.llmService.NewClient(ctx)
-	if err != nil {
-		return c.Reply(fmt.Sprintf("创建LLMClient失败: %v", err))
-	}
-	config := &genai.GenerateContentConfig{
-		ResponseMIMEType:  "application/json",
-		SystemInstruction: genai.NewContentFromText(b.config.Prompts["system_prompt"], genai.RoleUser),
-		ResponseSchema: &genai.Schema{
-			Type: genai.TypeObject,
-			Properties: map[string]*genai.Schema{
-				"player_name": {
-					Type:        genai.TypeString,
-					Description: "修仙者的姓名",
-				},
-				"spiritual_roots": {
-					Type: genai.TypeArray,
-					Items: &genai.Schema{
-						Type:        genai.TypeObject,
-						Description: "单个灵根的键值对",
-						Properties: map[string]*genai.Schema{
-							"root_name": {
-								Type:        genai.TypeString,
-								Description: "灵根的名称 (常见灵根：'金', '木', '水', '火', '土'，特殊灵根：冰、雷、风、暗、光、空间、时间、混沌等指定灵根，比较罕见)",
-							},
-							"affinity": {
-								Type:        genai.TypeInteger,
-								Description: "该灵根的资质数值 (0-100)，越大越罕见",
-							},
-						},
-						Required: []string{"root_name", "affinity"},
-					},
-					Description: "灵根属性列表，每个元素包含灵根名称和其对应的资质。",
-				},
-				"physique": {
-					Type:        genai.TypeInteger,
-					Description: "根骨/体魄，影响生命值、攻击力、防御力",
-				},
-				"comprehension": {
-					Type:        genai.TypeInteger,
-					Description: "悟性，影响修炼速度和功法领悟",
-				},
-				"luck": {
-					Type:        genai.TypeInteger,
-					Description: "幸运值，影响奇遇概率",
-				},
-				"spirit_sense": {
-					Type:        genai.TypeInteger,
-					Description: "神识强度，根据灵根（特别是精神系灵根如空间、时间）和悟性计算。影响感知能力和法术威力",
-				},
-				"attack": {
-					Type:        genai.TypeInteger,
-					Description: "攻击力，主要基于金灵根、根骨，攻击型特殊灵根（雷、火）有加成",
-				},
-				"defense": {
-					Type:        genai.TypeInteger,
-					Description: "防御力，主要基于土灵根、根骨，防御型特殊灵根（冰、暗）有加成",
-				},
-				"speed": {
-					Type:        genai.TypeInteger,
-					Description: "速度，主要基于木灵根，风灵根有巨大加成，雷灵根也有提升",
-				},
-				"lifespan": {
-					Type:        genai.TypeInteger,
-					Description: "寿命（100-200），基于灵根品质和特殊灵根计算。时间灵根、混沌灵根等顶级灵根大幅延长寿命",
-				},
-				"background_story": {
-					Type:        genai.TypeString,
-					Description: "背景故事，要结合灵根特点描述角色的出身和修仙机缘",
-				},
-				"init_inventory": {
-					Type:        genai.TypeArray,
-					Items:       llm.InventoryItemSchema,
-					Description: "初始背包物品列表，每个元素包含物品名称，数量，类型，品质，等级，属性，描述等，列表是根据角色的命格生成，有好有坏，全凭命理（不包含灵石）",
-				},
-			},
-			Required: []string{"player_name", "spiritual_roots", "physique", "comprehension", "luck", "spirit_sense", "attack", "defense", "speed", "lifespan", "background_story", "init_inventory"},
-		},
-	}
 	message, _ := b.Reply(c.Message(), "正在生成角色...")
-	result, err := client.Models.GenerateContent(
-		ctx,
-		"gemini-2.5-flash",
-		genai.Text(fmt.Sprintf("创建一个修仙者角色，角色名称为: %s，现在时间是: %s", name, time.Now().Format("2006-01-02 15:04:05"))),
-		config,
-	)
+	meter := &llm.Meter{}
+	result, err := b.generateCharacter(context.Background(), fmt.Sprintf("创建一个修仙者角色，角色名称为: %s，现在时间是: %s", name, time.Now().Format("2006-01-02 15:04:05")), meter)
+	b.chargeUsage(user.ID, 0, database.UsageKindRegister, meter)
 	if err != nil {
 		b.Edit(message, fmt.Sprintf("创建角色失败: %v", err))
 		return err
 	}
-	fmt.Println(result.Text())
-	player, inventory, err := CreatePlayer(b.db, user.ID, result.Text())
+	player, inventory, err := CreatePlayer(b.db, user.ID, result, b.config.Game.MaxCharacterSlots)
+	var full *database.CharacterSlotsFullError
+	if errors.As(err, &full) || errors.Is(err, database.ErrNameExists) {
+		b.Edit(message, err.Error())
+		return nil
+	}
 	if err != nil {
 		b.Edit(message, fmt.Sprintf("创建角色失败: %v", err))
 		return err
 	}
-	b.Edit(message, fmt.Sprintf("角色创建成功: \n%s\n初始背包物品: \n%s\n", formatPlayerInfo(player), formatInventoryInfo(inventory)))
+	b.Edit(message, fmt.Sprintf("角色创建成功: \n%s\n初始背包物品: \n%s\n", formatPlayerInfo(player, nil, nil), formatInventoryInfo(inventory)))
 	return nil
 }
 
-// CreatePlayer 创建新的修仙者角色
-func CreatePlayer(db *database.DB, userID int, args string) (*database.CharacterStats, []*database.InventoryItem, error) {
+// generateCharacter 让模型按照角色结构生成一个修仙者，返回JSON文本，用量记入 meter
+func (b *Bot) generateCharacter(ctx context.Context, prompt string, meter *llm.Meter) (string, error) {
+	client, err := b.llmService.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("创建LLMClient失败: %v", err)
+	}
+	config := &genai.GenerateContentConfig{
+		ResponseMIMEType:  "application/json",
+		SystemInstruction: genai.NewContentFromText(b.config.Prompts["system_prompt"], genai.RoleUser),
+		ResponseSchema:    characterSchema,
+	}
+	result, err := client.Models.GenerateContent(ctx, llm.ChatModel, genai.Text(prompt), config)
+	if err != nil {
+		return "", err
+	}
+	meter.Record(llm.UsageFromMetadata(llm.ChatModel, result.UsageMetadata))
+	fmt.Println(result.Text())
+	return result.Text(), nil
+}
+
+// CreatePlayer 创建新的修仙者角色，并切换为当前角色，存活角色已占满 maxSlots 时返回 CharacterSlotsFullError
+func CreatePlayer(db *database.DB, userID int, args string, maxSlots int) (*database.CharacterStats, []*database.InventoryItem, error) {
 	ctx := context.Background()
 
+	stats, inventory, err := buildPlayer(userID, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := db.GetPool().Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := db.LockCharacterSlotsInTx(ctx, tx, userID, maxSlots); err != nil {
+		return nil, nil, err
+	}
+	if err := createPlayerInTx(ctx, db, tx, stats, inventory); err != nil {
+		return nil, nil, err
+	}
+
+	return stats, inventory, tx.Commit(ctx)
+}
+
+// buildPlayer 把模型生成的角色JSON转换为人物属性和初始背包
+func buildPlayer(userID int, args string) (*database.CharacterStats, []*database.InventoryItem, error) {
 	// 使用 JSON 序列化进行类型转换
 	var params CreatePlayerParams
 	err := json.Unmarshal([]byte(args), &params)
@@ -151,6 +191,7 @@ func CreatePlayer(db *database.DB, userID int, args string) (*database.Character
 	stats := &database.CharacterStats{
 		UserID:         userID,
 		Name:           params.PlayerName,
+		Generation:     1,
 		Realm:          "练气期",
 		RealmLevel:     1,
 		SpiritualRoots: params.SpiritualRoots,
@@ -174,7 +215,6 @@ func CreatePlayer(db *database.DB, userID int, args string) (*database.Character
 	inventory := []*database.InventoryItem{}
 	for _, item := range params.InitInventory {
 		inventory = append(inventory, &database.InventoryItem{
-			UserID:       userID,
 			ItemName:     item.ItemName,
 			Quantity:     item.Quantity,
 			ItemType:     item.ItemType,
@@ -187,26 +227,34 @@ func CreatePlayer(db *database.DB, userID int, args string) (*database.Character
 		})
 	}
 
-	tx, err := db.GetPool().Begin(ctx)
+	return stats, inventory, nil
+}
+
+// createPlayerInTx 在事务中保存角色和初始背包，并切换为当前角色
+func createPlayerInTx(ctx context.Context, db *database.DB, tx pgx.Tx, stats *database.CharacterStats, inventory []*database.InventoryItem) error {
+	// 保存到数据库
+	err := db.CreateCharacterStatsInTx(ctx, tx, stats)
+	if errors.Is(err, database.ErrNameExists) {
+		return err
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("开始事务失败: %v", err)
+		return fmt.Errorf("创建角色失败: %v", err)
 	}
-	defer tx.Rollback(ctx)
 
 	for _, item := range inventory {
-		item.UserID = userID
+		item.ID = 0
+		item.CharacterID = stats.ID
 	}
 
 	err = db.AddInventoryItemsBatchInTx(ctx, tx, inventory)
 	if err != nil {
-		return nil, nil, fmt.Errorf("添加物品失败: %v", err)
+		return fmt.Errorf("添加物品失败: %v", err)
 	}
 
-	// 保存到数据库
-	err = db.CreateCharacterStatsInTx(ctx, tx, stats)
+	err = db.SetActiveCharacterInTx(ctx, tx, stats.UserID, stats.ID)
 	if err != nil {
-		return nil, nil, fmt.Errorf("创建角色失败: %v", err)
+		return fmt.Errorf("切换角色失败: %v", err)
 	}
 
-	return stats, inventory, tx.Commit(ctx)
+	return nil
 }
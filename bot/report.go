@@ -0,0 +1,179 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+const (
+	reportDefaultDays = 7   // 不指定日期时统计最近几天
+	reportMaxDays     = 366 // 报表最多统计的天数
+	reportTopSpenders = 10  // 消耗排行的人数
+)
+
+// adminReport 处理 /admin stats 和 /admin export，查看或导出一段时间的运营数据
+func (b *Bot) adminReport(c tele.Context, admin *database.User, action string, args []string) error {
+	start, end, err := parseReportRange(args)
+	if err != nil {
+		return c.Reply(err.Error())
+	}
+	report, err := b.db.GetReport(context.Background(), start, end, reportTopSpenders)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取运营数据失败: %v", err))
+	}
+	b.auditAdmin(admin, action, nil, formatReportRange(report))
+	if action == "stats" {
+		return c.Reply(formatReport(report))
+	}
+	data, err := reportCSV(report)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("导出报表失败: %v", err))
+	}
+	return c.Reply(&tele.Document{
+		File:     tele.FromReader(bytes.NewReader(data)),
+		FileName: fmt.Sprintf("report_%s_%s.csv", start.Format("20060102"), end.AddDate(0, 0, -1).Format("20060102")),
+		MIME:     "text/csv",
+		Caption:  formatReportRange(report),
+	})
+}
+
+// parseReportRange 解析报表的日期范围，结束日期包含在内，返回 [start, end)
+// 不指定时为最近几天，只指定开始日期时统计到今天
+func parseReportRange(args []string) (time.Time, time.Time, error) {
+	today := startOfDay(time.Now())
+	start, end := today.AddDate(0, 0, 1-reportDefaultDays), today
+	if len(args) > 2 {
+		return start, end, fmt.Errorf("请输入正确的日期范围，格式为: [开始日期] [结束日期]")
+	}
+	dates := []*time.Time{&start, &end}
+	for i, arg := range args {
+		date, err := time.ParseInLocation("2006-01-02", arg, time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("日期 %s 格式错误，应为 2006-01-02", arg)
+		}
+		*dates[i] = date
+	}
+	if end.Before(start) {
+		return start, end, fmt.Errorf("结束日期不能早于开始日期")
+	}
+	end = end.AddDate(0, 0, 1)
+	if end.Sub(start) > reportMaxDays*24*time.Hour {
+		return start, end, fmt.Errorf("最多统计 %d 天", reportMaxDays)
+	}
+	return start, end, nil
+}
+
+func formatReportRange(report *database.Report) string {
+	return fmt.Sprintf("%s 至 %s", report.Start.Format("2006-01-02"), report.End.AddDate(0, 0, -1).Format("2006-01-02"))
+}
+
+// reportTotals 报表期间的充值和消耗合计
+func reportTotals(report *database.Report) (int64, int64) {
+	recharged, spent := int64(0), int64(0)
+	for _, day := range report.Days {
+		recharged += day.Recharged
+		spent += day.Spent
+	}
+	return recharged, spent
+}
+
+// imageGenerations 报表期间生成图片的次数
+func imageGenerations(report *database.Report) int64 {
+	for _, tool := range report.ToolCalls {
+		if tool.Name == string(llm.ToolGenerateImage) {
+			return tool.Count
+		}
+	}
+	return 0
+}
+
+func formatReport(report *database.Report) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📈 运营数据（%s）\n\n", formatReportRange(report)))
+
+	sb.WriteString("每日（新用户/活跃用户/发言/充值/消耗）：\n")
+	for _, day := range report.Days {
+		sb.WriteString(fmt.Sprintf("- %s：%d/%d/%d/%d/%d\n", day.Date.Format("01-02"), day.NewUsers, day.ActiveUsers, day.Messages, day.Recharged, day.Spent))
+	}
+	recharged, spent := reportTotals(report)
+	sb.WriteString(fmt.Sprintf("合计充值灵石 %d，消耗灵石 %d\n\n", recharged, spent))
+
+	sb.WriteString("模型用量（输入/输出/思考/缓存/图片 token，灵石）：\n")
+	if len(report.Models) == 0 {
+		sb.WriteString("- 无\n")
+	}
+	for _, model := range report.Models {
+		sb.WriteString(fmt.Sprintf("- %s：%d/%d/%d/%d/%d，%d\n", model.Model, model.Input, model.Output, model.Thinking, model.Cached, model.Image, model.Cost))
+	}
+
+	sb.WriteString("\n消耗排行：\n")
+	if len(report.TopSpenders) == 0 {
+		sb.WriteString("- 无\n")
+	}
+	for i, spender := range report.TopSpenders {
+		sb.WriteString(fmt.Sprintf("%d. @%s（用户 #%d）%d 灵石\n", i+1, spender.Username, spender.UserID, spender.Spent))
+	}
+
+	sb.WriteString(fmt.Sprintf("\n工具调用（生成图片 %d 次）：\n", imageGenerations(report)))
+	if len(report.ToolCalls) == 0 {
+		sb.WriteString("- 无\n")
+	}
+	for _, tool := range report.ToolCalls {
+		sb.WriteString(fmt.Sprintf("- %s：%d\n", tool.Name, tool.Count))
+	}
+
+	funnel := report.Funnel
+	sb.WriteString(fmt.Sprintf("\n新用户转化：新用户 %d → 创建角色 %d → 发言 %d → 充值 %d", funnel.NewUsers, funnel.Registered, funnel.Chatted, funnel.Recharged))
+	return sb.String()
+}
+
+// reportCSV 把报表导出为 CSV，各部分之间以空行分隔
+func reportCSV(report *database.Report) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	format := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	w.Write([]string{"date", "new_users", "active_users", "messages", "recharged", "spent"})
+	for _, day := range report.Days {
+		w.Write([]string{day.Date.Format("2006-01-02"), format(day.NewUsers), format(day.ActiveUsers), format(day.Messages), format(day.Recharged), format(day.Spent)})
+	}
+	recharged, spent := reportTotals(report)
+	w.Write([]string{"total", "", "", "", format(recharged), format(spent)})
+	w.Write(nil)
+
+	w.Write([]string{"model", "input", "output", "thinking", "cached", "image", "cost"})
+	for _, model := range report.Models {
+		w.Write([]string{model.Model, format(model.Input), format(model.Output), format(model.Thinking), format(model.Cached), format(model.Image), format(model.Cost)})
+	}
+	w.Write(nil)
+
+	w.Write([]string{"user_id", "tg_id", "username", "spent"})
+	for _, spender := range report.TopSpenders {
+		w.Write([]string{strconv.Itoa(spender.UserID), format(spender.TgID), spender.Username, format(spender.Spent)})
+	}
+	w.Write(nil)
+
+	w.Write([]string{"tool", "calls"})
+	for _, tool := range report.ToolCalls {
+		w.Write([]string{tool.Name, format(tool.Count)})
+	}
+	w.Write([]string{"image_generations", format(imageGenerations(report))})
+	w.Write(nil)
+
+	funnel := report.Funnel
+	w.Write([]string{"new_users", "registered", "chatted", "recharged"})
+	w.Write([]string{format(funnel.NewUsers), format(funnel.Registered), format(funnel.Chatted), format(funnel.Recharged)})
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
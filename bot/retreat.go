@@ -0,0 +1,264 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+
+	"google.golang.org/genai"
+	tele "gopkg.in/telebot.v4"
+)
+
+const (
+	retreatExpPerHour      = 60.0 // 基础每小时修炼经验
+	retreatProgressPerHour = 2.0  // 基础每小时功法进度
+	retreatInterruptRatio  = 0.5  // 强行出关时收益折损比例
+)
+
+// spiritDensityByKeyword 地点关键字对应的灵气浓度，未匹配的地点为1
+var spiritDensityByKeyword = []struct {
+	keyword string
+	density float64
+}{
+	{"灵脉", 2.0},
+	{"秘境", 1.8},
+	{"禁地", 1.8},
+	{"洞天", 1.8},
+	{"福地", 1.6},
+	{"洞府", 1.5},
+	{"灵山", 1.5},
+	{"宗门", 1.3},
+	{"坊市", 0.9},
+	{"新手村", 0.8},
+	{"凡人", 0.6},
+}
+
+// retreatTechniqueTypes 闭关时优先参悟的功法类型
+var retreatTechniqueTypes = []string{"cultivation", "修炼", "心法", "功法"}
+
+// handleRetreat 处理 /retreat 命令，/retreat <小时> 开始闭关，/retreat stop 强行出关
+func (b *Bot) handleRetreat(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	ctx := context.Background()
+	player, err := b.db.GetActiveCharacter(ctx, user.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取玩家信息失败: %v", err))
+	}
+	if player == nil {
+		return c.Reply("您还没有注册角色，请使用/reg 角色名 注册之后进行游戏")
+	}
+	if player.IsDead() {
+		return c.Reply(fmt.Sprintf("角色「%s」已经陨落，无法闭关", player.Name))
+	}
+	retreat, err := b.db.GetOngoingRetreat(ctx, player.ID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取闭关信息失败: %v", err))
+	}
+
+	args := c.Args()
+	if len(args) == 1 && args[0] == "stop" {
+		if retreat == nil {
+			return c.Reply("您当前没有在闭关")
+		}
+		b.finishRetreat(ctx, player, retreat, true)
+		return nil
+	}
+
+	if retreat != nil {
+		return c.Reply(fmt.Sprintf("您正在闭关中，预计 %s 出关，/retreat stop 强行出关", retreat.EndsAt.Format("2006-01-02 15:04")))
+	}
+	if len(args) != 1 {
+		return c.Reply(fmt.Sprintf("请输入正确的命令，格式为: /retreat <小时数(1-%d)>", b.config.Game.MaxRetreatHours))
+	}
+	hours, err := strconv.Atoi(args[0])
+	if err != nil || hours <= 0 || hours > b.config.Game.MaxRetreatHours {
+		return c.Reply(fmt.Sprintf("闭关时长需在1到%d小时之间", b.config.Game.MaxRetreatHours))
+	}
+
+	now := time.Now()
+	retreat = &database.Retreat{
+		CharacterID: player.ID,
+		Hours:       hours,
+		StartedAt:   now,
+		EndsAt:      now.Add(time.Duration(hours) * time.Hour),
+	}
+	err = b.db.StartRetreat(ctx, retreat)
+	if errors.Is(err, database.ErrAlreadyInRetreat) || errors.Is(err, database.ErrRetreatDead) {
+		return c.Reply(err.Error())
+	}
+	if err != nil {
+		return c.Reply(fmt.Sprintf("闭关失败: %v", err))
+	}
+	return c.Reply(fmt.Sprintf("「%s」于%s开始闭关，灵气浓度 %.1f，预计 %s 出关。闭关期间无法冒险，/retreat stop 强行出关",
+		player.Name, player.Location, spiritDensity(player.Location), retreat.EndsAt.Format("2006-01-02 15:04")))
+}
+
+// retreatLoop 定时结算到期的闭关
+func (b *Bot) retreatLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		b.settleDueRetreats()
+		<-ticker.C
+	}
+}
+
+func (b *Bot) settleDueRetreats() {
+	ctx := context.Background()
+	retreats, err := b.db.GetDueRetreats(ctx, time.Now())
+	if err != nil {
+		log.Printf("获取到期闭关失败: %v", err)
+		return
+	}
+	for _, retreat := range retreats {
+		player, err := b.db.GetCharacterStats(ctx, retreat.CharacterID)
+		if err != nil || player == nil {
+			log.Printf("获取闭关角色 %d 失败: %v", retreat.CharacterID, err)
+			continue
+		}
+		b.finishRetreat(ctx, player, retreat, false)
+	}
+}
+
+// finishRetreat 结算闭关收益，发放经验和功法进度，并把天道的闭关总结发给玩家
+func (b *Bot) finishRetreat(ctx context.Context, player *database.CharacterStats, retreat *database.Retreat, interrupted bool) {
+	now := time.Now()
+	hours := float64(retreat.Hours)
+	retreat.Status = database.RetreatStatusCompleted
+	if interrupted {
+		hours = math.Min(now.Sub(retreat.StartedAt).Hours(), hours) * retreatInterruptRatio
+		retreat.Status = database.RetreatStatusInterrupted
+	}
+
+	techniques, err := b.db.GetCharacterCultivationTechniques(ctx, player.ID)
+	if err != nil {
+		log.Printf("获取角色 %d 功法失败: %v", player.ID, err)
+	}
+	technique := pickRetreatTechnique(techniques)
+
+	retreat.FinishedAt = now
+	retreat.ExperienceGained = retreatExperience(player, hours)
+	if technique != nil {
+		retreat.TechniqueName = technique.TechniqueName
+		retreat.ProgressGained = retreatProgress(player, hours)
+	}
+
+	finished, err := b.db.FinishRetreat(ctx, retreat)
+	if err != nil {
+		log.Printf("结束闭关 %d 失败: %v", retreat.ID, err)
+		return
+	}
+	if !finished {
+		return
+	}
+
+	result := fmt.Sprintf("闭关%s，修炼经验 +%d", retreatOutcome(interrupted), retreat.ExperienceGained)
+	if technique != nil {
+		result += fmt.Sprintf("，《%s》进度 +%d%%", technique.TechniqueName, retreat.ProgressGained)
+	}
+	meter := &llm.Meter{}
+	summary, err := b.summarizeRetreat(ctx, player, retreat, interrupted, meter)
+	b.chargeUsage(player.UserID, player.ID, database.UsageKindRetreat, meter)
+	if err != nil {
+		log.Printf("生成闭关 %d 总结失败: %v", retreat.ID, err)
+	} else {
+		b.db.AddMessage(ctx, player.ID, "model", []*genai.Part{genai.NewPartFromText(summary)})
+		result = summary + "\n\n" + result
+	}
+	if _, err := b.Send(tele.ChatID(retreat.TgID), result); err != nil {
+		log.Printf("发送闭关 %d 结果失败: %v", retreat.ID, err)
+	}
+}
+
+// summarizeRetreat 让天道为本次闭关写一段总结，用量记入 meter
+func (b *Bot) summarizeRetreat(ctx context.Context, player *database.CharacterStats, retreat *database.Retreat, interrupted bool, meter *llm.Meter) (string, error) {
+	client, err := b.llmService.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("创建LLMClient失败: %v", err)
+	}
+	config := &genai.GenerateContentConfig{
+		SystemInstruction: genai.NewContentFromText(b.config.Prompts["system_prompt"], genai.RoleUser),
+	}
+	prompt := fmt.Sprintf("玩家%s的信息如下：\n\n%s\n\n玩家在「%s」闭关%d小时，闭关%s。本次闭关获得修炼经验%d",
+		player.Name, player, player.Location, retreat.Hours, retreatOutcome(interrupted), retreat.ExperienceGained)
+	if retreat.TechniqueName != "" {
+		prompt += fmt.Sprintf("，功法《%s》修炼进度增加%d%%", retreat.TechniqueName, retreat.ProgressGained)
+	}
+	prompt += "。请以天道的口吻，用两三百字描写这次闭关的经过和感悟，不要改变上述收益数值。"
+	result, err := client.Models.GenerateContent(ctx, llm.ChatModel, genai.Text(prompt), config)
+	if err != nil {
+		return "", err
+	}
+	meter.Record(llm.UsageFromMetadata(llm.ChatModel, result.UsageMetadata))
+	return result.Text(), nil
+}
+
+func retreatOutcome(interrupted bool) string {
+	if interrupted {
+		return "被强行中断，收益折损"
+	}
+	return "圆满结束"
+}
+
+// spiritDensity 根据地点估算灵气浓度
+func spiritDensity(location string) float64 {
+	for _, entry := range spiritDensityByKeyword {
+		if strings.Contains(location, entry.keyword) {
+			return entry.density
+		}
+	}
+	return 1.0
+}
+
+// rootFactor 灵根修炼系数：最高资质决定上限，灵根越驳杂修炼越慢
+func rootFactor(roots *database.SpiritualRoots) float64 {
+	if roots == nil || len(*roots) == 0 {
+		return 0.5
+	}
+	best := 0
+	for _, root := range *roots {
+		best = max(best, root.Afinity)
+	}
+	return (0.5 + float64(best)/100) / (1 + 0.15*float64(len(*roots)-1))
+}
+
+// comprehensionFactor 悟性修炼系数
+func comprehensionFactor(comprehension int) float64 {
+	return 1 + float64(max(comprehension, 0))/100
+}
+
+// retreatExperience 闭关获得的修炼经验
+func retreatExperience(player *database.CharacterStats, hours float64) int64 {
+	return int64(hours * retreatExpPerHour * rootFactor(player.SpiritualRoots) * comprehensionFactor(player.Comprehension) * spiritDensity(player.Location))
+}
+
+// retreatProgress 闭关获得的功法进度
+func retreatProgress(player *database.CharacterStats, hours float64) int {
+	return int(hours * retreatProgressPerHour * comprehensionFactor(player.Comprehension) * spiritDensity(player.Location))
+}
+
+// pickRetreatTechnique 选择闭关参悟的功法：优先未圆满的修炼类功法，其次任意未圆满功法
+func pickRetreatTechnique(techniques []*database.CultivationTechnique) *database.CultivationTechnique {
+	var fallback *database.CultivationTechnique
+	for _, technique := range techniques {
+		if technique.Progress >= 100 {
+			continue
+		}
+		if slices.Contains(retreatTechniqueTypes, technique.TechniqueType) {
+			return technique
+		}
+		if fallback == nil {
+			fallback = technique
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,162 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleShop 处理 /shop 命令，列出商店目录
+// 管理员可用 /shop all 查看全部商品，/shop add <价格> <库存> <JSON> 上架商品，
+// /shop price <ID> <价格>、/shop stock <ID> <库存> 修改价格和库存，/shop on|off <ID> 上架或下架
+func (b *Bot) handleShop(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	action, payload, _ := strings.Cut(strings.TrimSpace(c.Message().Payload), " ")
+	payload = strings.TrimSpace(payload)
+	if action == "" {
+		return b.listShopItems(c, true)
+	}
+	if !slices.Contains(b.config.Bot.AdminIds, user.TgId) {
+		return c.Reply("您没有权限使用此命令")
+	}
+
+	switch action {
+	case "all":
+		return b.listShopItems(c, false)
+	case "add":
+		return b.addShopItem(c, user, payload)
+	case "price", "stock", "on", "off":
+		return b.updateShopItem(c, user, action, payload)
+	}
+	return c.Reply("请输入正确的命令，格式为: /shop [all|add <价格> <库存> <JSON>|price <ID> <价格>|stock <ID> <库存>|on <ID>|off <ID>]")
+}
+
+func (b *Bot) listShopItems(c tele.Context, activeOnly bool) error {
+	shopItems, err := b.db.GetShopItems(context.Background(), activeOnly)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取商店目录失败: %v", err))
+	}
+	if len(shopItems) == 0 {
+		return c.Reply("商店暂无商品")
+	}
+	var sb strings.Builder
+	sb.WriteString("🏪 商店目录：\n")
+	sb.WriteString(formatShopCatalog(shopItems))
+	if activeOnly {
+		sb.WriteString("\n想买什么，直接告诉天道即可")
+	}
+	return c.Reply(sb.String())
+}
+
+func (b *Bot) addShopItem(c tele.Context, admin *database.User, payload string) error {
+	usage := "请输入正确的命令，格式为: /shop add <价格> <库存> <JSON>，库存 -1 表示不限\n格式示例: /shop add 500 10 {\"item_name\":\"筑基丹\",\"item_type\":\"丹药\",\"quality\":\"稀有\",\"quantity\":1,\"description\":\"助练气圆满修士筑基\"}"
+	fields := strings.SplitN(payload, " ", 3)
+	if len(fields) < 3 {
+		return c.Reply(usage)
+	}
+	price, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || price <= 0 {
+		return c.Reply("价格必须是正整数")
+	}
+	stock, err := strconv.Atoi(fields[1])
+	if err != nil || stock < database.UnlimitedStock {
+		return c.Reply("库存必须是非负整数或 -1")
+	}
+	var item database.InventoryItem
+	if err := json.Unmarshal([]byte(strings.TrimSpace(fields[2])), &item); err != nil {
+		return c.Reply(fmt.Sprintf("解析商品失败: %v\n%s", err, usage))
+	}
+	if item.ItemName == "" {
+		return c.Reply("商品缺少名称")
+	}
+	item.ID = 0
+	item.CharacterID = 0
+	item.Quantity = max(item.Quantity, 1)
+
+	shopItem := &database.ShopItem{Item: &item, Price: price, Stock: stock, Active: true}
+	if err := b.db.CreateShopItem(context.Background(), shopItem); err != nil {
+		return c.Reply(fmt.Sprintf("上架商品失败: %v", err))
+	}
+	b.auditAdmin(admin, "shop_add", nil, fmt.Sprintf("商品 #%d %s", shopItem.ID, payload))
+	return c.Reply("已上架商品：" + formatShopItem(shopItem))
+}
+
+func (b *Bot) updateShopItem(c tele.Context, admin *database.User, action string, payload string) error {
+	idText, value, _ := strings.Cut(payload, " ")
+	value = strings.TrimSpace(value)
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		return c.Reply("请输入正确的商品ID")
+	}
+	ctx := context.Background()
+	shopItem, err := b.db.GetShopItem(ctx, id)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取商品失败: %v", err))
+	}
+	if shopItem == nil {
+		return c.Reply(fmt.Sprintf("商品 #%d 不存在", id))
+	}
+
+	switch action {
+	case "price":
+		price, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || price <= 0 {
+			return c.Reply("价格必须是正整数")
+		}
+		shopItem.Price = price
+	case "stock":
+		stock, err := strconv.Atoi(value)
+		if err != nil || stock < database.UnlimitedStock {
+			return c.Reply("库存必须是非负整数或 -1")
+		}
+		shopItem.Stock = stock
+	case "on":
+		shopItem.Active = true
+	case "off":
+		shopItem.Active = false
+	}
+	updated, err := b.db.UpdateShopItem(ctx, shopItem)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("修改商品失败: %v", err))
+	}
+	if !updated {
+		return c.Reply(fmt.Sprintf("商品 #%d 不存在", id))
+	}
+	b.auditAdmin(admin, "shop_"+action, nil, fmt.Sprintf("商品 #%d %s", id, value))
+	return c.Reply("已修改商品：" + formatShopItem(shopItem))
+}
+
+// formatShopItem 商品的简要说明
+func formatShopItem(shopItem *database.ShopItem) string {
+	stock := "不限量"
+	if shopItem.Stock != database.UnlimitedStock {
+		stock = fmt.Sprintf("剩余%d份", shopItem.Stock)
+	}
+	text := fmt.Sprintf("#%d %s（%s，%s）x%d，%d灵石，%s", shopItem.ID, shopItem.Item.ItemName, shopItem.Item.ItemType, shopItem.Item.Quality, shopItem.Item.Quantity, shopItem.Price, stock)
+	if !shopItem.Active {
+		text += "，已下架"
+	}
+	return text
+}
+
+// formatShopCatalog 商店目录，也用于提供给天道
+func formatShopCatalog(shopItems []*database.ShopItem) string {
+	catalog := ""
+	for _, shopItem := range shopItems {
+		catalog += "- " + formatShopItem(shopItem) + "\n"
+		if shopItem.Item.Description != "" {
+			catalog += "  " + shopItem.Item.Description + "\n"
+		}
+	}
+	if catalog == "" {
+		catalog = "商店暂无商品\n"
+	}
+	return catalog
+}
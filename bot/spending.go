@@ -0,0 +1,114 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleLimit 处理 /limit 命令，查看今日消耗和消耗上限
+// /limit daily <灵石> 设置每日上限，/limit turn <灵石> 设置单轮对话上限，0 表示恢复默认上限
+func (b *Bot) handleLimit(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	ctx := context.Background()
+	args := c.Args()
+	if len(args) == 0 {
+		spent, err := b.db.GetUsageCostSince(ctx, user.ID, startOfDay(time.Now()))
+		if err != nil {
+			return c.Reply(fmt.Sprintf("获取今日消耗失败: %v", err))
+		}
+		dailyLimit, turnLimit := b.spendingLimits(user)
+		return c.Reply(fmt.Sprintf("📊 今日已消耗灵石 %d / %d\n单轮对话上限 %d\n当前灵石 %d\n\n/limit daily <灵石> 设置每日上限（最多 %d）\n/limit turn <灵石> 设置单轮对话上限（最多 %d）\n设为 0 恢复默认上限",
+			spent, dailyLimit, turnLimit, user.TotalRechargedToken-user.TotalUsedToken, b.config.Spending.MaxDailyLimit, b.config.Spending.MaxTurnLimit))
+	}
+
+	if len(args) != 2 || (args[0] != "daily" && args[0] != "turn") {
+		return c.Reply("请输入正确的命令，格式为: /limit [daily|turn <灵石>]")
+	}
+	limit, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || limit < 0 {
+		return c.Reply("上限必须是非负整数")
+	}
+	dailyLimit, turnLimit := user.DailyLimit, user.TurnLimit
+	if args[0] == "daily" {
+		if limit > b.config.Spending.MaxDailyLimit {
+			return c.Reply(fmt.Sprintf("每日上限不能超过 %d", b.config.Spending.MaxDailyLimit))
+		}
+		dailyLimit = limit
+	} else {
+		if limit > b.config.Spending.MaxTurnLimit {
+			return c.Reply(fmt.Sprintf("单轮对话上限不能超过 %d", b.config.Spending.MaxTurnLimit))
+		}
+		turnLimit = limit
+	}
+	if err := b.db.SetUserSpendingLimits(ctx, user.ID, dailyLimit, turnLimit); err != nil {
+		return c.Reply(fmt.Sprintf("设置上限失败: %v", err))
+	}
+	user.DailyLimit, user.TurnLimit = dailyLimit, turnLimit
+	dailyLimit, turnLimit = b.spendingLimits(user)
+	return c.Reply(fmt.Sprintf("已设置：每日上限 %d，单轮对话上限 %d", dailyLimit, turnLimit))
+}
+
+// spendingLimits 用户生效的每日和单轮对话消耗上限，未设置的使用默认上限
+func (b *Bot) spendingLimits(user *database.User) (int64, int64) {
+	dailyLimit, turnLimit := b.config.Spending.MaxDailyLimit, b.config.Spending.MaxTurnLimit
+	if user.DailyLimit > 0 {
+		dailyLimit = min(user.DailyLimit, dailyLimit)
+	}
+	if user.TurnLimit > 0 {
+		turnLimit = min(user.TurnLimit, turnLimit)
+	}
+	return dailyLimit, turnLimit
+}
+
+// spendingLimitReason 检查在已消耗 dailySpent（不含本轮）和本轮 calls 次调用已消耗 turnSpent 的情况下能否再调用一次模型，不能时返回原因
+// 按预估的单次调用消耗判断，避免最后一次调用超出余额或上限
+func (b *Bot) spendingLimitReason(user *database.User, dailySpent int64, turnSpent int64, calls int) string {
+	dailyLimit, turnLimit := b.spendingLimits(user)
+	estimate := b.config.Spending.EstimatedCallCost
+	if calls > 0 {
+		// 本轮已有调用时按实际的平均消耗预估
+		estimate = max(estimate, turnSpent/int64(calls))
+	}
+	switch {
+	case user.TotalRechargedToken-user.TotalUsedToken-turnSpent < estimate:
+		return "您的灵石不足，请先充值，/buy 购买灵石"
+	case dailySpent+turnSpent+estimate > dailyLimit:
+		return fmt.Sprintf("今日消耗的灵石即将超过上限 %d，请明日再来，/limit 查看或调整上限", dailyLimit)
+	case turnSpent+estimate > turnLimit:
+		return fmt.Sprintf("本轮对话消耗的灵石即将超过上限 %d，/limit 查看或调整上限", turnLimit)
+	}
+	return ""
+}
+
+// refreshBalance 重新读取用户的灵石余额，本轮中途购买等扣费后使用
+func (b *Bot) refreshBalance(ctx context.Context, user *database.User) {
+	fresh, err := b.db.GetUserByID(ctx, user.ID)
+	if err != nil || fresh == nil {
+		log.Printf("重新读取用户 %d 的余额失败: %v", user.ID, err)
+		return
+	}
+	user.TotalRechargedToken, user.TotalUsedToken = fresh.TotalRechargedToken, fresh.TotalUsedToken
+}
+
+// warnLowBalance 本次扣费使灵石余额跌破提醒线时提醒玩家充值
+func (b *Bot) warnLowBalance(c tele.Context, user *database.User, charged int64) {
+	threshold := b.config.Spending.LowBalanceThreshold
+	before := user.TotalRechargedToken - user.TotalUsedToken
+	after := before - charged
+	if before >= threshold && after < threshold {
+		c.Send(fmt.Sprintf("⚠️ 您的灵石仅剩 %d，请及时充值，/buy 购买灵石", after))
+	}
+}
+
+// startOfDay 当天零点
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
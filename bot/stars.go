@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"jiangfengwhu/nagi-bot-go/config"
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// starPayloadPrefix Stars 账单 payload 的前缀，后接套餐ID
+const starPayloadPrefix = "stars|"
+
+var btnBuyPackage = tele.Btn{Unique: "buy_package"}
+
+// handleBuy 处理 /buy 命令，列出灵石套餐
+// 管理员可用 /buy refund <支付ID> 退款，退还 Stars 并扣回灵石
+func (b *Bot) handleBuy(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	args := c.Args()
+	if len(args) > 0 && args[0] == "refund" {
+		if !slices.Contains(b.config.Bot.AdminIds, user.TgId) {
+			return c.Reply("您没有权限使用此命令")
+		}
+		if len(args) != 2 {
+			return c.Reply("请输入正确的命令，格式为: /buy refund <支付ID>")
+		}
+		return b.refundStars(c, user, args[1])
+	}
+
+	markup := &tele.ReplyMarkup{}
+	rows := []tele.Row{}
+	for _, pkg := range b.config.Payment.StarPackages {
+		rows = append(rows, markup.Row(markup.Data(fmt.Sprintf("%s：%d 灵石 / %d ⭐", pkg.Title, pkg.Amount, pkg.Stars), btnBuyPackage.Unique, pkg.ID)))
+	}
+	markup.Inline(rows...)
+	return c.Reply("💎 选择要购买的灵石套餐，使用 Telegram Stars 支付：", markup)
+}
+
+// handleBuyPackage 发送所选套餐的 Stars 账单
+func (b *Bot) handleBuyPackage(c tele.Context) error {
+	pkg := b.starPackage(c.Callback().Data)
+	if pkg == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "该套餐已下架"})
+	}
+	invoice := &tele.Invoice{
+		Title:       pkg.Title,
+		Description: fmt.Sprintf("充值 %d 灵石", pkg.Amount),
+		Payload:     starPayloadPrefix + pkg.ID,
+		Currency:    tele.Stars,
+		Prices:      []tele.Price{{Label: pkg.Title, Amount: pkg.Stars}},
+	}
+	c.Respond()
+	return c.Send(invoice)
+}
+
+// handleCheckout 处理付款前的确认，套餐或金额不符时拒绝付款
+// 付款前的确认没有消息，不经过 Auth 中间件
+func (b *Bot) handleCheckout(c tele.Context) error {
+	query := c.PreCheckoutQuery()
+	if _, reason := b.checkStarPayment(query.Currency, query.Payload, query.Total); reason != "" {
+		return c.Accept(reason)
+	}
+	return c.Accept()
+}
+
+// handlePayment 处理付款成功，按支付ID去重后入账
+func (b *Bot) handlePayment(c tele.Context) error {
+	user := c.Get("db_user").(*database.User)
+	payment := c.Message().Payment
+	pkg, reason := b.checkStarPayment(payment.Currency, payment.Payload, payment.Total)
+	if reason != "" {
+		// 付款前已经校验过，到这里说明套餐在付款期间被修改，记录下来由管理员处理
+		log.Printf("用户 %d 的支付 %s 无法入账: %s", user.ID, payment.TelegramChargeID, reason)
+		return c.Reply(fmt.Sprintf("支付已收到，但%s，请联系管理员处理，支付ID: %s", reason, payment.TelegramChargeID))
+	}
+
+	credited, err := b.db.CreditStarPayment(context.Background(), &database.StarPayment{
+		UserID:           user.ID,
+		ChargeID:         payment.TelegramChargeID,
+		ProviderChargeID: payment.ProviderChargeID,
+		PackageID:        pkg.ID,
+		Stars:            payment.Total,
+		Amount:           pkg.Amount,
+	})
+	if err != nil {
+		log.Printf("用户 %d 的支付 %s 入账失败: %v", user.ID, payment.TelegramChargeID, err)
+		return c.Reply(fmt.Sprintf("充值入账失败，请联系管理员处理，支付ID: %s", payment.TelegramChargeID))
+	}
+	if !credited {
+		return nil
+	}
+	balance := user.TotalRechargedToken - user.TotalUsedToken + pkg.Amount
+	return c.Reply(fmt.Sprintf("充值成功，获得灵石 %d，当前灵石 %d", pkg.Amount, balance))
+}
+
+// handleRefund 处理 Telegram 发来的退款通知，扣回灵石
+func (b *Bot) handleRefund(c tele.Context) error {
+	refunded := c.Message().RefundedPayment
+	payment, changed, err := b.db.RefundStarPayment(context.Background(), refunded.TelegramChargeID)
+	if err != nil {
+		log.Printf("支付 %s 退款失败: %v", refunded.TelegramChargeID, err)
+		return nil
+	}
+	if payment == nil || !changed {
+		return nil
+	}
+	return c.Reply(fmt.Sprintf("支付 %s 已退款，扣回灵石 %d", payment.ChargeID, payment.Amount))
+}
+
+// refundStars 管理员退款：先退还 Stars，再扣回灵石
+func (b *Bot) refundStars(c tele.Context, admin *database.User, chargeID string) error {
+	ctx := context.Background()
+	payment, err := b.db.GetStarPayment(ctx, chargeID)
+	if err != nil {
+		return c.Reply(fmt.Sprintf("获取支付失败: %v", err))
+	}
+	if payment == nil {
+		return c.Reply(fmt.Sprintf("支付 %s 不存在", chargeID))
+	}
+	if payment.Status == database.StarPaymentStatusRefunded {
+		return c.Reply(fmt.Sprintf("支付 %s 已经退款", chargeID))
+	}
+	if err := b.RefundStars(tele.ChatID(payment.TgID), chargeID); err != nil {
+		return c.Reply(fmt.Sprintf("退还 Stars 失败: %v", err))
+	}
+	b.auditAdmin(admin, "stars_refund", &database.User{ID: payment.UserID}, fmt.Sprintf("支付 %s 退还 %d ⭐，扣回灵石 %d", chargeID, payment.Stars, payment.Amount))
+	if _, _, err := b.db.RefundStarPayment(ctx, chargeID); err != nil {
+		return c.Reply(fmt.Sprintf("Stars 已退还，但扣回灵石失败: %v", err))
+	}
+	b.Send(tele.ChatID(payment.TgID), fmt.Sprintf("支付 %s 已退款，退还 %d ⭐，扣回灵石 %d", chargeID, payment.Stars, payment.Amount))
+	return c.Reply(fmt.Sprintf("已退款：用户 #%d 的支付 %s，退还 %d ⭐，扣回灵石 %d", payment.UserID, chargeID, payment.Stars, payment.Amount))
+}
+
+// checkStarPayment 校验账单的币种、套餐和金额，不通过时返回原因
+func (b *Bot) checkStarPayment(currency string, payload string, total int) (*config.StarPackage, string) {
+	if currency != tele.Stars {
+		return nil, "只支持 Telegram Stars 支付"
+	}
+	packageID, ok := strings.CutPrefix(payload, starPayloadPrefix)
+	if !ok {
+		return nil, "无效的账单"
+	}
+	pkg := b.starPackage(packageID)
+	if pkg == nil {
+		return nil, "该套餐已下架"
+	}
+	if pkg.Stars != total {
+		return nil, "套餐价格已变动，请重新购买"
+	}
+	return pkg, ""
+}
+
+// starPackage 按ID查找灵石套餐
+func (b *Bot) starPackage(id string) *config.StarPackage {
+	for i := range b.config.Payment.StarPackages {
+		if b.config.Payment.StarPackages[i].ID == id {
+			return &b.config.Payment.StarPackages[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/config"
+	"jiangfengwhu/nagi-bot-go/database"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// fakeTelegram 模拟 Telegram Bot API，记录 bot 发出的请求
+type fakeTelegram struct {
+	mu    sync.Mutex
+	calls []fakeCall
+}
+
+type fakeCall struct {
+	method string
+	params map[string]any
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	params := map[string]any{}
+	json.NewDecoder(r.Body).Decode(&params)
+
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{method: method, params: params})
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if method == "sendMessage" {
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":%v,"type":"private"},"text":%q}}`, params["chat_id"], params["text"])
+		return
+	}
+	fmt.Fprint(w, `{"ok":true,"result":true}`)
+}
+
+// take 取出并清空已记录的请求
+func (f *fakeTelegram) take() []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// newStarsTestBot 创建连接模拟 Telegram API 的 bot，db 为 nil 时只能测试不访问数据库的流程
+func newStarsTestBot(t *testing.T, db *database.DB) (*Bot, *fakeTelegram) {
+	t.Helper()
+	api := &fakeTelegram{}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	tb, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatalf("创建 bot 失败: %v", err)
+	}
+	cfg := &config.Config{}
+	cfg.Payment.StarPackages = []config.StarPackage{{ID: "small", Title: "一袋灵石", Stars: 50, Amount: 500000}}
+	return &Bot{Bot: tb, config: cfg, db: db}, api
+}
+
+// openStarsTestDB 连接 TEST_DATABASE_URL 指定的测试数据库并建表，未设置时跳过测试
+func openStarsTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("未设置 TEST_DATABASE_URL，跳过需要数据库的测试")
+	}
+	db, err := database.New(url)
+	if err != nil {
+		t.Fatalf("连接数据库失败: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	schema, err := os.ReadFile("../scripts/table.sql")
+	if err != nil {
+		t.Fatalf("读取表结构失败: %v", err)
+	}
+	if _, err := db.GetPool().Exec(context.Background(), string(schema)); err != nil {
+		t.Fatalf("建表失败: %v", err)
+	}
+	return db
+}
+
+// createStarsTestUser 创建测试用户，测试结束后删除用户和充值记录
+func createStarsTestUser(t *testing.T, db *database.DB) *database.User {
+	t.Helper()
+	ctx := context.Background()
+	user := &database.User{TgId: time.Now().UnixNano(), Username: "stars_test", CreatedAt: time.Now()}
+	if err := db.CreateUser(ctx, user); err != nil {
+		t.Fatalf("创建用户失败: %v", err)
+	}
+	t.Cleanup(func() {
+		db.GetPool().Exec(ctx, `DELETE FROM star_payments WHERE user_id = $1`, user.ID)
+		db.GetPool().Exec(ctx, `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	return user
+}
+
+func balanceOf(t *testing.T, db *database.DB, user *database.User) int64 {
+	t.Helper()
+	balance, err := db.GetUserTotalToken(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("获取灵石失败: %v", err)
+	}
+	return balance
+}
+
+func paymentUpdate(user *database.User, chargeID string, total int) tele.Update {
+	return tele.Update{Message: &tele.Message{
+		Chat:   &tele.Chat{ID: user.TgId, Type: tele.ChatPrivate},
+		Sender: &tele.User{ID: user.TgId, Username: user.Username},
+		Payment: &tele.Payment{
+			Currency:         tele.Stars,
+			Total:            total,
+			Payload:          starPayloadPrefix + "small",
+			TelegramChargeID: chargeID,
+			ProviderChargeID: "provider-" + chargeID,
+		},
+	}}
+}
+
+func refundUpdate(user *database.User, chargeID string) tele.Update {
+	return tele.Update{Message: &tele.Message{
+		Chat:   &tele.Chat{ID: user.TgId, Type: tele.ChatPrivate},
+		Sender: &tele.User{ID: user.TgId, Username: user.Username},
+		RefundedPayment: &tele.RefundedPayment{
+			Currency:         tele.Stars,
+			Total:            50,
+			Payload:          starPayloadPrefix + "small",
+			TelegramChargeID: chargeID,
+		},
+	}}
+}
+
+// pushPayment 把付款成功的消息交给 handlePayment，与 Auth 中间件一样设置 db_user
+func pushPayment(t *testing.T, b *Bot, db *database.DB, update tele.Update) {
+	t.Helper()
+	user, err := db.GetUser(context.Background(), update.Message.Sender.ID)
+	if err != nil {
+		t.Fatalf("获取用户失败: %v", err)
+	}
+	c := b.NewContext(update)
+	c.Set("db_user", user)
+	if err := b.handlePayment(c); err != nil {
+		t.Fatalf("handlePayment 返回错误: %v", err)
+	}
+}
+
+func TestHandleCheckout(t *testing.T) {
+	b, api := newStarsTestBot(t, nil)
+
+	tests := []struct {
+		name     string
+		currency string
+		payload  string
+		total    int
+		reason   string
+	}{
+		{"有效套餐", tele.Stars, starPayloadPrefix + "small", 50, ""},
+		{"金额不符", tele.Stars, starPayloadPrefix + "small", 10, "套餐价格已变动，请重新购买"},
+		{"套餐下架", tele.Stars, starPayloadPrefix + "gone", 50, "该套餐已下架"},
+		{"非 Stars 币种", "USD", starPayloadPrefix + "small", 50, "只支持 Telegram Stars 支付"},
+		{"无效账单", tele.Stars, "other|small", 50, "无效的账单"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := b.NewContext(tele.Update{PreCheckoutQuery: &tele.PreCheckoutQuery{
+				ID:       "query-1",
+				Sender:   &tele.User{ID: 1},
+				Currency: tt.currency,
+				Payload:  tt.payload,
+				Total:    tt.total,
+			}})
+			if err := b.handleCheckout(c); err != nil {
+				t.Fatalf("handleCheckout 返回错误: %v", err)
+			}
+
+			calls := api.take()
+			if len(calls) != 1 || calls[0].method != "answerPreCheckoutQuery" {
+				t.Fatalf("期望一次 answerPreCheckoutQuery，实际 %+v", calls)
+			}
+			params := calls[0].params
+			if params["pre_checkout_query_id"] != "query-1" {
+				t.Errorf("pre_checkout_query_id = %v", params["pre_checkout_query_id"])
+			}
+			if tt.reason == "" {
+				if params["ok"] != "true" {
+					t.Errorf("期望接受付款，实际 %+v", params)
+				}
+				return
+			}
+			if params["ok"] == "true" || params["error_message"] != tt.reason {
+				t.Errorf("期望以「%s」拒绝付款，实际 %+v", tt.reason, params)
+			}
+		})
+	}
+}
+
+func TestHandlePaymentDuplicateCharge(t *testing.T) {
+	db := openStarsTestDB(t)
+	b, api := newStarsTestBot(t, db)
+	user := createStarsTestUser(t, db)
+	chargeID := fmt.Sprintf("charge-dup-%d", user.TgId)
+
+	pushPayment(t, b, db, paymentUpdate(user, chargeID, 50))
+	if balance := balanceOf(t, db, user); balance != 500000 {
+		t.Fatalf("首次付款后灵石 = %d，期望 500000", balance)
+	}
+	if calls := api.take(); len(calls) != 1 || !strings.Contains(fmt.Sprint(calls[0].params["text"]), "充值成功") {
+		t.Fatalf("期望一条充值成功消息，实际 %+v", calls)
+	}
+
+	// Telegram 重发同一笔支付时不能重复入账，也不再通知玩家
+	pushPayment(t, b, db, paymentUpdate(user, chargeID, 50))
+	if balance := balanceOf(t, db, user); balance != 500000 {
+		t.Fatalf("重复付款后灵石 = %d，期望仍为 500000", balance)
+	}
+	if calls := api.take(); len(calls) != 0 {
+		t.Fatalf("重复付款不应发送消息，实际 %+v", calls)
+	}
+
+	payment, err := db.GetStarPayment(context.Background(), chargeID)
+	if err != nil || payment == nil {
+		t.Fatalf("获取支付失败: %v", err)
+	}
+	if payment.Status != database.StarPaymentStatusPaid || payment.Amount != 500000 || payment.Stars != 50 {
+		t.Errorf("支付记录不符: %+v", payment)
+	}
+}
+
+func TestHandleRefundAfterSpent(t *testing.T) {
+	db := openStarsTestDB(t)
+	b, api := newStarsTestBot(t, db)
+	user := createStarsTestUser(t, db)
+	chargeID := fmt.Sprintf("charge-refund-%d", user.TgId)
+
+	pushPayment(t, b, db, paymentUpdate(user, chargeID, 50))
+	api.take()
+
+	// 玩家已经花掉大部分灵石
+	if err := db.UpdateUserTotalUsedToken(context.Background(), user.ID, 400000); err != nil {
+		t.Fatalf("扣除灵石失败: %v", err)
+	}
+
+	if err := b.handleRefund(b.NewContext(refundUpdate(user, chargeID))); err != nil {
+		t.Fatalf("handleRefund 返回错误: %v", err)
+	}
+	// 退款扣回全部充值，已花掉的部分记为欠款
+	if balance := balanceOf(t, db, user); balance != -400000 {
+		t.Fatalf("退款后灵石 = %d，期望 -400000", balance)
+	}
+	if calls := api.take(); len(calls) != 1 || !strings.Contains(fmt.Sprint(calls[0].params["text"]), "已退款") {
+		t.Fatalf("期望一条退款通知，实际 %+v", calls)
+	}
+
+	// 重复的退款通知不能重复扣回
+	if err := b.handleRefund(b.NewContext(refundUpdate(user, chargeID))); err != nil {
+		t.Fatalf("handleRefund 返回错误: %v", err)
+	}
+	if balance := balanceOf(t, db, user); balance != -400000 {
+		t.Fatalf("重复退款后灵石 = %d，期望仍为 -400000", balance)
+	}
+	if calls := api.take(); len(calls) != 0 {
+		t.Fatalf("重复退款不应发送消息，实际 %+v", calls)
+	}
+
+	payment, err := db.GetStarPayment(context.Background(), chargeID)
+	if err != nil || payment == nil {
+		t.Fatalf("获取支付失败: %v", err)
+	}
+	if payment.Status != database.StarPaymentStatusRefunded || payment.RefundedAt.IsZero() {
+		t.Errorf("支付未标记为已退款: %+v", payment)
+	}
+}
+
+func TestPaymentInGroupChat(t *testing.T) {
+	db := openStarsTestDB(t)
+	b, api := newStarsTestBot(t, db)
+	user := createStarsTestUser(t, db)
+	chargeID := fmt.Sprintf("charge-group-%d", user.TgId)
+	group := &tele.Chat{ID: -100, Type: tele.ChatSuperGroup}
+
+	// 在群里发出的账单，付款和退款通知都发到群里且不会@机器人，仍要经过 Auth 中间件入账
+	payment := paymentUpdate(user, chargeID, 50)
+	payment.Message.Chat = group
+	if err := Auth(db, b.Bot, b.config)(b.handlePayment)(b.NewContext(payment)); err != nil {
+		t.Fatalf("handlePayment 返回错误: %v", err)
+	}
+	if balance := balanceOf(t, db, user); balance != 500000 {
+		t.Fatalf("群里付款后灵石 = %d，期望 500000", balance)
+	}
+	if calls := api.take(); len(calls) != 1 || !strings.Contains(fmt.Sprint(calls[0].params["text"]), "充值成功") {
+		t.Fatalf("期望一条充值成功消息，实际 %+v", calls)
+	}
+
+	refund := refundUpdate(user, chargeID)
+	refund.Message.Chat = group
+	if err := Auth(db, b.Bot, b.config)(b.handleRefund)(b.NewContext(refund)); err != nil {
+		t.Fatalf("handleRefund 返回错误: %v", err)
+	}
+	if balance := balanceOf(t, db, user); balance != 0 {
+		t.Fatalf("群里退款后灵石 = %d，期望 0", balance)
+	}
+	if calls := api.take(); len(calls) != 1 || !strings.Contains(fmt.Sprint(calls[0].params["text"]), "已退款") {
+		t.Fatalf("期望一条退款通知，实际 %+v", calls)
+	}
+}
@@ -23,13 +23,13 @@ type CreatePlayerParams struct {
 }
 
 type CreateInventoryParams struct {
-	ItemName     string    `json:"item_name"`
-	Quantity     int       `json:"quantity"`
-	ItemType     string    `json:"item_type"`
-	Quality      string    `json:"quality"`
-	Level        int       `json:"level"`
-	Properties   string    `json:"properties"`
-	Description  string    `json:"description"`
-	ObtainedFrom string    `json:"obtained_from"`
-	ObtainedAt   time.Time `json:"obtained_at"`
+	ItemName     string                   `json:"item_name"`
+	Quantity     int                      `json:"quantity"`
+	ItemType     string                   `json:"item_type"`
+	Quality      string                   `json:"quality"`
+	Level        int                      `json:"level"`
+	Properties   *database.ItemProperties `json:"properties"`
+	Description  string                   `json:"description"`
+	ObtainedFrom string                   `json:"obtained_from"`
+	ObtainedAt   time.Time                `json:"obtained_at"`
 }
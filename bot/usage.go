@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/llm"
+)
+
+// chargeUsage 按模型价格折算累计的用量，记录用量明细并扣除灵石，返回扣除的灵石
+// characterID 为 0 表示不关联角色
+func (b *Bot) chargeUsage(userID int, characterID int, kind string, meter *llm.Meter) int64 {
+	now := time.Now()
+	records := []*database.UsageRecord{}
+	total := int64(0)
+	for _, usage := range meter.Usages {
+		if usage.Total() == 0 {
+			continue
+		}
+		record := &database.UsageRecord{
+			CharacterID: characterID,
+			Kind:        kind,
+			Model:       usage.Model,
+			Input:       usage.Input,
+			Output:      usage.Output,
+			Thinking:    usage.Thinking,
+			Cached:      usage.Cached,
+			Image:       usage.Image,
+			Cost:        llm.Cost(b.config, usage, now),
+		}
+		records = append(records, record)
+		total += record.Cost
+	}
+	if err := b.db.ChargeUsage(context.Background(), userID, records); err != nil {
+		log.Printf("用户 %d 扣除灵石 %d 失败: %v", userID, total, err)
+		return 0
+	}
+	return total
+}
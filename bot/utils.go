@@ -164,7 +164,8 @@ func ConvertMarkdownToTelegramMarkdownV2(md string) string {
 	return md
 }
 
-func formatPlayerInfo(player *database.CharacterStats) string {
+func formatPlayerInfo(player *database.CharacterStats, equipment []*database.Equipment, buffs []*database.Buff) string {
+	effective := player.Effective(equipment, buffs)
 
 	spiritualRoots := ""
 	for _, root := range *player.SpiritualRoots {
@@ -175,32 +176,82 @@ func formatPlayerInfo(player *database.CharacterStats) string {
 		fmt.Sprintf("🌟 角色等级: %d\n", player.RealmLevel) + "\n" +
 		fmt.Sprintf("🌿 角色境界: %s\n", player.Realm) + "\n" +
 		fmt.Sprintf("🌱 角色灵根: \n%s\n", spiritualRoots) + "\n" +
-		fmt.Sprintf("🔮 角色神识: %d\n", player.SpiritSense) + "\n" +
-		fmt.Sprintf("💪 角色根骨: %d\n", player.Physique) + "\n" +
+		fmt.Sprintf("🔮 角色神识: %s\n", formatStat(player.SpiritSense, effective.SpiritSense)) + "\n" +
+		fmt.Sprintf("💪 角色根骨: %s\n", formatStat(player.Physique, effective.Physique)) + "\n" +
 		fmt.Sprintf("👹 角色煞气: %d\n", player.DemonicAura) + "\n" +
 		fmt.Sprintf("👺 角色道号: %s\n", player.TaoistName) + "\n" +
-		fmt.Sprintf("💪 角色攻击力: %d\n", player.Attack) + "\n" +
-		fmt.Sprintf("🛡️ 角色防御力: %d\n", player.Defense) + "\n" +
-		fmt.Sprintf("🏃 角色速度: %d\n", player.Speed) + "\n" +
-		fmt.Sprintf("🍀 角色幸运值: %d\n", player.Luck) + "\n" +
+		fmt.Sprintf("💪 角色攻击力: %s\n", formatStat(player.Attack, effective.Attack)) + "\n" +
+		fmt.Sprintf("🛡️ 角色防御力: %s\n", formatStat(player.Defense, effective.Defense)) + "\n" +
+		fmt.Sprintf("🏃 角色速度: %s\n", formatStat(player.Speed, effective.Speed)) + "\n" +
+		fmt.Sprintf("🍀 角色幸运值: %s\n", formatStat(player.Luck, effective.Luck)) + "\n" +
 		fmt.Sprintf("💪 角色修炼经验: %d\n", player.Experience) + "\n" +
 		fmt.Sprintf("🤔 角色悟性: %d\n", player.Comprehension) + "\n" +
 		fmt.Sprintf("👵 角色年龄: %d\n", player.Age) + "\n" +
 		fmt.Sprintf("👴 角色寿命: %d\n", player.Lifespan) + "\n" +
 		fmt.Sprintf("🏠 角色位置: %s\n", player.Location) + "\n" +
 		fmt.Sprintf("👨‍🦰 角色状态: %s\n", player.Status) + "\n" +
+		fmt.Sprintf("⚔️ 角色装备: \n%s\n", formatEquipmentInfo(equipment)) + "\n" +
+		fmt.Sprintf("✨ 角色增益: \n%s\n", formatBuffInfo(buffs)) + "\n" +
 		fmt.Sprintf("📚 角色成长经历: %s\n", player.Stories)
 }
 
+// formatStat 展示基础属性，有装备或增益加成时附带实际属性
+func formatStat(base int, effective int) string {
+	if base == effective {
+		return fmt.Sprintf("%d", base)
+	}
+	return fmt.Sprintf("%d（加成%+d，实际%d）", base, effective-base, effective)
+}
+
+// formatEffectiveStats 装备和增益加成后的实际战斗属性，供天道参考
+func formatEffectiveStats(effective *database.CharacterStats) string {
+	return fmt.Sprintf("加成后的实际属性：攻击力%d，防御力%d，速度%d，神识%d，根骨%d，幸运值%d",
+		effective.Attack, effective.Defense, effective.Speed, effective.SpiritSense, effective.Physique, effective.Luck)
+}
+
+func formatEquipmentInfo(equipment []*database.Equipment) string {
+	equipmentInfo := ""
+	for _, e := range equipment {
+		equipmentInfo += fmt.Sprintf("- %s: %s（%s）\n", database.EquipSlotNames[e.Slot], e.Item.ItemName, e.Modifiers.String())
+	}
+	if equipmentInfo == "" {
+		equipmentInfo = "未穿戴装备\n"
+	}
+	return equipmentInfo
+}
+
+func formatBuffInfo(buffs []*database.Buff) string {
+	buffInfo := ""
+	for _, buff := range buffs {
+		buffInfo += fmt.Sprintf("- %s: %s，%s 结束\n", buff.Source, buff.Modifiers.String(), buff.ExpiresAt.Format("01-02 15:04"))
+	}
+	if buffInfo == "" {
+		buffInfo = "无\n"
+	}
+	return buffInfo
+}
+
+// formatInventoryBrief 精简的背包列表，供天道按ID引用物品
+func formatInventoryBrief(inventory []*database.InventoryItem) string {
+	inventoryInfo := ""
+	for _, item := range inventory {
+		inventoryInfo += fmt.Sprintf("- #%d %s（%s，%s）x%d\n", item.ID, item.ItemName, item.ItemType, item.Quality, item.Quantity)
+	}
+	if inventoryInfo == "" {
+		inventoryInfo = "背包物品为空\n"
+	}
+	return inventoryInfo
+}
+
 func formatInventoryInfo(inventory []*database.InventoryItem) string {
 	inventoryInfo := ""
 	for _, item := range inventory {
-		inventoryInfo += fmt.Sprintf("💼 背包物品: %s\n", item.ItemName) + "\n" +
+		inventoryInfo += fmt.Sprintf("💼 背包物品: %s（#%d）\n", item.ItemName, item.ID) + "\n" +
 			fmt.Sprintf("🔍 物品数量: %d\n", item.Quantity) + "\n" +
 			fmt.Sprintf("🎯 物品类型: %s\n", item.ItemType) + "\n" +
 			fmt.Sprintf("🔮 物品品质: %s\n", item.Quality) + "\n" +
 			fmt.Sprintf("🔍 物品等级: %d\n", item.Level) + "\n" +
-			fmt.Sprintf("🔍 物品属性: %s\n", item.Properties) + "\n" +
+			fmt.Sprintf("🔍 物品属性: %s\n", item.Properties.String()) + "\n" +
 			fmt.Sprintf("📝 物品描述: %s\n", item.Description)
 		inventoryInfo += "\n"
 	}
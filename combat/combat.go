@@ -0,0 +1,278 @@
+package combat
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+const (
+	maxRounds      = 30   // 最多回合数，超过后按剩余气血比例判定胜负
+	lowHPRatio     = 0.3  // 气血低于该比例时优先服用丹药
+	criticalDamage = 1.5  // 暴击伤害倍率
+	defenseFactor  = 0.5  // 防御抵消伤害的比例
+	minChance      = 0.05 // 闪避、暴击的最低概率
+	maxChance      = 0.4  // 闪避、暴击的最高概率
+)
+
+// 战斗经验，由引擎按敌人属性和等级计算，不由GM设定
+const (
+	MaxEnemyTier  = 8   // 敌人等级上限，1炼气到8大乘
+	expPerPower   = 0.5 // 每点敌人战力折合的修炼经验
+	baseTierExp   = 120 // 1级敌人最多给予的修炼经验
+	tierExpGrowth = 3   // 敌人每高一级，经验上限的倍数
+)
+
+// 行动类型
+const (
+	ActionAttack = "attack"
+	ActionSkill  = "skill"
+	ActionItem   = "item"
+)
+
+// Enemy GM设定的敌人
+type Enemy struct {
+	Name        string   `json:"name"`
+	Realm       string   `json:"realm"`
+	HP          int      `json:"hp"`
+	Attack      int      `json:"attack"`
+	Defense     int      `json:"defense"`
+	Speed       int      `json:"speed"`
+	SpiritSense int      `json:"spirit_sense"`
+	Skills      []*Skill `json:"skills"`
+}
+
+// Validate 检查GM给出的敌人设定是否合法
+func (e *Enemy) Validate() error {
+	if strings.TrimSpace(e.Name) == "" {
+		return fmt.Errorf("敌人缺少名称")
+	}
+	if e.HP <= 0 {
+		return fmt.Errorf("敌人「%s」的气血必须大于0", e.Name)
+	}
+	if e.Attack < 0 || e.Defense < 0 || e.Speed < 0 || e.SpiritSense < 0 {
+		return fmt.Errorf("敌人「%s」的属性不能为负数", e.Name)
+	}
+	for _, skill := range e.Skills {
+		if skill == nil {
+			continue
+		}
+		if strings.TrimSpace(skill.Name) == "" {
+			return fmt.Errorf("敌人「%s」的神通缺少名称", e.Name)
+		}
+		if skill.Power < 0 {
+			return fmt.Errorf("敌人「%s」的神通「%s」威力不能为负数", e.Name, skill.Name)
+		}
+	}
+	return nil
+}
+
+// Experience 击败敌人获得的修炼经验，按敌人的气血和各项属性折算，并限制在敌人等级对应的上限内
+func (e *Enemy) Experience(tier int) int64 {
+	tier = min(max(tier, 1), MaxEnemyTier)
+	limit := int64(baseTierExp)
+	for range tier - 1 {
+		limit *= tierExpGrowth
+	}
+	power := float64(e.HP)/10 + float64(e.Attack+e.Defense+e.Speed+e.SpiritSense)
+	return min(max(int64(power*expPerPower), 1), limit)
+}
+
+// Combatant 把敌人设定转换为参战者，跳过空的神通
+func (e *Enemy) Combatant() *Combatant {
+	hp := max(e.HP, 1)
+	skills := make([]*Skill, 0, len(e.Skills))
+	for _, skill := range e.Skills {
+		if skill == nil {
+			continue
+		}
+		if skill.Cooldown <= 0 {
+			skill.Cooldown = 3
+		}
+		skills = append(skills, skill)
+	}
+	return &Combatant{
+		Name:        e.Name,
+		MaxHP:       hp,
+		HP:          hp,
+		Attack:      e.Attack,
+		Defense:     e.Defense,
+		Speed:       e.Speed,
+		SpiritSense: e.SpiritSense,
+		Skills:      skills,
+	}
+}
+
+// Round 一次行动的记录
+type Round struct {
+	Round    int    `json:"round"`
+	Actor    string `json:"actor"`
+	Target   string `json:"target"`
+	Action   string `json:"action"`
+	Name     string `json:"name,omitempty"` // 神通或丹药名称
+	Damage   int    `json:"damage,omitempty"`
+	Heal     int    `json:"heal,omitempty"`
+	Critical bool   `json:"critical,omitempty"`
+	Dodged   bool   `json:"dodged,omitempty"`
+	ActorHP  int    `json:"actor_hp"`
+	TargetHP int    `json:"target_hp"`
+}
+
+// String 战斗日志中的一行
+func (r *Round) String() string {
+	switch r.Action {
+	case ActionItem:
+		return fmt.Sprintf("第%d回合：%s服用「%s」，恢复%d点气血（%d）", r.Round, r.Actor, r.Name, r.Heal, r.ActorHP)
+	}
+	move := "攻击"
+	if r.Action == ActionSkill {
+		move = fmt.Sprintf("施展「%s」攻击", r.Name)
+	}
+	if r.Dodged {
+		return fmt.Sprintf("第%d回合：%s%s%s，被闪避", r.Round, r.Actor, move, r.Target)
+	}
+	critical := ""
+	if r.Critical {
+		critical = "（暴击）"
+	}
+	return fmt.Sprintf("第%d回合：%s%s%s，造成%d点伤害%s（%s剩余气血%d）", r.Round, r.Actor, move, r.Target, r.Damage, critical, r.Target, r.TargetHP)
+}
+
+// Result 战斗结果
+type Result struct {
+	Winner   string     `json:"winner"`
+	Loser    string     `json:"loser"`
+	AWon     bool       `json:"a_won"`     // 先手方（a）是否获胜
+	TimedOut bool       `json:"timed_out"` // 回合耗尽，按剩余气血比例判定
+	Rounds   []*Round   `json:"rounds"`
+	A        *Combatant `json:"a"`
+	B        *Combatant `json:"b"`
+}
+
+// Log 完整的战斗日志
+func (r *Result) Log() string {
+	var sb strings.Builder
+	for _, round := range r.Rounds {
+		sb.WriteString(round.String())
+		sb.WriteString("\n")
+	}
+	ending := fmt.Sprintf("%s击败了%s", r.Winner, r.Loser)
+	if r.TimedOut {
+		ending = fmt.Sprintf("%d回合内未分胜负，%s气血占优，判定获胜", maxRounds, r.Winner)
+	}
+	sb.WriteString(fmt.Sprintf("战斗结束：%s。%s 气血 %d/%d，%s 气血 %d/%d", ending, r.A.Name, r.A.HP, r.A.MaxHP, r.B.Name, r.B.HP, r.B.MaxHP))
+	return sb.String()
+}
+
+// Simulate 模拟 a 与 b 之间的回合制战斗，速度高者先手
+func Simulate(a *Combatant, b *Combatant, rng *rand.Rand) *Result {
+	result := &Result{A: a, B: b}
+	for _, combatant := range []*Combatant{a, b} {
+		if combatant.Used == nil {
+			combatant.Used = make(map[string]int)
+		}
+	}
+
+	order := []*Combatant{a, b}
+	if b.Speed > a.Speed {
+		order = []*Combatant{b, a}
+	}
+
+	for round := 1; round <= maxRounds && a.HP > 0 && b.HP > 0; round++ {
+		for i, actor := range order {
+			target := order[1-i]
+			if actor.HP <= 0 || target.HP <= 0 {
+				break
+			}
+			result.Rounds = append(result.Rounds, act(round, actor, target, rng))
+		}
+	}
+
+	winner, loser := a, b
+	switch {
+	case a.HP <= 0:
+		winner, loser = b, a
+	case b.HP <= 0:
+	default:
+		result.TimedOut = true
+		if float64(b.HP)/float64(b.MaxHP) > float64(a.HP)/float64(a.MaxHP) {
+			winner, loser = b, a
+		}
+	}
+	result.Winner = winner.Name
+	result.Loser = loser.Name
+	result.AWon = winner == a
+	return result
+}
+
+// act 参战者的一次行动：气血不足时服药，否则优先施展威力最大的可用神通
+func act(round int, actor *Combatant, target *Combatant, rng *rand.Rand) *Round {
+	record := &Round{Round: round, Actor: actor.Name, Target: target.Name, Action: ActionAttack}
+
+	if float64(actor.HP) < float64(actor.MaxHP)*lowHPRatio {
+		if consumable := actor.nextConsumable(); consumable != nil {
+			consumable.Quantity--
+			actor.Used[consumable.Name]++
+			heal := min(actor.MaxHP*consumable.Heal/100, actor.MaxHP-actor.HP)
+			actor.HP += heal
+			record.Action = ActionItem
+			record.Name = consumable.Name
+			record.Heal = heal
+			record.ActorHP = actor.HP
+			record.TargetHP = target.HP
+			return record
+		}
+	}
+
+	power := 0.0
+	if skill := actor.readySkill(round); skill != nil {
+		skill.ready = round + skill.Cooldown
+		power = skill.Power
+		record.Action = ActionSkill
+		record.Name = skill.Name
+	}
+
+	if rng.Float64() < chance(target.Speed, actor.Speed) {
+		record.Dodged = true
+	} else {
+		damage := float64(actor.Attack)*(1+power)*(0.9+rng.Float64()*0.2) - float64(target.Defense)*defenseFactor
+		if rng.Float64() < chance(actor.SpiritSense, target.SpiritSense) {
+			record.Critical = true
+			damage *= criticalDamage
+		}
+		record.Damage = max(int(damage), 1)
+		target.HP = max(target.HP-record.Damage, 0)
+	}
+	record.ActorHP = actor.HP
+	record.TargetHP = target.HP
+	return record
+}
+
+// chance 根据双方属性差计算闪避或暴击概率
+func chance(mine int, theirs int) float64 {
+	total := float64(max(mine, 0) + max(theirs, 0) + 1)
+	p := minChance + float64(mine-theirs)/total*maxChance
+	return min(max(p, minChance), maxChance)
+}
+
+func (c *Combatant) nextConsumable() *Consumable {
+	for _, consumable := range c.Consumables {
+		if consumable.Quantity > 0 {
+			return consumable
+		}
+	}
+	return nil
+}
+
+func (c *Combatant) readySkill(round int) *Skill {
+	var best *Skill
+	for _, skill := range c.Skills {
+		if skill.ready > round {
+			continue
+		}
+		if best == nil || skill.Power > best.Power {
+			best = skill
+		}
+	}
+	return best
+}
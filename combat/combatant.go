@@ -0,0 +1,121 @@
+package combat
+
+import (
+	"slices"
+	"strings"
+
+	"jiangfengwhu/nagi-bot-go/database"
+)
+
+// combatTechniqueTypes 可在战斗中施展的功法类型
+var combatTechniqueTypes = []string{"combat", "战斗", "攻击", "神通", "秘术"}
+
+// consumableItemTypes 可在战斗中服用的物品类型
+var consumableItemTypes = []string{"丹药", "pill", "灵药"}
+
+// qualityPower 功法品质对威力的加成
+var qualityPower = map[string]float64{
+	"低阶": 0.1, "黄阶": 0.1, "mortal": 0.1,
+	"中阶": 0.2, "玄阶": 0.2, "spiritual": 0.2,
+	"高阶": 0.35, "地阶": 0.35, "earth": 0.35,
+	"天阶": 0.5, "heaven": 0.5,
+	"仙阶": 0.8, "immortal": 0.8,
+}
+
+// defaultHeal 未设定效果的丹药恢复气血的百分比
+const defaultHeal = 30
+
+// Skill 战斗中可施展的神通
+type Skill struct {
+	Name     string  `json:"name"`
+	Power    float64 `json:"power"`    // 伤害加成倍率，0.5 表示额外造成 50% 伤害
+	Cooldown int     `json:"cooldown"` // 冷却回合数
+
+	ready int // 下一次可施展的回合
+}
+
+// Consumable 战斗中可服用的丹药
+type Consumable struct {
+	Name     string `json:"name"`
+	Heal     int    `json:"heal"` // 恢复气血的百分比
+	Quantity int    `json:"quantity"`
+}
+
+// Combatant 参战者
+type Combatant struct {
+	Name        string        `json:"name"`
+	MaxHP       int           `json:"max_hp"`
+	HP          int           `json:"hp"`
+	Attack      int           `json:"attack"`
+	Defense     int           `json:"defense"`
+	Speed       int           `json:"speed"`
+	SpiritSense int           `json:"spirit_sense"`
+	Skills      []*Skill      `json:"skills"`
+	Consumables []*Consumable `json:"consumables"`
+
+	// Used 战斗中消耗的物品，物品名 -> 数量
+	Used map[string]int `json:"used,omitempty"`
+}
+
+// NewCharacterCombatant 根据角色属性、功法和背包构造参战者
+func NewCharacterCombatant(stats *database.CharacterStats, techniques []*database.CultivationTechnique, inventory []*database.InventoryItem) *Combatant {
+	combatant := &Combatant{
+		Name:        stats.Name,
+		MaxHP:       characterMaxHP(stats),
+		Attack:      stats.Attack,
+		Defense:     stats.Defense,
+		Speed:       stats.Speed,
+		SpiritSense: stats.SpiritSense,
+	}
+	combatant.HP = combatant.MaxHP
+
+	for _, technique := range techniques {
+		if !slices.Contains(combatTechniqueTypes, technique.TechniqueType) {
+			continue
+		}
+		combatant.Skills = append(combatant.Skills, &Skill{
+			Name:     technique.TechniqueName,
+			Power:    0.3 + 0.1*float64(technique.TechniqueLevel) + qualityPower[technique.Quality],
+			Cooldown: 3,
+		})
+	}
+
+	for _, item := range inventory {
+		if item.Quantity <= 0 || !isConsumable(item) {
+			continue
+		}
+		combatant.Consumables = append(combatant.Consumables, &Consumable{
+			Name:     item.ItemName,
+			Heal:     itemHeal(item),
+			Quantity: item.Quantity,
+		})
+	}
+
+	return combatant
+}
+
+// characterMaxHP 气血上限，由根骨和境界决定
+func characterMaxHP(stats *database.CharacterStats) int {
+	return 100 + stats.Physique*10 + stats.RealmLevel*20
+}
+
+// isConsumable 有恢复气血效果的物品，或未设定效果的丹药类物品可在战斗中服用
+func isConsumable(item *database.InventoryItem) bool {
+	if item.Properties != nil && item.Properties.Effect != nil {
+		return item.Properties.Effect.Heal > 0
+	}
+	for _, itemType := range consumableItemTypes {
+		if strings.Contains(item.ItemType, itemType) {
+			return true
+		}
+	}
+	return false
+}
+
+// itemHeal 物品恢复气血的百分比，未设定时按默认值
+func itemHeal(item *database.InventoryItem) int {
+	if item.Properties != nil && item.Properties.Effect != nil && item.Properties.Effect.Heal > 0 {
+		return item.Properties.Effect.Heal
+	}
+	return defaultHeal
+}
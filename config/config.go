@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"time"
 )
 
 // Config 配置结构体
@@ -24,9 +26,81 @@ type Config struct {
 		BaseURL             string `json:"base_url"`
 		GoogleSearchAPIKeys string `json:"google_search_api_keys"`
 	} `json:"llm"`
+	Game struct {
+		MaxCharacterSlots    int            `json:"max_character_slots"`   // 每个用户最多可拥有的角色数
+		ReincarnationInherit float64        `json:"reincarnation_inherit"` // 转世时继承前世属性的比例 (0-1)
+		MaxRetreatHours      int            `json:"max_retreat_hours"`     // 单次闭关的最长时间（小时）
+		DuelCooldownMinutes  int            `json:"duel_cooldown_minutes"` // 两次切磋之间的冷却时间（分钟）
+		InventoryCapacity    int            `json:"inventory_capacity"`    // 未装备储物袋时的基础背包容量（格）
+		LootQualityWeights   map[string]int `json:"loot_quality_weights"`  // 掉落表中各品质物品的默认权重
+		LootLuckFactor       float64        `json:"loot_luck_factor"`      // 每点幸运值对高品质物品权重的提升比例
+	} `json:"game"`
+	Pricing struct {
+		ExchangeRate  float64               `json:"exchange_rate"`  // 每美元折合的灵石
+		Models        map[string]ModelPrice `json:"models"`         // 各模型的价格
+		Default       ModelPrice            `json:"default"`        // 未列出的模型的价格
+		Discount      float64               `json:"discount"`       // 促销折扣，如 0.8 表示八折，不填为不打折
+		DiscountStart time.Time             `json:"discount_start"` // 促销开始时间，不填为立即开始
+		DiscountEnd   time.Time             `json:"discount_end"`   // 促销结束时间，不填为一直有效
+	} `json:"pricing"`
+	Spending struct {
+		MaxDailyLimit       int64 `json:"max_daily_limit"`       // 每日消耗灵石上限，玩家只能在此范围内调低
+		MaxTurnLimit        int64 `json:"max_turn_limit"`        // 单轮对话消耗灵石上限，玩家只能在此范围内调低
+		LowBalanceThreshold int64 `json:"low_balance_threshold"` // 灵石余额低于此值时提醒玩家充值
+		EstimatedCallCost   int64 `json:"estimated_call_cost"`   // 预估单次模型调用消耗的灵石，剩余额度不够一次调用时不再调用
+	} `json:"spending"`
+	Access struct {
+		StartingGrant *int64  `json:"starting_grant"` // 新用户赠送的灵石，不填为 100000，填 0 表示不赠送
+		InviteOnly    bool    `json:"invite_only"`    // 仅邀请模式，只有邀请名单中的用户和管理员可以创建账号
+		Allowlist     []int64 `json:"allowlist"`      // 邀请名单（Telegram ID），也可以用 /admin allow 添加
+	} `json:"access"`
+	Abuse struct {
+		InjectionPatterns   []string `json:"injection_patterns"`    // 疑似提示注入的正则表达式
+		RepeatWindowMinutes int      `json:"repeat_window_minutes"` // 统计重复发言的时间窗口（分钟）
+		RepeatLimit         int      `json:"repeat_limit"`          // 时间窗口内相同发言达到此条数视为刷屏
+		RepeatMinRunes      int      `json:"repeat_min_runes"`      // 发言达到此字数才统计重复，“继续”等短句不算刷屏
+		StrikeWindowMinutes int      `json:"strike_window_minutes"` // 统计违规次数的时间窗口（分钟）
+		MaxStrikes          int      `json:"max_strikes"`           // 时间窗口内违规达到此次数自动临时封禁
+		BanMinutes          int      `json:"ban_minutes"`           // 自动临时封禁的时长（分钟）
+	} `json:"abuse"`
+	RateLimit struct {
+		Chat     RateRule `json:"chat"`     // 与天道对话
+		Upload   RateRule `json:"upload"`   // 上传图片、语音和文件
+		Register RateRule `json:"register"` // 创建角色和转世
+		Command  RateRule `json:"command"`  // 其他命令和按钮
+	} `json:"rate_limit"`
+	Broadcast struct {
+		MessagesPerSecond int `json:"messages_per_second"` // 发送公告的速度（条/秒），Telegram 限制每秒约 30 条
+	} `json:"broadcast"`
+	Payment struct {
+		StarPackages []StarPackage `json:"star_packages"` // 使用 Telegram Stars 购买灵石的套餐
+	} `json:"payment"`
 	Prompts map[string]string `json:"prompts"`
 }
 
+// ModelPrice 模型每百万 token 的价格（美元），按 token 类别区分
+type ModelPrice struct {
+	Input    float64 `json:"input"`    // 输入（不含缓存命中）
+	Output   float64 `json:"output"`   // 文本输出
+	Thinking float64 `json:"thinking"` // 思考
+	Cached   float64 `json:"cached"`   // 缓存命中的输入
+	Image    float64 `json:"image"`    // 图片输出
+}
+
+// RateRule 令牌桶限流规则，允许连续发起 Burst 次，之后每分钟恢复 PerMinute 次
+type RateRule struct {
+	Burst     int     `json:"burst"`
+	PerMinute float64 `json:"per_minute"`
+}
+
+// StarPackage 使用 Telegram Stars 购买灵石的套餐
+type StarPackage struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Stars  int    `json:"stars"`  // 价格（Telegram Stars）
+	Amount int64  `json:"amount"` // 获得的灵石
+}
+
 // Load 从配置文件加载配置
 func Load(filename string) (*Config, error) {
 	file, err := os.Open(filename)
@@ -76,6 +150,149 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("请在配置文件中设置数据库连接 URL")
 	}
 
+	// 验证游戏配置
+	if c.Game.MaxCharacterSlots <= 0 {
+		c.Game.MaxCharacterSlots = 3
+	}
+	if c.Game.ReincarnationInherit < 0 || c.Game.ReincarnationInherit > 1 {
+		return fmt.Errorf("reincarnation_inherit 必须在0到1之间")
+	}
+	if c.Game.ReincarnationInherit == 0 {
+		c.Game.ReincarnationInherit = 0.1
+	}
+	if c.Game.MaxRetreatHours <= 0 {
+		c.Game.MaxRetreatHours = 72
+	}
+	if c.Game.DuelCooldownMinutes <= 0 {
+		c.Game.DuelCooldownMinutes = 30
+	}
+	if c.Game.InventoryCapacity <= 0 {
+		c.Game.InventoryCapacity = 50
+	}
+	if len(c.Game.LootQualityWeights) == 0 {
+		c.Game.LootQualityWeights = map[string]int{"普通": 100, "高级": 40, "稀有": 15, "史诗": 5, "传说": 1}
+	}
+	if c.Game.LootLuckFactor <= 0 {
+		c.Game.LootLuckFactor = 0.01
+	}
+
+	// 验证计价配置
+	if c.Pricing.ExchangeRate <= 0 {
+		c.Pricing.ExchangeRate = 1000000
+	}
+	if len(c.Pricing.Models) == 0 {
+		c.Pricing.Models = map[string]ModelPrice{
+			"gemini-2.5-flash":                          {Input: 0.3, Output: 2.5, Thinking: 2.5, Cached: 0.075},
+			"gemini-2.0-flash-preview-image-generation": {Input: 0.1, Output: 0.4, Image: 30},
+		}
+	}
+	if c.Pricing.Default == (ModelPrice{}) {
+		c.Pricing.Default = ModelPrice{Input: 0.3, Output: 2.5, Thinking: 2.5, Cached: 0.075, Image: 30}
+	}
+	if c.Pricing.Discount < 0 || c.Pricing.Discount > 1 {
+		return fmt.Errorf("discount 必须在0到1之间")
+	}
+
+	// 验证消耗限制配置
+	if c.Spending.MaxDailyLimit <= 0 {
+		c.Spending.MaxDailyLimit = 1000000
+	}
+	if c.Spending.MaxTurnLimit <= 0 {
+		c.Spending.MaxTurnLimit = 100000
+	}
+	if c.Spending.LowBalanceThreshold <= 0 {
+		c.Spending.LowBalanceThreshold = 50000
+	}
+	if c.Spending.EstimatedCallCost <= 0 {
+		c.Spending.EstimatedCallCost = 5000
+	}
+
+	// 验证访问控制配置
+	if c.Access.StartingGrant == nil {
+		grant := int64(100000)
+		c.Access.StartingGrant = &grant
+	}
+	if *c.Access.StartingGrant < 0 {
+		return fmt.Errorf("starting_grant 不能为负数")
+	}
+
+	// 验证防滥用配置
+	if len(c.Abuse.InjectionPatterns) == 0 {
+		c.Abuse.InjectionPatterns = []string{
+			`(?i)ignore\s+(all\s+)?(previous|above|prior)\s+(instructions|prompts)`,
+			`(?i)(reveal|show|print).{0,20}system\s*prompt`,
+			`(?i)developer\s+mode|jailbreak`,
+			`(忽略|无视|忘记)(之前|以上|上面|前面|所有)的?(所有)?(指令|指示|提示|设定|规则)`,
+			`(输出|显示|告诉我|重复).{0,10}(系统提示|提示词|system\s*prompt)`,
+			`^\s*\[\s*(系统|system|天道)\s*\]`,
+		}
+	}
+	for _, pattern := range c.Abuse.InjectionPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("injection_patterns 中的正则表达式 %s 无效: %v", pattern, err)
+		}
+	}
+	if c.Abuse.RepeatWindowMinutes <= 0 {
+		c.Abuse.RepeatWindowMinutes = 10
+	}
+	if c.Abuse.RepeatLimit <= 0 {
+		c.Abuse.RepeatLimit = 3
+	}
+	if c.Abuse.RepeatMinRunes <= 0 {
+		c.Abuse.RepeatMinRunes = 10
+	}
+	if c.Abuse.StrikeWindowMinutes <= 0 {
+		c.Abuse.StrikeWindowMinutes = 60
+	}
+	if c.Abuse.MaxStrikes <= 0 {
+		c.Abuse.MaxStrikes = 3
+	}
+	if c.Abuse.BanMinutes <= 0 {
+		c.Abuse.BanMinutes = 60
+	}
+
+	// 验证限流配置
+	for _, entry := range []struct {
+		rule     *RateRule
+		defaults RateRule
+	}{
+		{&c.RateLimit.Chat, RateRule{Burst: 5, PerMinute: 6}},
+		{&c.RateLimit.Upload, RateRule{Burst: 3, PerMinute: 2}},
+		{&c.RateLimit.Register, RateRule{Burst: 2, PerMinute: 0.2}},
+		{&c.RateLimit.Command, RateRule{Burst: 20, PerMinute: 30}},
+	} {
+		if entry.rule.Burst <= 0 {
+			entry.rule.Burst = entry.defaults.Burst
+		}
+		if entry.rule.PerMinute <= 0 {
+			entry.rule.PerMinute = entry.defaults.PerMinute
+		}
+	}
+
+	// 验证公告配置
+	if c.Broadcast.MessagesPerSecond <= 0 {
+		c.Broadcast.MessagesPerSecond = 20
+	}
+
+	// 验证支付配置
+	if len(c.Payment.StarPackages) == 0 {
+		c.Payment.StarPackages = []StarPackage{
+			{ID: "small", Title: "一袋灵石", Stars: 50, Amount: 500000},
+			{ID: "medium", Title: "一箱灵石", Stars: 250, Amount: 2750000},
+			{ID: "large", Title: "灵石矿脉", Stars: 1000, Amount: 12000000},
+		}
+	}
+	packageIDs := make(map[string]bool)
+	for _, pkg := range c.Payment.StarPackages {
+		if pkg.ID == "" || pkg.Stars <= 0 || pkg.Amount <= 0 {
+			return fmt.Errorf("star_packages 中的套餐必须设置 id，且 stars 和 amount 大于0")
+		}
+		if packageIDs[pkg.ID] {
+			return fmt.Errorf("star_packages 中的套餐 id %s 重复", pkg.ID)
+		}
+		packageIDs[pkg.ID] = true
+	}
+
 	// 验证LLM配置
 	if c.LLM.APIKeys == "" {
 		return fmt.Errorf("请在配置文件中设置LLM API密钥")
@@ -0,0 +1,252 @@
+package crafting
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/database"
+)
+
+const (
+	minSuccessRate       = 5   // 成功率下限
+	maxSuccessRate       = 95  // 成功率上限
+	comprehensionPerRate = 5   // 每多少点悟性增加1%成功率
+	furnaceRatePerTier   = 5   // 丹炉品质每高一阶增加的成功率
+	realmRatePerLevel    = 2   // 境界每高出要求一级增加的成功率
+	perfectRatio         = 0.2 // 掷骰落在成功率前段时产出品质提升一阶
+	flawedRatio          = 0.8 // 掷骰落在成功率后段时产出品质降低一阶
+	defaultMinutes       = 60  // 配方未设定时的炼制时间（分钟）
+)
+
+// realms 大境界，从低到高，炼气和练气两种写法都可以匹配
+var realms = [][]string{
+	{"炼气", "练气"}, {"筑基"}, {"结丹", "金丹"}, {"元婴"}, {"化神"},
+	{"炼虚"}, {"合体"}, {"大乘"},
+	{"真仙"}, {"金仙"}, {"太乙"}, {"大罗"}, {"道祖"},
+}
+
+// furnaceKeywords 各制作类型可用的炉鼎关键字，优先匹配专用炉鼎
+var furnaceKeywords = map[string][]string{
+	database.CraftTypeAlchemy:  {"丹炉", "丹鼎", "药鼎", "药炉"},
+	database.CraftTypeRefining: {"器炉", "器鼎", "炼器炉", "地火"},
+}
+
+// genericFurnaceKeywords 炼丹炼器都可以使用的炉鼎关键字
+var genericFurnaceKeywords = []string{"炉", "鼎"}
+
+// defaultWaste 配方未设定废品时，失败产出的废品
+var defaultWaste = map[string]*database.InventoryItem{
+	database.CraftTypeAlchemy:  {ItemName: "废丹", ItemType: "材料", Quality: "普通", Quantity: 1, Stackable: true, Description: "炼丹失败留下的焦黑丹渣，药力尽失"},
+	database.CraftTypeRefining: {ItemName: "废料", ItemType: "材料", Quality: "普通", Quantity: 1, Stackable: true, Description: "炼器失败留下的残渣，尚可回炉"},
+}
+
+// RequirementError 角色不满足配方要求
+type RequirementError struct {
+	RecipeName string
+	Reason     string
+}
+
+func (e *RequirementError) Error() string {
+	return fmt.Sprintf("无法炼制「%s」：%s", e.RecipeName, e.Reason)
+}
+
+// Normalize 校验配方并补全默认值
+func Normalize(recipe *database.Recipe) error {
+	if recipe.RecipeName == "" {
+		return fmt.Errorf("配方名称不能为空")
+	}
+	if _, ok := database.CraftTypeNames[recipe.CraftType]; !ok {
+		recipe.CraftType = database.CraftTypeAlchemy
+	}
+	if len(recipe.Ingredients) == 0 {
+		return fmt.Errorf("配方「%s」缺少材料", recipe.RecipeName)
+	}
+	for _, ingredient := range recipe.Ingredients {
+		if ingredient.ItemName == "" || ingredient.Quantity <= 0 {
+			return fmt.Errorf("配方「%s」的材料无效", recipe.RecipeName)
+		}
+	}
+	if recipe.Output == nil || recipe.Output.ItemName == "" {
+		return fmt.Errorf("配方「%s」缺少产出物品", recipe.RecipeName)
+	}
+	recipe.Output.Quantity = max(recipe.Output.Quantity, 1)
+	recipe.SuccessRate = min(max(recipe.SuccessRate, 0), 100)
+	if recipe.Minutes <= 0 {
+		recipe.Minutes = defaultMinutes
+	}
+	return nil
+}
+
+// Start 检查配方要求，选用背包中最好的炉鼎并开始炼制，材料在同一事务中扣除
+// 不满足要求时返回 RequirementError，材料不足时返回 InsufficientItemError
+func Start(ctx context.Context, db *database.DB, player *database.CharacterStats, recipe *database.Recipe) (*database.Craft, error) {
+	techniques, err := db.GetCharacterCultivationTechniques(ctx, player.ID)
+	if err != nil {
+		return nil, fmt.Errorf("获取功法失败: %v", err)
+	}
+	if reason := Unmet(player, techniques, recipe); reason != "" {
+		return nil, &RequirementError{RecipeName: recipe.RecipeName, Reason: reason}
+	}
+	inventory, err := db.GetCharacterInventory(ctx, player.ID)
+	if err != nil {
+		return nil, fmt.Errorf("获取背包物品失败: %v", err)
+	}
+	furnace := PickFurnace(inventory, recipe.CraftType)
+
+	now := time.Now()
+	craft := &database.Craft{
+		CharacterID: player.ID,
+		RecipeName:  recipe.RecipeName,
+		Recipe:      recipe,
+		SuccessRate: SuccessRate(player, recipe, furnace),
+		StartedAt:   now,
+		EndsAt:      now.Add(time.Duration(max(recipe.Minutes, 1)) * time.Minute),
+	}
+	if furnace != nil {
+		craft.FurnaceName = furnace.ItemName
+	}
+	if err := db.StartCraft(ctx, craft); err != nil {
+		return nil, err
+	}
+	return craft, nil
+}
+
+// FormatStart 开始炼制的说明
+func FormatStart(craft *database.Craft) string {
+	furnace := "没有炉鼎"
+	if craft.FurnaceName != "" {
+		furnace = "使用「" + craft.FurnaceName + "」"
+	}
+	return fmt.Sprintf("开始%s「%s」，%s，成功率%d%%，材料已投入，预计 %s 出炉",
+		database.CraftTypeNames[craft.Recipe.CraftType], craft.RecipeName, furnace, craft.SuccessRate, craft.EndsAt.Format("2006-01-02 15:04"))
+}
+
+// RealmRank 大境界的序号，无法识别时返回 -1
+func RealmRank(realm string) int {
+	for rank, names := range realms {
+		for _, name := range names {
+			if strings.Contains(realm, name) {
+				return rank
+			}
+		}
+	}
+	return -1
+}
+
+// Unmet 检查角色是否满足配方的功法和境界要求，满足时返回空字符串
+func Unmet(player *database.CharacterStats, techniques []*database.CultivationTechnique, recipe *database.Recipe) string {
+	if recipe.RequiredTechnique != "" && !slices.ContainsFunc(techniques, func(t *database.CultivationTechnique) bool {
+		return t.TechniqueName == recipe.RequiredTechnique
+	}) {
+		return fmt.Sprintf("需要掌握功法《%s》", recipe.RequiredTechnique)
+	}
+	if realmGap(player, recipe) < 0 {
+		return fmt.Sprintf("需要达到%s%d层", recipe.RequiredRealm, recipe.RequiredRealmLevel)
+	}
+	return ""
+}
+
+// realmGap 角色境界高出配方要求的等级数，大境界高出时视为高出一个完整的大境界
+func realmGap(player *database.CharacterStats, recipe *database.Recipe) int {
+	if recipe.RequiredRealm == "" {
+		return 0
+	}
+	required, current := RealmRank(recipe.RequiredRealm), RealmRank(player.Realm)
+	if required < 0 {
+		return 0
+	}
+	if current != required {
+		return (current - required) * 10
+	}
+	return player.RealmLevel - recipe.RequiredRealmLevel
+}
+
+// PickFurnace 从背包中选出品质最高的炉鼎，没有时返回 nil
+func PickFurnace(inventory []*database.InventoryItem, craftType string) *database.InventoryItem {
+	for _, keywords := range [][]string{furnaceKeywords[craftType], genericFurnaceKeywords} {
+		var best *database.InventoryItem
+		for _, item := range inventory {
+			if !containsAny(item.ItemName+item.ItemType, keywords) {
+				continue
+			}
+			if best == nil || database.QualityTier(item.Quality) > database.QualityTier(best.Quality) {
+				best = item
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+// SuccessRate 计算炼制成功率：配方基础成功率，加上悟性、炉鼎品质和境界的加成
+func SuccessRate(player *database.CharacterStats, recipe *database.Recipe, furnace *database.InventoryItem) int {
+	rate := recipe.SuccessRate + max(player.Comprehension, 0)/comprehensionPerRate
+	if furnace != nil {
+		rate += (database.QualityTier(furnace.Quality) + 1) * furnaceRatePerTier
+	}
+	rate += min(max(realmGap(player, recipe), 0), 10) * realmRatePerLevel
+	return min(max(rate, minSuccessRate), maxSuccessRate)
+}
+
+// Roll 掷骰决定炼制结果，成功时按掷骰结果调整产出品质，失败时产出废品
+func Roll(recipe *database.Recipe, rate int, rng *rand.Rand) (*database.InventoryItem, bool) {
+	roll := rng.IntN(100)
+	if roll >= rate {
+		waste := recipe.Waste
+		if waste == nil {
+			waste = defaultWaste[recipe.CraftType]
+		}
+		result := *waste
+		result.ID = 0
+		result.Quantity = max(result.Quantity, 1)
+		result.ObtainedFrom = "craft"
+		return &result, false
+	}
+
+	result := *recipe.Output
+	result.ID = 0
+	result.Quantity = max(result.Quantity, 1)
+	result.ObtainedFrom = "craft"
+	if tier := database.QualityTier(result.Quality); tier >= 0 {
+		switch {
+		case float64(roll) < float64(rate)*perfectRatio:
+			result.Quality = database.ItemQualities[min(tier+1, len(database.ItemQualities)-1)]
+		case float64(roll) >= float64(rate)*flawedRatio:
+			result.Quality = database.ItemQualities[max(tier-1, 0)]
+		}
+	}
+	return &result, true
+}
+
+// FormatRecipe 配方的简要说明
+func FormatRecipe(recipe *database.Recipe) string {
+	ingredients := []string{}
+	for _, ingredient := range recipe.Ingredients {
+		ingredients = append(ingredients, fmt.Sprintf("%s x%d", ingredient.ItemName, ingredient.Quantity))
+	}
+	text := fmt.Sprintf("【%s】%s，产出%s x%d（%s），材料：%s，基础成功率%d%%，耗时%d分钟",
+		database.CraftTypeNames[recipe.CraftType], recipe.RecipeName, recipe.Output.ItemName, max(recipe.Output.Quantity, 1), recipe.Output.Quality,
+		strings.Join(ingredients, "、"), recipe.SuccessRate, recipe.Minutes)
+	if recipe.RequiredTechnique != "" {
+		text += fmt.Sprintf("，需功法《%s》", recipe.RequiredTechnique)
+	}
+	if recipe.RequiredRealm != "" {
+		text += fmt.Sprintf("，需%s%d层", recipe.RequiredRealm, recipe.RequiredRealmLevel)
+	}
+	return text
+}
+
+func containsAny(text string, keywords []string) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// 违规类型
+const (
+	AbuseKindInjection = "injection" // 疑似提示注入
+	AbuseKindSpam      = "spam"      // 短时间内重复发言
+)
+
+// AllowlistEntry 邀请名单中的一项，按 Telegram ID 或用户名匹配
+type AllowlistEntry struct {
+	ID        int       `json:"id"`
+	TgID      int64     `json:"tg_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	AddedBy   int64     `json:"added_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddAbuseStrike 记录一次违规，返回 since 之后（含本次）的违规次数
+func (db *DB) AddAbuseStrike(ctx context.Context, userID int, kind string, content string, since time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO abuse_strikes (user_id, kind, content, created_at) VALUES ($1, $2, $3, $4)`, userID, kind, content, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	var strikes int
+	err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM abuse_strikes WHERE user_id = $1 AND created_at >= $2`, userID, since).Scan(&strikes)
+	if err != nil {
+		return 0, err
+	}
+
+	return strikes, tx.Commit(ctx)
+}
+
+// CountRepeatedMessages 统计用户 since 之后发送的与 text 相同的发言条数
+func (db *DB) CountRepeatedMessages(ctx context.Context, userID int, text string, since time.Time) (int, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT COUNT(*)
+		FROM messages
+		WHERE user_id = $1 AND role = 'user' AND created_at >= $2 AND content @> jsonb_build_array(jsonb_build_object('text', $3::text))
+	`
+	var count int
+	err := db.GetPool().QueryRow(timeoutCtx, query, userID, since, text).Scan(&count)
+	return count, err
+}
+
+// AddAllowlistEntry 把 Telegram ID 或用户名加入邀请名单，已存在时忽略
+func (db *DB) AddAllowlistEntry(ctx context.Context, tgID int64, username string, addedBy int64) error {
+	query := `
+		INSERT INTO allowlist (tg_id, username, added_by, created_at)
+		VALUES (NULLIF($1::bigint, 0), NULLIF($2, ''), $3, $4)
+		ON CONFLICT DO NOTHING
+	`
+	_, err := db.GetPool().Exec(ctx, query, tgID, normalizeUsername(username), addedBy, time.Now())
+	return err
+}
+
+// RemoveAllowlistEntry 从邀请名单中移除 Telegram ID 或用户名，不在名单中时返回 false
+func (db *DB) RemoveAllowlistEntry(ctx context.Context, tgID int64, username string) (bool, error) {
+	query := `DELETE FROM allowlist WHERE tg_id = NULLIF($1::bigint, 0) OR username = NULLIF($2, '')`
+	tag, err := db.GetPool().Exec(ctx, query, tgID, normalizeUsername(username))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetAllowlist 获取邀请名单
+func (db *DB) GetAllowlist(ctx context.Context) ([]*AllowlistEntry, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT id, COALESCE(tg_id, 0), COALESCE(username, ''), added_by, created_at FROM allowlist ORDER BY id`
+	rows, err := db.GetPool().Query(timeoutCtx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*AllowlistEntry
+	for rows.Next() {
+		var entry AllowlistEntry
+		if err := rows.Scan(&entry.ID, &entry.TgID, &entry.Username, &entry.AddedBy, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// IsAllowlisted Telegram ID 或用户名是否在邀请名单中
+func (db *DB) IsAllowlisted(ctx context.Context, tgID int64, username string) (bool, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT EXISTS(SELECT 1 FROM allowlist WHERE tg_id = $1 OR username = NULLIF($2, ''))`
+	var allowed bool
+	err := db.GetPool().QueryRow(timeoutCtx, query, tgID, normalizeUsername(username)).Scan(&allowed)
+	return allowed, err
+}
+
+// normalizeUsername 用户名不区分大小写，去掉开头的 @
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimPrefix(username, "@"))
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// AdminAuditLog 一次管理员操作
+type AdminAuditLog struct {
+	ID             int       `json:"id"`
+	AdminTgID      int64     `json:"admin_tg_id"`
+	Action         string    `json:"action"`
+	TargetUserID   int       `json:"target_user_id,omitempty"` // 0 表示不针对具体用户
+	TargetUsername string    `json:"target_username,omitempty"`
+	Detail         string    `json:"detail"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// AddAdminAuditLog 记录一次管理员操作
+func (db *DB) AddAdminAuditLog(ctx context.Context, log *AdminAuditLog) error {
+	var targetUserID *int
+	if log.TargetUserID != 0 {
+		targetUserID = &log.TargetUserID
+	}
+	log.CreatedAt = time.Now()
+	query := `
+		INSERT INTO admin_audit_logs (admin_tg_id, action, target_user_id, detail, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	return db.GetPool().QueryRow(ctx, query, log.AdminTgID, log.Action, targetUserID, log.Detail, log.CreatedAt).Scan(&log.ID)
+}
+
+// GetAdminAuditLogs 获取最近的管理员操作，targetUserID 不为 0 时只返回针对该用户的操作
+func (db *DB) GetAdminAuditLogs(ctx context.Context, targetUserID int, limit int) ([]*AdminAuditLog, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT l.id, l.admin_tg_id, l.action, COALESCE(l.target_user_id, 0), COALESCE(u.username, ''), l.detail, l.created_at
+		FROM admin_audit_logs l
+		LEFT JOIN users u ON u.id = l.target_user_id
+		WHERE $1 = 0 OR l.target_user_id = $1
+		ORDER BY l.id DESC
+		LIMIT $2
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, targetUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []*AdminAuditLog
+	for rows.Next() {
+		var log AdminAuditLog
+		if err := rows.Scan(&log.ID, &log.AdminTgID, &log.Action, &log.TargetUserID, &log.TargetUsername, &log.Detail, &log.CreatedAt); err != nil {
+			return nil, err
+		}
+		logs = append(logs, &log)
+	}
+	return logs, rows.Err()
+}
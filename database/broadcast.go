@@ -0,0 +1,230 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 公告的发送对象
+const (
+	BroadcastTargetAll      = "all"      // 所有用户
+	BroadcastTargetActive   = "active"   // 最近若干天发过消息的用户
+	BroadcastTargetRealm    = "realm"    // 有指定境界角色的用户
+	BroadcastTargetLocation = "location" // 有角色位于指定地点的用户
+)
+
+// 公告状态
+const (
+	BroadcastStatusDraft     = "draft"     // 等待管理员确认
+	BroadcastStatusScheduled = "scheduled" // 已确认，等待定时发送
+	BroadcastStatusSending   = "sending"
+	BroadcastStatusSent      = "sent"
+	BroadcastStatusCancelled = "cancelled"
+)
+
+// Broadcast 管理员发送给玩家的公告
+type Broadcast struct {
+	ID           int       `json:"id"`
+	CreatedBy    int64     `json:"created_by"` // 创建者的 Telegram ID
+	Target       string    `json:"target"`
+	TargetValue  string    `json:"target_value"` // 活跃天数、境界或地点
+	Text         string    `json:"text"`
+	Status       string    `json:"status"`
+	ScheduledAt  time.Time `json:"scheduled_at,omitzero"` // 零值表示确认后立即发送
+	CursorUserID int       `json:"cursor_user_id"`        // 已经发送到的用户ID，按用户ID顺序发送
+	Sent         int       `json:"sent"`
+	Failed       int       `json:"failed"`
+	Blocked      int       `json:"blocked"` // 屏蔽了机器人的用户数
+	CreatedAt    time.Time `json:"created_at"`
+	StartedAt    time.Time `json:"started_at,omitzero"`
+	FinishedAt   time.Time `json:"finished_at,omitzero"`
+}
+
+const broadcastColumns = `id, created_by, target, target_value, text, status, COALESCE(scheduled_at, 'epoch'::timestamp),
+			cursor_user_id, sent, failed, blocked, created_at, COALESCE(started_at, 'epoch'::timestamp), COALESCE(finished_at, 'epoch'::timestamp)`
+
+func scanBroadcast(row pgx.Row) (*Broadcast, error) {
+	var broadcast Broadcast
+	err := row.Scan(
+		&broadcast.ID, &broadcast.CreatedBy, &broadcast.Target, &broadcast.TargetValue, &broadcast.Text, &broadcast.Status, &broadcast.ScheduledAt,
+		&broadcast.CursorUserID, &broadcast.Sent, &broadcast.Failed, &broadcast.Blocked, &broadcast.CreatedAt, &broadcast.StartedAt, &broadcast.FinishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range []*time.Time{&broadcast.ScheduledAt, &broadcast.StartedAt, &broadcast.FinishedAt} {
+		if t.Unix() == 0 {
+			*t = time.Time{}
+		}
+	}
+	return &broadcast, nil
+}
+
+func (db *DB) queryBroadcasts(ctx context.Context, query string, args ...any) ([]*Broadcast, error) {
+	rows, err := db.GetPool().Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var broadcasts []*Broadcast
+	for rows.Next() {
+		broadcast, err := scanBroadcast(rows)
+		if err != nil {
+			return nil, err
+		}
+		broadcasts = append(broadcasts, broadcast)
+	}
+	return broadcasts, rows.Err()
+}
+
+// CreateBroadcast 创建等待确认的公告
+func (db *DB) CreateBroadcast(ctx context.Context, broadcast *Broadcast) error {
+	var scheduledAt *time.Time
+	if !broadcast.ScheduledAt.IsZero() {
+		scheduledAt = &broadcast.ScheduledAt
+	}
+	broadcast.Status = BroadcastStatusDraft
+	broadcast.CreatedAt = time.Now()
+	query := `
+		INSERT INTO broadcasts (created_by, target, target_value, text, status, scheduled_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	return db.GetPool().QueryRow(ctx, query, broadcast.CreatedBy, broadcast.Target, broadcast.TargetValue, broadcast.Text,
+		broadcast.Status, scheduledAt, broadcast.CreatedAt).Scan(&broadcast.ID)
+}
+
+// GetBroadcast 获取公告，不存在时返回 nil
+func (db *DB) GetBroadcast(ctx context.Context, id int) (*Broadcast, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	broadcast, err := scanBroadcast(db.GetPool().QueryRow(timeoutCtx, `SELECT `+broadcastColumns+` FROM broadcasts WHERE id = $1`, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return broadcast, nil
+}
+
+// GetBroadcasts 获取最近的公告
+func (db *DB) GetBroadcasts(ctx context.Context, limit int) ([]*Broadcast, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return db.queryBroadcasts(timeoutCtx, `SELECT `+broadcastColumns+` FROM broadcasts ORDER BY id DESC LIMIT $1`, limit)
+}
+
+// ConfirmBroadcast 确认发送公告：定时未到的进入等待，否则开始发送
+// 公告不是等待确认的状态时返回 nil
+func (db *DB) ConfirmBroadcast(ctx context.Context, id int) (*Broadcast, error) {
+	query := `
+		UPDATE broadcasts
+		SET status = CASE WHEN scheduled_at > $2 THEN $3 ELSE $4 END,
+			started_at = CASE WHEN scheduled_at > $2 THEN NULL ELSE $2::timestamp END
+		WHERE id = $1 AND status = $5
+		RETURNING ` + broadcastColumns
+	broadcast, err := scanBroadcast(db.GetPool().QueryRow(ctx, query, id, time.Now(), BroadcastStatusScheduled, BroadcastStatusSending, BroadcastStatusDraft))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return broadcast, nil
+}
+
+// StartDueBroadcasts 把定时已到的公告改为发送中，返回所有发送中的公告（包括重启前没有发完的）
+func (db *DB) StartDueBroadcasts(ctx context.Context, now time.Time) ([]*Broadcast, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `UPDATE broadcasts SET status = $2, started_at = $1 WHERE status = $3 AND scheduled_at <= $1`
+	if _, err := db.GetPool().Exec(timeoutCtx, query, now, BroadcastStatusSending, BroadcastStatusScheduled); err != nil {
+		return nil, err
+	}
+	return db.queryBroadcasts(timeoutCtx, `SELECT `+broadcastColumns+` FROM broadcasts WHERE status = $1 ORDER BY id`, BroadcastStatusSending)
+}
+
+// UpdateBroadcastProgress 保存公告的发送进度
+func (db *DB) UpdateBroadcastProgress(ctx context.Context, broadcast *Broadcast) error {
+	query := `UPDATE broadcasts SET cursor_user_id = $2, sent = $3, failed = $4, blocked = $5 WHERE id = $1`
+	_, err := db.GetPool().Exec(ctx, query, broadcast.ID, broadcast.CursorUserID, broadcast.Sent, broadcast.Failed, broadcast.Blocked)
+	return err
+}
+
+// FinishBroadcast 标记公告发送完毕，已被取消的不变
+func (db *DB) FinishBroadcast(ctx context.Context, broadcast *Broadcast) error {
+	broadcast.FinishedAt = time.Now()
+	query := `UPDATE broadcasts SET status = $2, finished_at = $3 WHERE id = $1 AND status = $4`
+	tag, err := db.GetPool().Exec(ctx, query, broadcast.ID, BroadcastStatusSent, broadcast.FinishedAt, BroadcastStatusSending)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		broadcast.Status = BroadcastStatusSent
+	}
+	return nil
+}
+
+// CancelBroadcast 取消尚未发完的公告，已经发完或取消的返回 false
+func (db *DB) CancelBroadcast(ctx context.Context, id int) (bool, error) {
+	query := `
+		UPDATE broadcasts SET status = $2, finished_at = $3
+		WHERE id = $1 AND status IN ($4, $5, $6)
+	`
+	tag, err := db.GetPool().Exec(ctx, query, id, BroadcastStatusCancelled, time.Now(),
+		BroadcastStatusDraft, BroadcastStatusScheduled, BroadcastStatusSending)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetBroadcastStatus 获取公告当前的状态，用于发送过程中检查是否被取消
+func (db *DB) GetBroadcastStatus(ctx context.Context, id int) (string, error) {
+	var status string
+	err := db.GetPool().QueryRow(ctx, `SELECT status FROM broadcasts WHERE id = $1`, id).Scan(&status)
+	return status, err
+}
+
+// GetReachableUsers 获取可以接收公告的用户：没有被封禁也没有屏蔽机器人，按用户ID排序
+// activeSince 不为零值时只返回此后发过消息的用户，userIDs 不为 nil 时只在其中查找，只返回ID大于 afterUserID 的用户
+func (db *DB) GetReachableUsers(ctx context.Context, activeSince time.Time, userIDs []int, afterUserID int) ([]*User, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var since *time.Time
+	if !activeSince.IsZero() {
+		since = &activeSince
+	}
+	query := `
+		SELECT ` + userColumns + `
+		FROM users u
+		WHERE u.id > $1 AND u.blocked_at IS NULL
+			AND (u.banned_at IS NULL OR u.banned_until <= $2)
+			AND ($3::timestamp IS NULL OR EXISTS(SELECT 1 FROM messages m WHERE m.user_id = u.id AND m.role = 'user' AND m.created_at >= $3))
+			AND ($4::int[] IS NULL OR u.id = ANY($4))
+		ORDER BY u.id
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, afterUserID, time.Now(), since, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Buff 使用物品获得的临时增益
+type Buff struct {
+	ID          int            `json:"id"`
+	CharacterID int            `json:"character_id"`
+	Source      string         `json:"source"` // 来源物品
+	Modifiers   *ItemModifiers `json:"modifiers"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+}
+
+// GetActiveBuffs 获取角色尚未过期的增益
+func (db *DB) GetActiveBuffs(ctx context.Context, characterID int) ([]*Buff, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT id, character_id, source, modifiers, expires_at
+		FROM buffs
+		WHERE character_id = $1 AND expires_at > $2
+		ORDER BY expires_at
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buffs []*Buff
+	for rows.Next() {
+		var buff Buff
+		var modifiersJSON []byte
+		if err := rows.Scan(&buff.ID, &buff.CharacterID, &buff.Source, &modifiersJSON, &buff.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(modifiersJSON, &buff.Modifiers); err != nil {
+			return nil, err
+		}
+		buffs = append(buffs, &buff)
+	}
+	return buffs, rows.Err()
+}
+
+func (db *DB) addBuffInTx(ctx context.Context, tx pgx.Tx, buff *Buff) error {
+	modifiersJSON, err := json.Marshal(buff.Modifiers)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO buffs (character_id, source, modifiers, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	return tx.QueryRow(ctx, query, buff.CharacterID, buff.Source, modifiersJSON, buff.ExpiresAt).Scan(&buff.ID)
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// InventoryCapacity 背包容量占用情况
+type InventoryCapacity struct {
+	Used     int `json:"used"`     // 已占用格数
+	Capacity int `json:"capacity"` // 总容量，基础容量加上储物袋容量
+}
+
+// Free 剩余容量，超出时为负数
+func (c *InventoryCapacity) Free() int {
+	return c.Capacity - c.Used
+}
+
+func (c *InventoryCapacity) String() string {
+	return fmt.Sprintf("%d/%d", c.Used, c.Capacity)
+}
+
+// InventoryFullError 放入物品后背包容量不足
+type InventoryFullError struct {
+	Used     int // 放入后的占用格数
+	Capacity int // 背包总容量
+}
+
+func (e *InventoryFullError) Error() string {
+	return fmt.Sprintf("背包容量不足：放入后需占用 %d 格，背包容量 %d 格", e.Used, e.Capacity)
+}
+
+// Weight 单件物品占用的背包格数，未设定时为1
+func (i *InventoryItem) Weight() int {
+	if i.Properties == nil || i.Properties.Weight <= 0 {
+		return 1
+	}
+	return i.Properties.Weight
+}
+
+// inventoryCapacityQuery 统计背包占用格数和已装备储物袋提供的容量
+const inventoryCapacityQuery = `
+	SELECT
+		(SELECT COALESCE(SUM(GREATEST(COALESCE((properties->>'weight')::int, 1), 1) * quantity), 0)
+			FROM inventory WHERE character_id = $1),
+		(SELECT COALESCE(SUM(GREATEST(COALESCE((item->'properties'->>'capacity')::int, 0), 0)), 0)
+			FROM equipment WHERE character_id = $1 AND slot = $2)
+`
+
+// GetInventoryCapacity 获取角色背包容量，baseCapacity 为未装备储物袋时的基础容量
+func (db *DB) GetInventoryCapacity(ctx context.Context, characterID int, baseCapacity int) (*InventoryCapacity, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var capacity InventoryCapacity
+	err := db.GetPool().QueryRow(timeoutCtx, inventoryCapacityQuery, characterID, EquipSlotStorage).Scan(&capacity.Used, &capacity.Capacity)
+	if err != nil {
+		return nil, err
+	}
+	capacity.Capacity += baseCapacity
+	return &capacity, nil
+}
+
+// GetInventoryCapacityInTx 在事务中获取角色背包容量
+func (db *DB) GetInventoryCapacityInTx(ctx context.Context, tx pgx.Tx, characterID int, baseCapacity int) (*InventoryCapacity, error) {
+	var capacity InventoryCapacity
+	err := tx.QueryRow(ctx, inventoryCapacityQuery, characterID, EquipSlotStorage).Scan(&capacity.Used, &capacity.Capacity)
+	if err != nil {
+		return nil, err
+	}
+	capacity.Capacity += baseCapacity
+	return &capacity, nil
+}
+
+// AddInventoryItemsWithCapacityInTx 在事务中增减角色背包物品并检查容量
+// 放入后超出容量且占用比之前更多时返回 InventoryFullError，只减少物品时不受限制
+func (db *DB) AddInventoryItemsWithCapacityInTx(ctx context.Context, tx pgx.Tx, characterID int, items []*InventoryItem, baseCapacity int) (*InventoryCapacity, error) {
+	before, err := db.GetInventoryCapacityInTx(ctx, tx, characterID, baseCapacity)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AddInventoryItemsBatchInTx(ctx, tx, items); err != nil {
+		return nil, err
+	}
+	return db.checkInventoryCapacityInTx(ctx, tx, characterID, before, baseCapacity)
+}
+
+// checkInventoryCapacityInTx 物品变动后检查容量，超出容量且占用比变动前更多时返回 InventoryFullError
+func (db *DB) checkInventoryCapacityInTx(ctx context.Context, tx pgx.Tx, characterID int, before *InventoryCapacity, baseCapacity int) (*InventoryCapacity, error) {
+	after, err := db.GetInventoryCapacityInTx(ctx, tx, characterID, baseCapacity)
+	if err != nil {
+		return nil, err
+	}
+	if after.Used > after.Capacity && after.Used > before.Used {
+		return nil, &InventoryFullError{Used: after.Used, Capacity: after.Capacity}
+	}
+	return after, nil
+}
+
+// 容量超出规则：
+// 玩家主动获得物品（天道发放、掉落、购买、战利品、卸下装备）时检查容量，放不下则本次变动不生效；
+// 已经付出代价的结算（炼制产出、切磋赢得的赌注）不能作废，总是放入背包，即使因此超出容量。
+// 超出容量后，在玩家丢弃物品或装备更大的储物袋之前，任何会增加占用的变动都会被拒绝。
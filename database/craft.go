@@ -0,0 +1,469 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 制作类型
+const (
+	CraftTypeAlchemy  = "alchemy"  // 炼丹
+	CraftTypeRefining = "refining" // 炼器
+)
+
+// CraftTypeNames 制作类型的中文名称
+var CraftTypeNames = map[string]string{
+	CraftTypeAlchemy:  "炼丹",
+	CraftTypeRefining: "炼器",
+}
+
+// 制作状态
+const (
+	CraftStatusOngoing   = "ongoing"
+	CraftStatusSucceeded = "succeeded"
+	CraftStatusFailed    = "failed"
+)
+
+// ErrCraftInProgress 角色已有进行中的制作
+var ErrCraftInProgress = errors.New("已有正在进行的炼制，请等待完成")
+
+// RecipeIngredient 配方所需的一种材料
+type RecipeIngredient struct {
+	ItemName string `json:"item_name"`
+	Quantity int    `json:"quantity"`
+}
+
+// Recipe 丹方或器方，由管理员在配方名录中设定，角色学会后保存一份副本
+type Recipe struct {
+	ID                 int                 `json:"id"`
+	CharacterID        int                 `json:"character_id"`
+	RecipeName         string              `json:"recipe_name"`
+	CraftType          string              `json:"craft_type"`
+	Ingredients        []*RecipeIngredient `json:"ingredients"`
+	Output             *InventoryItem      `json:"output"`                         // 成功时的产出，品质为基础品质
+	Waste              *InventoryItem      `json:"waste,omitempty"`                // 失败时的废品，不填时产出默认废品
+	RequiredTechnique  string              `json:"required_technique,omitempty"`   // 需要掌握的功法
+	RequiredRealm      string              `json:"required_realm,omitempty"`       // 需要达到的境界
+	RequiredRealmLevel int                 `json:"required_realm_level,omitempty"` // 需要达到的境界等级
+	SuccessRate        int                 `json:"success_rate"`                   // 基础成功率 (0-100)
+	Minutes            int                 `json:"minutes"`                        // 炼制所需时间（分钟）
+	LearnedAt          time.Time           `json:"learned_at,omitzero"`
+}
+
+// Craft 一次炼制，材料在开始时扣除，到期后结算产出
+type Craft struct {
+	ID          int            `json:"id"`
+	CharacterID int            `json:"character_id"`
+	TgID        int64          `json:"tg_id"`
+	RecipeName  string         `json:"recipe_name"`
+	Recipe      *Recipe        `json:"recipe"` // 开始炼制时的配方快照
+	FurnaceName string         `json:"furnace_name"`
+	SuccessRate int            `json:"success_rate"`
+	Status      string         `json:"status"`
+	StartedAt   time.Time      `json:"started_at"`
+	EndsAt      time.Time      `json:"ends_at"`
+	FinishedAt  time.Time      `json:"finished_at,omitzero"`
+	Result      *InventoryItem `json:"result,omitempty"` // 炼制产出的物品
+}
+
+const recipeColumns = `id, character_id, recipe_name, craft_type, ingredients, output, waste,
+	required_technique, required_realm, required_realm_level, success_rate, minutes, learned_at`
+
+func scanRecipe(row pgx.Row) (*Recipe, error) {
+	var recipe Recipe
+	var ingredientsJSON, outputJSON, wasteJSON []byte
+	err := row.Scan(
+		&recipe.ID, &recipe.CharacterID, &recipe.RecipeName, &recipe.CraftType, &ingredientsJSON, &outputJSON, &wasteJSON,
+		&recipe.RequiredTechnique, &recipe.RequiredRealm, &recipe.RequiredRealmLevel, &recipe.SuccessRate, &recipe.Minutes, &recipe.LearnedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析材料和产出JSON
+	if err := json.Unmarshal(ingredientsJSON, &recipe.Ingredients); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(outputJSON, &recipe.Output); err != nil {
+		return nil, err
+	}
+	if len(wasteJSON) > 0 {
+		if err := json.Unmarshal(wasteJSON, &recipe.Waste); err != nil {
+			return nil, err
+		}
+	}
+	return &recipe, nil
+}
+
+// LearnRecipe 学习配方，已掌握同名配方时覆盖
+func (db *DB) LearnRecipe(ctx context.Context, recipe *Recipe) error {
+	ingredientsJSON, err := json.Marshal(recipe.Ingredients)
+	if err != nil {
+		return err
+	}
+	outputJSON, err := json.Marshal(recipe.Output)
+	if err != nil {
+		return err
+	}
+	var wasteJSON []byte
+	if recipe.Waste != nil {
+		wasteJSON, err = json.Marshal(recipe.Waste)
+		if err != nil {
+			return err
+		}
+	}
+	if recipe.LearnedAt.IsZero() {
+		recipe.LearnedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO recipes (
+			character_id, recipe_name, craft_type, ingredients, output, waste,
+			required_technique, required_realm, required_realm_level, success_rate, minutes, learned_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (character_id, recipe_name) DO UPDATE SET
+			craft_type = EXCLUDED.craft_type,
+			ingredients = EXCLUDED.ingredients,
+			output = EXCLUDED.output,
+			waste = EXCLUDED.waste,
+			required_technique = EXCLUDED.required_technique,
+			required_realm = EXCLUDED.required_realm,
+			required_realm_level = EXCLUDED.required_realm_level,
+			success_rate = EXCLUDED.success_rate,
+			minutes = EXCLUDED.minutes
+		RETURNING id
+	`
+	return db.GetPool().QueryRow(ctx, query,
+		recipe.CharacterID, recipe.RecipeName, recipe.CraftType, ingredientsJSON, outputJSON, wasteJSON,
+		recipe.RequiredTechnique, recipe.RequiredRealm, recipe.RequiredRealmLevel, recipe.SuccessRate, recipe.Minutes, recipe.LearnedAt,
+	).Scan(&recipe.ID)
+}
+
+// GetRecipe 获取角色掌握的配方，未掌握时返回 nil
+func (db *DB) GetRecipe(ctx context.Context, characterID int, recipeName string) (*Recipe, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + recipeColumns + `
+		FROM recipes
+		WHERE character_id = $1 AND recipe_name = $2
+	`
+	recipe, err := scanRecipe(db.GetPool().QueryRow(timeoutCtx, query, characterID, recipeName))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return recipe, nil
+}
+
+// GetCharacterRecipes 获取角色掌握的全部配方
+func (db *DB) GetCharacterRecipes(ctx context.Context, characterID int) ([]*Recipe, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + recipeColumns + `
+		FROM recipes
+		WHERE character_id = $1
+		ORDER BY craft_type, learned_at
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipes []*Recipe
+	for rows.Next() {
+		recipe, err := scanRecipe(rows)
+		if err != nil {
+			return nil, err
+		}
+		recipes = append(recipes, recipe)
+	}
+
+	return recipes, rows.Err()
+}
+
+// catalogRecipeColumns 配方名录查询字段，与 scanRecipe 的顺序一致，角色ID为0，学习时间为最后修改时间
+const catalogRecipeColumns = `id, 0, recipe_name, craft_type, ingredients, output, waste,
+	required_technique, required_realm, required_realm_level, success_rate, minutes, updated_at`
+
+// SaveCatalogRecipe 保存管理员设定的配方，同名配方会被覆盖，已学会的角色不受影响
+func (db *DB) SaveCatalogRecipe(ctx context.Context, recipe *Recipe) error {
+	ingredientsJSON, err := json.Marshal(recipe.Ingredients)
+	if err != nil {
+		return err
+	}
+	outputJSON, err := json.Marshal(recipe.Output)
+	if err != nil {
+		return err
+	}
+	var wasteJSON []byte
+	if recipe.Waste != nil {
+		wasteJSON, err = json.Marshal(recipe.Waste)
+		if err != nil {
+			return err
+		}
+	}
+	recipe.LearnedAt = time.Now()
+
+	query := `
+		INSERT INTO recipe_catalog (
+			recipe_name, craft_type, ingredients, output, waste,
+			required_technique, required_realm, required_realm_level, success_rate, minutes, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (recipe_name) DO UPDATE SET
+			craft_type = EXCLUDED.craft_type,
+			ingredients = EXCLUDED.ingredients,
+			output = EXCLUDED.output,
+			waste = EXCLUDED.waste,
+			required_technique = EXCLUDED.required_technique,
+			required_realm = EXCLUDED.required_realm,
+			required_realm_level = EXCLUDED.required_realm_level,
+			success_rate = EXCLUDED.success_rate,
+			minutes = EXCLUDED.minutes,
+			updated_at = EXCLUDED.updated_at
+		RETURNING id
+	`
+	return db.GetPool().QueryRow(ctx, query,
+		recipe.RecipeName, recipe.CraftType, ingredientsJSON, outputJSON, wasteJSON,
+		recipe.RequiredTechnique, recipe.RequiredRealm, recipe.RequiredRealmLevel, recipe.SuccessRate, recipe.Minutes, recipe.LearnedAt,
+	).Scan(&recipe.ID)
+}
+
+// DeleteCatalogRecipe 从配方名录中删除配方，返回是否存在
+func (db *DB) DeleteCatalogRecipe(ctx context.Context, recipeName string) (bool, error) {
+	tag, err := db.GetPool().Exec(ctx, `DELETE FROM recipe_catalog WHERE recipe_name = $1`, recipeName)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetCatalogRecipe 获取配方名录中的配方，不存在时返回 nil
+func (db *DB) GetCatalogRecipe(ctx context.Context, recipeName string) (*Recipe, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + catalogRecipeColumns + ` FROM recipe_catalog WHERE recipe_name = $1`
+	recipe, err := scanRecipe(db.GetPool().QueryRow(timeoutCtx, query, recipeName))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return recipe, nil
+}
+
+// GetCatalogRecipes 获取配方名录中的全部配方
+func (db *DB) GetCatalogRecipes(ctx context.Context) ([]*Recipe, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + catalogRecipeColumns + ` FROM recipe_catalog ORDER BY craft_type, recipe_name`
+	rows, err := db.GetPool().Query(timeoutCtx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipes []*Recipe
+	for rows.Next() {
+		recipe, err := scanRecipe(rows)
+		if err != nil {
+			return nil, err
+		}
+		recipes = append(recipes, recipe)
+	}
+
+	return recipes, rows.Err()
+}
+
+const craftColumns = `cr.id, cr.character_id, u.tg_id, cr.recipe_name, cr.recipe, cr.furnace_name, cr.success_rate,
+	cr.status, cr.started_at, cr.ends_at, COALESCE(cr.finished_at, 'epoch'), cr.result`
+
+func scanCraft(row pgx.Row) (*Craft, error) {
+	var craft Craft
+	var recipeJSON, resultJSON []byte
+	err := row.Scan(
+		&craft.ID, &craft.CharacterID, &craft.TgID, &craft.RecipeName, &recipeJSON, &craft.FurnaceName, &craft.SuccessRate,
+		&craft.Status, &craft.StartedAt, &craft.EndsAt, &craft.FinishedAt, &resultJSON,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if craft.FinishedAt.Unix() == 0 {
+		craft.FinishedAt = time.Time{}
+	}
+
+	// 解析配方快照和产出JSON
+	if err := json.Unmarshal(recipeJSON, &craft.Recipe); err != nil {
+		return nil, err
+	}
+	if len(resultJSON) > 0 {
+		if err := json.Unmarshal(resultJSON, &craft.Result); err != nil {
+			return nil, err
+		}
+	}
+	return &craft, nil
+}
+
+// StartCraft 开始炼制，在同一事务中扣除全部材料并记录炼制
+// 材料不足时返回 InsufficientItemError，已有进行中的炼制时返回 ErrCraftInProgress
+func (db *DB) StartCraft(ctx context.Context, craft *Craft) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// 锁定角色，避免同时开始两次炼制
+	if _, err := tx.Exec(ctx, `SELECT id FROM character_stats WHERE id = $1 FOR UPDATE`, craft.CharacterID); err != nil {
+		return err
+	}
+	var ongoing bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM crafts WHERE character_id = $1 AND status = $2)`, craft.CharacterID, CraftStatusOngoing).Scan(&ongoing)
+	if err != nil {
+		return err
+	}
+	if ongoing {
+		return ErrCraftInProgress
+	}
+
+	if err := db.consumeIngredientsInTx(ctx, tx, craft.CharacterID, craft.Recipe.Ingredients); err != nil {
+		return err
+	}
+
+	recipeJSON, err := json.Marshal(craft.Recipe)
+	if err != nil {
+		return err
+	}
+	craft.Status = CraftStatusOngoing
+	query := `
+		INSERT INTO crafts (character_id, recipe_name, recipe, furnace_name, success_rate, status, started_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, query,
+		craft.CharacterID, craft.RecipeName, recipeJSON, craft.FurnaceName, craft.SuccessRate, craft.Status, craft.StartedAt, craft.EndsAt,
+	).Scan(&craft.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// consumeIngredientsInTx 在事务中按名称扣除材料，任一材料不足时返回 InsufficientItemError
+func (db *DB) consumeIngredientsInTx(ctx context.Context, tx pgx.Tx, characterID int, ingredients []*RecipeIngredient) error {
+	items := []*InventoryItem{}
+	for _, ingredient := range ingredients {
+		items = append(items, &InventoryItem{ItemName: ingredient.ItemName, Quantity: ingredient.Quantity})
+	}
+	return db.consumeInventoryItemsInTx(ctx, tx, characterID, items)
+}
+
+// GetOngoingCraft 获取角色正在进行的炼制
+func (db *DB) GetOngoingCraft(ctx context.Context, characterID int) (*Craft, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + craftColumns + `
+		FROM crafts cr
+		JOIN character_stats c ON c.id = cr.character_id
+		JOIN users u ON u.id = c.user_id
+		WHERE cr.character_id = $1 AND cr.status = $2
+	`
+	craft, err := scanCraft(db.GetPool().QueryRow(timeoutCtx, query, characterID, CraftStatusOngoing))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return craft, nil
+}
+
+// GetDueCrafts 获取已经到期但尚未结算的炼制
+func (db *DB) GetDueCrafts(ctx context.Context, now time.Time) ([]*Craft, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + craftColumns + `
+		FROM crafts cr
+		JOIN character_stats c ON c.id = cr.character_id
+		JOIN users u ON u.id = c.user_id
+		WHERE cr.status = $1 AND cr.ends_at <= $2
+		ORDER BY cr.ends_at ASC
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, CraftStatusOngoing, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var crafts []*Craft
+	for rows.Next() {
+		craft, err := scanCraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		crafts = append(crafts, craft)
+	}
+
+	return crafts, rows.Err()
+}
+
+// FinishCraft 结束炼制并把产出放入背包，只有进行中的炼制才能结束，返回是否由本次调用结束
+// 材料已在开始时扣除，产出总是放入背包，即使因此超出容量（见 checkInventoryCapacityInTx 处的容量超出规则）
+func (db *DB) FinishCraft(ctx context.Context, craft *Craft) (bool, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var resultJSON []byte
+	if craft.Result != nil {
+		resultJSON, err = json.Marshal(craft.Result)
+		if err != nil {
+			return false, err
+		}
+	}
+	query := `
+		UPDATE crafts
+		SET status = $2, finished_at = $3, result = $4
+		WHERE id = $1 AND status = $5
+	`
+	tag, err := tx.Exec(ctx, query, craft.ID, craft.Status, craft.FinishedAt, resultJSON, CraftStatusOngoing)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if craft.Result != nil && craft.Result.Quantity > 0 {
+		item := *craft.Result
+		item.CharacterID = craft.CharacterID
+		if err := db.AddInventoryItemsBatchInTx(ctx, tx, []*InventoryItem{&item}); err != nil {
+			return false, err
+		}
+		if err := db.RecordItemGrantsInTx(ctx, tx, craft.CharacterID, GrantSourceCraft, 0, []*InventoryItem{&item}); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit(ctx)
+}
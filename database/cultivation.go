@@ -11,7 +11,7 @@ import (
 
 // CultivationTechnique 修炼功法结构
 type CultivationTechnique struct {
-	UserID         int                    `json:"user_id"`
+	CharacterID    int                    `json:"character_id"`
 	TechniqueName  string                 `json:"technique_name"`
 	TechniqueType  string                 `json:"technique_type"`
 	TechniqueLevel int                    `json:"technique_level"`
@@ -25,7 +25,7 @@ type CultivationTechnique struct {
 // LearnCultivationTechnique 学习新功法
 func (db *DB) LearnCultivationTechnique(ctx context.Context, technique *CultivationTechnique) error {
 	// 检查是否已经学习过这个功法
-	existing, err := db.GetCultivationTechnique(ctx, technique.UserID, technique.TechniqueName)
+	existing, err := db.GetCultivationTechnique(ctx, technique.CharacterID, technique.TechniqueName)
 	if err != nil {
 		return err
 	}
@@ -46,36 +46,36 @@ func (db *DB) LearnCultivationTechnique(ctx context.Context, technique *Cultivat
 
 	query := `
 		INSERT INTO cultivation_techniques (
-			user_id, technique_name, technique_type, technique_level, quality,
+			character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
 
 	_, err = db.GetPool().Exec(ctx, query,
-		technique.UserID, technique.TechniqueName, technique.TechniqueType, technique.TechniqueLevel, technique.Quality,
+		technique.CharacterID, technique.TechniqueName, technique.TechniqueType, technique.TechniqueLevel, technique.Quality,
 		technique.Progress, effectsJSON, requirementsJSON, technique.LearnedAt,
 	)
 	return err
 }
 
 // GetCultivationTechnique 获取特定功法
-func (db *DB) GetCultivationTechnique(ctx context.Context, userID int, techniqueName string) (*CultivationTechnique, error) {
+func (db *DB) GetCultivationTechnique(ctx context.Context, characterID int, techniqueName string) (*CultivationTechnique, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, technique_name, technique_type, technique_level, quality,
+		SELECT character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		FROM cultivation_techniques
-		WHERE user_id = $1 AND technique_name = $2
+		WHERE character_id = $1 AND technique_name = $2
 	`
 
-	row := db.GetPool().QueryRow(timeoutCtx, query, userID, techniqueName)
+	row := db.GetPool().QueryRow(timeoutCtx, query, characterID, techniqueName)
 
 	var technique CultivationTechnique
 	var effectsJSON, requirementsJSON []byte
 	err := row.Scan(
-		&technique.UserID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
+		&technique.CharacterID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
 		&technique.Progress, &effectsJSON, &requirementsJSON, &technique.LearnedAt,
 	)
 
@@ -104,20 +104,20 @@ func (db *DB) GetCultivationTechnique(ctx context.Context, userID int, technique
 	return &technique, nil
 }
 
-// GetUserCultivationTechniques 获取用户所有功法
-func (db *DB) GetUserCultivationTechniques(ctx context.Context, userID int) ([]*CultivationTechnique, error) {
+// GetCharacterCultivationTechniques 获取角色所有功法
+func (db *DB) GetCharacterCultivationTechniques(ctx context.Context, characterID int) ([]*CultivationTechnique, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, technique_name, technique_type, technique_level, quality,
+		SELECT character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		FROM cultivation_techniques
-		WHERE user_id = $1
+		WHERE character_id = $1
 		ORDER BY technique_type, quality DESC, technique_level DESC, learned_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID)
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +128,7 @@ func (db *DB) GetUserCultivationTechniques(ctx context.Context, userID int) ([]*
 		var technique CultivationTechnique
 		var effectsJSON, requirementsJSON []byte
 		err := rows.Scan(
-			&technique.UserID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
+			&technique.CharacterID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
 			&technique.Progress, &effectsJSON, &requirementsJSON, &technique.LearnedAt,
 		)
 		if err != nil {
@@ -157,19 +157,19 @@ func (db *DB) GetUserCultivationTechniques(ctx context.Context, userID int) ([]*
 }
 
 // GetCultivationTechniquesByType 根据功法类型获取功法
-func (db *DB) GetCultivationTechniquesByType(ctx context.Context, userID int, techniqueType string) ([]*CultivationTechnique, error) {
+func (db *DB) GetCultivationTechniquesByType(ctx context.Context, characterID int, techniqueType string) ([]*CultivationTechnique, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, technique_name, technique_type, technique_level, quality,
+		SELECT character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		FROM cultivation_techniques
-		WHERE user_id = $1 AND technique_type = $2
+		WHERE character_id = $1 AND technique_type = $2
 		ORDER BY quality DESC, technique_level DESC, learned_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID, techniqueType)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, techniqueType)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +180,7 @@ func (db *DB) GetCultivationTechniquesByType(ctx context.Context, userID int, te
 		var technique CultivationTechnique
 		var effectsJSON, requirementsJSON []byte
 		err := rows.Scan(
-			&technique.UserID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
+			&technique.CharacterID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
 			&technique.Progress, &effectsJSON, &requirementsJSON, &technique.LearnedAt,
 		)
 		if err != nil {
@@ -209,7 +209,7 @@ func (db *DB) GetCultivationTechniquesByType(ctx context.Context, userID int, te
 }
 
 // UpdateCultivationTechniqueProgress 更新功法修炼进度
-func (db *DB) UpdateCultivationTechniqueProgress(ctx context.Context, userID int, techniqueName string, progress int) error {
+func (db *DB) UpdateCultivationTechniqueProgress(ctx context.Context, characterID int, techniqueName string, progress int) error {
 	// 确保进度在0-100范围内
 	if progress < 0 {
 		progress = 0
@@ -220,16 +220,16 @@ func (db *DB) UpdateCultivationTechniqueProgress(ctx context.Context, userID int
 	query := `
 		UPDATE cultivation_techniques 
 		SET progress = $3
-		WHERE user_id = $1 AND technique_name = $2
+		WHERE character_id = $1 AND technique_name = $2
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, techniqueName, progress)
+	_, err := db.GetPool().Exec(ctx, query, characterID, techniqueName, progress)
 	return err
 }
 
 // UpgradeCultivationTechnique 升级功法
-func (db *DB) UpgradeCultivationTechnique(ctx context.Context, userID int, techniqueName string) error {
+func (db *DB) UpgradeCultivationTechnique(ctx context.Context, characterID int, techniqueName string) error {
 	// 先检查当前进度是否达到100%
-	technique, err := db.GetCultivationTechnique(ctx, userID, techniqueName)
+	technique, err := db.GetCultivationTechnique(ctx, characterID, techniqueName)
 	if err != nil {
 		return err
 	}
@@ -245,14 +245,14 @@ func (db *DB) UpgradeCultivationTechnique(ctx context.Context, userID int, techn
 	query := `
 		UPDATE cultivation_techniques 
 		SET technique_level = technique_level + 1, progress = 0
-		WHERE user_id = $1 AND technique_name = $2
+		WHERE character_id = $1 AND technique_name = $2
 	`
-	_, err = db.GetPool().Exec(ctx, query, userID, techniqueName)
+	_, err = db.GetPool().Exec(ctx, query, characterID, techniqueName)
 	return err
 }
 
 // UpdateCultivationTechniqueEffects 更新功法效果
-func (db *DB) UpdateCultivationTechniqueEffects(ctx context.Context, userID int, techniqueName string, effects map[string]interface{}) error {
+func (db *DB) UpdateCultivationTechniqueEffects(ctx context.Context, characterID int, techniqueName string, effects map[string]interface{}) error {
 	effectsJSON, err := json.Marshal(effects)
 	if err != nil {
 		return err
@@ -261,47 +261,58 @@ func (db *DB) UpdateCultivationTechniqueEffects(ctx context.Context, userID int,
 	query := `
 		UPDATE cultivation_techniques 
 		SET effects = $3
-		WHERE user_id = $1 AND technique_name = $2
+		WHERE character_id = $1 AND technique_name = $2
 	`
-	_, err = db.GetPool().Exec(ctx, query, userID, techniqueName, effectsJSON)
+	_, err = db.GetPool().Exec(ctx, query, characterID, techniqueName, effectsJSON)
 	return err
 }
 
 // AddCultivationTechniqueProgress 增加功法修炼进度
-func (db *DB) AddCultivationTechniqueProgress(ctx context.Context, userID int, techniqueName string, addProgress int) error {
+func (db *DB) AddCultivationTechniqueProgress(ctx context.Context, characterID int, techniqueName string, addProgress int) error {
 	query := `
 		UPDATE cultivation_techniques 
 		SET progress = LEAST(100, progress + $3)
-		WHERE user_id = $1 AND technique_name = $2
+		WHERE character_id = $1 AND technique_name = $2
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, techniqueName, addProgress)
+	_, err := db.GetPool().Exec(ctx, query, characterID, techniqueName, addProgress)
+	return err
+}
+
+// AddCultivationTechniqueProgressInTx 在事务中增加功法修炼进度
+func (db *DB) AddCultivationTechniqueProgressInTx(ctx context.Context, tx pgx.Tx, characterID int, techniqueName string, addProgress int) error {
+	query := `
+		UPDATE cultivation_techniques
+		SET progress = LEAST(100, progress + $3)
+		WHERE character_id = $1 AND technique_name = $2
+	`
+	_, err := tx.Exec(ctx, query, characterID, techniqueName, addProgress)
 	return err
 }
 
 // ForgetCultivationTechnique 遗忘功法
-func (db *DB) ForgetCultivationTechnique(ctx context.Context, userID int, techniqueName string) error {
+func (db *DB) ForgetCultivationTechnique(ctx context.Context, characterID int, techniqueName string) error {
 	query := `
 		DELETE FROM cultivation_techniques
-		WHERE user_id = $1 AND technique_name = $2
+		WHERE character_id = $1 AND technique_name = $2
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, techniqueName)
+	_, err := db.GetPool().Exec(ctx, query, characterID, techniqueName)
 	return err
 }
 
 // GetCultivationTechniquesByQuality 根据品质获取功法
-func (db *DB) GetCultivationTechniquesByQuality(ctx context.Context, userID int, quality string) ([]*CultivationTechnique, error) {
+func (db *DB) GetCultivationTechniquesByQuality(ctx context.Context, characterID int, quality string) ([]*CultivationTechnique, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, technique_name, technique_type, technique_level, quality,
+		SELECT character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		FROM cultivation_techniques
-		WHERE user_id = $1 AND quality = $2
+		WHERE character_id = $1 AND quality = $2
 		ORDER BY technique_type, technique_level DESC, learned_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID, quality)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, quality)
 	if err != nil {
 		return nil, err
 	}
@@ -312,7 +323,7 @@ func (db *DB) GetCultivationTechniquesByQuality(ctx context.Context, userID int,
 		var technique CultivationTechnique
 		var effectsJSON, requirementsJSON []byte
 		err := rows.Scan(
-			&technique.UserID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
+			&technique.CharacterID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
 			&technique.Progress, &effectsJSON, &requirementsJSON, &technique.LearnedAt,
 		)
 		if err != nil {
@@ -341,19 +352,19 @@ func (db *DB) GetCultivationTechniquesByQuality(ctx context.Context, userID int,
 }
 
 // SearchCultivationTechniquesByName 根据功法名称搜索功法
-func (db *DB) SearchCultivationTechniquesByName(ctx context.Context, userID int, techniqueName string) ([]*CultivationTechnique, error) {
+func (db *DB) SearchCultivationTechniquesByName(ctx context.Context, characterID int, techniqueName string) ([]*CultivationTechnique, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, technique_name, technique_type, technique_level, quality,
+		SELECT character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		FROM cultivation_techniques
-		WHERE user_id = $1 AND technique_name ILIKE '%' || $2 || '%'
+		WHERE character_id = $1 AND technique_name ILIKE '%' || $2 || '%'
 		ORDER BY technique_type, quality DESC, technique_level DESC, learned_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID, techniqueName)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, techniqueName)
 	if err != nil {
 		return nil, err
 	}
@@ -364,7 +375,7 @@ func (db *DB) SearchCultivationTechniquesByName(ctx context.Context, userID int,
 		var technique CultivationTechnique
 		var effectsJSON, requirementsJSON []byte
 		err := rows.Scan(
-			&technique.UserID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
+			&technique.CharacterID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
 			&technique.Progress, &effectsJSON, &requirementsJSON, &technique.LearnedAt,
 		)
 		if err != nil {
@@ -393,19 +404,19 @@ func (db *DB) SearchCultivationTechniquesByName(ctx context.Context, userID int,
 }
 
 // GetMasteredCultivationTechniques 获取已完全掌握的功法（进度100%）
-func (db *DB) GetMasteredCultivationTechniques(ctx context.Context, userID int) ([]*CultivationTechnique, error) {
+func (db *DB) GetMasteredCultivationTechniques(ctx context.Context, characterID int) ([]*CultivationTechnique, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, technique_name, technique_type, technique_level, quality,
+		SELECT character_id, technique_name, technique_type, technique_level, quality,
 			progress, effects, requirements, learned_at
 		FROM cultivation_techniques
-		WHERE user_id = $1 AND progress = 100
+		WHERE character_id = $1 AND progress = 100
 		ORDER BY technique_type, quality DESC, technique_level DESC, learned_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID)
 	if err != nil {
 		return nil, err
 	}
@@ -416,7 +427,7 @@ func (db *DB) GetMasteredCultivationTechniques(ctx context.Context, userID int)
 		var technique CultivationTechnique
 		var effectsJSON, requirementsJSON []byte
 		err := rows.Scan(
-			&technique.UserID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
+			&technique.CharacterID, &technique.TechniqueName, &technique.TechniqueType, &technique.TechniqueLevel, &technique.Quality,
 			&technique.Progress, &effectsJSON, &requirementsJSON, &technique.LearnedAt,
 		)
 		if err != nil {
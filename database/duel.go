@@ -0,0 +1,281 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 切磋状态
+const (
+	DuelStatusPending  = "pending"
+	DuelStatusDeclined = "declined"
+	DuelStatusExpired  = "expired"
+	DuelStatusFinished = "finished"
+)
+
+// Duel 玩家之间的切磋，赌注物品在结算前由系统托管
+type Duel struct {
+	ID              int            `json:"id"`
+	ChallengerID    int            `json:"challenger_id"` // 发起方角色ID
+	DefenderID      int            `json:"defender_id"`   // 应战方角色ID
+	ChallengerTgID  int64          `json:"challenger_tg_id"`
+	DefenderTgID    int64          `json:"defender_tg_id"`
+	StakeItemName   string         `json:"stake_item_name"` // 双方各自押上的物品，空表示没有赌注
+	StakeQuantity   int            `json:"stake_quantity"`
+	ChallengerStake *InventoryItem `json:"challenger_stake"` // 托管中的发起方赌注
+	DefenderStake   *InventoryItem `json:"defender_stake"`   // 托管中的应战方赌注
+	Status          string         `json:"status"`
+	WinnerID        int            `json:"winner_id"`
+	Log             string         `json:"log"`
+	CreatedAt       time.Time      `json:"created_at"`
+	ResolvedAt      time.Time      `json:"resolved_at,omitzero"`
+}
+
+const duelColumns = `d.id, d.challenger_id, d.defender_id, cu.tg_id, du.tg_id, d.stake_item_name, d.stake_quantity,
+			d.challenger_stake, d.defender_stake, d.status, COALESCE(d.winner_id, 0), d.log, d.created_at,
+			COALESCE(d.resolved_at, 'epoch'::timestamp)`
+
+const duelJoins = `
+		FROM duels d
+		JOIN character_stats cc ON cc.id = d.challenger_id
+		JOIN users cu ON cu.id = cc.user_id
+		JOIN character_stats dc ON dc.id = d.defender_id
+		JOIN users du ON du.id = dc.user_id`
+
+func scanDuel(row pgx.Row) (*Duel, error) {
+	var duel Duel
+	var challengerStakeJSON, defenderStakeJSON []byte
+	err := row.Scan(
+		&duel.ID, &duel.ChallengerID, &duel.DefenderID, &duel.ChallengerTgID, &duel.DefenderTgID, &duel.StakeItemName, &duel.StakeQuantity,
+		&challengerStakeJSON, &defenderStakeJSON, &duel.Status, &duel.WinnerID, &duel.Log, &duel.CreatedAt,
+		&duel.ResolvedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if duel.ResolvedAt.Unix() == 0 {
+		duel.ResolvedAt = time.Time{}
+	}
+
+	// 解析托管物品JSON
+	if len(challengerStakeJSON) > 0 {
+		if err := json.Unmarshal(challengerStakeJSON, &duel.ChallengerStake); err != nil {
+			return nil, err
+		}
+	}
+	if len(defenderStakeJSON) > 0 {
+		if err := json.Unmarshal(defenderStakeJSON, &duel.DefenderStake); err != nil {
+			return nil, err
+		}
+	}
+	return &duel, nil
+}
+
+// CreateDuel 发起切磋，如有赌注则先托管发起方的赌注
+func (db *DB) CreateDuel(ctx context.Context, duel *Duel) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var challengerStakeJSON []byte
+	if duel.StakeItemName != "" {
+		duel.ChallengerStake, err = db.takeInventoryItemInTx(ctx, tx, duel.ChallengerID, 0, duel.StakeItemName, duel.StakeQuantity)
+		if err != nil {
+			return err
+		}
+		challengerStakeJSON, err = json.Marshal(duel.ChallengerStake)
+		if err != nil {
+			return err
+		}
+	}
+
+	duel.Status = DuelStatusPending
+	duel.CreatedAt = time.Now()
+	query := `
+		INSERT INTO duels (challenger_id, defender_id, stake_item_name, stake_quantity, challenger_stake, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, query,
+		duel.ChallengerID, duel.DefenderID, duel.StakeItemName, duel.StakeQuantity, challengerStakeJSON, duel.Status, duel.CreatedAt,
+	).Scan(&duel.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetDuel 获取切磋
+func (db *DB) GetDuel(ctx context.Context, id int) (*Duel, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + duelColumns + duelJoins + ` WHERE d.id = $1`
+	duel, err := scanDuel(db.GetPool().QueryRow(timeoutCtx, query, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return duel, nil
+}
+
+// GetExpiredDuels 获取在指定时间之前发起且仍未应战的切磋
+func (db *DB) GetExpiredDuels(ctx context.Context, before time.Time) ([]*Duel, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + duelColumns + duelJoins + ` WHERE d.status = $1 AND d.created_at < $2`
+	rows, err := db.GetPool().Query(timeoutCtx, query, DuelStatusPending, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var duels []*Duel
+	for rows.Next() {
+		duel, err := scanDuel(rows)
+		if err != nil {
+			return nil, err
+		}
+		duels = append(duels, duel)
+	}
+	return duels, rows.Err()
+}
+
+// GetLastDuelTime 获取角色最近一次参与切磋（已结算或待应战）的时间，没有则返回零值
+func (db *DB) GetLastDuelTime(ctx context.Context, characterID int) (time.Time, error) {
+	query := `
+		SELECT COALESCE(MAX(created_at), 'epoch'::timestamp)
+		FROM duels
+		WHERE (challenger_id = $1 OR defender_id = $1) AND status IN ($2, $3)
+	`
+	var last time.Time
+	err := db.GetPool().QueryRow(ctx, query, characterID, DuelStatusPending, DuelStatusFinished).Scan(&last)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if last.Unix() == 0 {
+		return time.Time{}, nil
+	}
+	return last, nil
+}
+
+// lockPendingDuelInTx 锁定一场待应战的切磋，已被处理的返回 nil
+func (db *DB) lockPendingDuelInTx(ctx context.Context, tx pgx.Tx, id int) (*Duel, error) {
+	query := `SELECT ` + duelColumns + duelJoins + ` WHERE d.id = $1 AND d.status = $2 FOR UPDATE OF d`
+	duel, err := scanDuel(tx.QueryRow(ctx, query, id, DuelStatusPending))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return duel, nil
+}
+
+// CancelDuel 拒绝或过期一场待应战的切磋，并退还发起方的赌注，已被处理的返回 nil
+func (db *DB) CancelDuel(ctx context.Context, id int, status string) (*Duel, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	duel, err := db.lockPendingDuelInTx(ctx, tx, id)
+	if err != nil || duel == nil {
+		return nil, err
+	}
+
+	if duel.ChallengerStake != nil {
+		refund := *duel.ChallengerStake
+		refund.CharacterID = duel.ChallengerID
+		if err := db.RestoreInventoryItemsInTx(ctx, tx, []*InventoryItem{&refund}); err != nil {
+			return nil, err
+		}
+	}
+
+	duel.Status = status
+	duel.ResolvedAt = time.Now()
+	_, err = tx.Exec(ctx, `UPDATE duels SET status = $2, resolved_at = $3 WHERE id = $1`, duel.ID, duel.Status, duel.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return duel, tx.Commit(ctx)
+}
+
+// DuelResolver 根据托管后的切磋计算胜者、战斗日志，以及双方在战斗中消耗的物品
+type DuelResolver func(duel *Duel) (winnerID int, log string, consumed []*InventoryItem, err error)
+
+// ResolveDuel 应战并结算切磋：托管应战方赌注、结算胜负、消耗物品并把双方赌注交给胜者
+// 已被处理的切磋返回 nil
+func (db *DB) ResolveDuel(ctx context.Context, id int, resolve DuelResolver) (*Duel, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	duel, err := db.lockPendingDuelInTx(ctx, tx, id)
+	if err != nil || duel == nil {
+		return nil, err
+	}
+
+	var defenderStakeJSON []byte
+	if duel.StakeItemName != "" {
+		duel.DefenderStake, err = db.takeInventoryItemInTx(ctx, tx, duel.DefenderID, 0, duel.StakeItemName, duel.StakeQuantity)
+		if err != nil {
+			return nil, err
+		}
+		defenderStakeJSON, err = json.Marshal(duel.DefenderStake)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	winnerID, log, consumed, err := resolve(duel)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AddInventoryItemsBatchInTx(ctx, tx, consumed); err != nil {
+		return nil, err
+	}
+	duel.WinnerID = winnerID
+	duel.Log = log
+
+	// 胜者获得双方赌注，赌注已经托管，总是放入胜者背包，即使因此超出容量
+	winnings := []*InventoryItem{}
+	for _, stake := range []*InventoryItem{duel.ChallengerStake, duel.DefenderStake} {
+		if stake == nil {
+			continue
+		}
+		item := *stake
+		item.CharacterID = duel.WinnerID
+		winnings = append(winnings, &item)
+	}
+	if err := db.RestoreInventoryItemsInTx(ctx, tx, winnings); err != nil {
+		return nil, err
+	}
+
+	duel.Status = DuelStatusFinished
+	duel.ResolvedAt = time.Now()
+	query := `
+		UPDATE duels
+		SET status = $2, defender_stake = $3, winner_id = $4, log = $5, resolved_at = $6
+		WHERE id = $1
+	`
+	_, err = tx.Exec(ctx, query, duel.ID, duel.Status, defenderStakeJSON, duel.WinnerID, duel.Log, duel.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return duel, tx.Commit(ctx)
+}
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 装备栏位
+const (
+	EquipSlotWeapon    = "weapon"
+	EquipSlotArmor     = "armor"
+	EquipSlotAccessory = "accessory"
+	EquipSlotTreasure  = "treasure"
+	EquipSlotStorage   = "storage" // 储物袋，提供额外的背包容量
+)
+
+// EquipSlots 全部装备栏位，按展示顺序排列
+var EquipSlots = []string{EquipSlotWeapon, EquipSlotArmor, EquipSlotAccessory, EquipSlotTreasure, EquipSlotStorage}
+
+// EquipSlotNames 装备栏位的中文名称
+var EquipSlotNames = map[string]string{
+	EquipSlotWeapon:    "武器",
+	EquipSlotArmor:     "防具",
+	EquipSlotAccessory: "饰品",
+	EquipSlotTreasure:  "法宝",
+	EquipSlotStorage:   "储物袋",
+}
+
+// equipSlotKeywords 根据物品类型推断装备栏位的关键字，按顺序匹配
+var equipSlotKeywords = []struct {
+	slot     string
+	keywords []string
+}{
+	{EquipSlotStorage, []string{"storage", "储物", "乾坤袋", "芥子"}},
+	{EquipSlotWeapon, []string{"weapon", "武器", "剑", "刀", "枪", "戟", "棍", "鞭", "弓", "扇"}},
+	{EquipSlotArmor, []string{"armor", "防具", "甲", "袍", "衣", "铠"}},
+	{EquipSlotAccessory, []string{"accessory", "饰品", "戒", "佩", "坠", "镯", "链", "簪"}},
+	{EquipSlotTreasure, []string{"treasure", "法宝", "法器", "灵宝", "至宝"}},
+}
+
+// Equipment 角色装备栏中的一件装备，穿戴时物品从背包中取出
+type Equipment struct {
+	CharacterID int            `json:"character_id"`
+	Slot        string         `json:"slot"`
+	Item        *InventoryItem `json:"item"`
+	Modifiers   *ItemModifiers `json:"modifiers"`
+	EquippedAt  time.Time      `json:"equipped_at,omitzero"`
+}
+
+// EquipSlotForItemType 根据物品类型推断装备栏位，无法装备时返回空字符串
+func EquipSlotForItemType(itemType string) string {
+	itemType = strings.ToLower(itemType)
+	for _, entry := range equipSlotKeywords {
+		for _, keyword := range entry.keywords {
+			if strings.Contains(itemType, keyword) {
+				return entry.slot
+			}
+		}
+	}
+	return ""
+}
+
+// Effective 计算穿戴装备和临时增益后的实际属性，返回新的属性副本
+func (c *CharacterStats) Effective(equipment []*Equipment, buffs []*Buff) *CharacterStats {
+	modifiers := []*ItemModifiers{}
+	for _, e := range equipment {
+		modifiers = append(modifiers, e.Modifiers)
+	}
+	for _, b := range buffs {
+		modifiers = append(modifiers, b.Modifiers)
+	}
+
+	effective := *c
+	for _, m := range modifiers {
+		if m == nil {
+			continue
+		}
+		effective.Attack += m.Attack
+		effective.Defense += m.Defense
+		effective.Speed += m.Speed
+		effective.SpiritSense += m.SpiritSense
+		effective.Physique += m.Physique
+		effective.Luck += m.Luck
+	}
+	return &effective
+}
+
+func scanEquipment(row pgx.Row) (*Equipment, error) {
+	var equipment Equipment
+	var itemJSON, modifiersJSON []byte
+	err := row.Scan(&equipment.CharacterID, &equipment.Slot, &itemJSON, &modifiersJSON, &equipment.EquippedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析装备物品和加成JSON
+	if err := json.Unmarshal(itemJSON, &equipment.Item); err != nil {
+		return nil, err
+	}
+	if len(modifiersJSON) > 0 {
+		if err := json.Unmarshal(modifiersJSON, &equipment.Modifiers); err != nil {
+			return nil, err
+		}
+	}
+	return &equipment, nil
+}
+
+// GetCharacterEquipment 获取角色已穿戴的装备
+func (db *DB) GetCharacterEquipment(ctx context.Context, characterID int) ([]*Equipment, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT character_id, slot, item, modifiers, equipped_at
+		FROM equipment
+		WHERE character_id = $1
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bySlot := make(map[string]*Equipment)
+	for rows.Next() {
+		equipment, err := scanEquipment(rows)
+		if err != nil {
+			return nil, err
+		}
+		bySlot[equipment.Slot] = equipment
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 按栏位顺序返回
+	var equipment []*Equipment
+	for _, slot := range EquipSlots {
+		if e, ok := bySlot[slot]; ok {
+			equipment = append(equipment, e)
+		}
+	}
+	return equipment, nil
+}
+
+// unequipInTx 卸下栏位中的装备并放回背包，栏位为空时返回 nil
+func (db *DB) unequipInTx(ctx context.Context, tx pgx.Tx, characterID int, slot string) (*Equipment, error) {
+	query := `
+		DELETE FROM equipment
+		WHERE character_id = $1 AND slot = $2
+		RETURNING character_id, slot, item, modifiers, equipped_at
+	`
+	equipment, err := scanEquipment(tx.QueryRow(ctx, query, characterID, slot))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	item := *equipment.Item
+	item.CharacterID = characterID
+	if err := db.RestoreInventoryItemsInTx(ctx, tx, []*InventoryItem{&item}); err != nil {
+		return nil, err
+	}
+	return equipment, nil
+}
+
+// EquipItem 从背包中取出一件物品穿戴到指定栏位，栏位上原有的装备放回背包
+// 属性加成以物品自身属性中的 modifiers 为准，返回新穿戴的装备和被替换下的装备（没有则为 nil）
+// 换下的装备放不下时返回 InventoryFullError
+func (db *DB) EquipItem(ctx context.Context, characterID int, itemID int, itemName string, slot string, baseCapacity int) (*Equipment, *Equipment, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := db.GetInventoryCapacityInTx(ctx, tx, characterID, baseCapacity)
+	if err != nil {
+		return nil, nil, err
+	}
+	replaced, err := db.unequipInTx(ctx, tx, characterID, slot)
+	if err != nil {
+		return nil, nil, err
+	}
+	item, err := db.takeInventoryItemInTx(ctx, tx, characterID, itemID, itemName, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	equipment := &Equipment{
+		CharacterID: characterID,
+		Slot:        slot,
+		Item:        item,
+		EquippedAt:  time.Now(),
+	}
+	if item.Properties != nil {
+		equipment.Modifiers = item.Properties.Modifiers
+	}
+	itemJSON, err := json.Marshal(equipment.Item)
+	if err != nil {
+		return nil, nil, err
+	}
+	var modifiersJSON []byte
+	if equipment.Modifiers != nil {
+		modifiersJSON, err = json.Marshal(equipment.Modifiers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	query := `
+		INSERT INTO equipment (character_id, slot, item, modifiers, equipped_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err = tx.Exec(ctx, query, equipment.CharacterID, equipment.Slot, itemJSON, modifiersJSON, equipment.EquippedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := db.checkInventoryCapacityInTx(ctx, tx, characterID, before, baseCapacity); err != nil {
+		return nil, nil, err
+	}
+
+	return equipment, replaced, tx.Commit(ctx)
+}
+
+// UnequipItem 卸下栏位中的装备并放回背包，栏位为空时返回 nil，背包放不下时返回 InventoryFullError
+func (db *DB) UnequipItem(ctx context.Context, characterID int, slot string, baseCapacity int) (*Equipment, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := db.GetInventoryCapacityInTx(ctx, tx, characterID, baseCapacity)
+	if err != nil {
+		return nil, err
+	}
+	equipment, err := db.unequipInTx(ctx, tx, characterID, slot)
+	if err != nil || equipment == nil {
+		return nil, err
+	}
+	if _, err := db.checkInventoryCapacityInTx(ctx, tx, characterID, before, baseCapacity); err != nil {
+		return nil, err
+	}
+	return equipment, tx.Commit(ctx)
+}
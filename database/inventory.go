@@ -2,6 +2,8 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,123 +11,239 @@ import (
 )
 
 // InventoryItem 背包物品结构
+// 可堆叠物品按名称合并为一条记录；不可堆叠的物品每件单独一条记录，拥有各自的属性
 type InventoryItem struct {
-	UserID       int       `json:"user_id,omitempty"`
-	ItemName     string    `json:"item_name"`
-	ItemType     string    `json:"item_type"`
-	Quality      string    `json:"quality"`
-	Level        int       `json:"level"`
-	Quantity     int       `json:"quantity"`
-	Properties   string    `json:"properties"`
-	Description  string    `json:"description"`
-	ObtainedFrom string    `json:"obtained_from"`
-	ObtainedAt   time.Time `json:"obtained_at,omitzero"`
-}
-
-// AddInventoryItemsBatchInTx 批量添加物品到背包
+	ID           int             `json:"id,omitempty"`
+	CharacterID  int             `json:"character_id,omitempty"`
+	ItemName     string          `json:"item_name"`
+	ItemType     string          `json:"item_type"`
+	Quality      string          `json:"quality"`
+	Level        int             `json:"level"`
+	Quantity     int             `json:"quantity"`
+	Stackable    bool            `json:"stackable"`
+	Properties   *ItemProperties `json:"properties"`
+	Description  string          `json:"description"`
+	ObtainedFrom string          `json:"obtained_from"`
+	ObtainedAt   time.Time       `json:"obtained_at,omitzero"`
+}
+
+// UnmarshalJSON 未指定是否可堆叠时，装备类物品默认不可堆叠，其余物品默认可堆叠
+func (i *InventoryItem) UnmarshalJSON(data []byte) error {
+	type plain InventoryItem
+	aux := struct {
+		*plain
+		Stackable *bool `json:"stackable"`
+	}{plain: (*plain)(i)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Stackable != nil {
+		i.Stackable = *aux.Stackable
+	} else {
+		i.Stackable = EquipSlotForItemType(i.ItemType) == ""
+	}
+	return nil
+}
+
+// inventoryColumns 背包表查询字段，与 scanInventoryItem 的顺序一致
+const inventoryColumns = `id, character_id, item_name, item_type, quality, level, quantity, stackable,
+			properties, description, obtained_from, obtained_at`
+
+func scanInventoryItem(row pgx.Row) (*InventoryItem, error) {
+	var item InventoryItem
+	var propertiesJSON []byte
+	err := row.Scan(
+		&item.ID, &item.CharacterID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity, &item.Stackable,
+		&propertiesJSON, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析物品属性JSON
+	if len(propertiesJSON) > 0 {
+		if err := json.Unmarshal(propertiesJSON, &item.Properties); err != nil {
+			return nil, err
+		}
+	}
+	return &item, nil
+}
+
+// AddInventoryItemsBatchInTx 批量添加物品到背包，数量为负数时扣除
+// 指定ID的物品必须在该角色的背包中，不可堆叠的物品只能扣除；新增的不可堆叠物品每件单独一条记录
+// 未指定ID时按名称处理：可堆叠物品合并到同名记录，不可堆叠物品每件新建一条记录，扣除时优先扣除同名的可堆叠记录
 func (db *DB) AddInventoryItemsBatchInTx(ctx context.Context, tx pgx.Tx, items []*InventoryItem) error {
+	return db.addInventoryItemsInTx(ctx, tx, items, false)
+}
+
+// RestoreInventoryItemsInTx 把先前从背包取出的物品放回（卸下装备、退还或转交托管的赌注、转世传承）
+// 不可堆叠物品尽量保留原ID，原ID已被占用时重新分配，其余规则与 AddInventoryItemsBatchInTx 相同
+func (db *DB) RestoreInventoryItemsInTx(ctx context.Context, tx pgx.Tx, items []*InventoryItem) error {
+	return db.addInventoryItemsInTx(ctx, tx, items, true)
+}
+
+func (db *DB) addInventoryItemsInTx(ctx context.Context, tx pgx.Tx, items []*InventoryItem, restore bool) error {
 	if len(items) == 0 {
 		return nil
 	}
 
-	// 为了提高效率，先批量查询现有物品
-	userItemMap := make(map[int]map[string]*InventoryItem)
-
-	// 按用户ID分组
-	userItems := make(map[int][]*InventoryItem)
+	// 按角色ID分组
+	characterItems := make(map[int][]*InventoryItem)
 	for _, item := range items {
-		userItems[item.UserID] = append(userItems[item.UserID], item)
+		characterItems[item.CharacterID] = append(characterItems[item.CharacterID], item)
 	}
 
-	// 为每个用户查询现有物品
-	for userID, userItemList := range userItems {
-		itemNames := make([]string, len(userItemList))
-		for i, item := range userItemList {
-			itemNames[i] = item.ItemName
+	// 准备批量插入和更新的数据，更新按记录ID去重
+	var itemsToInsert []*InventoryItem
+	itemsToUpdate := make(map[int]*InventoryItem)
+
+	for characterID, characterItemList := range characterItems {
+		itemIDs := []int{}
+		itemNames := []string{}
+		for _, item := range characterItemList {
+			if item.ID > 0 {
+				itemIDs = append(itemIDs, item.ID)
+			}
+			itemNames = append(itemNames, item.ItemName)
 		}
 
-		// 批量查询现有物品
-		existingItems, err := db.getInventoryItemsByNamesInTx(ctx, tx, userID, itemNames)
+		// 为了提高效率，先批量查询现有物品
+		existingItems, err := db.getInventoryItemsInTx(ctx, tx, characterID, itemIDs, itemNames)
 		if err != nil {
 			return err
 		}
-
-		// 建立用户物品映射
-		if userItemMap[userID] == nil {
-			userItemMap[userID] = make(map[string]*InventoryItem)
-		}
+		byID := make(map[int]*InventoryItem)
+		stackableByName := make(map[string]*InventoryItem)
+		uniqueByName := make(map[string][]*InventoryItem)
 		for _, existingItem := range existingItems {
-			userItemMap[userID][existingItem.ItemName] = existingItem
+			byID[existingItem.ID] = existingItem
+			if existingItem.Stackable {
+				stackableByName[existingItem.ItemName] = existingItem
+			} else {
+				uniqueByName[existingItem.ItemName] = append(uniqueByName[existingItem.ItemName], existingItem)
+			}
 		}
-	}
 
-	// 准备批量插入、更新和删除的数据
-	var itemsToInsert []*InventoryItem
-	var itemsToUpdate []*InventoryItem
-	var itemsToDelete []*InventoryItem
+		for _, item := range characterItemList {
+			if item.ObtainedAt.IsZero() {
+				item.ObtainedAt = time.Now()
+			}
+			if item.ID > 0 {
+				existingItem, exists := byID[item.ID]
+				switch {
+				case exists && !existingItem.Stackable && item.Quantity > 0:
+					return fmt.Errorf("物品 %s（ID %d）不可堆叠，无法增加数量", existingItem.ItemName, item.ID)
+				case exists && existingItem.Quantity+item.Quantity < 0:
+					return &InsufficientItemError{ItemName: existingItem.ItemName, Required: -item.Quantity, Available: existingItem.Quantity}
+				case exists:
+					// 指定ID的物品，直接更新数量
+					existingItem.Quantity += item.Quantity
+					itemsToUpdate[existingItem.ID] = existingItem
+					continue
+				case !restore || item.Quantity < 0:
+					return fmt.Errorf("物品 %s（ID %d）不在背包中", item.ItemName, item.ID)
+				case !item.Stackable && item.Quantity > 0:
+					// 不可堆叠物品按原ID放回，多出的数量每件新建一条记录
+					for i := range item.Quantity {
+						newItem := *item
+						newItem.Quantity = 1
+						if i > 0 {
+							newItem.ID = 0
+						}
+						itemsToInsert = append(itemsToInsert, &newItem)
+					}
+					continue
+				}
+				// 放回的可堆叠物品按名称合并
+			}
 
-	for _, item := range items {
-		if existingItem, exists := userItemMap[item.UserID][item.ItemName]; exists {
-			// 物品已存在，准备更新数量
-			existingItem.Quantity += item.Quantity
-			itemsToUpdate = append(itemsToUpdate, existingItem)
-		} else {
-			// 新物品处理
-			if item.Quantity < 0 {
-				// 如果是负数量的新物品，添加到删除列表（删除可能存在的记录）
-				itemsToDelete = append(itemsToDelete, item)
-			} else {
-				// 正数量的新物品，准备插入
-				// 如果ObtainedAt为零值，使用当前时间
-				if item.ObtainedAt.IsZero() {
-					item.ObtainedAt = time.Now()
+			switch {
+			case item.Quantity >= 0 && item.Stackable:
+				if existingItem, exists := stackableByName[item.ItemName]; exists {
+					existingItem.Quantity += item.Quantity
+					if existingItem.ID > 0 {
+						itemsToUpdate[existingItem.ID] = existingItem
+					}
+				} else {
+					newItem := *item
+					newItem.ID = 0
+					stackableByName[item.ItemName] = &newItem
+					itemsToInsert = append(itemsToInsert, &newItem)
+				}
+			case item.Quantity > 0:
+				// 不可堆叠物品每件单独一条记录
+				for range item.Quantity {
+					newItem := *item
+					newItem.ID = 0
+					newItem.Quantity = 1
+					itemsToInsert = append(itemsToInsert, &newItem)
+				}
+			default:
+				// 按名称扣除，优先扣除可堆叠记录，不足的部分逐件扣除不可堆叠记录
+				remaining := -item.Quantity
+				available := 0
+				if existingItem, exists := stackableByName[item.ItemName]; exists && existingItem.Quantity > 0 {
+					available += existingItem.Quantity
+					taken := min(remaining, existingItem.Quantity)
+					existingItem.Quantity -= taken
+					remaining -= taken
+					if existingItem.ID > 0 {
+						itemsToUpdate[existingItem.ID] = existingItem
+					}
+				}
+				for _, existingItem := range uniqueByName[item.ItemName] {
+					if remaining <= 0 {
+						break
+					}
+					if existingItem.Quantity > 0 {
+						available += existingItem.Quantity
+						taken := min(remaining, existingItem.Quantity)
+						existingItem.Quantity -= taken
+						remaining -= taken
+						itemsToUpdate[existingItem.ID] = existingItem
+					}
+				}
+				if remaining > 0 {
+					return &InsufficientItemError{ItemName: item.ItemName, Required: -item.Quantity, Available: available}
 				}
-				itemsToInsert = append(itemsToInsert, item)
 			}
 		}
 	}
 
-	// 批量插入新物品
-	if len(itemsToInsert) > 0 {
-		err := db.batchInsertInventoryItems(ctx, tx, itemsToInsert)
-		if err != nil {
-			return err
+	// 批量插入新物品，数量不为正的不插入
+	var inserts []*InventoryItem
+	for _, item := range itemsToInsert {
+		if item.Quantity > 0 {
+			inserts = append(inserts, item)
 		}
 	}
-
-	// 批量更新现有物品数量
-	if len(itemsToUpdate) > 0 {
-		err := db.batchUpdateInventoryItemQuantity(ctx, tx, itemsToUpdate)
-		if err != nil {
-			return err
-		}
+	if err := db.batchInsertInventoryItems(ctx, tx, inserts); err != nil {
+		return err
 	}
 
-	// 批量删除物品
-	if len(itemsToDelete) > 0 {
-		err := db.batchDeleteInventoryItems(ctx, tx, itemsToDelete)
-		if err != nil {
-			return err
-		}
+	// 批量更新现有物品数量
+	var updates []*InventoryItem
+	for _, item := range itemsToUpdate {
+		updates = append(updates, item)
 	}
-
-	return nil
+	return db.batchUpdateInventoryItemQuantity(ctx, tx, updates)
 }
 
-// getInventoryItemsByNamesInTx 在事务中批量查询物品
-func (db *DB) getInventoryItemsByNamesInTx(ctx context.Context, tx pgx.Tx, userID int, itemNames []string) ([]*InventoryItem, error) {
-	if len(itemNames) == 0 {
+// getInventoryItemsInTx 在事务中按ID或名称批量查询并锁定物品
+func (db *DB) getInventoryItemsInTx(ctx context.Context, tx pgx.Tx, characterID int, itemIDs []int, itemNames []string) ([]*InventoryItem, error) {
+	if len(itemIDs) == 0 && len(itemNames) == 0 {
 		return nil, nil
 	}
 
 	query := `
-		SELECT user_id, item_name, item_type, quality, level, quantity,
-			properties, description, obtained_from, obtained_at
+		SELECT ` + inventoryColumns + `
 		FROM inventory
-		WHERE user_id = $1 AND item_name = ANY($2)
+		WHERE character_id = $1 AND (id = ANY($2) OR item_name = ANY($3))
+		ORDER BY id
+		FOR UPDATE
 	`
 
-	rows, err := tx.Query(ctx, query, userID, itemNames)
+	rows, err := tx.Query(ctx, query, characterID, itemIDs, itemNames)
 	if err != nil {
 		return nil, err
 	}
@@ -133,38 +251,46 @@ func (db *DB) getInventoryItemsByNamesInTx(ctx context.Context, tx pgx.Tx, userI
 
 	var items []*InventoryItem
 	for rows.Next() {
-		var item InventoryItem
-		err := rows.Scan(
-			&item.UserID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity,
-			&item.Properties, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
-		)
+		item, err := scanInventoryItem(rows)
 		if err != nil {
 			return nil, err
 		}
-		items = append(items, &item)
+		items = append(items, item)
 	}
 
 	return items, rows.Err()
 }
 
-// batchInsertInventoryItems 批量插入物品
+// batchInsertInventoryItems 批量插入物品，并回填新记录的ID
 func (db *DB) batchInsertInventoryItems(ctx context.Context, tx pgx.Tx, items []*InventoryItem) error {
 	if len(items) == 0 {
 		return nil
 	}
 
+	// 放回的物品保留原ID，原ID已被占用或未指定时自动生成
 	query := `
 		INSERT INTO inventory (
-			user_id, item_name, item_type, quality, level, quantity,
+			id, character_id, item_name, item_type, quality, level, quantity, stackable,
 			properties, description, obtained_from, obtained_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		) VALUES (
+			COALESCE(
+				(SELECT $1::int WHERE $1 > 0 AND NOT EXISTS (SELECT 1 FROM inventory WHERE id = $1)),
+				nextval(pg_get_serial_sequence('inventory', 'id'))
+			),
+			$2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
+		)
+		RETURNING id
 	`
 
 	batch := &pgx.Batch{}
 	for _, item := range items {
+		propertiesJSON, err := marshalItemProperties(item.Properties)
+		if err != nil {
+			return err
+		}
 		batch.Queue(query,
-			item.UserID, item.ItemName, item.ItemType, item.Quality, item.Level, item.Quantity,
-			item.Properties, item.Description, item.ObtainedFrom, item.ObtainedAt,
+			item.ID, item.CharacterID, item.ItemName, item.ItemType, item.Quality, item.Level, item.Quantity, item.Stackable,
+			propertiesJSON, item.Description, item.ObtainedFrom, item.ObtainedAt,
 		)
 	}
 
@@ -172,36 +298,8 @@ func (db *DB) batchInsertInventoryItems(ctx context.Context, tx pgx.Tx, items []
 	defer results.Close()
 
 	// 处理所有批量插入结果
-	for range items {
-		_, err := results.Exec()
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-// batchDeleteInventoryItems 批量删除物品
-func (db *DB) batchDeleteInventoryItems(ctx context.Context, tx pgx.Tx, items []*InventoryItem) error {
-	if len(items) == 0 {
-		return nil
-	}
-
-	query := `DELETE FROM inventory WHERE user_id = $1 AND item_name = $2`
-
-	batch := &pgx.Batch{}
 	for _, item := range items {
-		batch.Queue(query, item.UserID, item.ItemName)
-	}
-
-	results := tx.SendBatch(ctx, batch)
-	defer results.Close()
-
-	// 处理所有批量删除结果
-	for range items {
-		_, err := results.Exec()
-		if err != nil {
+		if err := results.QueryRow().Scan(&item.ID); err != nil {
 			return err
 		}
 	}
@@ -217,18 +315,18 @@ func (db *DB) batchUpdateInventoryItemQuantity(ctx context.Context, tx pgx.Tx, i
 
 	query := `
 		UPDATE inventory 
-		SET quantity = $3
-		WHERE user_id = $1 AND item_name = $2
+		SET quantity = $2
+		WHERE id = $1
 	`
 
 	batch := &pgx.Batch{}
 	for _, item := range items {
 		if item.Quantity <= 0 {
 			// 数量为0或负数时，删除物品
-			deleteQuery := `DELETE FROM inventory WHERE user_id = $1 AND item_name = $2`
-			batch.Queue(deleteQuery, item.UserID, item.ItemName)
+			deleteQuery := `DELETE FROM inventory WHERE id = $1`
+			batch.Queue(deleteQuery, item.ID)
 		} else {
-			batch.Queue(query, item.UserID, item.ItemName, item.Quantity)
+			batch.Queue(query, item.ID, item.Quantity)
 		}
 	}
 
@@ -246,26 +344,42 @@ func (db *DB) batchUpdateInventoryItemQuantity(ctx context.Context, tx pgx.Tx, i
 	return nil
 }
 
-// GetInventoryItemByID 根据物品ID获取背包物品
-func (db *DB) GetInventoryItemByName(ctx context.Context, userID int, itemName string) (*InventoryItem, error) {
+// GetInventoryItem 根据物品ID获取背包物品
+func (db *DB) GetInventoryItem(ctx context.Context, characterID int, itemID int) (*InventoryItem, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, item_name, item_type, quality, level, quantity,
-			properties, description, obtained_from, obtained_at
+		SELECT ` + inventoryColumns + `
 		FROM inventory
-		WHERE user_id = $1 AND item_name = $2
+		WHERE character_id = $1 AND id = $2
 	`
 
-	row := db.GetPool().QueryRow(timeoutCtx, query, userID, itemName)
+	item, err := scanInventoryItem(db.GetPool().QueryRow(timeoutCtx, query, characterID, itemID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
 
-	var item InventoryItem
-	err := row.Scan(
-		&item.UserID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity,
-		&item.Properties, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
-	)
+	return item, nil
+}
+
+// GetInventoryItemByName 根据物品名称获取背包物品，有多件同名物品时优先返回可堆叠的，其次是最早获得的
+func (db *DB) GetInventoryItemByName(ctx context.Context, characterID int, itemName string) (*InventoryItem, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + inventoryColumns + `
+		FROM inventory
+		WHERE character_id = $1 AND item_name = $2
+		ORDER BY stackable DESC, id
+		LIMIT 1
+	`
 
+	item, err := scanInventoryItem(db.GetPool().QueryRow(timeoutCtx, query, characterID, itemName))
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -273,23 +387,22 @@ func (db *DB) GetInventoryItemByName(ctx context.Context, userID int, itemName s
 		return nil, err
 	}
 
-	return &item, nil
+	return item, nil
 }
 
-// GetUserInventory 获取用户完整背包
-func (db *DB) GetUserInventory(ctx context.Context, userID int) ([]*InventoryItem, error) {
+// GetCharacterInventory 获取角色完整背包
+func (db *DB) GetCharacterInventory(ctx context.Context, characterID int) ([]*InventoryItem, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, item_name, item_type, quality, level, quantity,
-			properties, description, obtained_from, obtained_at
+		SELECT ` + inventoryColumns + `
 		FROM inventory
-		WHERE user_id = $1
+		WHERE character_id = $1
 		ORDER BY item_type, quality DESC, level DESC, obtained_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID)
 	if err != nil {
 		return nil, err
 	}
@@ -297,35 +410,30 @@ func (db *DB) GetUserInventory(ctx context.Context, userID int) ([]*InventoryIte
 
 	var items []*InventoryItem
 	for rows.Next() {
-		var item InventoryItem
-		err := rows.Scan(
-			&item.UserID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity,
-			&item.Properties, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
-		)
+		item, err := scanInventoryItem(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		items = append(items, &item)
+		items = append(items, item)
 	}
 
 	return items, rows.Err()
 }
 
 // GetInventoryByType 根据物品类型获取背包物品
-func (db *DB) GetInventoryByType(ctx context.Context, userID int, itemType string) ([]*InventoryItem, error) {
+func (db *DB) GetInventoryByType(ctx context.Context, characterID int, itemType string) ([]*InventoryItem, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, item_name, item_type, quality, level, quantity,
-			properties, description, obtained_from, obtained_at
+		SELECT ` + inventoryColumns + `
 		FROM inventory
-		WHERE user_id = $1 AND item_type = $2
+		WHERE character_id = $1 AND item_type = $2
 		ORDER BY quality DESC, level DESC, obtained_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID, itemType)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, itemType)
 	if err != nil {
 		return nil, err
 	}
@@ -333,89 +441,302 @@ func (db *DB) GetInventoryByType(ctx context.Context, userID int, itemType strin
 
 	var items []*InventoryItem
 	for rows.Next() {
-		var item InventoryItem
-		err := rows.Scan(
-			&item.UserID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity,
-			&item.Properties, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
-		)
+		item, err := scanInventoryItem(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		items = append(items, &item)
+		items = append(items, item)
 	}
 
 	return items, rows.Err()
 }
 
 // UpdateInventoryItemQuantity 更新物品数量
-func (db *DB) UpdateInventoryItemQuantity(ctx context.Context, userID int, itemName string, quantity int) error {
+func (db *DB) UpdateInventoryItemQuantity(ctx context.Context, characterID int, itemName string, quantity int) error {
 	if quantity <= 0 {
 		// 数量为0或负数时，删除物品
-		return db.RemoveInventoryItem(ctx, userID, itemName)
+		return db.RemoveInventoryItem(ctx, characterID, itemName)
 	}
 
 	query := `
 		UPDATE inventory 
 		SET quantity = $3
-		WHERE user_id = $1 AND item_name = $2
+		WHERE character_id = $1 AND item_name = $2
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, itemName, quantity)
+	_, err := db.GetPool().Exec(ctx, query, characterID, itemName, quantity)
 	return err
 }
 
 // RemoveInventoryItem 从背包移除物品
-func (db *DB) RemoveInventoryItem(ctx context.Context, userID int, itemName string) error {
+func (db *DB) RemoveInventoryItem(ctx context.Context, characterID int, itemName string) error {
 	query := `
 		DELETE FROM inventory
-		WHERE user_id = $1 AND item_name = $2
+		WHERE character_id = $1 AND item_name = $2
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, itemName)
+	_, err := db.GetPool().Exec(ctx, query, characterID, itemName)
 	return err
 }
 
 // UpdateInventoryItemProperties 更新物品属性
-func (db *DB) UpdateInventoryItemProperties(ctx context.Context, userID int, itemName string, properties string) error {
+func (db *DB) UpdateInventoryItemProperties(ctx context.Context, characterID int, itemName string, properties *ItemProperties) error {
+	propertiesJSON, err := marshalItemProperties(properties)
+	if err != nil {
+		return err
+	}
 	query := `
 		UPDATE inventory 
 		SET properties = $3
-		WHERE user_id = $1 AND item_name = $2
+		WHERE character_id = $1 AND item_name = $2
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, itemName, properties)
+	_, err = db.GetPool().Exec(ctx, query, characterID, itemName, propertiesJSON)
 	return err
 }
 
-// UseItem 使用物品（减少数量）
-func (db *DB) UseItem(ctx context.Context, userID int, itemName string, useQuantity int) error {
-	// 先获取当前数量
-	item, err := db.GetInventoryItemByName(ctx, userID, itemName)
+// ErrItemNotUsable 物品没有可使用的效果
+var ErrItemNotUsable = errors.New("该物品没有可使用的效果")
+
+// ItemUsage 使用物品的结果，效果已按使用数量叠加
+type ItemUsage struct {
+	Item     *InventoryItem `json:"item"`
+	Quantity int            `json:"quantity"`
+	Effect   *ItemEffect    `json:"effect"`
+	Buff     *Buff          `json:"buff,omitempty"`
+}
+
+func (u *ItemUsage) String() string {
+	result := fmt.Sprintf("使用了「%s」x%d", u.Item.ItemName, u.Quantity)
+	if effect := u.Effect.String(); effect != "" {
+		result += "，效果：" + effect
+	}
+	return result
+}
+
+// UseItem 在一个事务中消耗物品并结算其效果：恢复状态、增加修为和寿元、消除煞气、添加临时增益
+// 数量不足时返回 InsufficientItemError，没有使用效果时返回 ErrItemNotUsable
+func (db *DB) UseItem(ctx context.Context, characterID int, itemID int, itemName string, quantity int) (*ItemUsage, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	item, err := db.takeInventoryItemInTx(ctx, tx, characterID, itemID, itemName, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if item.Properties == nil || item.Properties.Effect == nil {
+		return nil, ErrItemNotUsable
+	}
+
+	effect := *item.Properties.Effect
+	effect.Experience *= int64(quantity)
+	effect.Lifespan *= quantity
+	effect.DemonicAura *= quantity
+	effect.BuffMinutes *= quantity
+	usage := &ItemUsage{Item: item, Quantity: quantity, Effect: &effect}
+
+	var previousStatus string
+	err = tx.QueryRow(ctx, `SELECT status FROM character_stats WHERE id = $1 FOR UPDATE`, characterID).Scan(&previousStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	// 疗伤丹药未指定恢复的状态时，把重伤恢复为健康
+	query := `
+		UPDATE character_stats
+		SET experience = experience + $2,
+			lifespan = lifespan + $3,
+			demonic_aura = GREATEST(demonic_aura - $4, 0),
+			status = CASE WHEN $5 <> '' THEN $5 WHEN $6 AND status = '重伤' THEN '健康' ELSE status END
+		WHERE id = $1
+		RETURNING status
+	`
+	var status string
+	err = tx.QueryRow(ctx, query, characterID, effect.Experience, effect.Lifespan, effect.DemonicAura, effect.Status, effect.Heal > 0).Scan(&status)
+	if err != nil {
+		return nil, err
+	}
+	effect.Status = ""
+	if status != previousStatus {
+		effect.Status = status
+	}
+
+	if effect.Buff != nil && effect.BuffMinutes > 0 {
+		usage.Buff = &Buff{
+			CharacterID: characterID,
+			Source:      item.ItemName,
+			Modifiers:   effect.Buff,
+			ExpiresAt:   time.Now().Add(time.Duration(effect.BuffMinutes) * time.Minute),
+		}
+		if err := db.addBuffInTx(ctx, tx, usage.Buff); err != nil {
+			return nil, err
+		}
+	}
+
+	return usage, tx.Commit(ctx)
+}
+
+// findInventoryItemInTx 在事务中定位并锁定一件物品：指定ID时按ID，否则按名称，优先可堆叠的记录，其次是最早获得的
+func (db *DB) findInventoryItemInTx(ctx context.Context, tx pgx.Tx, characterID int, itemID int, itemName string) (*InventoryItem, error) {
+	var items []*InventoryItem
+	var err error
+	if itemID > 0 {
+		items, err = db.getInventoryItemsInTx(ctx, tx, characterID, []int{itemID}, nil)
+	} else {
+		items, err = db.getInventoryItemsInTx(ctx, tx, characterID, nil, []string{itemName})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var found *InventoryItem
+	for _, item := range items {
+		if item.Stackable {
+			return item, nil
+		}
+		if found == nil {
+			found = item
+		}
+	}
+	return found, nil
+}
+
+// takeInventoryItemInTx 从角色背包中取出指定数量的物品（托管赌注、穿戴装备等），返回取出的物品
+// 不可堆叠的物品每件单独存放，一次取出多件时返回 UnstackableQuantityError
+func (db *DB) takeInventoryItemInTx(ctx context.Context, tx pgx.Tx, characterID int, itemID int, itemName string, quantity int) (*InventoryItem, error) {
+	found, err := db.findInventoryItemInTx(ctx, tx, characterID, itemID, itemName)
+	if err != nil {
+		return nil, err
+	}
+	if found != nil && !found.Stackable && quantity > 1 {
+		return nil, &UnstackableQuantityError{ItemName: found.ItemName}
+	}
+	available := 0
+	if found != nil {
+		available = found.Quantity
+		itemName = found.ItemName
+	}
+	if available < quantity {
+		return nil, &InsufficientItemError{ItemName: itemName, Required: quantity, Available: available}
+	}
+
+	item := *found
+	item.Quantity = -quantity
+	if err := db.AddInventoryItemsBatchInTx(ctx, tx, []*InventoryItem{&item}); err != nil {
+		return nil, err
+	}
+	item.Quantity = quantity
+	return &item, nil
+}
+
+// consumeInventoryItemsInTx 在事务中按名称扣除物品，同名物品合并计算，任一物品不足时返回 InsufficientItemError
+func (db *DB) consumeInventoryItemsInTx(ctx context.Context, tx pgx.Tx, characterID int, items []*InventoryItem) error {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.ItemName)
+	}
+	existingItems, err := db.getInventoryItemsInTx(ctx, tx, characterID, nil, names)
+	if err != nil {
+		return err
+	}
+	available := make(map[string]int)
+	for _, item := range existingItems {
+		available[item.ItemName] += item.Quantity
+	}
+
+	required := make(map[string]int)
+	changes := []*InventoryItem{}
+	for _, item := range items {
+		required[item.ItemName] += item.Quantity
+		if available[item.ItemName] < required[item.ItemName] {
+			return &InsufficientItemError{ItemName: item.ItemName, Required: required[item.ItemName], Available: available[item.ItemName]}
+		}
+		changes = append(changes, &InventoryItem{CharacterID: characterID, ItemName: item.ItemName, Quantity: -item.Quantity})
+	}
+	return db.AddInventoryItemsBatchInTx(ctx, tx, changes)
+}
+
+// GrantInventoryItems 直接增减角色背包物品并记录发放来源，不检查背包容量，数量为负数时扣除
+func (db *DB) GrantInventoryItems(ctx context.Context, characterID int, source string, items []*InventoryItem) error {
+	tx, err := db.BeginTx(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
+
+	for _, item := range items {
+		item.CharacterID = characterID
+	}
+	if err := db.AddInventoryItemsBatchInTx(ctx, tx, items); err != nil {
+		return err
+	}
+	if err := db.RecordItemGrantsInTx(ctx, tx, characterID, source, 0, items); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DiscardInventoryItem 丢弃背包中指定ID的物品，返回被丢弃的物品
+// quantity 不大于0时丢弃整组，数量不足时返回 InsufficientItemError
+func (db *DB) DiscardInventoryItem(ctx context.Context, characterID int, itemID int, quantity int) (*InventoryItem, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	found, err := db.findInventoryItemInTx(ctx, tx, characterID, itemID, "")
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, pgx.ErrNoRows
+	}
+	if quantity <= 0 {
+		quantity = found.Quantity
+	}
+	item, err := db.takeInventoryItemInTx(ctx, tx, characterID, itemID, "", quantity)
+	if err != nil {
+		return nil, err
+	}
+	return item, tx.Commit(ctx)
+}
+
+// MoveInventoryItemInTx 在事务中把物品整组转移到另一个角色的背包（如转世传承）
+func (db *DB) MoveInventoryItemInTx(ctx context.Context, tx pgx.Tx, fromCharacterID int, toCharacterID int, itemName string) (*InventoryItem, error) {
+	item, err := db.findInventoryItemInTx(ctx, tx, fromCharacterID, 0, itemName)
+	if err != nil {
+		return nil, err
+	}
 	if item == nil {
-		return pgx.ErrNoRows
+		return nil, pgx.ErrNoRows
 	}
 
-	if item.Quantity < useQuantity {
-		return &InsufficientItemError{ItemName: item.ItemName, Required: useQuantity, Available: item.Quantity}
+	if _, err := tx.Exec(ctx, `DELETE FROM inventory WHERE id = $1`, item.ID); err != nil {
+		return nil, err
 	}
 
-	newQuantity := item.Quantity - useQuantity
-	return db.UpdateInventoryItemQuantity(ctx, userID, item.ItemName, newQuantity)
+	// 不可堆叠物品保留原ID，可堆叠物品合并到新角色的同名物品
+	item.CharacterID = toCharacterID
+	if err := db.RestoreInventoryItemsInTx(ctx, tx, []*InventoryItem{item}); err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
 // GetInventoryItemCount 获取特定物品的数量
-func (db *DB) GetInventoryItemCount(ctx context.Context, userID int, itemName string) (int, error) {
+func (db *DB) GetInventoryItemCount(ctx context.Context, characterID int, itemName string) (int, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
 		SELECT quantity FROM inventory
-		WHERE user_id = $1 AND item_name = $2
+		WHERE character_id = $1 AND item_name = $2
 	`
 
 	var quantity int
-	err := db.GetPool().QueryRow(timeoutCtx, query, userID, itemName).Scan(&quantity)
+	err := db.GetPool().QueryRow(timeoutCtx, query, characterID, itemName).Scan(&quantity)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return 0, nil
@@ -427,19 +748,18 @@ func (db *DB) GetInventoryItemCount(ctx context.Context, userID int, itemName st
 }
 
 // GetInventoryByQuality 根据品质获取背包物品
-func (db *DB) GetInventoryByQuality(ctx context.Context, userID int, quality string) ([]*InventoryItem, error) {
+func (db *DB) GetInventoryByQuality(ctx context.Context, characterID int, quality string) ([]*InventoryItem, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, item_name, item_type, quality, level, quantity,
-			properties, description, obtained_from, obtained_at
+		SELECT ` + inventoryColumns + `
 		FROM inventory
-		WHERE user_id = $1 AND quality = $2
+		WHERE character_id = $1 AND quality = $2
 		ORDER BY item_type, level DESC, obtained_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID, quality)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, quality)
 	if err != nil {
 		return nil, err
 	}
@@ -447,35 +767,30 @@ func (db *DB) GetInventoryByQuality(ctx context.Context, userID int, quality str
 
 	var items []*InventoryItem
 	for rows.Next() {
-		var item InventoryItem
-		err := rows.Scan(
-			&item.UserID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity,
-			&item.Properties, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
-		)
+		item, err := scanInventoryItem(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		items = append(items, &item)
+		items = append(items, item)
 	}
 
 	return items, rows.Err()
 }
 
 // SearchInventoryByName 根据物品名称搜索背包物品
-func (db *DB) SearchInventoryByName(ctx context.Context, userID int, itemName string) ([]*InventoryItem, error) {
+func (db *DB) SearchInventoryByName(ctx context.Context, characterID int, itemName string) ([]*InventoryItem, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, item_name, item_type, quality, level, quantity,
-			properties, description, obtained_from, obtained_at
+		SELECT ` + inventoryColumns + `
 		FROM inventory
-		WHERE user_id = $1 AND item_name ILIKE '%' || $2 || '%'
+		WHERE character_id = $1 AND item_name ILIKE '%' || $2 || '%'
 		ORDER BY item_type, quality DESC, level DESC, obtained_at DESC
 	`
 
-	rows, err := db.GetPool().Query(timeoutCtx, query, userID, itemName)
+	rows, err := db.GetPool().Query(timeoutCtx, query, characterID, itemName)
 	if err != nil {
 		return nil, err
 	}
@@ -483,16 +798,12 @@ func (db *DB) SearchInventoryByName(ctx context.Context, userID int, itemName st
 
 	var items []*InventoryItem
 	for rows.Next() {
-		var item InventoryItem
-		err := rows.Scan(
-			&item.UserID, &item.ItemName, &item.ItemType, &item.Quality, &item.Level, &item.Quantity,
-			&item.Properties, &item.Description, &item.ObtainedFrom, &item.ObtainedAt,
-		)
+		item, err := scanInventoryItem(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		items = append(items, &item)
+		items = append(items, item)
 	}
 
 	return items, rows.Err()
@@ -508,3 +819,12 @@ type InsufficientItemError struct {
 func (e *InsufficientItemError) Error() string {
 	return fmt.Sprintf("物品 %s 数量不足：需要 %d，可用 %d", e.ItemName, e.Required, e.Available)
 }
+
+// UnstackableQuantityError 不可堆叠的物品一次只能取出一件
+type UnstackableQuantityError struct {
+	ItemName string
+}
+
+func (e *UnstackableQuantityError) Error() string {
+	return fmt.Sprintf("%s 不可堆叠，每件单独存放，一次只能押上或取出一件", e.ItemName)
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ItemQualities 物品品质，从低到高
+var ItemQualities = []string{"普通", "高级", "稀有", "史诗", "传说"}
+
+// QualityTier 品质的序号，无法识别时返回 -1
+func QualityTier(quality string) int {
+	return slices.Index(ItemQualities, quality)
+}
+
+// ItemModifiers 装备对角色属性的加成
+type ItemModifiers struct {
+	Attack      int `json:"attack,omitempty"`
+	Defense     int `json:"defense,omitempty"`
+	Speed       int `json:"speed,omitempty"`
+	SpiritSense int `json:"spirit_sense,omitempty"`
+	Physique    int `json:"physique,omitempty"`
+	Luck        int `json:"luck,omitempty"`
+}
+
+func (m *ItemModifiers) String() string {
+	if m == nil {
+		return "无"
+	}
+	parts := []string{}
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"攻击", m.Attack}, {"防御", m.Defense}, {"速度", m.Speed},
+		{"神识", m.SpiritSense}, {"根骨", m.Physique}, {"幸运", m.Luck},
+	} {
+		if field.value != 0 {
+			parts = append(parts, fmt.Sprintf("%s%+d", field.name, field.value))
+		}
+	}
+	if len(parts) == 0 {
+		return "无"
+	}
+	return strings.Join(parts, " ")
+}
+
+// ItemEffect 丹药等消耗品的使用效果
+type ItemEffect struct {
+	Heal        int    `json:"heal,omitempty"`         // 战斗中恢复气血的百分比
+	Status      string `json:"status,omitempty"`       // 使用后恢复的状态，如"健康"
+	Experience  int64  `json:"experience,omitempty"`   // 增加的修炼经验
+	Lifespan    int    `json:"lifespan,omitempty"`     // 增加的寿元
+	DemonicAura int    `json:"demonic_aura,omitempty"` // 消除的煞气
+
+	// 临时增益，持续时间按使用数量叠加
+	Buff        *ItemModifiers `json:"buff,omitempty"`
+	BuffMinutes int            `json:"buff_minutes,omitempty"`
+}
+
+func (e *ItemEffect) String() string {
+	parts := []string{}
+	if e.Heal > 0 {
+		parts = append(parts, fmt.Sprintf("恢复%d%%气血", e.Heal))
+	}
+	if e.Status != "" {
+		parts = append(parts, fmt.Sprintf("恢复为%s", e.Status))
+	}
+	if e.Experience != 0 {
+		parts = append(parts, fmt.Sprintf("修炼经验%+d", e.Experience))
+	}
+	if e.Lifespan != 0 {
+		parts = append(parts, fmt.Sprintf("寿元%+d", e.Lifespan))
+	}
+	if e.DemonicAura > 0 {
+		parts = append(parts, fmt.Sprintf("消除%d点煞气", e.DemonicAura))
+	}
+	if e.Buff != nil && e.BuffMinutes > 0 {
+		parts = append(parts, fmt.Sprintf("%d分钟内%s", e.BuffMinutes, e.Buff))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ItemProperties 物品的结构化属性 (JSONB存储)
+type ItemProperties struct {
+	Modifiers     *ItemModifiers `json:"modifiers,omitempty"`      // 装备后的属性加成
+	Effect        *ItemEffect    `json:"effect,omitempty"`         // 使用后的效果
+	Durability    int            `json:"durability,omitempty"`     // 当前耐久
+	MaxDurability int            `json:"max_durability,omitempty"` // 最大耐久
+	Bound         bool           `json:"bound,omitempty"`          // 是否绑定，绑定物品不能交易
+	Element       string         `json:"element,omitempty"`        // 五行属性
+	Weight        int            `json:"weight,omitempty"`         // 单件占用的背包容量，不填按1计
+	Capacity      int            `json:"capacity,omitempty"`       // 储物袋提供的背包容量
+	Notes         string         `json:"notes,omitempty"`          // 其他特殊效果的文字描述
+}
+
+// UnmarshalJSON 兼容旧版的纯文本属性，文本保存在 Notes 中
+func (p *ItemProperties) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*p = ItemProperties{Notes: text}
+		return nil
+	}
+	type plain ItemProperties
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+func (p *ItemProperties) String() string {
+	if p == nil {
+		return "无"
+	}
+	parts := []string{}
+	if p.Modifiers != nil && *p.Modifiers != (ItemModifiers{}) {
+		parts = append(parts, p.Modifiers.String())
+	}
+	if p.Effect != nil {
+		if effect := p.Effect.String(); effect != "" {
+			parts = append(parts, effect)
+		}
+	}
+	if p.Element != "" {
+		parts = append(parts, fmt.Sprintf("%s属性", p.Element))
+	}
+	if p.Capacity > 0 {
+		parts = append(parts, fmt.Sprintf("容量%d", p.Capacity))
+	}
+	if p.Weight > 1 {
+		parts = append(parts, fmt.Sprintf("占用%d格", p.Weight))
+	}
+	if p.MaxDurability > 0 {
+		parts = append(parts, fmt.Sprintf("耐久%d/%d", p.Durability, p.MaxDurability))
+	}
+	if p.Bound {
+		parts = append(parts, "已绑定")
+	}
+	if p.Notes != "" {
+		parts = append(parts, p.Notes)
+	}
+	if len(parts) == 0 {
+		return "无"
+	}
+	return strings.Join(parts, "，")
+}
+
+// marshalItemProperties 序列化物品属性，没有属性时返回 nil 以存储 NULL
+func marshalItemProperties(properties *ItemProperties) ([]byte, error) {
+	if properties == nil {
+		return nil, nil
+	}
+	return json.Marshal(properties)
+}
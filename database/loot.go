@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 物品发放来源，用于审计
+const (
+	GrantSourceLoot     = "loot"     // roll_loot 掷出的掉落
+	GrantSourceGM       = "gm"       // 天道通过 update_inventory 直接发放，现已只能扣除，仅保留历史记录
+	GrantSourcePurchase = "purchase" // 灵石购买
+	GrantSourceCombat   = "combat"   // 战斗胜利奖励
+	GrantSourceCraft    = "craft"    // 炼丹炼器产出
+	GrantSourceAdmin    = "admin"    // 管理员通过 /admin give 发放
+)
+
+// LootEntry 掉落表中的一项，Item 为空表示什么也没掉
+type LootEntry struct {
+	Item        *InventoryItem `json:"item,omitempty"`
+	Weight      int            `json:"weight,omitempty"`       // 权重，不填时按物品品质决定
+	MinQuantity int            `json:"min_quantity,omitempty"` // 掉落数量下限，不填为1
+	MaxQuantity int            `json:"max_quantity,omitempty"` // 掉落数量上限，不填等于下限
+}
+
+// LootTable 管理员设定的掉落表，按地点和敌人等级匹配
+type LootTable struct {
+	ID        int          `json:"id"`
+	Name      string       `json:"name"`
+	Location  string       `json:"location"`   // 地点关键字，为空时适用于任意地点
+	EnemyTier int          `json:"enemy_tier"` // 敌人等级，0 表示任意
+	Rolls     int          `json:"rolls"`      // 每次抽取的次数
+	Entries   []*LootEntry `json:"entries"`
+	CreatedAt time.Time    `json:"created_at,omitzero"`
+}
+
+// LootRoll 一次掉落抽取记录，Rolled 为掷出的物品
+type LootRoll struct {
+	ID          int              `json:"id"`
+	CharacterID int              `json:"character_id"`
+	LootTableID int              `json:"loot_table_id"`
+	Location    string           `json:"location"`
+	EnemyTier   int              `json:"enemy_tier"`
+	Rolled      []*InventoryItem `json:"rolled"`
+	Granted     bool             `json:"granted"` // 是否已放入背包
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// GrantAudit 角色在一段时间内掷出和实际获得的物品数量
+type GrantAudit struct {
+	CharacterID int    `json:"character_id"`
+	Name        string `json:"name"`
+	Rolled      int    `json:"rolled"`   // roll_loot 掷出的数量
+	Looted      int    `json:"looted"`   // 掉落实际放入背包的数量
+	GMGranted   int    `json:"gm"`       // 天道直接发放的数量
+	Combat      int    `json:"combat"`   // 战斗奖励的数量
+	Purchased   int    `json:"purchase"` // 购买的数量
+	Crafted     int    `json:"craft"`    // 炼制产出的数量
+}
+
+const lootTableColumns = `id, name, location, enemy_tier, rolls, entries, created_at`
+
+func scanLootTable(row pgx.Row) (*LootTable, error) {
+	var table LootTable
+	var entriesJSON []byte
+	err := row.Scan(&table.ID, &table.Name, &table.Location, &table.EnemyTier, &table.Rolls, &entriesJSON, &table.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析掉落项JSON
+	if err := json.Unmarshal(entriesJSON, &table.Entries); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// SaveLootTable 保存掉落表，同名的掉落表会被覆盖
+func (db *DB) SaveLootTable(ctx context.Context, table *LootTable) error {
+	entriesJSON, err := json.Marshal(table.Entries)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO loot_tables (name, location, enemy_tier, rolls, entries)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name) DO UPDATE SET
+			location = EXCLUDED.location,
+			enemy_tier = EXCLUDED.enemy_tier,
+			rolls = EXCLUDED.rolls,
+			entries = EXCLUDED.entries
+		RETURNING id, created_at
+	`
+	return db.GetPool().QueryRow(ctx, query, table.Name, table.Location, table.EnemyTier, table.Rolls, entriesJSON).Scan(&table.ID, &table.CreatedAt)
+}
+
+// DeleteLootTable 删除掉落表，返回是否存在
+func (db *DB) DeleteLootTable(ctx context.Context, name string) (bool, error) {
+	tag, err := db.GetPool().Exec(ctx, `DELETE FROM loot_tables WHERE name = $1`, name)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetLootTables 获取全部掉落表
+func (db *DB) GetLootTables(ctx context.Context) ([]*LootTable, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + lootTableColumns + `
+		FROM loot_tables
+		ORDER BY enemy_tier, name
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []*LootTable
+	for rows.Next() {
+		table, err := scanLootTable(rows)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
+// CreateLootRollInTx 在事务中记录一次掉落抽取
+func (db *DB) CreateLootRollInTx(ctx context.Context, tx pgx.Tx, roll *LootRoll) error {
+	rolledJSON, err := json.Marshal(roll.Rolled)
+	if err != nil {
+		return err
+	}
+	if roll.CreatedAt.IsZero() {
+		roll.CreatedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO loot_rolls (character_id, loot_table_id, location, enemy_tier, rolled, granted, created_at)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	return tx.QueryRow(ctx, query,
+		roll.CharacterID, roll.LootTableID, roll.Location, roll.EnemyTier, rolledJSON, roll.Granted, roll.CreatedAt,
+	).Scan(&roll.ID)
+}
+
+// RecordItemGrantsInTx 在事务中记录发放到角色背包的物品，数量不为正的忽略
+func (db *DB) RecordItemGrantsInTx(ctx context.Context, tx pgx.Tx, characterID int, source string, lootRollID int, items []*InventoryItem) error {
+	query := `
+		INSERT INTO item_grants (character_id, source, loot_roll_id, item_name, quality, quantity)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6)
+	`
+	batch := &pgx.Batch{}
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			continue
+		}
+		batch.Queue(query, characterID, source, lootRollID, item.ItemName, item.Quality, item.Quantity)
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return tx.SendBatch(ctx, batch).Close()
+}
+
+// GetGrantAudit 统计一段时间内各角色掷出的掉落和各来源实际发放的物品数量，天道直接发放多的排在前面
+func (db *DB) GetGrantAudit(ctx context.Context, since time.Time, limit int) ([]*GrantAudit, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		WITH rolled AS (
+			SELECT r.character_id, SUM((e->>'quantity')::int) AS quantity
+			FROM loot_rolls r, jsonb_array_elements(r.rolled) e
+			WHERE r.created_at >= $1
+			GROUP BY r.character_id
+		), granted AS (
+			SELECT character_id,
+				SUM(quantity) FILTER (WHERE source = $2) AS loot,
+				SUM(quantity) FILTER (WHERE source = $3) AS gm,
+				SUM(quantity) FILTER (WHERE source = $4) AS combat,
+				SUM(quantity) FILTER (WHERE source = $5) AS purchase,
+				SUM(quantity) FILTER (WHERE source = $6) AS craft
+			FROM item_grants
+			WHERE created_at >= $1
+			GROUP BY character_id
+		)
+		SELECT c.id, c.name, COALESCE(r.quantity, 0), COALESCE(g.loot, 0), COALESCE(g.gm, 0),
+			COALESCE(g.combat, 0), COALESCE(g.purchase, 0), COALESCE(g.craft, 0)
+		FROM character_stats c
+		LEFT JOIN rolled r ON r.character_id = c.id
+		LEFT JOIN granted g ON g.character_id = c.id
+		WHERE r.character_id IS NOT NULL OR g.character_id IS NOT NULL
+		ORDER BY COALESCE(g.gm, 0) + COALESCE(g.combat, 0) DESC, c.id
+		LIMIT $7
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, since,
+		GrantSourceLoot, GrantSourceGM, GrantSourceCombat, GrantSourcePurchase, GrantSourceCraft, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var audits []*GrantAudit
+	for rows.Next() {
+		var audit GrantAudit
+		err := rows.Scan(&audit.CharacterID, &audit.Name, &audit.Rolled, &audit.Looted, &audit.GMGranted,
+			&audit.Combat, &audit.Purchased, &audit.Crafted)
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, &audit)
+	}
+
+	return audits, rows.Err()
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"slices"
 	"time"
 
 	"google.golang.org/genai"
@@ -10,16 +11,27 @@ import (
 
 // Message 表示一条消息
 type Message struct {
-	ID         int       `json:"id"`
-	UserID     int       `json:"user_id"`
-	Role       string    `json:"role"`
-	Content    any       `json:"content"`
-	CreatedAt  time.Time `json:"created_at"`
-	LLMAPIType string    `json:"llm_api_type"`
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	CharacterID int       `json:"character_id"`
+	Role        string    `json:"role"`
+	Content     any       `json:"content"`
+	CreatedAt   time.Time `json:"created_at"`
+	LLMAPIType  string    `json:"llm_api_type"`
 }
 
-// AddMessage 添加新消息
-func (db *DB) AddMessage(ctx context.Context, userID int, role string, content any) error {
+// AddMessage 添加新消息，消息归属于角色，用户ID由角色推导
+func (db *DB) AddMessage(ctx context.Context, characterID int, role string, content any) error {
+	return db.addMessage(ctx, characterID, role, content, false)
+}
+
+// AddSystemMessage 以玩家身份写入一条系统提示（炼制结果、订单结果等），供天道下次参考
+// 系统提示单独标记，不计入玩家的发言统计
+func (db *DB) AddSystemMessage(ctx context.Context, characterID int, text string) error {
+	return db.addMessage(ctx, characterID, "user", []*genai.Part{genai.NewPartFromText("[系统]: " + text)}, true)
+}
+
+func (db *DB) addMessage(ctx context.Context, characterID int, role string, content any, system bool) error {
 	tx, err := db.BeginTx(ctx)
 	if err != nil {
 		return err
@@ -34,9 +46,9 @@ func (db *DB) AddMessage(ctx context.Context, userID int, role string, content a
 
 	// 插入新消息
 	_, err = tx.Exec(ctx, `
-		INSERT INTO messages (user_id, role, content)
-		VALUES ($1, $2, $3)
-	`, userID, role, contentBytes)
+		INSERT INTO messages (user_id, character_id, role, content, is_system)
+		SELECT user_id, id, $2, $3, $4 FROM character_stats WHERE id = $1
+	`, characterID, role, contentBytes, system)
 	if err != nil {
 		return err
 	}
@@ -47,7 +59,7 @@ func (db *DB) AddMessage(ctx context.Context, userID int, role string, content a
 // GetUserMessages 获取用户的所有消息，按创建时间排序
 func (db *DB) GetUserMessages(ctx context.Context, userID int) ([]Message, error) {
 	query := `
-		SELECT id, user_id, role, content, created_at, llm_api_type
+		SELECT id, user_id, COALESCE(character_id, 0), role, content, created_at, llm_api_type
 		FROM messages
 		WHERE user_id = $1
 		ORDER BY created_at ASC
@@ -67,6 +79,7 @@ func (db *DB) GetUserMessages(ctx context.Context, userID int) ([]Message, error
 		err := rows.Scan(
 			&msg.ID,
 			&msg.UserID,
+			&msg.CharacterID,
 			&msg.Role,
 			&contentBytes,
 			&msg.CreatedAt,
@@ -91,17 +104,17 @@ func (db *DB) GetUserMessages(ctx context.Context, userID int) ([]Message, error
 	return messages, rows.Err()
 }
 
-// GetRecentMessages 获取用户最近的N条消息
-func (db *DB) GetRecentMessages(ctx context.Context, userID int, limit int) ([]Message, error) {
+// GetRecentMessages 获取角色最近的N条消息
+func (db *DB) GetRecentMessages(ctx context.Context, characterID int, limit int) ([]Message, error) {
 	query := `
-		SELECT id, user_id, role, content, created_at, llm_api_type
+		SELECT id, user_id, COALESCE(character_id, 0), role, content, created_at, llm_api_type
 		FROM messages
-		WHERE user_id = $1
+		WHERE character_id = $1
 		ORDER BY created_at DESC
 		LIMIT $2
 	`
 
-	rows, err := db.GetPool().Query(ctx, query, userID, limit)
+	rows, err := db.GetPool().Query(ctx, query, characterID, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -115,6 +128,7 @@ func (db *DB) GetRecentMessages(ctx context.Context, userID int, limit int) ([]M
 		err := rows.Scan(
 			&msg.ID,
 			&msg.UserID,
+			&msg.CharacterID,
 			&msg.Role,
 			&contentBytes,
 			&msg.CreatedAt,
@@ -144,12 +158,54 @@ func (db *DB) GetRecentMessages(ctx context.Context, userID int, limit int) ([]M
 	return messages, rows.Err()
 }
 
+// GetRecentUserMessages 获取用户所有角色最近的N条消息，按时间正序
+func (db *DB) GetRecentUserMessages(ctx context.Context, userID int, limit int) ([]Message, error) {
+	query := `
+		SELECT id, user_id, COALESCE(character_id, 0), role, content, created_at, llm_api_type
+		FROM messages
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+
+	rows, err := db.GetPool().Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var contentBytes []byte
+		err := rows.Scan(&msg.ID, &msg.UserID, &msg.CharacterID, &msg.Role, &contentBytes, &msg.CreatedAt, &msg.LLMAPIType)
+		if err != nil {
+			return nil, err
+		}
+		var parts []*genai.Part
+		if err := json.Unmarshal(contentBytes, &parts); err != nil {
+			return nil, err
+		}
+		msg.Content = parts
+		messages = append(messages, msg)
+	}
+
+	slices.Reverse(messages)
+	return messages, rows.Err()
+}
+
 // ClearUserMessages 清空用户的所有消息
 func (db *DB) ClearUserMessages(ctx context.Context, userID int) error {
 	_, err := db.GetPool().Exec(ctx, "DELETE FROM messages WHERE user_id = $1", userID)
 	return err
 }
 
+// ClearCharacterMessages 清空角色的所有消息
+func (db *DB) ClearCharacterMessages(ctx context.Context, characterID int) error {
+	_, err := db.GetPool().Exec(ctx, "DELETE FROM messages WHERE character_id = $1", characterID)
+	return err
+}
+
 // GetMessageCount 获取用户的消息数量
 func (db *DB) GetMessageCount(ctx context.Context, userID int) (int, error) {
 	var count int
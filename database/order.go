@@ -0,0 +1,339 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 订单状态
+const (
+	OrderStatusPending   = "pending"   // 等待玩家确认
+	OrderStatusConfirmed = "confirmed" // 玩家确认且已扣款
+	OrderStatusCancelled = "cancelled" // 玩家取消
+	OrderStatusExpired   = "expired"   // 玩家未在规定时间内确认
+	OrderStatusFailed    = "failed"    // 确认时商品、余额或背包不满足条件
+	OrderStatusRefunded  = "refunded"  // 已由管理员退款
+)
+
+// ErrOrderNotRefundable 只有已成交的订单可以退款
+var ErrOrderNotRefundable = errors.New("只有已成交的订单可以退款")
+
+// Order 天道发起的购买订单，玩家确认后才扣除灵石
+type Order struct {
+	ID            int              `json:"id"`
+	UserID        int              `json:"user_id"`
+	CharacterID   int              `json:"character_id"`
+	CharacterName string           `json:"character_name"`
+	TgID          int64            `json:"tg_id"`
+	Lines         []*ShopOrderLine `json:"lines"`
+	Total         int64            `json:"total"`          // 下单时报价的总价
+	Items         []*InventoryItem `json:"items"`          // 成交后放入背包的物品
+	BalanceBefore int64            `json:"balance_before"` // 成交前的灵石余额
+	BalanceAfter  int64            `json:"balance_after"`  // 成交后的灵石余额
+	MessageID     int              `json:"message_id"`     // 触发购买的玩家消息
+	Turn          string           `json:"turn"`           // 触发购买的玩家发言
+	Status        string           `json:"status"`
+	Result        string           `json:"result"` // 失败或退款原因
+	CreatedAt     time.Time        `json:"created_at"`
+	ResolvedAt    time.Time        `json:"resolved_at,omitzero"`
+	RefundedAt    time.Time        `json:"refunded_at,omitzero"`
+}
+
+// OrderStatusNames 订单状态的中文名
+var OrderStatusNames = map[string]string{
+	OrderStatusPending:   "待确认",
+	OrderStatusConfirmed: "已成交",
+	OrderStatusCancelled: "已取消",
+	OrderStatusExpired:   "已过期",
+	OrderStatusFailed:    "失败",
+	OrderStatusRefunded:  "已退款",
+}
+
+const orderColumns = `o.id, o.user_id, o.character_id, c.name, u.tg_id, o.lines, o.total, o.items,
+			COALESCE(o.balance_before, 0), COALESCE(o.balance_after, 0), o.message_id, o.turn, o.status, o.result, o.created_at,
+			COALESCE(o.resolved_at, 'epoch'::timestamp), COALESCE(o.refunded_at, 'epoch'::timestamp)`
+
+const orderJoins = `
+		FROM orders o
+		JOIN users u ON u.id = o.user_id
+		JOIN character_stats c ON c.id = o.character_id`
+
+func scanOrder(row pgx.Row) (*Order, error) {
+	var order Order
+	var linesJSON, itemsJSON []byte
+	err := row.Scan(
+		&order.ID, &order.UserID, &order.CharacterID, &order.CharacterName, &order.TgID, &linesJSON, &order.Total, &itemsJSON,
+		&order.BalanceBefore, &order.BalanceAfter, &order.MessageID, &order.Turn, &order.Status, &order.Result, &order.CreatedAt,
+		&order.ResolvedAt, &order.RefundedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if order.ResolvedAt.Unix() == 0 {
+		order.ResolvedAt = time.Time{}
+	}
+	if order.RefundedAt.Unix() == 0 {
+		order.RefundedAt = time.Time{}
+	}
+
+	// 解析订单明细和成交物品JSON
+	if err := json.Unmarshal(linesJSON, &order.Lines); err != nil {
+		return nil, err
+	}
+	if len(itemsJSON) > 0 {
+		if err := json.Unmarshal(itemsJSON, &order.Items); err != nil {
+			return nil, err
+		}
+	}
+	return &order, nil
+}
+
+// CreateOrder 按当前价格报价并创建待确认订单，不扣除灵石
+// 商品不可购买时返回 ShopItemUnavailableError，余额不足时返回 InsufficientBalanceError
+func (db *DB) CreateOrder(ctx context.Context, order *Order) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	order.Lines, _, err = db.quoteShopItemsInTx(ctx, tx, order.Lines, false)
+	if err != nil {
+		return err
+	}
+	order.Total = 0
+	for _, line := range order.Lines {
+		order.Total += line.UnitPrice * int64(line.Quantity)
+	}
+	balance, err := db.GetUserTotalToken(ctx, order.UserID)
+	if err != nil {
+		return err
+	}
+	if balance < order.Total {
+		return &InsufficientBalanceError{Required: order.Total, Available: balance}
+	}
+
+	linesJSON, err := json.Marshal(order.Lines)
+	if err != nil {
+		return err
+	}
+	order.Status = OrderStatusPending
+	order.CreatedAt = time.Now()
+	query := `
+		INSERT INTO orders (user_id, character_id, lines, total, message_id, turn, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, query,
+		order.UserID, order.CharacterID, linesJSON, order.Total, order.MessageID, order.Turn, order.Status, order.CreatedAt,
+	).Scan(&order.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetOrder 获取订单
+func (db *DB) GetOrder(ctx context.Context, id int) (*Order, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + orderColumns + orderJoins + ` WHERE o.id = $1`
+	order, err := scanOrder(db.GetPool().QueryRow(timeoutCtx, query, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+// GetUserOrders 获取用户最近的订单，新的在前
+func (db *DB) GetUserOrders(ctx context.Context, userID int, limit int) ([]*Order, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + orderColumns + orderJoins + ` WHERE o.user_id = $1 ORDER BY o.created_at DESC LIMIT $2`
+	rows, err := db.GetPool().Query(timeoutCtx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []*Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, rows.Err()
+}
+
+// GetExpiredOrders 获取在指定时间之前创建且仍未确认的订单
+func (db *DB) GetExpiredOrders(ctx context.Context, before time.Time) ([]*Order, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + orderColumns + orderJoins + ` WHERE o.status = $1 AND o.created_at < $2`
+	rows, err := db.GetPool().Query(timeoutCtx, query, OrderStatusPending, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []*Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, rows.Err()
+}
+
+// lockPendingOrderInTx 锁定一笔待确认的订单，已被处理的返回 nil
+func (db *DB) lockPendingOrderInTx(ctx context.Context, tx pgx.Tx, id int) (*Order, error) {
+	query := `SELECT ` + orderColumns + orderJoins + ` WHERE o.id = $1 AND o.status = $2 FOR UPDATE OF o`
+	order, err := scanOrder(tx.QueryRow(ctx, query, id, OrderStatusPending))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+// ResolveOrder 取消、过期或标记失败一笔待确认的订单，已被处理的返回 nil
+func (db *DB) ResolveOrder(ctx context.Context, id int, status string, result string) (*Order, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	order, err := db.lockPendingOrderInTx(ctx, tx, id)
+	if err != nil || order == nil {
+		return nil, err
+	}
+	if err := db.resolveOrderInTx(ctx, tx, order, status, result); err != nil {
+		return nil, err
+	}
+
+	return order, tx.Commit(ctx)
+}
+
+func (db *DB) resolveOrderInTx(ctx context.Context, tx pgx.Tx, order *Order, status string, result string) error {
+	order.Status = status
+	order.Result = result
+	order.ResolvedAt = time.Now()
+	_, err := tx.Exec(ctx, `UPDATE orders SET status = $2, result = $3, resolved_at = $4 WHERE id = $1`,
+		order.ID, order.Status, order.Result, order.ResolvedAt)
+	return err
+}
+
+// ConfirmOrder 玩家确认订单后按报价结算，在同一事务中校验价格和库存、扣除灵石并放入背包
+// 商品、余额或背包不满足条件时订单标记为失败，并返回对应的错误；已被处理的订单返回 nil
+func (db *DB) ConfirmOrder(ctx context.Context, id int, baseCapacity int) (*Order, *Purchase, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	order, err := db.lockPendingOrderInTx(ctx, tx, id)
+	if err != nil || order == nil {
+		return nil, nil, err
+	}
+
+	purchase, err := db.purchaseShopItemsInTx(ctx, tx, order.UserID, order.CharacterID, order.Lines, baseCapacity)
+	if err != nil {
+		var unavailable *ShopItemUnavailableError
+		var insufficient *InsufficientBalanceError
+		var full *InventoryFullError
+		if !errors.As(err, &unavailable) && !errors.As(err, &insufficient) && !errors.As(err, &full) {
+			return nil, nil, err
+		}
+		tx.Rollback(ctx)
+		if _, resolveErr := db.ResolveOrder(ctx, id, OrderStatusFailed, err.Error()); resolveErr != nil {
+			return nil, nil, resolveErr
+		}
+		return order, nil, err
+	}
+	if err := db.resolveOrderInTx(ctx, tx, order, OrderStatusConfirmed, ""); err != nil {
+		return nil, nil, err
+	}
+
+	// 记录成交物品和前后余额，供查询和退款
+	order.Items = purchase.Items
+	order.BalanceBefore = purchase.Balance + purchase.Cost
+	order.BalanceAfter = purchase.Balance
+	itemsJSON, err := json.Marshal(order.Items)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = tx.Exec(ctx, `UPDATE orders SET items = $2, balance_before = $3, balance_after = $4 WHERE id = $1`,
+		order.ID, itemsJSON, order.BalanceBefore, order.BalanceAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return order, purchase, tx.Commit(ctx)
+}
+
+// RefundOrder 退款一笔已成交的订单，在同一事务中退还灵石、收回物品并恢复库存
+// 订单不存在时返回 nil，未成交时返回 ErrOrderNotRefundable，物品已被用掉时返回 InsufficientItemError
+func (db *DB) RefundOrder(ctx context.Context, id int, reason string) (*Order, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT ` + orderColumns + orderJoins + ` WHERE o.id = $1 FOR UPDATE OF o`
+	order, err := scanOrder(tx.QueryRow(ctx, query, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if order.Status != OrderStatusConfirmed {
+		return nil, ErrOrderNotRefundable
+	}
+
+	if err := db.consumeInventoryItemsInTx(ctx, tx, order.CharacterID, order.Items); err != nil {
+		return nil, err
+	}
+	if err := db.UpdateUserTotalUsedTokenTx(ctx, tx, order.UserID, -(order.BalanceBefore - order.BalanceAfter)); err != nil {
+		return nil, err
+	}
+	for _, line := range order.Lines {
+		_, err := tx.Exec(ctx, `UPDATE shop_items SET stock = stock + $2 WHERE id = $1 AND stock <> $3`, line.ShopItemID, line.Quantity, UnlimitedStock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order.Status = OrderStatusRefunded
+	order.Result = reason
+	order.RefundedAt = time.Now()
+	_, err = tx.Exec(ctx, `UPDATE orders SET status = $2, result = $3, refunded_at = $4 WHERE id = $1`,
+		order.ID, order.Status, order.Result, order.RefundedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, tx.Commit(ctx)
+}
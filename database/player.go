@@ -3,11 +3,13 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 // SpiritualRoots 灵根属性结构
@@ -18,11 +20,19 @@ type SpiritualRoot struct {
 	Afinity  int    `json:"affinity"`
 }
 
+// CharacterStatusDead 角色陨落后的状态，陨落的角色只能转世
+const CharacterStatusDead = "陨落"
+
 // CharacterStats 人物属性结构
 type CharacterStats struct {
+	ID     int    `json:"id"`
 	UserID int    `json:"user_id"`
 	Name   string `json:"name"`
 
+	// 转世信息
+	Generation          int `json:"generation"`            // 第几世
+	PreviousCharacterID int `json:"previous_character_id"` // 前世角色ID，0表示没有前世
+
 	// 修炼境界
 	Realm      string `json:"realm"`
 	RealmLevel int    `json:"realm_level"`
@@ -58,11 +68,13 @@ type CharacterStats struct {
 
 	// 成长经历
 	Stories string `json:"stories"`
+
+	CreatedAt time.Time `json:"created_at,omitzero"`
 }
 
 // CharacterStatsUpdate 用于部分更新的结构体，所有字段都是指针类型
 type CharacterStatsUpdate struct {
-	UserID int `json:"user_id,omitempty"` // 必须字段，不使用指针
+	CharacterID int `json:"character_id,omitempty"` // 必须字段，不使用指针
 
 	// 修炼境界
 	Realm      *string `json:"realm,omitempty"`
@@ -103,6 +115,71 @@ func (c *CharacterStats) String() string {
 	return string(json)
 }
 
+// IsDead 角色是否已经陨落
+func (c *CharacterStats) IsDead() bool {
+	return c.Status == CharacterStatusDead
+}
+
+// characterStatsColumns 人物属性表查询字段，与 scanCharacterStats 的顺序一致
+const characterStatsColumns = `id, user_id, name, generation, previous_character_id, realm, realm_level,
+			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
+			attack, defense, speed, luck,
+			experience, comprehension,
+			age, lifespan, location, status, stories, created_at`
+
+// scanCharacterStats 扫描一行人物属性
+func scanCharacterStats(row pgx.Row) (*CharacterStats, error) {
+	var stats CharacterStats
+	var spiritualRootsJSON []byte
+	var previousCharacterID *int
+	err := row.Scan(
+		&stats.ID, &stats.UserID, &stats.Name, &stats.Generation, &previousCharacterID, &stats.Realm, &stats.RealmLevel,
+		&spiritualRootsJSON, &stats.SpiritSense, &stats.Physique, &stats.DemonicAura, &stats.TaoistName,
+		&stats.Attack, &stats.Defense, &stats.Speed, &stats.Luck,
+		&stats.Experience, &stats.Comprehension,
+		&stats.Age, &stats.Lifespan, &stats.Location, &stats.Status, &stats.Stories, &stats.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if previousCharacterID != nil {
+		stats.PreviousCharacterID = *previousCharacterID
+	}
+
+	// 解析灵根JSON
+	if len(spiritualRootsJSON) > 0 {
+		err = json.Unmarshal(spiritualRootsJSON, &stats.SpiritualRoots)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &stats, nil
+}
+
+// queryCharacterStats 查询多行人物属性
+func (db *DB) queryCharacterStats(ctx context.Context, query string, args ...any) ([]*CharacterStats, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := db.GetPool().Query(timeoutCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var characters []*CharacterStats
+	for rows.Next() {
+		stats, err := scanCharacterStats(rows)
+		if err != nil {
+			return nil, err
+		}
+		characters = append(characters, stats)
+	}
+
+	return characters, rows.Err()
+}
+
 // CreateCharacterStatsInTx 在事务中创建人物属性
 func (db *DB) CreateCharacterStatsInTx(ctx context.Context, tx pgx.Tx, stats *CharacterStats) error {
 	var spiritualRootsJSON []byte
@@ -115,31 +192,45 @@ func (db *DB) CreateCharacterStatsInTx(ctx context.Context, tx pgx.Tx, stats *Ch
 		}
 	}
 
+	if stats.Generation <= 0 {
+		stats.Generation = 1
+	}
+	if stats.CreatedAt.IsZero() {
+		stats.CreatedAt = time.Now()
+	}
+	var previousCharacterID *int
+	if stats.PreviousCharacterID > 0 {
+		previousCharacterID = &stats.PreviousCharacterID
+	}
+
 	query := `
 		INSERT INTO character_stats (
-			user_id, name, realm, realm_level,
+			user_id, name, generation, previous_character_id, realm, realm_level,
 			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
 			attack, defense, speed, luck,
 			experience, comprehension,
-			age, lifespan, location, status, stories
+			age, lifespan, location, status, stories, created_at
 		) VALUES (
-			$1, $2, $3, $4,
-			$5, $6, $7, $8, $9,
-			$10, $11, $12, $13,
-			$14, $15, $16, $17,
-			$18, $19,
-			$20
+			$1, $2, $3, $4, $5, $6,
+			$7, $8, $9, $10, $11,
+			$12, $13, $14, $15,
+			$16, $17,
+			$18, $19, $20, $21, $22, $23
 		)
+		RETURNING id
 	`
 
-	_, err = tx.Exec(ctx, query,
-		stats.UserID, stats.Name, stats.Realm, stats.RealmLevel,
+	err = tx.QueryRow(ctx, query,
+		stats.UserID, stats.Name, stats.Generation, previousCharacterID, stats.Realm, stats.RealmLevel,
 		spiritualRootsJSON, stats.SpiritSense, stats.Physique, stats.DemonicAura, stats.TaoistName,
 		stats.Attack, stats.Defense, stats.Speed, stats.Luck,
 		stats.Experience, stats.Comprehension,
-		stats.Age, stats.Lifespan, stats.Location, stats.Status,
-		stats.Stories,
-	)
+		stats.Age, stats.Lifespan, stats.Location, stats.Status, stats.Stories, stats.CreatedAt,
+	).Scan(&stats.ID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_character_stats_name" {
+		return ErrNameExists
+	}
 	return err
 }
 
@@ -153,32 +244,41 @@ func (db *DB) NameExists(ctx context.Context, name string) (bool, error) {
 }
 
 // GetCharacterStats 获取人物属性
-func (db *DB) GetCharacterStats(ctx context.Context, userID int) (*CharacterStats, error) {
+func (db *DB) GetCharacterStats(ctx context.Context, characterID int) (*CharacterStats, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT user_id, name, realm, realm_level,
-			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
-			attack, defense, speed, luck,
-			experience, comprehension,
-			age, lifespan, location, status, stories
+		SELECT ` + characterStatsColumns + `
 		FROM character_stats
-		WHERE user_id = $1
+		WHERE id = $1
 	`
 
-	row := db.GetPool().QueryRow(timeoutCtx, query, userID)
+	stats, err := scanCharacterStats(db.GetPool().QueryRow(timeoutCtx, query, characterID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
 
-	var stats CharacterStats
-	var spiritualRootsJSON []byte
-	err := row.Scan(
-		&stats.UserID, &stats.Name, &stats.Realm, &stats.RealmLevel,
-		&spiritualRootsJSON, &stats.SpiritSense, &stats.Physique, &stats.DemonicAura, &stats.TaoistName,
-		&stats.Attack, &stats.Defense, &stats.Speed, &stats.Luck,
-		&stats.Experience, &stats.Comprehension,
-		&stats.Age, &stats.Lifespan, &stats.Location, &stats.Status, &stats.Stories,
-	)
+	return stats, nil
+}
+
+// GetCharacterByName 根据角色名获取人物属性
+func (db *DB) GetCharacterByName(ctx context.Context, name string) (*CharacterStats, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + characterStatsColumns + `
+		FROM character_stats
+		WHERE name = $1
+		ORDER BY id DESC
+		LIMIT 1
+	`
 
+	stats, err := scanCharacterStats(db.GetPool().QueryRow(timeoutCtx, query, name))
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -186,15 +286,105 @@ func (db *DB) GetCharacterStats(ctx context.Context, userID int) (*CharacterStat
 		return nil, err
 	}
 
-	// 解析灵根JSON
-	if len(spiritualRootsJSON) > 0 {
-		err = json.Unmarshal(spiritualRootsJSON, &stats.SpiritualRoots)
-		if err != nil {
-			return nil, err
+	return stats, nil
+}
+
+// GetActiveCharacter 获取用户当前激活的角色
+func (db *DB) GetActiveCharacter(ctx context.Context, userID int) (*CharacterStats, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + characterStatsColumns + `
+		FROM character_stats
+		WHERE id = (SELECT active_character_id FROM users WHERE id = $1)
+	`
+
+	stats, err := scanCharacterStats(db.GetPool().QueryRow(timeoutCtx, query, userID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
 		}
+		return nil, err
 	}
 
-	return &stats, nil
+	return stats, nil
+}
+
+// GetUserCharacters 获取用户的所有角色，按创建时间排序
+func (db *DB) GetUserCharacters(ctx context.Context, userID int) ([]*CharacterStats, error) {
+	query := `
+		SELECT ` + characterStatsColumns + `
+		FROM character_stats
+		WHERE user_id = $1
+		ORDER BY created_at ASC, id ASC
+	`
+	return db.queryCharacterStats(ctx, query, userID)
+}
+
+// CountAliveCharacters 获取用户未陨落的角色数量，即占用的角色栏位
+func (db *DB) CountAliveCharacters(ctx context.Context, userID int) (int, error) {
+	var count int
+	err := db.GetPool().QueryRow(ctx, "SELECT COUNT(*) FROM character_stats WHERE user_id = $1 AND status <> $2", userID, CharacterStatusDead).Scan(&count)
+	return count, err
+}
+
+// ErrNameExists 角色名已被占用，由角色名的唯一索引保证
+var ErrNameExists = errors.New("该角色名已存在，请重新输入")
+
+// CharacterSlotsFullError 用户存活的角色已占满角色栏位
+type CharacterSlotsFullError struct {
+	Count int
+	Max   int
+}
+
+func (e *CharacterSlotsFullError) Error() string {
+	return fmt.Sprintf("您的角色栏位已满（%d/%d），/chars 查看已有角色", e.Count, e.Max)
+}
+
+// LockCharacterSlotsInTx 锁定用户并在事务中重新统计存活角色，避免同时创建角色超出栏位
+func (db *DB) LockCharacterSlotsInTx(ctx context.Context, tx pgx.Tx, userID int, maxSlots int) error {
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return fmt.Errorf("锁定用户失败: %v", err)
+	}
+	var count int
+	err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM character_stats WHERE user_id = $1 AND status <> $2", userID, CharacterStatusDead).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("获取角色数量失败: %v", err)
+	}
+	if count >= maxSlots {
+		return &CharacterSlotsFullError{Count: count, Max: maxSlots}
+	}
+	return nil
+}
+
+// HasReincarnated 角色是否已经转世过
+func (db *DB) HasReincarnated(ctx context.Context, characterID int) (bool, error) {
+	var exists bool
+	err := db.GetPool().QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM character_stats WHERE previous_character_id = $1)", characterID).Scan(&exists)
+	return exists, err
+}
+
+// ErrAlreadyReincarnated 陨落的角色已经转世过
+var ErrAlreadyReincarnated = errors.New("该角色已经转世过了")
+
+// LockReincarnationInTx 锁定陨落的角色并确认尚未转世，避免同时转世出多个后人
+func (db *DB) LockReincarnationInTx(ctx context.Context, tx pgx.Tx, characterID int) error {
+	var status string
+	if err := tx.QueryRow(ctx, "SELECT status FROM character_stats WHERE id = $1 FOR UPDATE", characterID).Scan(&status); err != nil {
+		return fmt.Errorf("获取前世角色失败: %v", err)
+	}
+	if status != CharacterStatusDead {
+		return fmt.Errorf("角色尚未陨落，无法转世")
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM character_stats WHERE previous_character_id = $1)", characterID).Scan(&exists); err != nil {
+		return fmt.Errorf("获取转世信息失败: %v", err)
+	}
+	if exists {
+		return ErrAlreadyReincarnated
+	}
+	return nil
 }
 
 // UpdateCharacterStats 更新人物属性
@@ -216,11 +406,11 @@ func (db *DB) UpdateCharacterStats(ctx context.Context, stats *CharacterStats) e
 			attack = $10, defense = $11, speed = $12, luck = $13,
 			experience = $14, comprehension = $15,
 			age = $16, lifespan = $17, location = $18, status = $19, stories = $20
-		WHERE user_id = $1
+		WHERE id = $1
 	`
 
 	_, err = db.GetPool().Exec(ctx, query,
-		stats.UserID, stats.Name, stats.Realm, stats.RealmLevel,
+		stats.ID, stats.Name, stats.Realm, stats.RealmLevel,
 		spiritualRootsJSON, stats.SpiritSense, stats.Physique, stats.DemonicAura, stats.TaoistName,
 		stats.Attack, stats.Defense, stats.Speed, stats.Luck,
 		stats.Experience, stats.Comprehension,
@@ -232,7 +422,7 @@ func (db *DB) UpdateCharacterStats(ctx context.Context, stats *CharacterStats) e
 // UpdateCharacterStatsPartial 部分更新人物属性，只更新非nil的字段
 func (db *DB) UpdateCharacterStatsPartial(ctx context.Context, update *CharacterStatsUpdate) error {
 	setParts := []string{}
-	args := []interface{}{update.UserID}
+	args := []interface{}{update.CharacterID}
 	argIndex := 2
 
 	// 动态构建SET子句
@@ -315,7 +505,7 @@ func (db *DB) UpdateCharacterStatsPartial(ctx context.Context, update *Character
 	// 构建完整的UPDATE语句
 	query := fmt.Sprintf(`
 		UPDATE character_stats SET %s
-		WHERE user_id = $1
+		WHERE id = $1
 	`, strings.Join(setParts, ", "))
 
 	_, err := db.GetPool().Exec(ctx, query, args...)
@@ -323,18 +513,18 @@ func (db *DB) UpdateCharacterStatsPartial(ctx context.Context, update *Character
 }
 
 // UpdateCharacterRealm 提升境界
-func (db *DB) UpdateCharacterRealm(ctx context.Context, userID int, realm string, realmLevel int) error {
+func (db *DB) UpdateCharacterRealm(ctx context.Context, characterID int, realm string, realmLevel int) error {
 	query := `
 		UPDATE character_stats 
 		SET realm = $2, realm_level = $3
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, realm, realmLevel)
+	_, err := db.GetPool().Exec(ctx, query, characterID, realm, realmLevel)
 	return err
 }
 
 // UpdateSpiritualRoots 更新灵根属性
-func (db *DB) UpdateSpiritualRoots(ctx context.Context, userID int, spiritualRoots *SpiritualRoots) error {
+func (db *DB) UpdateSpiritualRoots(ctx context.Context, characterID int, spiritualRoots *SpiritualRoots) error {
 	spiritualRootsJSON, err := json.Marshal(spiritualRoots)
 	if err != nil {
 		return err
@@ -343,312 +533,174 @@ func (db *DB) UpdateSpiritualRoots(ctx context.Context, userID int, spiritualRoo
 	query := `
 		UPDATE character_stats 
 		SET spiritual_roots = $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err = db.GetPool().Exec(ctx, query, userID, spiritualRootsJSON)
+	_, err = db.GetPool().Exec(ctx, query, characterID, spiritualRootsJSON)
 	return err
 }
 
 // UpdateSpiritSense 更新神识
-func (db *DB) UpdateSpiritSense(ctx context.Context, userID int, spiritSense int) error {
+func (db *DB) UpdateSpiritSense(ctx context.Context, characterID int, spiritSense int) error {
 	query := `
 		UPDATE character_stats 
 		SET spirit_sense = $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, spiritSense)
+	_, err := db.GetPool().Exec(ctx, query, characterID, spiritSense)
 	return err
 }
 
 // UpdatePhysique 更新根骨/体魄
-func (db *DB) UpdatePhysique(ctx context.Context, userID int, physique int) error {
+func (db *DB) UpdatePhysique(ctx context.Context, characterID int, physique int) error {
 	query := `
 		UPDATE character_stats 
 		SET physique = $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, physique)
+	_, err := db.GetPool().Exec(ctx, query, characterID, physique)
 	return err
 }
 
 // UpdateDemonicAura 更新煞气/心魔
-func (db *DB) UpdateDemonicAura(ctx context.Context, userID int, demonicAura int) error {
+func (db *DB) UpdateDemonicAura(ctx context.Context, characterID int, demonicAura int) error {
 	query := `
 		UPDATE character_stats 
 		SET demonic_aura = $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, demonicAura)
+	_, err := db.GetPool().Exec(ctx, query, characterID, demonicAura)
 	return err
 }
 
 // SetTaoistName 设置道号
-func (db *DB) SetTaoistName(ctx context.Context, userID int, taoistName string) error {
+func (db *DB) SetTaoistName(ctx context.Context, characterID int, taoistName string) error {
 	query := `
 		UPDATE character_stats 
 		SET taoist_name = $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, taoistName)
+	_, err := db.GetPool().Exec(ctx, query, characterID, taoistName)
 	return err
 }
 
 // AddExperience 增加修炼经验
-func (db *DB) AddExperience(ctx context.Context, userID int, exp int64) error {
+func (db *DB) AddExperience(ctx context.Context, characterID int, exp int64) error {
 	query := `
 		UPDATE character_stats 
 		SET experience = experience + $2
-		WHERE user_id = $1
+		WHERE id = $1
+	`
+	_, err := db.GetPool().Exec(ctx, query, characterID, exp)
+	return err
+}
+
+// AddExperienceInTx 在事务中增加修炼经验
+func (db *DB) AddExperienceInTx(ctx context.Context, tx pgx.Tx, characterID int, exp int64) error {
+	query := `
+		UPDATE character_stats 
+		SET experience = experience + $2
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, exp)
+	_, err := tx.Exec(ctx, query, characterID, exp)
 	return err
 }
 
 // UpdateCharacterLocation 更新位置
-func (db *DB) UpdateCharacterLocation(ctx context.Context, userID int, location string) error {
+func (db *DB) UpdateCharacterLocation(ctx context.Context, characterID int, location string) error {
 	query := `
 		UPDATE character_stats 
 		SET location = $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, location)
+	_, err := db.GetPool().Exec(ctx, query, characterID, location)
 	return err
 }
 
 // UpdateCharacterStatus 更新状态
-func (db *DB) UpdateCharacterStatus(ctx context.Context, userID int, status string) error {
+func (db *DB) UpdateCharacterStatus(ctx context.Context, characterID int, status string) error {
 	query := `
 		UPDATE character_stats 
 		SET status = $2
-		WHERE user_id = $1
+		WHERE id = $1
+	`
+	_, err := db.GetPool().Exec(ctx, query, characterID, status)
+	return err
+}
+
+// UpdateCharacterStatusInTx 在事务中更新状态
+func (db *DB) UpdateCharacterStatusInTx(ctx context.Context, tx pgx.Tx, characterID int, status string) error {
+	query := `
+		UPDATE character_stats 
+		SET status = $2
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, status)
+	_, err := tx.Exec(ctx, query, characterID, status)
 	return err
 }
 
 // GetCharactersByRealm 根据境界查询人物
 func (db *DB) GetCharactersByRealm(ctx context.Context, realm string) ([]*CharacterStats, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
 	query := `
-		SELECT user_id, name, realm, realm_level,
-			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
-			attack, defense, speed, luck,
-			experience, comprehension,
-			age, lifespan, location, status, stories
+		SELECT ` + characterStatsColumns + `
 		FROM character_stats
 		WHERE realm = $1
 		ORDER BY realm_level DESC, experience DESC
 	`
-
-	rows, err := db.GetPool().Query(timeoutCtx, query, realm)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var characters []*CharacterStats
-	for rows.Next() {
-		var stats CharacterStats
-		var spiritualRootsJSON []byte
-		err := rows.Scan(
-			&stats.UserID, &stats.Name, &stats.Realm, &stats.RealmLevel,
-			&spiritualRootsJSON, &stats.SpiritSense, &stats.Physique, &stats.DemonicAura, &stats.TaoistName,
-			&stats.Attack, &stats.Defense, &stats.Speed, &stats.Luck,
-			&stats.Experience, &stats.Comprehension,
-			&stats.Age, &stats.Lifespan, &stats.Location, &stats.Status, &stats.Stories,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		// 解析灵根JSON
-		if len(spiritualRootsJSON) > 0 {
-			err = json.Unmarshal(spiritualRootsJSON, &stats.SpiritualRoots)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		characters = append(characters, &stats)
-	}
-
-	return characters, rows.Err()
+	return db.queryCharacterStats(ctx, query, realm)
 }
 
 // GetCharactersByLocation 根据位置查询人物
 func (db *DB) GetCharactersByLocation(ctx context.Context, location string) ([]*CharacterStats, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
 	query := `
-		SELECT user_id, name, realm, realm_level,
-			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
-			attack, defense, speed, luck,
-			experience, comprehension,
-			age, lifespan, location, status, stories
+		SELECT ` + characterStatsColumns + `
 		FROM character_stats
 		WHERE location = $1
 		ORDER BY realm_level DESC, experience DESC
 	`
-
-	rows, err := db.GetPool().Query(timeoutCtx, query, location)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var characters []*CharacterStats
-	for rows.Next() {
-		var stats CharacterStats
-		var spiritualRootsJSON []byte
-		err := rows.Scan(
-			&stats.UserID, &stats.Name, &stats.Realm, &stats.RealmLevel,
-			&spiritualRootsJSON, &stats.SpiritSense, &stats.Physique, &stats.DemonicAura, &stats.TaoistName,
-			&stats.Attack, &stats.Defense, &stats.Speed, &stats.Luck,
-			&stats.Experience, &stats.Comprehension,
-			&stats.Age, &stats.Lifespan, &stats.Location, &stats.Status, &stats.Stories,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		// 解析灵根JSON
-		if len(spiritualRootsJSON) > 0 {
-			err = json.Unmarshal(spiritualRootsJSON, &stats.SpiritualRoots)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		characters = append(characters, &stats)
-	}
-
-	return characters, rows.Err()
+	return db.queryCharacterStats(ctx, query, location)
 }
 
 // GetCharactersByTaoistName 根据道号查询人物
 func (db *DB) GetCharactersByTaoistName(ctx context.Context, taoistName string) ([]*CharacterStats, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
 	query := `
-		SELECT user_id, name, realm, realm_level,
-			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
-			attack, defense, speed, luck,
-			experience, comprehension,
-			age, lifespan, location, status, stories
+		SELECT ` + characterStatsColumns + `
 		FROM character_stats
 		WHERE taoist_name ILIKE '%' || $1 || '%'
 		ORDER BY realm_level DESC, experience DESC
 	`
-
-	rows, err := db.GetPool().Query(timeoutCtx, query, taoistName)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var characters []*CharacterStats
-	for rows.Next() {
-		var stats CharacterStats
-		var spiritualRootsJSON []byte
-		err := rows.Scan(
-			&stats.UserID, &stats.Name, &stats.Realm, &stats.RealmLevel,
-			&spiritualRootsJSON, &stats.SpiritSense, &stats.Physique, &stats.DemonicAura, &stats.TaoistName,
-			&stats.Attack, &stats.Defense, &stats.Speed, &stats.Luck,
-			&stats.Experience, &stats.Comprehension,
-			&stats.Age, &stats.Lifespan, &stats.Location, &stats.Status, &stats.Stories,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		// 解析灵根JSON
-		if len(spiritualRootsJSON) > 0 {
-			err = json.Unmarshal(spiritualRootsJSON, &stats.SpiritualRoots)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		characters = append(characters, &stats)
-	}
-
-	return characters, rows.Err()
+	return db.queryCharacterStats(ctx, query, taoistName)
 }
 
 // AddDemonicAura 增加煞气/心魔
-func (db *DB) AddDemonicAura(ctx context.Context, userID int, amount int) error {
+func (db *DB) AddDemonicAura(ctx context.Context, characterID int, amount int) error {
 	query := `
 		UPDATE character_stats 
 		SET demonic_aura = GREATEST(0, demonic_aura + $2)
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, amount)
+	_, err := db.GetPool().Exec(ctx, query, characterID, amount)
 	return err
 }
 
 // AddSpiritSense 增加神识
-func (db *DB) AddSpiritSense(ctx context.Context, userID int, amount int) error {
+func (db *DB) AddSpiritSense(ctx context.Context, characterID int, amount int) error {
 	query := `
 		UPDATE character_stats 
 		SET spirit_sense = spirit_sense + $2
-		WHERE user_id = $1
+		WHERE id = $1
 	`
-	_, err := db.GetPool().Exec(ctx, query, userID, amount)
+	_, err := db.GetPool().Exec(ctx, query, characterID, amount)
 	return err
 }
 
 // GetCharactersBySpiritualRoot 根据特定灵根查询人物
 func (db *DB) GetCharactersBySpiritualRoot(ctx context.Context, rootType string, minValue int) ([]*CharacterStats, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
 	query := `
-		SELECT user_id, name, realm, realm_level,
-			spiritual_roots, spirit_sense, physique, demonic_aura, taoist_name,
-			attack, defense, speed, luck,
-			experience, comprehension,
-			age, lifespan, location, status, stories
+		SELECT ` + characterStatsColumns + `
 		FROM character_stats
 		WHERE spiritual_roots ->> $1 IS NOT NULL 
 		AND CAST(spiritual_roots ->> $1 AS INTEGER) >= $2
 		ORDER BY CAST(spiritual_roots ->> $1 AS INTEGER) DESC, realm_level DESC
 	`
-
-	rows, err := db.GetPool().Query(timeoutCtx, query, rootType, minValue)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var characters []*CharacterStats
-	for rows.Next() {
-		var stats CharacterStats
-		var spiritualRootsJSON []byte
-		err := rows.Scan(
-			&stats.UserID, &stats.Name, &stats.Realm, &stats.RealmLevel,
-			&spiritualRootsJSON, &stats.SpiritSense, &stats.Physique, &stats.DemonicAura, &stats.TaoistName,
-			&stats.Attack, &stats.Defense, &stats.Speed, &stats.Luck,
-			&stats.Experience, &stats.Comprehension,
-			&stats.Age, &stats.Lifespan, &stats.Location, &stats.Status, &stats.Stories,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		// 解析灵根JSON
-		if len(spiritualRootsJSON) > 0 {
-			err = json.Unmarshal(spiritualRootsJSON, &stats.SpiritualRoots)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		characters = append(characters, &stats)
-	}
-
-	return characters, rows.Err()
+	return db.queryCharacterStats(ctx, query, rootType, minValue)
 }
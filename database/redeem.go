@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 兑换失败的原因
+var (
+	ErrRedeemCodeNotFound = errors.New("兑换码不存在")
+	ErrRedeemCodeExpired  = errors.New("兑换码已过期")
+	ErrRedeemCodeUsedUp   = errors.New("兑换码已被领完")
+	ErrRedeemCodeRedeemed = errors.New("您已经使用过这个兑换码")
+)
+
+// RedeemCode 管理员生成的灵石兑换码
+type RedeemCode struct {
+	ID        int       `json:"id"`
+	Code      string    `json:"code"`
+	Batch     string    `json:"batch"`      // 批次名，便于按批次查询
+	Amount    int64     `json:"amount"`     // 每次兑换获得的灵石
+	MaxUses   int       `json:"max_uses"`   // 最多可被多少位玩家使用
+	UsedCount int       `json:"used_count"` // 已被使用的次数
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	CreatedBy int64     `json:"created_by"` // 创建者的 Telegram ID
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Redemption 一次兑换记录
+type Redemption struct {
+	ID        int       `json:"id"`
+	CodeID    int       `json:"code_id"`
+	Code      string    `json:"code"`
+	UserID    int       `json:"user_id"`
+	TgID      int64     `json:"tg_id"`
+	Username  string    `json:"username"`
+	Amount    int64     `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const redeemCodeColumns = `id, code, batch, amount, max_uses, used_count, COALESCE(expires_at, 'epoch'::timestamp), created_by, created_at`
+
+func scanRedeemCode(row pgx.Row) (*RedeemCode, error) {
+	var code RedeemCode
+	err := row.Scan(&code.ID, &code.Code, &code.Batch, &code.Amount, &code.MaxUses, &code.UsedCount, &code.ExpiresAt, &code.CreatedBy, &code.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if code.ExpiresAt.Unix() == 0 {
+		code.ExpiresAt = time.Time{}
+	}
+	return &code, nil
+}
+
+// CreateRedeemCodes 批量创建兑换码，兑换码重复时整批失败
+func (db *DB) CreateRedeemCodes(ctx context.Context, codes []*RedeemCode) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO redeem_codes (code, batch, amount, max_uses, expires_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	for _, code := range codes {
+		var expiresAt *time.Time
+		if !code.ExpiresAt.IsZero() {
+			expiresAt = &code.ExpiresAt
+		}
+		code.CreatedAt = time.Now()
+		err := tx.QueryRow(ctx, query, code.Code, code.Batch, code.Amount, code.MaxUses, expiresAt, code.CreatedBy, code.CreatedAt).Scan(&code.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetRedeemCodes 获取兑换码，batch 为空时返回最近创建的
+func (db *DB) GetRedeemCodes(ctx context.Context, batch string, limit int) ([]*RedeemCode, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + redeemCodeColumns + `
+		FROM redeem_codes
+		WHERE $1 = '' OR batch = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, batch, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []*RedeemCode
+	for rows.Next() {
+		code, err := scanRedeemCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, rows.Err()
+}
+
+// Redeem 使用兑换码，在同一事务中校验有效期和次数、记录兑换并增加用户的充值灵石
+// 兑换码无效时返回 ErrRedeemCodeNotFound、ErrRedeemCodeExpired、ErrRedeemCodeUsedUp 或 ErrRedeemCodeRedeemed
+func (db *DB) Redeem(ctx context.Context, userID int, codeText string) (*Redemption, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT ` + redeemCodeColumns + ` FROM redeem_codes WHERE code = $1 FOR UPDATE`
+	code, err := scanRedeemCode(tx.QueryRow(ctx, query, codeText))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrRedeemCodeNotFound
+		}
+		return nil, err
+	}
+	switch {
+	case !code.ExpiresAt.IsZero() && time.Now().After(code.ExpiresAt):
+		return nil, ErrRedeemCodeExpired
+	case code.UsedCount >= code.MaxUses:
+		return nil, ErrRedeemCodeUsedUp
+	}
+
+	redemption := &Redemption{CodeID: code.ID, Code: code.Code, UserID: userID, Amount: code.Amount, CreatedAt: time.Now()}
+	query = `
+		INSERT INTO redemptions (code_id, user_id, amount, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (code_id, user_id) DO NOTHING
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, query, redemption.CodeID, redemption.UserID, redemption.Amount, redemption.CreatedAt).Scan(&redemption.ID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrRedeemCodeRedeemed
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE redeem_codes SET used_count = used_count + 1 WHERE id = $1`, code.ID); err != nil {
+		return nil, err
+	}
+	if err := db.UpdateUserTotalRechargedTokenTx(ctx, tx, userID, code.Amount); err != nil {
+		return nil, err
+	}
+
+	return redemption, tx.Commit(ctx)
+}
+
+// GetRedemptions 获取兑换码的使用记录
+func (db *DB) GetRedemptions(ctx context.Context, codeText string) ([]*Redemption, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT r.id, r.code_id, c.code, r.user_id, u.tg_id, u.username, r.amount, r.created_at
+		FROM redemptions r
+		JOIN redeem_codes c ON c.id = r.code_id
+		JOIN users u ON u.id = r.user_id
+		WHERE c.code = $1
+		ORDER BY r.created_at
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, codeText)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var redemptions []*Redemption
+	for rows.Next() {
+		var redemption Redemption
+		err := rows.Scan(&redemption.ID, &redemption.CodeID, &redemption.Code, &redemption.UserID, &redemption.TgID,
+			&redemption.Username, &redemption.Amount, &redemption.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, &redemption)
+	}
+
+	return redemptions, rows.Err()
+}
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CharacterStatusRetreat 闭关中的状态，闭关期间无法冒险
+const CharacterStatusRetreat = "闭关"
+
+// 闭关记录状态
+const (
+	RetreatStatusOngoing     = "ongoing"
+	RetreatStatusCompleted   = "completed"
+	RetreatStatusInterrupted = "interrupted"
+)
+
+// 无法开始闭关的原因
+var (
+	ErrAlreadyInRetreat = errors.New("角色正在闭关中")
+	ErrRetreatDead      = errors.New("角色已经陨落，无法闭关")
+)
+
+// Retreat 闭关记录
+type Retreat struct {
+	ID               int       `json:"id"`
+	CharacterID      int       `json:"character_id"`
+	TgID             int64     `json:"tg_id"` // 角色所属用户的 Telegram ID，用于通知
+	Hours            int       `json:"hours"`
+	Status           string    `json:"status"`
+	StartedAt        time.Time `json:"started_at"`
+	EndsAt           time.Time `json:"ends_at"`
+	FinishedAt       time.Time `json:"finished_at,omitzero"`
+	ExperienceGained int64     `json:"experience_gained"`
+	TechniqueName    string    `json:"technique_name"`
+	ProgressGained   int       `json:"progress_gained"`
+	PreviousStatus   string    `json:"previous_status"` // 闭关前的角色状态，出关后恢复
+}
+
+const retreatColumns = `r.id, r.character_id, u.tg_id, r.hours, r.status, r.started_at, r.ends_at,
+			COALESCE(r.finished_at, 'epoch'::timestamp), r.experience_gained, r.technique_name, r.progress_gained,
+			r.previous_status`
+
+func scanRetreat(row pgx.Row) (*Retreat, error) {
+	var retreat Retreat
+	err := row.Scan(
+		&retreat.ID, &retreat.CharacterID, &retreat.TgID, &retreat.Hours, &retreat.Status, &retreat.StartedAt, &retreat.EndsAt,
+		&retreat.FinishedAt, &retreat.ExperienceGained, &retreat.TechniqueName, &retreat.ProgressGained,
+		&retreat.PreviousStatus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if retreat.FinishedAt.Unix() == 0 {
+		retreat.FinishedAt = time.Time{}
+	}
+	return &retreat, nil
+}
+
+// StartRetreat 开始闭关，记录闭关前的状态并把角色状态设为闭关
+// 在锁定角色后检查状态，角色已在闭关时返回 ErrAlreadyInRetreat，已陨落时返回 ErrRetreatDead
+func (db *DB) StartRetreat(ctx context.Context, retreat *Retreat) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `SELECT status FROM character_stats WHERE id = $1 FOR UPDATE`, retreat.CharacterID).Scan(&retreat.PreviousStatus)
+	if err != nil {
+		return err
+	}
+	switch retreat.PreviousStatus {
+	case CharacterStatusDead:
+		return ErrRetreatDead
+	case CharacterStatusRetreat:
+		return ErrAlreadyInRetreat
+	}
+	var ongoing bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM retreats WHERE character_id = $1 AND status = $2)`, retreat.CharacterID, RetreatStatusOngoing).Scan(&ongoing)
+	if err != nil {
+		return err
+	}
+	if ongoing {
+		return ErrAlreadyInRetreat
+	}
+
+	retreat.Status = RetreatStatusOngoing
+	query := `
+		INSERT INTO retreats (character_id, hours, status, started_at, ends_at, previous_status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, query, retreat.CharacterID, retreat.Hours, retreat.Status, retreat.StartedAt, retreat.EndsAt, retreat.PreviousStatus).Scan(&retreat.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE character_stats SET status = $2 WHERE id = $1`, retreat.CharacterID, CharacterStatusRetreat)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetOngoingRetreat 获取角色正在进行的闭关
+func (db *DB) GetOngoingRetreat(ctx context.Context, characterID int) (*Retreat, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + retreatColumns + `
+		FROM retreats r
+		JOIN character_stats c ON c.id = r.character_id
+		JOIN users u ON u.id = c.user_id
+		WHERE r.character_id = $1 AND r.status = $2
+		ORDER BY r.started_at DESC
+		LIMIT 1
+	`
+
+	retreat, err := scanRetreat(db.GetPool().QueryRow(timeoutCtx, query, characterID, RetreatStatusOngoing))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return retreat, nil
+}
+
+// GetDueRetreats 获取已经到期但尚未结算的闭关
+func (db *DB) GetDueRetreats(ctx context.Context, now time.Time) ([]*Retreat, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + retreatColumns + `
+		FROM retreats r
+		JOIN character_stats c ON c.id = r.character_id
+		JOIN users u ON u.id = c.user_id
+		WHERE r.status = $1 AND r.ends_at <= $2
+		ORDER BY r.ends_at ASC
+	`
+
+	rows, err := db.GetPool().Query(timeoutCtx, query, RetreatStatusOngoing, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var retreats []*Retreat
+	for rows.Next() {
+		retreat, err := scanRetreat(rows)
+		if err != nil {
+			return nil, err
+		}
+		retreats = append(retreats, retreat)
+	}
+
+	return retreats, rows.Err()
+}
+
+// FinishRetreat 结束闭关，在同一事务中记录并发放经验和功法进度，只有进行中的闭关才能结束，返回是否由本次调用结束
+func (db *DB) FinishRetreat(ctx context.Context, retreat *Retreat) (bool, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE retreats
+		SET status = $2, finished_at = $3, experience_gained = $4, technique_name = $5, progress_gained = $6
+		WHERE id = $1 AND status = $7
+	`
+	tag, err := tx.Exec(ctx, query,
+		retreat.ID, retreat.Status, retreat.FinishedAt, retreat.ExperienceGained, retreat.TechniqueName, retreat.ProgressGained,
+		RetreatStatusOngoing,
+	)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if err := db.AddExperienceInTx(ctx, tx, retreat.CharacterID, retreat.ExperienceGained); err != nil {
+		return false, err
+	}
+	if retreat.TechniqueName != "" {
+		if err := db.AddCultivationTechniqueProgressInTx(ctx, tx, retreat.CharacterID, retreat.TechniqueName, retreat.ProgressGained); err != nil {
+			return false, err
+		}
+	}
+
+	// 出关后恢复闭关前的状态（如重伤），闭关期间被改成其他状态（如陨落）的不做处理
+	query = `
+		UPDATE character_stats c SET status = COALESCE(NULLIF(r.previous_status, ''), '健康')
+		FROM retreats r
+		WHERE r.id = $1 AND c.id = r.character_id AND c.status = $2
+	`
+	if _, err := tx.Exec(ctx, query, retreat.ID, CharacterStatusRetreat); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
@@ -0,0 +1,272 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// UnlimitedStock 不限库存
+const UnlimitedStock = -1
+
+// ShopItem 商店货架上的商品，价格和库存由管理员设定
+type ShopItem struct {
+	ID        int            `json:"id"`
+	Item      *InventoryItem `json:"item"`   // 商品物品，数量为每份的件数
+	Price     int64          `json:"price"`  // 每份的灵石价格
+	Stock     int            `json:"stock"`  // 剩余库存（份），-1 表示不限
+	Active    bool           `json:"active"` // 是否上架
+	CreatedAt time.Time      `json:"created_at,omitzero"`
+}
+
+// ShopOrderLine 购买的一种商品，ItemName 和 UnitPrice 为下单时的报价
+type ShopOrderLine struct {
+	ShopItemID int    `json:"shop_item_id"`
+	Quantity   int    `json:"quantity"` // 购买的份数
+	ItemName   string `json:"item_name,omitempty"`
+	UnitPrice  int64  `json:"unit_price,omitempty"` // 每份的灵石价格，结算时价格变动则购买失败
+}
+
+// Purchase 一次购买的结果
+type Purchase struct {
+	Items    []*InventoryItem   // 放入背包的物品
+	Cost     int64              // 花费的灵石
+	Balance  int64              // 购买后的灵石余额
+	Capacity *InventoryCapacity // 购买后的背包容量
+}
+
+// ShopItemUnavailableError 商品不存在、已下架或库存不足
+type ShopItemUnavailableError struct {
+	ShopItemID int
+	Reason     string
+}
+
+func (e *ShopItemUnavailableError) Error() string {
+	return fmt.Sprintf("商品 #%d %s", e.ShopItemID, e.Reason)
+}
+
+// InsufficientBalanceError 灵石余额不足
+type InsufficientBalanceError struct {
+	Required  int64
+	Available int64
+}
+
+func (e *InsufficientBalanceError) Error() string {
+	return fmt.Sprintf("灵石余额不足：需要 %d，现有 %d", e.Required, e.Available)
+}
+
+const shopItemColumns = `id, item, price, stock, active, created_at`
+
+func scanShopItem(row pgx.Row) (*ShopItem, error) {
+	var shopItem ShopItem
+	var itemJSON []byte
+	err := row.Scan(&shopItem.ID, &itemJSON, &shopItem.Price, &shopItem.Stock, &shopItem.Active, &shopItem.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析商品物品JSON
+	if err := json.Unmarshal(itemJSON, &shopItem.Item); err != nil {
+		return nil, err
+	}
+	return &shopItem, nil
+}
+
+// GetShopItems 获取商品列表，activeOnly 为 true 时只返回上架中的商品
+func (db *DB) GetShopItems(ctx context.Context, activeOnly bool) ([]*ShopItem, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + shopItemColumns + `
+		FROM shop_items
+		WHERE active OR NOT $1
+		ORDER BY id
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shopItems []*ShopItem
+	for rows.Next() {
+		shopItem, err := scanShopItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		shopItems = append(shopItems, shopItem)
+	}
+
+	return shopItems, rows.Err()
+}
+
+// GetShopItem 获取商品，不存在时返回 nil
+func (db *DB) GetShopItem(ctx context.Context, id int) (*ShopItem, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + shopItemColumns + ` FROM shop_items WHERE id = $1`
+	shopItem, err := scanShopItem(db.GetPool().QueryRow(timeoutCtx, query, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return shopItem, nil
+}
+
+// CreateShopItem 上架新商品
+func (db *DB) CreateShopItem(ctx context.Context, shopItem *ShopItem) error {
+	itemJSON, err := json.Marshal(shopItem.Item)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO shop_items (item, price, stock, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+	return db.GetPool().QueryRow(ctx, query, itemJSON, shopItem.Price, shopItem.Stock, shopItem.Active).Scan(&shopItem.ID, &shopItem.CreatedAt)
+}
+
+// UpdateShopItem 修改商品的价格、库存和上架状态，返回商品是否存在
+func (db *DB) UpdateShopItem(ctx context.Context, shopItem *ShopItem) (bool, error) {
+	query := `
+		UPDATE shop_items
+		SET price = $2, stock = $3, active = $4
+		WHERE id = $1
+	`
+	tag, err := db.GetPool().Exec(ctx, query, shopItem.ID, shopItem.Price, shopItem.Stock, shopItem.Active)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// quoteShopItemsInTx 校验商品是否可以购买并按当前价格报价，同一商品合并数量
+// lock 为 true 时锁定商品记录；报价中已有单价的，价格变动时返回 ShopItemUnavailableError
+func (db *DB) quoteShopItemsInTx(ctx context.Context, tx pgx.Tx, lines []*ShopOrderLine, lock bool) ([]*ShopOrderLine, map[int]*ShopItem, error) {
+	if len(lines) == 0 {
+		return nil, nil, fmt.Errorf("没有要购买的商品")
+	}
+
+	merged := []*ShopOrderLine{}
+	byID := make(map[int]*ShopOrderLine)
+	ids := []int{}
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			return nil, nil, &ShopItemUnavailableError{ShopItemID: line.ShopItemID, Reason: "购买数量必须大于0"}
+		}
+		if existing, ok := byID[line.ShopItemID]; ok {
+			existing.Quantity += line.Quantity
+			continue
+		}
+		quoted := *line
+		byID[line.ShopItemID] = &quoted
+		merged = append(merged, &quoted)
+		ids = append(ids, line.ShopItemID)
+	}
+
+	query := `SELECT ` + shopItemColumns + ` FROM shop_items WHERE id = ANY($1) ORDER BY id`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	rows, err := tx.Query(ctx, query, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	shopItems := make(map[int]*ShopItem)
+	for rows.Next() {
+		shopItem, err := scanShopItem(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		shopItems[shopItem.ID] = shopItem
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, line := range merged {
+		shopItem := shopItems[line.ShopItemID]
+		switch {
+		case shopItem == nil:
+			return nil, nil, &ShopItemUnavailableError{ShopItemID: line.ShopItemID, Reason: "不存在"}
+		case !shopItem.Active:
+			return nil, nil, &ShopItemUnavailableError{ShopItemID: line.ShopItemID, Reason: fmt.Sprintf("「%s」已下架", shopItem.Item.ItemName)}
+		case shopItem.Stock != UnlimitedStock && shopItem.Stock < line.Quantity:
+			return nil, nil, &ShopItemUnavailableError{ShopItemID: line.ShopItemID, Reason: fmt.Sprintf("「%s」库存不足，仅剩 %d 份", shopItem.Item.ItemName, shopItem.Stock)}
+		case line.UnitPrice > 0 && line.UnitPrice != shopItem.Price:
+			return nil, nil, &ShopItemUnavailableError{ShopItemID: line.ShopItemID, Reason: fmt.Sprintf("「%s」价格已变动为 %d 灵石", shopItem.Item.ItemName, shopItem.Price)}
+		}
+		line.ItemName = shopItem.Item.ItemName
+		line.UnitPrice = shopItem.Price
+	}
+	return merged, shopItems, nil
+}
+
+// getBalanceInTx 在事务中锁定用户并获取灵石余额
+func (db *DB) getBalanceInTx(ctx context.Context, tx pgx.Tx, userID int) (int64, error) {
+	var balance int64
+	err := tx.QueryRow(ctx, `SELECT total_recharged_token - total_used_token FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&balance)
+	return balance, err
+}
+
+// purchaseShopItemsInTx 在事务中完成购买：校验价格和库存、扣除灵石、扣减库存并放入背包，商品和用户记录都会被锁定
+// 商品不可购买时返回 ShopItemUnavailableError，余额不足时返回 InsufficientBalanceError，背包放不下时返回 InventoryFullError
+func (db *DB) purchaseShopItemsInTx(ctx context.Context, tx pgx.Tx, userID int, characterID int, lines []*ShopOrderLine, baseCapacity int) (*Purchase, error) {
+	lines, shopItems, err := db.quoteShopItemsInTx(ctx, tx, lines, true)
+	if err != nil {
+		return nil, err
+	}
+
+	purchase := &Purchase{}
+	for _, line := range lines {
+		shopItem := shopItems[line.ShopItemID]
+		purchase.Cost += line.UnitPrice * int64(line.Quantity)
+
+		item := *shopItem.Item
+		item.ID = 0
+		item.CharacterID = characterID
+		item.Quantity = max(item.Quantity, 1) * line.Quantity
+		item.ObtainedFrom = "商店"
+		item.ObtainedAt = time.Now()
+		purchase.Items = append(purchase.Items, &item)
+
+		if shopItem.Stock != UnlimitedStock {
+			if _, err := tx.Exec(ctx, `UPDATE shop_items SET stock = stock - $2 WHERE id = $1`, shopItem.ID, line.Quantity); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 锁定用户后校验并扣除灵石
+	balance, err := db.getBalanceInTx(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if balance < purchase.Cost {
+		return nil, &InsufficientBalanceError{Required: purchase.Cost, Available: balance}
+	}
+	if err := db.UpdateUserTotalUsedTokenTx(ctx, tx, userID, purchase.Cost); err != nil {
+		return nil, err
+	}
+	purchase.Balance = balance - purchase.Cost
+
+	purchase.Capacity, err = db.AddInventoryItemsWithCapacityInTx(ctx, tx, characterID, purchase.Items, baseCapacity)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.RecordItemGrantsInTx(ctx, tx, characterID, GrantSourcePurchase, 0, purchase.Items); err != nil {
+		return nil, err
+	}
+	return purchase, nil
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Stars 充值状态
+const (
+	StarPaymentStatusPaid     = "paid"
+	StarPaymentStatusRefunded = "refunded"
+)
+
+// StarPayment 一笔 Telegram Stars 充值，以 Telegram 的支付ID去重
+type StarPayment struct {
+	ID               int       `json:"id"`
+	UserID           int       `json:"user_id"`
+	TgID             int64     `json:"tg_id"`
+	ChargeID         string    `json:"charge_id"` // telegram_payment_charge_id
+	ProviderChargeID string    `json:"provider_charge_id"`
+	PackageID        string    `json:"package_id"`
+	Stars            int       `json:"stars"`  // 支付的 Stars 数
+	Amount           int64     `json:"amount"` // 充值的灵石
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+	RefundedAt       time.Time `json:"refunded_at,omitzero"`
+}
+
+const starPaymentColumns = `p.id, p.user_id, u.tg_id, p.charge_id, p.provider_charge_id, p.package_id, p.stars, p.amount, p.status,
+			p.created_at, COALESCE(p.refunded_at, 'epoch'::timestamp)`
+
+func scanStarPayment(row pgx.Row) (*StarPayment, error) {
+	var payment StarPayment
+	err := row.Scan(
+		&payment.ID, &payment.UserID, &payment.TgID, &payment.ChargeID, &payment.ProviderChargeID, &payment.PackageID, &payment.Stars,
+		&payment.Amount, &payment.Status, &payment.CreatedAt, &payment.RefundedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if payment.RefundedAt.Unix() == 0 {
+		payment.RefundedAt = time.Time{}
+	}
+	return &payment, nil
+}
+
+// CreditStarPayment 记录一笔 Stars 充值并增加用户的充值灵石
+// 同一支付ID重复到达时不会重复入账，返回 false
+func (db *DB) CreditStarPayment(ctx context.Context, payment *StarPayment) (bool, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	payment.Status = StarPaymentStatusPaid
+	payment.CreatedAt = time.Now()
+	query := `
+		INSERT INTO star_payments (user_id, charge_id, provider_charge_id, package_id, stars, amount, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (charge_id) DO NOTHING
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, query,
+		payment.UserID, payment.ChargeID, payment.ProviderChargeID, payment.PackageID, payment.Stars, payment.Amount, payment.Status, payment.CreatedAt,
+	).Scan(&payment.ID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := db.UpdateUserTotalRechargedTokenTx(ctx, tx, payment.UserID, payment.Amount); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// GetStarPayment 按支付ID获取 Stars 充值，不存在时返回 nil
+func (db *DB) GetStarPayment(ctx context.Context, chargeID string) (*StarPayment, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + starPaymentColumns + ` FROM star_payments p JOIN users u ON u.id = p.user_id WHERE p.charge_id = $1`
+	payment, err := scanStarPayment(db.GetPool().QueryRow(timeoutCtx, query, chargeID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+// RefundStarPayment 退款一笔 Stars 充值并扣回充值的灵石，已退款的不会重复扣回，返回 false
+// 支付不存在时返回 nil
+func (db *DB) RefundStarPayment(ctx context.Context, chargeID string) (*StarPayment, bool, error) {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT ` + starPaymentColumns + ` FROM star_payments p JOIN users u ON u.id = p.user_id WHERE p.charge_id = $1 FOR UPDATE OF p`
+	payment, err := scanStarPayment(tx.QueryRow(ctx, query, chargeID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if payment.Status == StarPaymentStatusRefunded {
+		return payment, false, nil
+	}
+
+	if err := db.UpdateUserTotalRechargedTokenTx(ctx, tx, payment.UserID, -payment.Amount); err != nil {
+		return nil, false, err
+	}
+	payment.Status = StarPaymentStatusRefunded
+	payment.RefundedAt = time.Now()
+	_, err = tx.Exec(ctx, `UPDATE star_payments SET status = $2, refunded_at = $3 WHERE id = $1`, payment.ID, payment.Status, payment.RefundedAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return payment, true, tx.Commit(ctx)
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// DailyStats 一天的运营数据
+type DailyStats struct {
+	Date        time.Time `json:"date"`
+	NewUsers    int64     `json:"new_users"`    // 新用户
+	ActiveUsers int64     `json:"active_users"` // 发过消息的用户
+	Messages    int64     `json:"messages"`     // 玩家发言条数
+	Recharged   int64     `json:"recharged"`    // 充值和兑换获得的灵石
+	Spent       int64     `json:"spent"`        // 模型调用和商店购买消耗的灵石
+}
+
+// ModelUsageStats 一个模型的累计用量
+type ModelUsageStats struct {
+	Model    string `json:"model"`
+	Input    int64  `json:"input"`
+	Output   int64  `json:"output"`
+	Thinking int64  `json:"thinking"`
+	Cached   int64  `json:"cached"`
+	Image    int64  `json:"image"`
+	Cost     int64  `json:"cost"`
+}
+
+// SpenderStats 一位用户消耗的灵石
+type SpenderStats struct {
+	UserID   int    `json:"user_id"`
+	TgID     int64  `json:"tg_id"`
+	Username string `json:"username"`
+	Spent    int64  `json:"spent"`
+}
+
+// ToolCallStats 一个工具被调用的次数
+type ToolCallStats struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// FunnelStats 新用户的转化漏斗
+type FunnelStats struct {
+	NewUsers   int64 `json:"new_users"`  // 新用户
+	Registered int64 `json:"registered"` // 创建了角色
+	Chatted    int64 `json:"chatted"`    // 发过消息
+	Recharged  int64 `json:"recharged"`  // 充值或兑换过
+}
+
+// Report 一段时间内的运营报表，时间范围为 [Start, End)
+type Report struct {
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Days        []*DailyStats      `json:"days"`
+	Models      []*ModelUsageStats `json:"models"`
+	TopSpenders []*SpenderStats    `json:"top_spenders"`
+	ToolCalls   []*ToolCallStats   `json:"tool_calls"`
+	Funnel      FunnelStats        `json:"funnel"`
+}
+
+// 玩家发言的条件（不含工具结果和系统提示）和订单消耗的灵石
+const (
+	userMessageCondition = `role = 'user' AND NOT is_system AND EXISTS(SELECT 1 FROM jsonb_array_elements(content) part WHERE part ? 'text')`
+	orderSpentColumn     = `COALESCE(balance_before - balance_after, 0)`
+)
+
+// GetReport 统计 [start, end) 内的运营数据，topSpenders 为消耗排行的人数
+func (db *DB) GetReport(ctx context.Context, start time.Time, end time.Time, topSpenders int) (*Report, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	report := &Report{Start: start, End: end}
+	var err error
+	if report.Days, err = db.getDailyStats(timeoutCtx, start, end); err != nil {
+		return nil, err
+	}
+	if report.Models, err = db.getModelUsageStats(timeoutCtx, start, end); err != nil {
+		return nil, err
+	}
+	if report.TopSpenders, err = db.getTopSpenders(timeoutCtx, start, end, topSpenders); err != nil {
+		return nil, err
+	}
+	if report.ToolCalls, err = db.getToolCallStats(timeoutCtx, start, end); err != nil {
+		return nil, err
+	}
+	if err := db.getFunnelStats(timeoutCtx, start, end, &report.Funnel); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (db *DB) getDailyStats(ctx context.Context, start time.Time, end time.Time) ([]*DailyStats, error) {
+	query := `
+		SELECT d,
+			(SELECT COUNT(*) FROM users WHERE created_at >= d AND created_at < d + interval '1 day'),
+			(SELECT COUNT(DISTINCT user_id) FROM messages WHERE ` + userMessageCondition + ` AND created_at >= d AND created_at < d + interval '1 day'),
+			(SELECT COUNT(*) FROM messages WHERE ` + userMessageCondition + ` AND created_at >= d AND created_at < d + interval '1 day'),
+			(SELECT COALESCE(SUM(amount), 0) FROM star_payments WHERE status = 'paid' AND created_at >= d AND created_at < d + interval '1 day') +
+				(SELECT COALESCE(SUM(amount), 0) FROM redemptions WHERE created_at >= d AND created_at < d + interval '1 day'),
+			(SELECT COALESCE(SUM(cost), 0) FROM usage_records WHERE created_at >= d AND created_at < d + interval '1 day') +
+				(SELECT COALESCE(SUM(` + orderSpentColumn + `), 0) FROM orders WHERE status = 'confirmed' AND resolved_at >= d AND resolved_at < d + interval '1 day')
+		FROM generate_series($1::timestamp, $2::timestamp - interval '1 day', interval '1 day') d
+		ORDER BY d
+	`
+	rows, err := db.GetPool().Query(ctx, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []*DailyStats
+	for rows.Next() {
+		var day DailyStats
+		if err := rows.Scan(&day.Date, &day.NewUsers, &day.ActiveUsers, &day.Messages, &day.Recharged, &day.Spent); err != nil {
+			return nil, err
+		}
+		days = append(days, &day)
+	}
+	return days, rows.Err()
+}
+
+func (db *DB) getModelUsageStats(ctx context.Context, start time.Time, end time.Time) ([]*ModelUsageStats, error) {
+	query := `
+		SELECT model, SUM(input_tokens), SUM(output_tokens), SUM(thinking_tokens), SUM(cached_tokens), SUM(image_tokens), SUM(cost)
+		FROM usage_records
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY model
+		ORDER BY SUM(cost) DESC
+	`
+	rows, err := db.GetPool().Query(ctx, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var models []*ModelUsageStats
+	for rows.Next() {
+		var model ModelUsageStats
+		if err := rows.Scan(&model.Model, &model.Input, &model.Output, &model.Thinking, &model.Cached, &model.Image, &model.Cost); err != nil {
+			return nil, err
+		}
+		models = append(models, &model)
+	}
+	return models, rows.Err()
+}
+
+func (db *DB) getTopSpenders(ctx context.Context, start time.Time, end time.Time, limit int) ([]*SpenderStats, error) {
+	query := `
+		SELECT u.id, u.tg_id, u.username, SUM(s.spent)
+		FROM (
+			SELECT user_id, cost AS spent FROM usage_records WHERE created_at >= $1 AND created_at < $2
+			UNION ALL
+			SELECT user_id, ` + orderSpentColumn + ` FROM orders WHERE status = 'confirmed' AND resolved_at >= $1 AND resolved_at < $2
+		) s
+		JOIN users u ON u.id = s.user_id
+		GROUP BY u.id, u.tg_id, u.username
+		ORDER BY SUM(s.spent) DESC
+		LIMIT $3
+	`
+	rows, err := db.GetPool().Query(ctx, query, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spenders []*SpenderStats
+	for rows.Next() {
+		var spender SpenderStats
+		if err := rows.Scan(&spender.UserID, &spender.TgID, &spender.Username, &spender.Spent); err != nil {
+			return nil, err
+		}
+		spenders = append(spenders, &spender)
+	}
+	return spenders, rows.Err()
+}
+
+func (db *DB) getToolCallStats(ctx context.Context, start time.Time, end time.Time) ([]*ToolCallStats, error) {
+	query := `
+		SELECT part->'functionCall'->>'name' AS name, COUNT(*)
+		FROM messages, jsonb_array_elements(content) part
+		WHERE role = 'model' AND part ? 'functionCall' AND created_at >= $1 AND created_at < $2
+		GROUP BY name
+		ORDER BY COUNT(*) DESC
+	`
+	rows, err := db.GetPool().Query(ctx, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tools []*ToolCallStats
+	for rows.Next() {
+		var tool ToolCallStats
+		if err := rows.Scan(&tool.Name, &tool.Count); err != nil {
+			return nil, err
+		}
+		tools = append(tools, &tool)
+	}
+	return tools, rows.Err()
+}
+
+func (db *DB) getFunnelStats(ctx context.Context, start time.Time, end time.Time, funnel *FunnelStats) error {
+	query := `
+		SELECT COUNT(*),
+			COUNT(*) FILTER (WHERE EXISTS(SELECT 1 FROM character_stats c WHERE c.user_id = u.id)),
+			COUNT(*) FILTER (WHERE EXISTS(SELECT 1 FROM messages m WHERE m.user_id = u.id AND ` + userMessageCondition + `)),
+			COUNT(*) FILTER (WHERE EXISTS(SELECT 1 FROM star_payments p WHERE p.user_id = u.id AND p.status = 'paid')
+				OR EXISTS(SELECT 1 FROM redemptions r WHERE r.user_id = u.id))
+		FROM users u
+		WHERE u.created_at >= $1 AND u.created_at < $2
+	`
+	return db.GetPool().QueryRow(ctx, query, start, end).Scan(&funnel.NewUsers, &funnel.Registered, &funnel.Chatted, &funnel.Recharged)
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// 用量的来源
+const (
+	UsageKindChat        = "chat"        // 对话，包括对话中的图片生成
+	UsageKindRegister    = "register"    // 创建角色
+	UsageKindReincarnate = "reincarnate" // 转世
+	UsageKindRetreat     = "retreat"     // 闭关总结
+)
+
+// UsageRecord 一次操作中某个模型的用量和扣除的灵石
+type UsageRecord struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	CharacterID int       `json:"character_id,omitempty"` // 创建角色时为 0
+	Kind        string    `json:"kind"`
+	Model       string    `json:"model"`
+	Input       int64     `json:"input"`
+	Output      int64     `json:"output"`
+	Thinking    int64     `json:"thinking"`
+	Cached      int64     `json:"cached"`
+	Image       int64     `json:"image"`
+	Cost        int64     `json:"cost"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GetUsageCostSince 获取用户从 since 起消耗的灵石
+func (db *DB) GetUsageCostSince(ctx context.Context, userID int, since time.Time) (int64, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT COALESCE(SUM(cost), 0) FROM usage_records WHERE user_id = $1 AND created_at >= $2`
+	var cost int64
+	if err := db.GetPool().QueryRow(timeoutCtx, query, userID, since).Scan(&cost); err != nil {
+		return 0, err
+	}
+	return cost, nil
+}
+
+// ChargeUsage 在同一事务中记录用量明细并扣除用户的灵石
+func (db *DB) ChargeUsage(ctx context.Context, userID int, records []*UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO usage_records (user_id, character_id, kind, model, input_tokens, output_tokens, thinking_tokens, cached_tokens, image_tokens, cost, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`
+	now := time.Now()
+	total := int64(0)
+	for _, record := range records {
+		var characterID *int
+		if record.CharacterID != 0 {
+			characterID = &record.CharacterID
+		}
+		record.UserID = userID
+		record.CreatedAt = now
+		err := tx.QueryRow(ctx, query, userID, characterID, record.Kind, record.Model, record.Input, record.Output,
+			record.Thinking, record.Cached, record.Image, record.Cost, record.CreatedAt).Scan(&record.ID)
+		if err != nil {
+			return err
+		}
+		total += record.Cost
+	}
+	if err := db.UpdateUserTotalUsedTokenTx(ctx, tx, userID, total); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
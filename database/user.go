@@ -15,15 +15,56 @@ type User struct {
 	TotalRechargedToken int64     `json:"total_recharged_token"`
 	TotalUsedToken      int64     `json:"total_used_token"`
 	SystemPrompt        string    `json:"system_prompt"`
+	ActiveCharacterID   int       `json:"active_character_id"`   // 当前激活的角色，0表示没有角色
+	DailyLimit          int64     `json:"daily_limit"`           // 每日消耗灵石上限，0表示使用默认上限
+	TurnLimit           int64     `json:"turn_limit"`            // 单轮对话消耗灵石上限，0表示使用默认上限
+	BannedAt            time.Time `json:"banned_at,omitzero"`    // 封禁时间，零值表示未封禁
+	BannedUntil         time.Time `json:"banned_until,omitzero"` // 临时封禁的解封时间，零值表示永久封禁
+	ShadowBanned        bool      `json:"shadow_banned"`         // 影子封禁，静默忽略用户的消息而不提示
+	BanReason           string    `json:"ban_reason"`
+	BlockedAt           time.Time `json:"blocked_at,omitzero"` // 发现用户屏蔽机器人的时间，零值表示未屏蔽
+}
+
+// IsBanned 用户当前是否处于封禁中，临时封禁到期后自动失效
+func (u *User) IsBanned() bool {
+	return !u.BannedAt.IsZero() && (u.BannedUntil.IsZero() || time.Now().Before(u.BannedUntil))
 }
 
 func (db *DB) CreateUser(ctx context.Context, user *User) error {
 	query := `
 		INSERT INTO users (tg_id, username, created_at, total_recharged_token, total_used_token, system_prompt)
 		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
 	`
-	_, err := db.GetPool().Exec(ctx, query, user.TgId, user.Username, user.CreatedAt, user.TotalRechargedToken, user.TotalUsedToken, user.SystemPrompt)
-	return err
+	return db.GetPool().QueryRow(ctx, query, user.TgId, user.Username, user.CreatedAt, user.TotalRechargedToken, user.TotalUsedToken, user.SystemPrompt).Scan(&user.ID)
+}
+
+const userColumns = `id, tg_id, username, created_at, total_recharged_token, total_used_token, system_prompt,
+			COALESCE(active_character_id, 0), daily_limit, turn_limit, COALESCE(banned_at, 'epoch'::timestamp),
+			COALESCE(banned_until, 'epoch'::timestamp), shadow_banned, ban_reason,
+			COALESCE(blocked_at, 'epoch'::timestamp)`
+
+func scanUser(row pgx.Row) (*User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.TgId, &user.Username, &user.CreatedAt, &user.TotalRechargedToken, &user.TotalUsedToken, &user.SystemPrompt, &user.ActiveCharacterID,
+		&user.DailyLimit, &user.TurnLimit, &user.BannedAt, &user.BannedUntil, &user.ShadowBanned, &user.BanReason, &user.BlockedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// 用户不存在，返回 nil
+			return nil, nil
+		}
+		return nil, err
+	}
+	if user.BannedAt.Unix() == 0 {
+		user.BannedAt = time.Time{}
+	}
+	if user.BannedUntil.Unix() == 0 {
+		user.BannedUntil = time.Time{}
+	}
+	if user.BlockedAt.Unix() == 0 {
+		user.BlockedAt = time.Time{}
+	}
+	return &user, nil
 }
 
 func (db *DB) GetUser(ctx context.Context, tgId int64) (*User, error) {
@@ -31,24 +72,149 @@ func (db *DB) GetUser(ctx context.Context, tgId int64) (*User, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	return scanUser(db.GetPool().QueryRow(timeoutCtx, `SELECT `+userColumns+` FROM users WHERE tg_id = $1`, tgId))
+}
+
+// GetUserByID 根据用户ID获取用户
+func (db *DB) GetUserByID(ctx context.Context, id int) (*User, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return scanUser(db.GetPool().QueryRow(timeoutCtx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+// GetUserByUsername 根据 Telegram 用户名获取用户，不区分大小写
+func (db *DB) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(username) = $1 ORDER BY id LIMIT 1`
+	return scanUser(db.GetPool().QueryRow(timeoutCtx, query, normalizeUsername(username)))
+}
+
+// UpdateUsername 用户修改了 Telegram 用户名时同步更新
+// 用户名可以被别人改用，同时清除其他用户记录中过期的同名用户名
+func (db *DB) UpdateUsername(ctx context.Context, id int, username string) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if username != "" {
+		_, err = tx.Exec(ctx, `UPDATE users SET username = '' WHERE lower(username) = $1 AND id <> $2`, normalizeUsername(username), id)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET username = $1 WHERE id = $2`, username, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// BanUser 封禁用户，until 为零值时永久封禁，shadow 为 true 时静默忽略用户的消息
+func (db *DB) BanUser(ctx context.Context, id int, until time.Time, shadow bool, reason string) error {
+	var bannedUntil *time.Time
+	if !until.IsZero() {
+		bannedUntil = &until
+	}
 	query := `
-		SELECT id, tg_id, username, created_at, total_recharged_token, total_used_token, system_prompt
-		FROM users
-		WHERE tg_id = $1
+		UPDATE users
+		SET banned_at = $2, banned_until = $3, shadow_banned = $4, ban_reason = $5
+		WHERE id = $1
 	`
-	row := db.GetPool().QueryRow(timeoutCtx, query, tgId)
+	_, err := db.GetPool().Exec(ctx, query, id, time.Now(), bannedUntil, shadow, reason)
+	return err
+}
 
-	var user User
-	err := row.Scan(&user.ID, &user.TgId, &user.Username, &user.CreatedAt, &user.TotalRechargedToken, &user.TotalUsedToken, &user.SystemPrompt)
+// UnbanUser 解封用户
+func (db *DB) UnbanUser(ctx context.Context, id int) error {
+	query := `
+		UPDATE users
+		SET banned_at = NULL, banned_until = NULL, shadow_banned = FALSE, ban_reason = ''
+		WHERE id = $1
+	`
+	_, err := db.GetPool().Exec(ctx, query, id)
+	return err
+}
+
+// SetUserBlocked 记录或清除用户屏蔽机器人的状态
+func (db *DB) SetUserBlocked(ctx context.Context, id int, blocked bool) error {
+	query := `
+		UPDATE users
+		SET blocked_at = CASE WHEN $2 THEN CURRENT_TIMESTAMP END
+		WHERE id = $1
+	`
+	_, err := db.GetPool().Exec(ctx, query, id, blocked)
+	return err
+}
+
+// GetBannedUsers 获取封禁中的用户，按封禁时间倒序
+func (db *DB) GetBannedUsers(ctx context.Context) ([]*User, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE banned_at IS NOT NULL AND (banned_until IS NULL OR banned_until > $1)
+		ORDER BY banned_at DESC
+	`
+	rows, err := db.GetPool().Query(timeoutCtx, query, time.Now())
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			// 用户不存在，返回 nil
-			return nil, nil
-		}
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &user, nil
+	var users []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// SetActiveCharacterInTx 在事务中切换用户当前激活的角色
+func (db *DB) SetActiveCharacterInTx(ctx context.Context, tx pgx.Tx, userID int, characterID int) error {
+	query := `
+		UPDATE users
+		SET active_character_id = $2
+		WHERE id = $1
+	`
+	_, err := tx.Exec(ctx, query, userID, characterID)
+	return err
+}
+
+// SetActiveCharacter 切换用户当前激活的角色，角色必须属于该用户
+func (db *DB) SetActiveCharacter(ctx context.Context, userID int, characterID int) error {
+	query := `
+		UPDATE users
+		SET active_character_id = $2
+		WHERE id = $1 AND EXISTS(SELECT 1 FROM character_stats WHERE id = $2 AND user_id = $1)
+	`
+	tag, err := db.GetPool().Exec(ctx, query, userID, characterID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// SetUserSpendingLimits 设置用户的每日和单轮对话消耗灵石上限，0 表示使用默认上限
+func (db *DB) SetUserSpendingLimits(ctx context.Context, id int, dailyLimit int64, turnLimit int64) error {
+	query := `
+		UPDATE users
+		SET daily_limit = $2, turn_limit = $3
+		WHERE id = $1
+	`
+	_, err := db.GetPool().Exec(ctx, query, id, dailyLimit, turnLimit)
+	return err
 }
 
 func (db *DB) UpdateUserTotalUsedToken(ctx context.Context, id int, usedToken int64) error {
@@ -82,6 +248,17 @@ func (db *DB) UpdateUserTotalRechargedToken(ctx context.Context, id int, recharg
 	return err
 }
 
+// UpdateUserTotalRechargedTokenTx 在事务中增加用户的充值灵石
+func (db *DB) UpdateUserTotalRechargedTokenTx(ctx context.Context, tx pgx.Tx, id int, rechargedToken int64) error {
+	query := `
+		UPDATE users
+		SET total_recharged_token = total_recharged_token + $1
+		WHERE id = $2
+	`
+	_, err := tx.Exec(ctx, query, rechargedToken, id)
+	return err
+}
+
 // 查看用户现有token数
 func (db *DB) GetUserTotalToken(ctx context.Context, id int) (int64, error) {
 	query := `
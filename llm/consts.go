@@ -2,17 +2,74 @@ package llm
 
 import "google.golang.org/genai"
 
+// 使用的模型
+const (
+	ChatModel  = "gemini-2.5-flash"                          // 对话、生成角色和总结
+	ImageModel = "gemini-2.0-flash-preview-image-generation" // 生成图片
+)
+
+var ItemModifiersSchema = &genai.Schema{
+	Type:        genai.TypeObject,
+	Description: "装备提供的属性加成，可以为负数",
+	Properties: map[string]*genai.Schema{
+		"attack":       {Type: genai.TypeInteger, Description: "攻击力加成"},
+		"defense":      {Type: genai.TypeInteger, Description: "防御力加成"},
+		"speed":        {Type: genai.TypeInteger, Description: "速度加成"},
+		"spirit_sense": {Type: genai.TypeInteger, Description: "神识加成"},
+		"physique":     {Type: genai.TypeInteger, Description: "根骨加成"},
+		"luck":         {Type: genai.TypeInteger, Description: "幸运值加成"},
+	},
+}
+
+var ItemEffectSchema = &genai.Schema{
+	Type:        genai.TypeObject,
+	Description: "丹药等消耗品的使用效果",
+	Properties: map[string]*genai.Schema{
+		"heal":         {Type: genai.TypeInteger, Description: "战斗中恢复气血的百分比，比如30"},
+		"status":       {Type: genai.TypeString, Description: "使用后恢复的状态，比如健康"},
+		"experience":   {Type: genai.TypeInteger, Description: "增加的修炼经验"},
+		"lifespan":     {Type: genai.TypeInteger, Description: "增加的寿元"},
+		"demonic_aura": {Type: genai.TypeInteger, Description: "消除的煞气"},
+		"buff":         ItemModifiersSchema,
+		"buff_minutes": {Type: genai.TypeInteger, Description: "临时增益的持续分钟数"},
+	},
+}
+
+var ItemPropertiesSchema = &genai.Schema{
+	Type:        genai.TypeObject,
+	Description: "物品的属性，装备填写属性加成，丹药等消耗品填写使用效果",
+	Properties: map[string]*genai.Schema{
+		"modifiers":      ItemModifiersSchema,
+		"effect":         ItemEffectSchema,
+		"durability":     {Type: genai.TypeInteger, Description: "当前耐久，没有耐久的物品不填"},
+		"max_durability": {Type: genai.TypeInteger, Description: "最大耐久，没有耐久的物品不填"},
+		"bound":          {Type: genai.TypeBoolean, Description: "是否绑定，绑定物品不能交易"},
+		"element":        {Type: genai.TypeString, Description: "五行属性，比如金，木，水，火，土"},
+		"weight":         {Type: genai.TypeInteger, Description: "单件物品占用的背包格数，不填按1格计算，大型器物可以占用多格"},
+		"capacity":       {Type: genai.TypeInteger, Description: "储物袋、储物戒等储物法器提供的背包容量，穿戴到储物栏后生效，其他物品不填"},
+		"notes":          {Type: genai.TypeString, Description: "其他特殊效果的文字描述"},
+	},
+}
+
 var InventoryItemSchema = &genai.Schema{
 	Type:        genai.TypeObject,
 	Description: "物品列表",
 	Properties: map[string]*genai.Schema{
+		"id": {
+			Type:        genai.TypeInteger,
+			Description: "背包中已有物品的ID，修改或扣除某一件特定物品时填写，新物品不填",
+		},
 		"item_name": {
 			Type:        genai.TypeString,
 			Description: "物品的名称",
 		},
+		"stackable": {
+			Type:        genai.TypeBoolean,
+			Description: "是否可堆叠。丹药、材料等同名物品合并计数；武器、防具、法宝等独一无二的物品不可堆叠，每件单独存放。不填时装备类物品默认不可堆叠",
+		},
 		"quantity": {
 			Type:        genai.TypeInteger,
-			Description: "物品的数量，添加时为正数，删除时为负数",
+			Description: "物品的数量，扣除时为负数",
 		},
 		"item_type": {
 			Type:        genai.TypeString,
@@ -26,10 +83,7 @@ var InventoryItemSchema = &genai.Schema{
 			Type:        genai.TypeInteger,
 			Description: "物品的等级，比如1品，珍品，远古，玄天，通天等",
 		},
-		"properties": {
-			Type:        genai.TypeString,
-			Description: "物品的属性，比如攻击力，防御力，特殊效果等",
-		},
+		"properties": ItemPropertiesSchema,
 		"description": {
 			Type:        genai.TypeString,
 			Description: "物品的描述",
@@ -72,6 +126,12 @@ const (
 	ToolUpdatePlayer    ToolEnum = "update_player"
 	ToolUpdateInventory ToolEnum = "update_inventory"
 	ToolInAppPurchase   ToolEnum = "in_app_purchase"
+	ToolStartCombat     ToolEnum = "start_combat"
+	ToolEquipItem       ToolEnum = "equip_item"
+	ToolUnequipItem     ToolEnum = "unequip_item"
+	ToolUseItem         ToolEnum = "use_item"
+	ToolAlchemy         ToolEnum = "alchemy"
+	ToolRollLoot        ToolEnum = "roll_loot"
 )
 
 var ToolsDescMap = map[ToolEnum]*genai.FunctionDeclaration{
@@ -109,7 +169,7 @@ var ToolsDescMap = map[ToolEnum]*genai.FunctionDeclaration{
 	},
 	ToolUpdateInventory: {
 		Name:        string(ToolUpdateInventory),
-		Description: "更新玩家背包中的物品，不包含灵石，灵石是该游戏世界的通用货币，不能通过该工具更新灵石",
+		Description: "扣除玩家背包中的物品，如消耗、丢失、交出物品，不包含灵石，灵石是该游戏世界的通用货币，不能通过该工具更新灵石。该工具只能扣除不能发放，宝物和战利品掉落必须使用 roll_loot",
 		Parameters: &genai.Schema{
 			Type: genai.TypeObject,
 			Properties: map[string]*genai.Schema{
@@ -177,7 +237,7 @@ var ToolsDescMap = map[ToolEnum]*genai.FunctionDeclaration{
 				},
 				"status": {
 					Type:        genai.TypeString,
-					Description: "状态",
+					Description: "状态，角色死亡时设置为“陨落”，陨落的角色只能转世",
 				},
 				"stories": {
 					Type:        genai.TypeString,
@@ -189,20 +249,198 @@ var ToolsDescMap = map[ToolEnum]*genai.FunctionDeclaration{
 	},
 	ToolInAppPurchase: {
 		Name:        string(ToolInAppPurchase),
-		Description: "在游戏中通过灵石购买物品(内购系统)",
+		Description: "玩家在商店用灵石购买物品(内购系统)，只能购买商店目录中的商品，价格和库存以商店为准，不能自行定价或发放目录外的物品。系统会请玩家确认订单，返回玩家确认、取消或过期后的结果",
 		Parameters: &genai.Schema{
 			Type: genai.TypeObject,
 			Properties: map[string]*genai.Schema{
 				"items": {
 					Type:        genai.TypeArray,
-					Items:       InventoryItemSchema,
-					Description: "玩家购买的物品列表",
+					Description: "玩家购买的商品列表",
+					Items: &genai.Schema{
+						Type: genai.TypeObject,
+						Properties: map[string]*genai.Schema{
+							"shop_item_id": {
+								Type:        genai.TypeInteger,
+								Description: "商品ID，即商店目录中#后的数字",
+							},
+							"quantity": {
+								Type:        genai.TypeInteger,
+								Description: "购买的份数",
+							},
+						},
+						Required: []string{"shop_item_id", "quantity"},
+					},
 				},
-				"cost": {
+			},
+			Required: []string{"items"},
+		},
+	},
+	ToolStartCombat: {
+		Name:        string(ToolStartCombat),
+		Description: "玩家与敌人发生战斗时调用，由战斗引擎按属性、战斗功法和丹药模拟回合制战斗，返回战斗日志和结果。你只需设定敌人和敌人等级，胜利后系统按敌人属性和等级计算修炼经验，并按当地掉落表和敌人等级自动掷骰战利品。根据返回的战斗日志进行叙述，不得自行编造战斗结果或战利品",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"enemy": {
+					Type:        genai.TypeObject,
+					Description: "敌人设定，属性应与敌人境界相符，可参考玩家属性设定强弱",
+					Properties: map[string]*genai.Schema{
+						"name": {
+							Type:        genai.TypeString,
+							Description: "敌人名称",
+						},
+						"realm": {
+							Type:        genai.TypeString,
+							Description: "敌人境界",
+						},
+						"hp": {
+							Type:        genai.TypeInteger,
+							Description: "气血，玩家气血约为 100 + 根骨*10 + 境界等级*20",
+						},
+						"attack": {
+							Type:        genai.TypeInteger,
+							Description: "攻击力",
+						},
+						"defense": {
+							Type:        genai.TypeInteger,
+							Description: "防御力",
+						},
+						"speed": {
+							Type:        genai.TypeInteger,
+							Description: "速度，影响先手和闪避",
+						},
+						"spirit_sense": {
+							Type:        genai.TypeInteger,
+							Description: "神识，影响暴击",
+						},
+						"skills": {
+							Type:        genai.TypeArray,
+							Description: "敌人的神通",
+							Items: &genai.Schema{
+								Type: genai.TypeObject,
+								Properties: map[string]*genai.Schema{
+									"name": {
+										Type:        genai.TypeString,
+										Description: "神通名称",
+									},
+									"power": {
+										Type:        genai.TypeNumber,
+										Description: "伤害加成倍率，0.5表示额外造成50%伤害",
+									},
+									"cooldown": {
+										Type:        genai.TypeInteger,
+										Description: "冷却回合数",
+									},
+								},
+								Required: []string{"name", "power"},
+							},
+						},
+					},
+					Required: []string{"name", "realm", "hp", "attack", "defense", "speed", "spirit_sense"},
+				},
+				"enemy_tier": {
 					Type:        genai.TypeInteger,
-					Description: "总价，需要支付的灵石数量，不宜过低",
+					Description: "敌人等级，按敌人的大境界填写：1炼气、2筑基、3结丹、4元婴、5化神、6炼虚、7合体、8大乘",
+				},
+			},
+			Required: []string{"enemy", "enemy_tier"},
+		},
+	},
+	ToolEquipItem: {
+		Name:        string(ToolEquipItem),
+		Description: "为玩家穿戴背包中的武器、防具、饰品或法宝，同一栏位原有的装备会自动卸下放回背包。属性加成以物品自身属性为准，无法在装备时另行设定",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"item_id": {
+					Type:        genai.TypeInteger,
+					Description: "背包中要装备的物品ID，有多件同名物品时必须填写",
+				},
+				"item_name": {
+					Type:        genai.TypeString,
+					Description: "背包中要装备的物品名称",
+				},
+				"slot": {
+					Type:        genai.TypeString,
+					Description: "装备栏位，不填时根据物品类型自动判断",
+					Enum:        []string{"weapon", "armor", "accessory", "treasure", "storage"},
+				},
+			},
+			Required: []string{"item_name"},
+		},
+	},
+	ToolUnequipItem: {
+		Name:        string(ToolUnequipItem),
+		Description: "卸下玩家指定栏位的装备并放回背包",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"slot": {
+					Type:        genai.TypeString,
+					Description: "装备栏位",
+					Enum:        []string{"weapon", "armor", "accessory", "treasure", "storage"},
+				},
+			},
+			Required: []string{"slot"},
+		},
+	},
+	ToolUseItem: {
+		Name:        string(ToolUseItem),
+		Description: "玩家在战斗之外服用丹药或使用消耗品时调用，系统会扣除物品并结算物品属性中的使用效果（恢复状态、增加修为和寿元、消除煞气、临时增益），并返回实际结果",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"item_id": {
+					Type:        genai.TypeInteger,
+					Description: "背包中要使用的物品ID，有多件同名物品时填写",
+				},
+				"item_name": {
+					Type:        genai.TypeString,
+					Description: "背包中要使用的物品名称",
+				},
+				"quantity": {
+					Type:        genai.TypeInteger,
+					Description: "使用数量，默认为1",
+				},
+			},
+			Required: []string{"item_name"},
+		},
+	},
+	ToolAlchemy: {
+		Name:        string(ToolAlchemy),
+		Description: "炼丹和炼器。玩家获得丹方、器方时用 learn 学习配方，配方只能是管理员设定的配方名录中已有的，材料、产出和成功率以名录为准；玩家开炉炼制时用 craft，系统会检查功法和境界要求、扣除材料并开始计时，出炉时由系统掷骰决定成败和品质",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"action": {
+					Type:        genai.TypeString,
+					Description: "learn 学习配方，craft 开始炼制",
+					Enum:        []string{"learn", "craft"},
+				},
+				"recipe_name": {
+					Type:        genai.TypeString,
+					Description: "配方名称，学习时填写配方名录中的配方，炼制时填写玩家已掌握的配方",
+				},
+			},
+			Required: []string{"action", "recipe_name"},
+		},
+	},
+	ToolRollLoot: {
+		Name:        string(ToolRollLoot),
+		Description: "玩家获得宝物、开启宝箱或搜刮战利品时调用，系统按管理员设定的掉落表和玩家幸运值掷骰，直接把掉落物品放入背包并返回结果。通过 start_combat 战斗胜利的掉落已自动掷骰，不要重复调用",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"enemy_tier": {
+					Type:        genai.TypeInteger,
+					Description: "敌人等级，按敌人的大境界填写：1炼气、2筑基、3结丹、4元婴、5化神、6炼虚、7合体、8大乘；没有敌人的寻宝、开箱填0",
+				},
+				"reason": {
+					Type:        genai.TypeString,
+					Description: "掉落来源，比如击败赤焰狼、开启古修士遗箱",
 				},
 			},
+			Required: []string{"enemy_tier", "reason"},
 		},
 	},
 }
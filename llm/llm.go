@@ -59,7 +59,7 @@ func (s *LLMService) NewClient(ctx context.Context) (*genai.Client, error) {
 
 func (s *LLMService) CreateConversation(ctx context.Context, client *genai.Client, model string, history []*genai.Content) (*genai.Chat, error) {
 	if model == "" {
-		model = "gemini-2.5-flash"
+		model = ChatModel
 	}
 
 	// 创建生成内容的配置
@@ -73,6 +73,12 @@ func (s *LLMService) CreateConversation(ctx context.Context, client *genai.Clien
 					ToolsDescMap[ToolUpdatePlayer],
 					ToolsDescMap[ToolUpdateInventory],
 					ToolsDescMap[ToolInAppPurchase],
+					ToolsDescMap[ToolStartCombat],
+					ToolsDescMap[ToolEquipItem],
+					ToolsDescMap[ToolUnequipItem],
+					ToolsDescMap[ToolUseItem],
+					ToolsDescMap[ToolAlchemy],
+					ToolsDescMap[ToolRollLoot],
 				},
 			},
 		},
@@ -0,0 +1,115 @@
+package llm
+
+import (
+	"math"
+	"time"
+
+	"jiangfengwhu/nagi-bot-go/config"
+
+	"google.golang.org/genai"
+)
+
+// Usage 模型调用的 token 用量，按计价类别区分
+type Usage struct {
+	Model    string `json:"model"`
+	Input    int64  `json:"input"`    // 输入（不含缓存命中），包括工具调用的输入
+	Output   int64  `json:"output"`   // 文本输出
+	Thinking int64  `json:"thinking"` // 思考
+	Cached   int64  `json:"cached"`   // 缓存命中的输入
+	Image    int64  `json:"image"`    // 图片输出
+}
+
+// UsageFromMetadata 从一次模型调用的用量元数据中统计各类 token
+func UsageFromMetadata(model string, metadata *genai.GenerateContentResponseUsageMetadata) *Usage {
+	usage := &Usage{Model: model}
+	if metadata == nil {
+		return usage
+	}
+	for _, detail := range metadata.CandidatesTokensDetails {
+		if detail.Modality == genai.MediaModalityImage {
+			usage.Image += int64(detail.TokenCount)
+		}
+	}
+	usage.Input = int64(metadata.PromptTokenCount-metadata.CachedContentTokenCount) + int64(metadata.ToolUsePromptTokenCount)
+	usage.Cached = int64(metadata.CachedContentTokenCount)
+	usage.Thinking = int64(metadata.ThoughtsTokenCount)
+	usage.Output = int64(metadata.CandidatesTokenCount) - usage.Image
+	return usage
+}
+
+// Add 累加同一模型的用量
+func (u *Usage) Add(other *Usage) {
+	u.Input += other.Input
+	u.Output += other.Output
+	u.Thinking += other.Thinking
+	u.Cached += other.Cached
+	u.Image += other.Image
+}
+
+// Total token 总数
+func (u *Usage) Total() int64 {
+	return u.Input + u.Output + u.Thinking + u.Cached + u.Image
+}
+
+// Meter 一次操作的用量累加器，记录每次模型调用的最终用量并按模型合并
+type Meter struct {
+	Usages []*Usage
+}
+
+// Record 记录一次模型调用的用量，usage 为 nil 时忽略
+func (m *Meter) Record(usage *Usage) {
+	if usage == nil {
+		return
+	}
+	for _, existing := range m.Usages {
+		if existing.Model == usage.Model {
+			existing.Add(usage)
+			return
+		}
+	}
+	merged := *usage
+	m.Usages = append(m.Usages, &merged)
+}
+
+// Cost 累计用量折算的灵石
+func (m *Meter) Cost(cfg *config.Config, now time.Time) int64 {
+	cost := int64(0)
+	for _, usage := range m.Usages {
+		cost += Cost(cfg, usage, now)
+	}
+	return cost
+}
+
+// ModelPrice 模型的价格，未单独设定的按默认价格
+func ModelPrice(cfg *config.Config, model string) config.ModelPrice {
+	if price, ok := cfg.Pricing.Models[model]; ok {
+		return price
+	}
+	return cfg.Pricing.Default
+}
+
+// Discount 当前生效的促销折扣，没有促销时为 1
+func Discount(cfg *config.Config, now time.Time) float64 {
+	pricing := cfg.Pricing
+	if pricing.Discount <= 0 || pricing.Discount >= 1 {
+		return 1
+	}
+	if !pricing.DiscountStart.IsZero() && now.Before(pricing.DiscountStart) {
+		return 1
+	}
+	if !pricing.DiscountEnd.IsZero() && now.After(pricing.DiscountEnd) {
+		return 1
+	}
+	return pricing.Discount
+}
+
+// Cost 按模型价格、汇率和促销折扣把用量折算为灵石，不足一个灵石的按一个计
+func Cost(cfg *config.Config, usage *Usage, now time.Time) int64 {
+	price := ModelPrice(cfg, usage.Model)
+	dollars := (float64(usage.Input)*price.Input +
+		float64(usage.Output)*price.Output +
+		float64(usage.Thinking)*price.Thinking +
+		float64(usage.Cached)*price.Cached +
+		float64(usage.Image)*price.Image) / 1e6
+	return int64(math.Ceil(dollars * cfg.Pricing.ExchangeRate * Discount(cfg, now)))
+}
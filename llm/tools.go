@@ -3,19 +3,26 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"jiangfengwhu/nagi-bot-go/combat"
+	"jiangfengwhu/nagi-bot-go/crafting"
 	"jiangfengwhu/nagi-bot-go/database"
+	"jiangfengwhu/nagi-bot-go/loot"
 
+	"github.com/jackc/pgx/v5"
 	"google.golang.org/genai"
 )
 
-func (s *LLMService) GenerateImage(prompt string) ([]byte, int32, error) {
+// GenerateImage 生成图片，返回图片和本次调用的用量
+func (s *LLMService) GenerateImage(prompt string) ([]byte, *Usage, error) {
 	ctx := context.Background()
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{
 		APIKey:      s.getApiKey(),
@@ -23,25 +30,26 @@ func (s *LLMService) GenerateImage(prompt string) ([]byte, int32, error) {
 	})
 
 	if err != nil {
-		return nil, 0, fmt.Errorf("创建LLMClient失败: %v", err)
+		return nil, nil, fmt.Errorf("创建LLMClient失败: %v", err)
 	}
 
 	config := &genai.GenerateContentConfig{
 		ResponseModalities: []string{"TEXT", "IMAGE"},
 		SafetySettings:     TextSafetySettings,
 	}
-	result, err := client.Models.GenerateContent(ctx, "gemini-2.0-flash-preview-image-generation", genai.Text(prompt), config)
+	result, err := client.Models.GenerateContent(ctx, ImageModel, genai.Text(prompt), config)
 
 	if err != nil {
-		return nil, 0, fmt.Errorf("生成图片失败: %v", err)
+		return nil, nil, fmt.Errorf("生成图片失败: %v", err)
 	}
 
+	usage := UsageFromMetadata(ImageModel, result.UsageMetadata)
 	for _, part := range result.Candidates[0].Content.Parts {
 		if part.InlineData != nil {
-			return part.InlineData.Data, result.UsageMetadata.TotalTokenCount, nil
+			return part.InlineData.Data, usage, nil
 		}
 	}
-	return nil, 0, fmt.Errorf("生成图片失败")
+	return nil, usage, fmt.Errorf("生成图片失败")
 }
 
 func (s *LLMService) GetTime() string {
@@ -72,7 +80,7 @@ func (s *LLMService) GoogleSearch(prompt string) (string, error) {
 	return formatSearchResults(&searchResponse), nil
 }
 
-func UpdatePlayer(db *database.DB, userID int, args map[string]any) (string, error) {
+func UpdatePlayer(db *database.DB, characterID int, args map[string]any) (string, error) {
 	ctx := context.Background()
 
 	// 解析JSON参数到部分更新结构体
@@ -85,8 +93,8 @@ func UpdatePlayer(db *database.DB, userID int, args map[string]any) (string, err
 		return "", fmt.Errorf("解析更新参数失败: %v", err)
 	}
 
-	// 设置用户ID
-	updateParams.UserID = userID
+	// 设置角色ID
+	updateParams.CharacterID = characterID
 
 	// 调用部分更新方法
 	if err := db.UpdateCharacterStatsPartial(ctx, &updateParams); err != nil {
@@ -145,7 +153,7 @@ func UpdatePlayer(db *database.DB, userID int, args map[string]any) (string, err
 	return fmt.Sprintf("玩家信息更新成功，已更新: %s", strings.Join(updateFields, ", ")), nil
 }
 
-func UpdateInventory(db *database.DB, userID int, args map[string]any) (string, error) {
+func UpdateInventory(db *database.DB, characterID int, baseCapacity int, args map[string]any) (string, error) {
 	ctx := context.Background()
 
 	// 解析JSON参数到部分更新结构体
@@ -159,7 +167,11 @@ func UpdateInventory(db *database.DB, userID int, args map[string]any) (string,
 		return "", fmt.Errorf("解析更新参数失败: %v", err)
 	}
 	for _, item := range updateParams {
-		item.UserID = userID
+		// 天道只能扣除物品，获得物品必须通过掉落、战斗、炼制或购买等有审计来源的途径
+		if item.Quantity > 0 {
+			return fmt.Sprintf("update_inventory 只能扣除物品，「%s」未能放入背包。获得宝物请使用 roll_loot，本次物品变动均未生效", item.ItemName), nil
+		}
+		item.CharacterID = characterID
 	}
 	tx, err := db.GetPool().Begin(ctx)
 	if err != nil {
@@ -167,62 +179,489 @@ func UpdateInventory(db *database.DB, userID int, args map[string]any) (string,
 	}
 	defer tx.Rollback(ctx)
 
-	// 调用部分更新方法
-	if err := db.AddInventoryItemsBatchInTx(ctx, tx, updateParams); err != nil {
+	// 调用部分更新方法，背包容量不足时原样返回 InventoryFullError
+	capacity, err := db.AddInventoryItemsWithCapacityInTx(ctx, tx, characterID, updateParams, baseCapacity)
+	var full *database.InventoryFullError
+	if errors.As(err, &full) {
+		return "", err
+	}
+	var insufficient *database.InsufficientItemError
+	if errors.As(err, &insufficient) {
+		return fmt.Sprintf("扣除物品失败：%v，本次物品变动均未生效", insufficient), nil
+	}
+	if err != nil {
 		return "", fmt.Errorf("更新背包物品失败: %v", err)
 	}
 
-	return "背包物品更新成功", tx.Commit(ctx)
+	return fmt.Sprintf("背包物品更新成功，背包容量 %s", capacity), tx.Commit(ctx)
 }
 
-func InAppPurchase(db *database.DB, userID int, args map[string]any) (string, error) {
-	ctx := context.Background()
+// InAppPurchaseParams 购买工具参数
+type InAppPurchaseParams struct {
+	Items []*database.ShopOrderLine `json:"items"`
+}
 
-	// 解析JSON参数到部分更新结构体
-	var updateParams []*database.InventoryItem
-	fmt.Println("argsJSON", args)
-	var cost = int64(args["cost"].(float64))
-	if cost <= 0 {
-		return "", fmt.Errorf("灵石数量不能小于等于0")
+// InAppPurchase 按商品目录报价并创建待玩家确认的订单，此时不扣除灵石，messageID 和 turn 为触发购买的玩家消息
+// 商品不可购买时返回 ShopItemUnavailableError，余额不足时返回 InsufficientBalanceError
+func InAppPurchase(db *database.DB, userID int, characterID int, messageID int, turn string, args map[string]any) (*database.Order, error) {
+	var params InAppPurchaseParams
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("解析购买参数失败: %v", err)
+	}
+	if err := json.Unmarshal(argsJSON, &params); err != nil {
+		return nil, fmt.Errorf("解析购买参数失败: %v", err)
 	}
-	totalToken, err := db.GetUserTotalToken(ctx, userID)
+	for _, line := range params.Items {
+		// 价格只能以商店为准
+		line.ItemName = ""
+		line.UnitPrice = 0
+	}
+
+	order := &database.Order{UserID: userID, CharacterID: characterID, MessageID: messageID, Turn: turn, Lines: params.Items}
+	if err := db.CreateOrder(context.Background(), order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// StartCombatParams 战斗工具参数
+type StartCombatParams struct {
+	Enemy     *combat.Enemy `json:"enemy"`
+	EnemyTier int           `json:"enemy_tier"`
+}
+
+// StartCombat 模拟战斗并结算，胜利后由引擎按敌人属性和等级计算修炼经验，并按当地掉落表和敌人等级掷骰战利品
+func StartCombat(db *database.DB, characterID int, baseCapacity int, settings loot.Settings, args map[string]any) (string, error) {
+	ctx := context.Background()
+
+	var params StartCombatParams
+	argsJSON, err := json.Marshal(args)
 	if err != nil {
-		return "", fmt.Errorf("获取用户现有灵石数失败: %v", err)
+		return "", fmt.Errorf("解析战斗参数失败: %v", err)
 	}
-	if totalToken < cost {
-		return "", fmt.Errorf("灵石余额不足")
+	if err := json.Unmarshal(argsJSON, &params); err != nil {
+		return "", fmt.Errorf("解析战斗参数失败: %v", err)
 	}
-	argsJSON, err := json.Marshal(args["items"])
+	if params.Enemy == nil {
+		return "", fmt.Errorf("缺少敌人设定")
+	}
+	if err := params.Enemy.Validate(); err != nil {
+		return "", err
+	}
+	if params.EnemyTier < 1 || params.EnemyTier > combat.MaxEnemyTier {
+		return "", fmt.Errorf("敌人等级必须在1到%d之间", combat.MaxEnemyTier)
+	}
+
+	stats, err := db.GetCharacterStats(ctx, characterID)
+	if err != nil || stats == nil {
+		return "", fmt.Errorf("获取玩家信息失败: %v", err)
+	}
+	techniques, err := db.GetCharacterCultivationTechniques(ctx, characterID)
 	if err != nil {
-		return "", fmt.Errorf("解析更新参数失败: %v", err)
+		return "", fmt.Errorf("获取玩家功法失败: %v", err)
 	}
-	if err := json.Unmarshal(argsJSON, &updateParams); err != nil {
-		return "", fmt.Errorf("解析更新参数失败: %v", err)
+	inventory, err := db.GetCharacterInventory(ctx, characterID)
+	if err != nil {
+		return "", fmt.Errorf("获取背包物品失败: %v", err)
 	}
-	for _, item := range updateParams {
-		item.UserID = userID
+	equipment, err := db.GetCharacterEquipment(ctx, characterID)
+	if err != nil {
+		return "", fmt.Errorf("获取玩家装备失败: %v", err)
+	}
+	buffs, err := db.GetActiveBuffs(ctx, characterID)
+	if err != nil {
+		return "", fmt.Errorf("获取玩家增益失败: %v", err)
 	}
-	// 事务处理扣除灵石和更新背包
+
+	effective := stats.Effective(equipment, buffs)
+	player := combat.NewCharacterCombatant(effective, techniques, inventory)
+	result := combat.Simulate(player, params.Enemy.Combatant(), rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+
+	// 事务处理丹药消耗和战斗奖励
 	tx, err := db.GetPool().Begin(ctx)
 	if err != nil {
 		return "", fmt.Errorf("开始事务失败: %v", err)
 	}
 	defer tx.Rollback(ctx)
 
-	// 扣除灵石（使用事务版本）
-	if err := db.UpdateUserTotalUsedTokenTx(ctx, tx, userID, cost); err != nil {
-		return "", fmt.Errorf("扣除灵石失败: %v", err)
+	changes := []*database.InventoryItem{}
+	for itemName, quantity := range player.Used {
+		changes = append(changes, &database.InventoryItem{CharacterID: characterID, ItemName: itemName, Quantity: -quantity})
 	}
 
-	// 更新背包物品（使用事务版本）
-	if err := db.AddInventoryItemsBatchInTx(ctx, tx, updateParams); err != nil {
+	if err := db.AddInventoryItemsBatchInTx(ctx, tx, changes); err != nil {
 		return "", fmt.Errorf("更新背包物品失败: %v", err)
 	}
 
-	// 提交事务
+	outcome := ""
+	if result.AWon {
+		experience := params.Enemy.Experience(params.EnemyTier)
+		if err := db.AddExperienceInTx(ctx, tx, characterID, experience); err != nil {
+			return "", fmt.Errorf("增加修炼经验失败: %v", err)
+		}
+		outcome = fmt.Sprintf("玩家胜利，获得修炼经验%d", experience)
+		rewards, err := rollCombatLootInTx(ctx, db, tx, effective, baseCapacity, settings, params.EnemyTier, params.Enemy.Name)
+		if err != nil {
+			return "", err
+		}
+		outcome += rewards
+	} else {
+		if err := db.UpdateCharacterStatusInTx(ctx, tx, characterID, "重伤"); err != nil {
+			return "", fmt.Errorf("更新玩家状态失败: %v", err)
+		}
+		outcome = "玩家战败，陷入重伤状态，没有获得任何奖励"
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return "", fmt.Errorf("提交事务失败: %v", err)
 	}
 
-	return "背包物品更新成功", nil
+	used := []string{}
+	for itemName, quantity := range player.Used {
+		used = append(used, fmt.Sprintf("%s x%d", itemName, quantity))
+	}
+	if len(used) > 0 {
+		outcome += "。战斗中消耗：" + strings.Join(used, "，")
+	}
+
+	return fmt.Sprintf("战斗日志：\n%s\n\n战斗结果：%s", result.Log(), outcome), nil
+}
+
+// rollCombatLootInTx 按当地掉落表和敌人等级掷骰战利品并放入背包，背包放不下时战利品全部遗落，不影响战斗的其他结算
+func rollCombatLootInTx(ctx context.Context, db *database.DB, tx pgx.Tx, player *database.CharacterStats, baseCapacity int, settings loot.Settings, enemyTier int, enemyName string) (string, error) {
+	tables, err := db.GetLootTables(ctx)
+	if err != nil {
+		return "", fmt.Errorf("获取掉落表失败: %v", err)
+	}
+	table := loot.Match(tables, player.Location, enemyTier)
+	if table == nil {
+		return "，没有掉落战利品", nil
+	}
+
+	items := loot.Roll(table, player.Luck, settings, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+	for _, item := range items {
+		item.CharacterID = player.ID
+		item.ObtainedFrom = fmt.Sprintf("击败%s", enemyName)
+	}
+	roll := &database.LootRoll{
+		CharacterID: player.ID,
+		LootTableID: table.ID,
+		Location:    player.Location,
+		EnemyTier:   enemyTier,
+		Rolled:      items,
+		Granted:     true,
+	}
+	if len(items) == 0 {
+		if err := db.CreateLootRollInTx(ctx, tx, roll); err != nil {
+			return "", fmt.Errorf("记录掉落失败: %v", err)
+		}
+		return "，没有掉落战利品", nil
+	}
+
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer savepoint.Rollback(ctx)
+
+	_, err = db.AddInventoryItemsWithCapacityInTx(ctx, savepoint, player.ID, items, baseCapacity)
+	var full *database.InventoryFullError
+	if errors.As(err, &full) {
+		// 背包放不下时只记录掷出的结果，物品不发放
+		savepoint.Rollback(ctx)
+		roll.Granted = false
+		if err := db.CreateLootRollInTx(ctx, tx, roll); err != nil {
+			return "", fmt.Errorf("记录掉落失败: %v", err)
+		}
+		return fmt.Sprintf("。%s，战利品未能带走", full.Error()), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("更新背包物品失败: %v", err)
+	}
+	if err := db.CreateLootRollInTx(ctx, savepoint, roll); err != nil {
+		return "", fmt.Errorf("记录掉落失败: %v", err)
+	}
+	if err := db.RecordItemGrantsInTx(ctx, savepoint, player.ID, database.GrantSourceCombat, roll.ID, items); err != nil {
+		return "", fmt.Errorf("记录物品发放失败: %v", err)
+	}
+	if err := savepoint.Commit(ctx); err != nil {
+		return "", fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	dropped := []string{}
+	for _, item := range items {
+		dropped = append(dropped, fmt.Sprintf("%s（%s）x%d", item.ItemName, item.Quality, item.Quantity))
+	}
+	return fmt.Sprintf("，按掉落表「%s」获得战利品：%s", table.Name, strings.Join(dropped, "，")), nil
+}
+
+// EquipItemParams 穿戴装备工具参数
+type EquipItemParams struct {
+	ItemID   int    `json:"item_id"`
+	ItemName string `json:"item_name"`
+	Slot     string `json:"slot"`
+}
+
+func EquipItem(db *database.DB, characterID int, baseCapacity int, args map[string]any) (string, error) {
+	ctx := context.Background()
+
+	var params EquipItemParams
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return "", fmt.Errorf("解析装备参数失败: %v", err)
+	}
+	if err := json.Unmarshal(argsJSON, &params); err != nil {
+		return "", fmt.Errorf("解析装备参数失败: %v", err)
+	}
+
+	var item *database.InventoryItem
+	if params.ItemID > 0 {
+		item, err = db.GetInventoryItem(ctx, characterID, params.ItemID)
+	} else {
+		item, err = db.GetInventoryItemByName(ctx, characterID, params.ItemName)
+	}
+	if err != nil {
+		return "", fmt.Errorf("获取背包物品失败: %v", err)
+	}
+	if item == nil {
+		return fmt.Sprintf("背包中没有「%s」，无法装备", params.ItemName), nil
+	}
+	if params.Slot == "" {
+		params.Slot = database.EquipSlotForItemType(item.ItemType)
+	}
+	if _, ok := database.EquipSlotNames[params.Slot]; !ok {
+		return fmt.Sprintf("「%s」（%s）无法装备", item.ItemName, item.ItemType), nil
+	}
+
+	equipped, replaced, err := db.EquipItem(ctx, characterID, item.ID, item.ItemName, params.Slot, baseCapacity)
+	var full *database.InventoryFullError
+	if errors.As(err, &full) {
+		return fmt.Sprintf("%s，换下的装备放不下，无法装备「%s」", full.Error(), item.ItemName), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("装备物品失败: %v", err)
+	}
+	result := fmt.Sprintf("已将「%s」装备在%s栏，属性加成：%s", equipped.Item.ItemName, database.EquipSlotNames[equipped.Slot], equipped.Modifiers.String())
+	if replaced != nil {
+		result += fmt.Sprintf("，原装备「%s」已放回背包", replaced.Item.ItemName)
+	}
+	return result, nil
+}
+
+func UnequipItem(db *database.DB, characterID int, baseCapacity int, args map[string]any) (string, error) {
+	ctx := context.Background()
+
+	slot, _ := args["slot"].(string)
+	if _, ok := database.EquipSlotNames[slot]; !ok {
+		return "", fmt.Errorf("无效的装备栏位: %s", slot)
+	}
+	equipment, err := db.UnequipItem(ctx, characterID, slot, baseCapacity)
+	var full *database.InventoryFullError
+	if errors.As(err, &full) {
+		return fmt.Sprintf("%s，无法卸下%s栏的装备", full.Error(), database.EquipSlotNames[slot]), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("卸下装备失败: %v", err)
+	}
+	if equipment == nil {
+		return fmt.Sprintf("%s栏没有装备", database.EquipSlotNames[slot]), nil
+	}
+	return fmt.Sprintf("已卸下%s栏的「%s」并放回背包", database.EquipSlotNames[slot], equipment.Item.ItemName), nil
+}
+
+func UseItem(db *database.DB, characterID int, args map[string]any) (string, error) {
+	ctx := context.Background()
+
+	itemName, _ := args["item_name"].(string)
+	itemID := 0
+	if id, ok := args["item_id"].(float64); ok {
+		itemID = int(id)
+	}
+	quantity := 1
+	if q, ok := args["quantity"].(float64); ok && q > 0 {
+		quantity = int(q)
+	}
+
+	usage, err := db.UseItem(ctx, characterID, itemID, itemName, quantity)
+	if err != nil {
+		// 数量不足或无法使用时告知天道，由天道向玩家说明
+		var insufficient *database.InsufficientItemError
+		if errors.As(err, &insufficient) || errors.Is(err, database.ErrItemNotUsable) {
+			return fmt.Sprintf("使用「%s」失败：%v", itemName, err), nil
+		}
+		return "", fmt.Errorf("使用物品失败: %v", err)
+	}
+	return usage.String(), nil
+}
+
+// AlchemyParams 炼丹炼器工具参数
+type AlchemyParams struct {
+	Action     string `json:"action"`
+	RecipeName string `json:"recipe_name"`
+}
+
+func Alchemy(db *database.DB, characterID int, args map[string]any) (string, error) {
+	ctx := context.Background()
+
+	var params AlchemyParams
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return "", fmt.Errorf("解析炼制参数失败: %v", err)
+	}
+	if err := json.Unmarshal(argsJSON, &params); err != nil {
+		return "", fmt.Errorf("解析炼制参数失败: %v", err)
+	}
+
+	if params.Action == "learn" {
+		// 配方只能来自管理员设定的配方名录
+		recipe, err := db.GetCatalogRecipe(ctx, params.RecipeName)
+		if err != nil {
+			return "", fmt.Errorf("获取配方失败: %v", err)
+		}
+		if recipe == nil {
+			return fmt.Sprintf("配方名录中没有「%s」，玩家无法学会这个配方，请不要自行编造配方", params.RecipeName), nil
+		}
+		recipe.ID = 0
+		recipe.CharacterID = characterID
+		recipe.LearnedAt = time.Time{}
+		if err := db.LearnRecipe(ctx, recipe); err != nil {
+			return "", fmt.Errorf("学习配方失败: %v", err)
+		}
+		return "已记下配方：" + crafting.FormatRecipe(recipe), nil
+	}
+
+	stats, err := db.GetCharacterStats(ctx, characterID)
+	if err != nil || stats == nil {
+		return "", fmt.Errorf("获取玩家信息失败: %v", err)
+	}
+	recipe, err := db.GetRecipe(ctx, characterID, params.RecipeName)
+	if err != nil {
+		return "", fmt.Errorf("获取配方失败: %v", err)
+	}
+	if recipe == nil {
+		return fmt.Sprintf("玩家尚未掌握配方「%s」，需要先获得丹方或器方", params.RecipeName), nil
+	}
+
+	craft, err := crafting.Start(ctx, db, stats, recipe)
+	if err != nil {
+		// 不满足要求、材料不足或正在炼制时告知天道，由天道向玩家说明
+		var unmet *crafting.RequirementError
+		var insufficient *database.InsufficientItemError
+		if errors.As(err, &unmet) || errors.As(err, &insufficient) || errors.Is(err, database.ErrCraftInProgress) {
+			return fmt.Sprintf("炼制「%s」失败：%v", params.RecipeName, err), nil
+		}
+		return "", fmt.Errorf("开始炼制失败: %v", err)
+	}
+	return crafting.FormatStart(craft) + "。出炉结果将由系统通知玩家，请不要自行编造炼制结果", nil
+}
+
+// RollLootParams 掉落工具参数
+type RollLootParams struct {
+	EnemyTier int    `json:"enemy_tier"`
+	Reason    string `json:"reason"`
+}
+
+func RollLoot(db *database.DB, characterID int, baseCapacity int, settings loot.Settings, args map[string]any) (string, error) {
+	ctx := context.Background()
+
+	var params RollLootParams
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return "", fmt.Errorf("解析掉落参数失败: %v", err)
+	}
+	if err := json.Unmarshal(argsJSON, &params); err != nil {
+		return "", fmt.Errorf("解析掉落参数失败: %v", err)
+	}
+
+	stats, err := db.GetCharacterStats(ctx, characterID)
+	if err != nil || stats == nil {
+		return "", fmt.Errorf("获取玩家信息失败: %v", err)
+	}
+	equipment, err := db.GetCharacterEquipment(ctx, characterID)
+	if err != nil {
+		return "", fmt.Errorf("获取玩家装备失败: %v", err)
+	}
+	buffs, err := db.GetActiveBuffs(ctx, characterID)
+	if err != nil {
+		return "", fmt.Errorf("获取玩家增益失败: %v", err)
+	}
+	tables, err := db.GetLootTables(ctx)
+	if err != nil {
+		return "", fmt.Errorf("获取掉落表失败: %v", err)
+	}
+	table := loot.Match(tables, stats.Location, params.EnemyTier)
+	if table == nil {
+		return fmt.Sprintf("「%s」没有可用的掉落表，本次没有掉落任何宝物", stats.Location), nil
+	}
+
+	items := loot.Roll(table, stats.Effective(equipment, buffs).Luck, settings, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+	for _, item := range items {
+		item.CharacterID = characterID
+		item.ObtainedFrom = params.Reason
+		if item.ObtainedFrom == "" {
+			item.ObtainedFrom = table.Name
+		}
+	}
+	roll := &database.LootRoll{
+		CharacterID: characterID,
+		LootTableID: table.ID,
+		Location:    stats.Location,
+		EnemyTier:   params.EnemyTier,
+		Rolled:      items,
+		Granted:     true,
+	}
+
+	tx, err := db.GetPool().Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := db.CreateLootRollInTx(ctx, tx, roll); err != nil {
+		return "", fmt.Errorf("记录掉落失败: %v", err)
+	}
+	_, err = db.AddInventoryItemsWithCapacityInTx(ctx, tx, characterID, items, baseCapacity)
+	var full *database.InventoryFullError
+	if errors.As(err, &full) {
+		// 背包放不下时只记录掷出的结果，物品不发放
+		tx.Rollback(ctx)
+		if err := recordUngrantedLootRoll(ctx, db, roll); err != nil {
+			return "", err
+		}
+		return "", full
+	}
+	if err != nil {
+		return "", fmt.Errorf("更新背包物品失败: %v", err)
+	}
+	if err := db.RecordItemGrantsInTx(ctx, tx, characterID, database.GrantSourceLoot, roll.ID, items); err != nil {
+		return "", fmt.Errorf("记录物品发放失败: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	if len(items) == 0 {
+		return fmt.Sprintf("按掉落表「%s」抽取，什么也没有掉落", table.Name), nil
+	}
+	dropped := []string{}
+	for _, item := range items {
+		dropped = append(dropped, fmt.Sprintf("%s（%s）x%d", item.ItemName, item.Quality, item.Quantity))
+	}
+	return fmt.Sprintf("按掉落表「%s」抽取，获得：%s，物品已放入背包", table.Name, strings.Join(dropped, "，")), nil
+}
+
+// recordUngrantedLootRoll 记录未能发放的掉落，供审计对照
+func recordUngrantedLootRoll(ctx context.Context, db *database.DB, roll *database.LootRoll) error {
+	tx, err := db.GetPool().Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	roll.Granted = false
+	if err := db.CreateLootRollInTx(ctx, tx, roll); err != nil {
+		return fmt.Errorf("记录掉落失败: %v", err)
+	}
+	return tx.Commit(ctx)
 }
@@ -0,0 +1,150 @@
+package loot
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"jiangfengwhu/nagi-bot-go/database"
+)
+
+// Settings 掉落的全局配置
+type Settings struct {
+	QualityWeights map[string]int // 各品质物品的默认权重
+	LuckFactor     float64        // 每点幸运值对高品质物品权重的提升比例
+}
+
+// Validate 校验掉落表并补全默认值
+func Validate(table *database.LootTable) error {
+	if table.Name == "" {
+		return fmt.Errorf("掉落表名称不能为空")
+	}
+	if len(table.Entries) == 0 {
+		return fmt.Errorf("掉落表「%s」没有掉落项", table.Name)
+	}
+	for _, entry := range table.Entries {
+		if entry.Item == nil && entry.Weight <= 0 {
+			return fmt.Errorf("掉落表「%s」的空掉落项必须设定权重", table.Name)
+		}
+		if entry.Item != nil && entry.Item.ItemName == "" {
+			return fmt.Errorf("掉落表「%s」有物品缺少名称", table.Name)
+		}
+		entry.MinQuantity = max(entry.MinQuantity, 1)
+		entry.MaxQuantity = max(entry.MaxQuantity, entry.MinQuantity)
+	}
+	table.Rolls = max(table.Rolls, 1)
+	table.EnemyTier = max(table.EnemyTier, 0)
+	return nil
+}
+
+// Match 选出最符合地点和敌人等级的掉落表：地点和等级都吻合的优先，其次是地点关键字更长的，最后是通用掉落表
+func Match(tables []*database.LootTable, location string, enemyTier int) *database.LootTable {
+	var best *database.LootTable
+	bestScore := -1
+	for _, table := range tables {
+		if table.Location != "" && !strings.Contains(location, table.Location) {
+			continue
+		}
+		if table.EnemyTier != 0 && table.EnemyTier != enemyTier {
+			continue
+		}
+		score := len(table.Location) * 2
+		if table.EnemyTier != 0 {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = table, score
+		}
+	}
+	return best
+}
+
+// Weight 掉落项的权重：未设定时按物品品质取默认权重，幸运值按品质阶数提高高品质物品的权重
+func Weight(entry *database.LootEntry, luck int, settings Settings) float64 {
+	weight := float64(entry.Weight)
+	if entry.Item == nil {
+		return weight
+	}
+	if weight <= 0 {
+		weight = float64(settings.QualityWeights[entry.Item.Quality])
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	if tier := database.QualityTier(entry.Item.Quality); tier > 0 && luck > 0 {
+		weight *= 1 + float64(luck)*settings.LuckFactor*float64(tier)
+	}
+	return weight
+}
+
+// Roll 按权重从掉落表中抽取物品，同名物品合并
+func Roll(table *database.LootTable, luck int, settings Settings, rng *rand.Rand) []*database.InventoryItem {
+	weights := make([]float64, len(table.Entries))
+	total := 0.0
+	for i, entry := range table.Entries {
+		weights[i] = Weight(entry, luck, settings)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	items := []*database.InventoryItem{}
+	byName := make(map[string]*database.InventoryItem)
+	for range max(table.Rolls, 1) {
+		entry := pick(table.Entries, weights, total, rng)
+		if entry == nil || entry.Item == nil {
+			continue
+		}
+		quantity := entry.MinQuantity
+		if entry.MaxQuantity > entry.MinQuantity {
+			quantity += rng.IntN(entry.MaxQuantity - entry.MinQuantity + 1)
+		}
+		if existing, ok := byName[entry.Item.ItemName]; ok {
+			existing.Quantity += max(quantity, 1)
+			continue
+		}
+		item := *entry.Item
+		item.ID = 0
+		item.Quantity = max(quantity, 1)
+		byName[item.ItemName] = &item
+		items = append(items, &item)
+	}
+	return items
+}
+
+func pick(entries []*database.LootEntry, weights []float64, total float64, rng *rand.Rand) *database.LootEntry {
+	roll := rng.Float64() * total
+	for i, entry := range entries {
+		roll -= weights[i]
+		if roll < 0 {
+			return entry
+		}
+	}
+	return nil
+}
+
+// FormatTable 掉落表的简要说明
+func FormatTable(table *database.LootTable, settings Settings) string {
+	location := table.Location
+	if location == "" {
+		location = "任意地点"
+	}
+	tier := "任意等级"
+	if table.EnemyTier > 0 {
+		tier = fmt.Sprintf("%d级敌人", table.EnemyTier)
+	}
+	total := 0.0
+	for _, entry := range table.Entries {
+		total += Weight(entry, 0, settings)
+	}
+	entries := []string{}
+	for _, entry := range table.Entries {
+		name := "无掉落"
+		if entry.Item != nil {
+			name = fmt.Sprintf("%s（%s）x%d-%d", entry.Item.ItemName, entry.Item.Quality, entry.MinQuantity, entry.MaxQuantity)
+		}
+		entries = append(entries, fmt.Sprintf("%s %.1f%%", name, Weight(entry, 0, settings)/total*100))
+	}
+	return fmt.Sprintf("【%s】%s·%s，抽取%d次：%s", table.Name, location, tier, table.Rolls, strings.Join(entries, "、"))
+}
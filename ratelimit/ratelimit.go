@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Rule 令牌桶规则
+type Rule struct {
+	Burst     int     // 桶容量，即允许连续发起的次数
+	PerMinute float64 // 每分钟补充的令牌数
+}
+
+// Bucket 一个令牌桶的状态
+type Bucket struct {
+	Tokens    float64   // 剩余令牌
+	UpdatedAt time.Time // 上次补充令牌的时间
+}
+
+// Store 令牌桶的存储，默认使用内存，需要跨进程或重启保留时可以替换为持久化实现
+type Store interface {
+	// Load 读取令牌桶，不存在时返回 nil
+	Load(key string) (*Bucket, error)
+	// Save 保存令牌桶
+	Save(key string, bucket *Bucket) error
+}
+
+// Limiter 按 key 和类别限流的令牌桶限流器
+type Limiter struct {
+	mu    sync.Mutex
+	store Store
+	rules map[string]Rule
+}
+
+// New 创建限流器，rules 为各类别的规则，没有规则的类别不限流
+func New(store Store, rules map[string]Rule) *Limiter {
+	return &Limiter{store: store, rules: rules}
+}
+
+// Allow 为 key 在 category 类别下消耗一个令牌，令牌不足时返回 false 和需要等待的时间
+// 存储出错时放行并返回错误
+func (l *Limiter) Allow(key string, category string, now time.Time) (bool, time.Duration, error) {
+	rule, ok := l.rules[category]
+	if !ok || rule.Burst <= 0 || rule.PerMinute <= 0 {
+		return true, 0, nil
+	}
+	rate := rule.PerMinute / float64(time.Minute)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucketKey := category + ":" + key
+	bucket, err := l.store.Load(bucketKey)
+	if err != nil {
+		return true, 0, err
+	}
+	if bucket == nil {
+		bucket = &Bucket{Tokens: float64(rule.Burst), UpdatedAt: now}
+	}
+	if elapsed := now.Sub(bucket.UpdatedAt); elapsed > 0 {
+		bucket.Tokens = min(float64(rule.Burst), bucket.Tokens+float64(elapsed)*rate)
+		bucket.UpdatedAt = now
+	}
+
+	allowed := bucket.Tokens >= 1
+	wait := time.Duration(0)
+	if allowed {
+		bucket.Tokens--
+	} else {
+		wait = time.Duration((1 - bucket.Tokens) / rate)
+	}
+	if err := l.store.Save(bucketKey, bucket); err != nil {
+		return true, 0, err
+	}
+	return allowed, wait, nil
+}
+
+// MemoryStore 内存中的令牌桶存储，重启后清空
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]Bucket
+}
+
+// NewMemoryStore 创建内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]Bucket)}
+}
+
+// Load 读取令牌桶，不存在时返回 nil
+func (s *MemoryStore) Load(key string) (*Bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		return nil, nil
+	}
+	return &bucket, nil
+}
+
+// Save 保存令牌桶
+func (s *MemoryStore) Save(key string, bucket *Bucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[key] = *bucket
+	return nil
+}
+
+// Prune 清理 before 之前就没有更新过的令牌桶
+// 调用方需保证这段时间足够补满令牌，这样的桶删除后与新建的等价
+func (s *MemoryStore) Prune(before time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, bucket := range s.buckets {
+		if bucket.UpdatedAt.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+}
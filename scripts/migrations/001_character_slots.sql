@@ -0,0 +1,39 @@
+-- 角色与用户解耦：一个用户可以拥有多个角色，背包、功法、消息历史归属于角色
+-- 适用于已经按旧版 table.sql 建表的数据库，新建库直接使用 table.sql 即可
+
+BEGIN;
+
+-- 人物属性表增加主键和转世信息
+ALTER TABLE character_stats ADD COLUMN IF NOT EXISTS id SERIAL PRIMARY KEY;
+ALTER TABLE character_stats DROP CONSTRAINT IF EXISTS character_stats_user_id_key;
+ALTER TABLE character_stats ADD COLUMN IF NOT EXISTS generation INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE character_stats ADD COLUMN IF NOT EXISTS previous_character_id INTEGER REFERENCES character_stats(id) ON DELETE SET NULL;
+ALTER TABLE character_stats ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+-- 用户当前激活的角色
+ALTER TABLE users ADD COLUMN IF NOT EXISTS active_character_id INTEGER;
+UPDATE users u SET active_character_id = c.id FROM character_stats c WHERE c.user_id = u.id;
+
+-- 消息历史归属到角色
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS character_id INTEGER REFERENCES character_stats(id) ON DELETE CASCADE;
+UPDATE messages m SET character_id = c.id FROM character_stats c WHERE c.user_id = m.user_id AND m.character_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_character_created ON messages(character_id, created_at);
+
+-- 背包归属到角色
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS character_id INTEGER REFERENCES character_stats(id) ON DELETE CASCADE;
+UPDATE inventory i SET character_id = c.id FROM character_stats c WHERE c.user_id = i.user_id;
+DELETE FROM inventory WHERE character_id IS NULL;
+ALTER TABLE inventory ALTER COLUMN character_id SET NOT NULL;
+ALTER TABLE inventory DROP COLUMN user_id;
+CREATE INDEX IF NOT EXISTS idx_inventory_character_id ON inventory(character_id);
+CREATE INDEX IF NOT EXISTS idx_inventory_character_type ON inventory(character_id, item_type);
+
+-- 功法归属到角色
+ALTER TABLE cultivation_techniques ADD COLUMN IF NOT EXISTS character_id INTEGER REFERENCES character_stats(id) ON DELETE CASCADE;
+UPDATE cultivation_techniques t SET character_id = c.id FROM character_stats c WHERE c.user_id = t.user_id;
+DELETE FROM cultivation_techniques WHERE character_id IS NULL;
+ALTER TABLE cultivation_techniques ALTER COLUMN character_id SET NOT NULL;
+ALTER TABLE cultivation_techniques DROP COLUMN user_id;
+CREATE INDEX IF NOT EXISTS idx_cultivation_techniques_character_id ON cultivation_techniques(character_id);
+
+COMMIT;
@@ -0,0 +1,71 @@
+-- 物品属性由纯文本改为结构化的 JSONB
+-- 原有文本尽量解析出属性加成、使用效果、耐久、绑定和五行，原文保留在 notes 中
+
+BEGIN;
+
+CREATE FUNCTION pg_temp.parse_item_properties(raw TEXT) RETURNS JSONB AS $$
+DECLARE
+    parsed JSONB;
+    modifiers JSONB;
+    effect JSONB;
+BEGIN
+    IF raw IS NULL OR btrim(raw) = '' THEN
+        RETURN NULL;
+    END IF;
+
+    -- 已经是JSON对象的直接使用
+    BEGIN
+        parsed := raw::JSONB;
+        IF jsonb_typeof(parsed) = 'object' THEN
+            RETURN parsed;
+        END IF;
+    EXCEPTION WHEN others THEN
+        NULL;
+    END;
+
+    modifiers := jsonb_strip_nulls(jsonb_build_object(
+        'attack',       substring(raw FROM '攻击力?\s*[:：+＋]?\s*\+?(-?\d+)')::INTEGER,
+        'defense',      substring(raw FROM '防御力?\s*[:：+＋]?\s*\+?(-?\d+)')::INTEGER,
+        'speed',        substring(raw FROM '速度\s*[:：+＋]?\s*\+?(-?\d+)')::INTEGER,
+        'spirit_sense', substring(raw FROM '神识\s*[:：+＋]?\s*\+?(-?\d+)')::INTEGER,
+        'physique',     substring(raw FROM '(?:根骨|体魄)\s*[:：+＋]?\s*\+?(-?\d+)')::INTEGER,
+        'luck',         substring(raw FROM '(?:幸运值?|气运)\s*[:：+＋]?\s*\+?(-?\d+)')::INTEGER
+    ));
+    effect := jsonb_strip_nulls(jsonb_build_object(
+        'heal',         substring(raw FROM '(?:恢复|回复)(?:气血|生命|法力)?\s*(\d+)\s*[%％]')::INTEGER,
+        'experience',   substring(raw FROM '(?:修为|经验)\s*[+＋]\s*(\d+)')::BIGINT,
+        'lifespan',     substring(raw FROM '寿元?\s*[+＋]\s*(\d+)')::INTEGER,
+        'demonic_aura', substring(raw FROM '(?:消除|降低|减少)煞气\s*(\d+)')::INTEGER
+    ));
+
+    RETURN jsonb_strip_nulls(jsonb_build_object(
+        'modifiers',      NULLIF(modifiers, '{}'::JSONB),
+        'effect',         NULLIF(effect, '{}'::JSONB),
+        'durability',     substring(raw FROM '耐久度?\s*[:：]?\s*(\d+)')::INTEGER,
+        'max_durability', COALESCE(substring(raw FROM '耐久度?\s*[:：]?\s*\d+\s*/\s*(\d+)'), substring(raw FROM '耐久度?\s*[:：]?\s*(\d+)'))::INTEGER,
+        'bound',          CASE WHEN raw LIKE '%绑定%' AND raw NOT LIKE '%未绑定%' THEN TRUE END,
+        'element',        substring(raw FROM '([金木水火土雷冰风])属性'),
+        'notes',          raw
+    ));
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE inventory ALTER COLUMN properties TYPE JSONB USING pg_temp.parse_item_properties(properties);
+
+-- 托管中的赌注和穿戴中的装备保存了物品快照，一并转换
+-- 切磋表和装备表由建表脚本创建，尚未建表的数据库没有需要转换的快照
+DO $$
+BEGIN
+    IF to_regclass('duels') IS NOT NULL THEN
+        UPDATE duels SET challenger_stake = jsonb_set(challenger_stake, '{properties}', COALESCE(pg_temp.parse_item_properties(challenger_stake->>'properties'), 'null'::JSONB))
+        WHERE jsonb_typeof(challenger_stake->'properties') = 'string';
+        UPDATE duels SET defender_stake = jsonb_set(defender_stake, '{properties}', COALESCE(pg_temp.parse_item_properties(defender_stake->>'properties'), 'null'::JSONB))
+        WHERE jsonb_typeof(defender_stake->'properties') = 'string';
+    END IF;
+    IF to_regclass('equipment') IS NOT NULL THEN
+        UPDATE equipment SET item = jsonb_set(item, '{properties}', COALESCE(pg_temp.parse_item_properties(item->>'properties'), 'null'::JSONB))
+        WHERE jsonb_typeof(item->'properties') = 'string';
+    END IF;
+END $$;
+
+COMMIT;
@@ -0,0 +1,25 @@
+-- 背包物品增加ID和可堆叠标记，装备类物品拆分为独立的记录
+
+BEGIN;
+
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS id SERIAL PRIMARY KEY;
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS stackable BOOLEAN NOT NULL DEFAULT TRUE;
+CREATE INDEX IF NOT EXISTS idx_inventory_character_name ON inventory(character_id, item_name);
+
+-- 与 database.EquipSlotForItemType 的关键字保持一致
+UPDATE inventory SET stackable = FALSE
+WHERE lower(item_type) ~ '(weapon|武器|剑|刀|枪|戟|棍|鞭|弓|扇|armor|防具|甲|袍|衣|铠|accessory|饰品|戒|佩|坠|镯|链|簪|treasure|法宝|法器|灵宝|至宝)';
+
+-- 已经合并的装备按数量拆分，每件一条记录
+INSERT INTO inventory (
+    character_id, item_name, item_type, quality, level, quantity, stackable,
+    properties, description, obtained_from, obtained_at
+)
+SELECT character_id, item_name, item_type, quality, level, 1, FALSE,
+    properties, description, obtained_from, obtained_at
+FROM inventory, generate_series(2, quantity)
+WHERE NOT stackable AND quantity > 1;
+
+UPDATE inventory SET quantity = 1 WHERE NOT stackable AND quantity > 1;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- 用户增加每日和单轮对话的消耗灵石上限
+
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS daily_limit BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS turn_limit BIGINT NOT NULL DEFAULT 0;
+
+COMMIT;
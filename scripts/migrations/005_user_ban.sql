@@ -0,0 +1,8 @@
+-- 用户增加封禁状态
+
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ban_reason TEXT NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- 用户增加临时封禁和影子封禁
+
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_until TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS shadow_banned BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMIT;
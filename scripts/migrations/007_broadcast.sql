@@ -0,0 +1,7 @@
+-- 用户增加屏蔽机器人的记录，用于公告发送时跳过
+
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked_at TIMESTAMP;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- 角色名唯一，避免同时创建出同名角色
+-- 已有重名角色时需先处理重名，否则索引创建失败
+
+BEGIN;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_character_stats_name ON character_stats(name);
+
+COMMIT;
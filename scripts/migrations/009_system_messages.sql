@@ -0,0 +1,10 @@
+-- 消息增加系统提示标记，炼制结果、订单结果等系统提示不计入玩家发言统计
+
+BEGIN;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_system BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE messages SET is_system = TRUE
+WHERE role = 'user' AND EXISTS(SELECT 1 FROM jsonb_array_elements(content) part WHERE part->>'text' LIKE '[系统]:%');
+
+COMMIT;
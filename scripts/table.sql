@@ -5,23 +5,26 @@ CREATE TABLE IF NOT EXISTS users (
     created_at TIMESTAMP NOT NULL,
     total_recharged_token BIGINT NOT NULL,
     total_used_token BIGINT NOT NULL,
-    system_prompt TEXT NOT NULL
+    system_prompt TEXT NOT NULL,
+    active_character_id INTEGER, -- 当前激活的角色 (character_stats.id)
+    daily_limit BIGINT NOT NULL DEFAULT 0, -- 玩家设置的每日消耗灵石上限，0 表示使用默认上限
+    turn_limit BIGINT NOT NULL DEFAULT 0,  -- 玩家设置的单轮对话消耗灵石上限，0 表示使用默认上限
+    banned_at TIMESTAMP,                   -- 封禁时间，为空表示未封禁
+    banned_until TIMESTAMP,                -- 临时封禁的解封时间，为空表示永久封禁
+    shadow_banned BOOLEAN NOT NULL DEFAULT FALSE, -- 影子封禁，静默忽略用户的消息
+    blocked_at TIMESTAMP,                  -- 发现用户屏蔽机器人的时间，用户再次发消息时清除
+    ban_reason TEXT NOT NULL DEFAULT ''
 );
 
--- 消息表，存储用户的消息历史
-CREATE TABLE IF NOT EXISTS messages (
+-- 人物属性表，存储修仙者的基本属性（参考凡人修仙传设定），一个用户可以拥有多个角色
+CREATE TABLE IF NOT EXISTS character_stats (
     id SERIAL PRIMARY KEY,
     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    role VARCHAR(20) NOT NULL CHECK (role IN ('user', 'model', 'system')),
-    content JSONB NOT NULL, -- 存储完整的parts数组内容，包括thoughtSignature
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    llm_api_type VARCHAR(50) NOT NULL DEFAULT 'gemini'
-);
-
--- 人物属性表，存储修仙者的基本属性（参考凡人修仙传设定）
-CREATE TABLE IF NOT EXISTS character_stats (
-    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE UNIQUE,
     name VARCHAR(50) NOT NULL, -- 修仙者姓名
+
+    -- 转世信息
+    generation INTEGER NOT NULL DEFAULT 1, -- 第几世
+    previous_character_id INTEGER REFERENCES character_stats(id) ON DELETE SET NULL, -- 前世角色
     
     -- 修炼境界 (筑基期、结丹期、元婴期等)
     realm VARCHAR(20) NOT NULL DEFAULT '练气期',
@@ -63,12 +66,27 @@ CREATE TABLE IF NOT EXISTS character_stats (
     status VARCHAR(20) NOT NULL DEFAULT '健康',
 
     -- 成长经历
-    stories TEXT NOT NULL DEFAULT '' -- 成长经历
+    stories TEXT NOT NULL DEFAULT '', -- 成长经历
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 消息表，存储角色的消息历史
+CREATE TABLE IF NOT EXISTS messages (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    character_id INTEGER REFERENCES character_stats(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('user', 'model', 'system')),
+    content JSONB NOT NULL, -- 存储完整的parts数组内容，包括thoughtSignature
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    llm_api_type VARCHAR(50) NOT NULL DEFAULT 'gemini',
+    is_system BOOLEAN NOT NULL DEFAULT FALSE -- 以玩家身份写入的系统提示（炼制结果、订单结果等），不算玩家发言
 );
 
 -- 背包系统表 - 存储物品信息
 CREATE TABLE IF NOT EXISTS inventory (
-    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
     item_name VARCHAR(100) NOT NULL, -- 物品名称
     item_type VARCHAR(50) NOT NULL,  -- 物品类型 (weapon, armor, pill, material, book, talisman)
     
@@ -78,9 +96,10 @@ CREATE TABLE IF NOT EXISTS inventory (
     
     -- 数量和堆叠
     quantity INTEGER NOT NULL DEFAULT 1,            -- 数量
+    stackable BOOLEAN NOT NULL DEFAULT TRUE,        -- 是否可堆叠，不可堆叠的物品每件单独一条记录
     
     -- 物品属性
-    properties TEXT,  -- 存储物品的具体属性 (攻击力、防御力、特殊效果等)
+    properties JSONB, -- 物品的结构化属性 (属性加成、使用效果、耐久、绑定、五行等)
     
     -- 物品描述
     description TEXT,    -- 物品描述
@@ -92,7 +111,7 @@ CREATE TABLE IF NOT EXISTS inventory (
 
 -- 修炼功法表
 CREATE TABLE IF NOT EXISTS cultivation_techniques (
-    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
     technique_name VARCHAR(100) NOT NULL,     -- 功法名称
     technique_type VARCHAR(50) NOT NULL,      -- 功法类型 (cultivation, combat, movement, auxiliary)
     
@@ -115,23 +134,338 @@ CREATE TABLE IF NOT EXISTS cultivation_techniques (
     learned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+-- 闭关记录表
+CREATE TABLE IF NOT EXISTS retreats (
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    hours INTEGER NOT NULL,                         -- 计划闭关时长（小时）
+    status VARCHAR(20) NOT NULL DEFAULT 'ongoing',  -- ongoing, completed, interrupted
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ends_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP,
+    experience_gained BIGINT NOT NULL DEFAULT 0,    -- 获得的修炼经验
+    technique_name VARCHAR(100) NOT NULL DEFAULT '', -- 参悟的功法
+    progress_gained INTEGER NOT NULL DEFAULT 0,     -- 功法进度增加
+    previous_status VARCHAR(20) NOT NULL DEFAULT '' -- 闭关前的角色状态，出关后恢复
+);
+
+-- 玩家切磋表，赌注物品在结算前由系统托管
+CREATE TABLE IF NOT EXISTS duels (
+    id SERIAL PRIMARY KEY,
+    challenger_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE, -- 发起方角色
+    defender_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,   -- 应战方角色
+    stake_item_name VARCHAR(100) NOT NULL DEFAULT '', -- 双方各自押上的物品
+    stake_quantity INTEGER NOT NULL DEFAULT 0,
+    challenger_stake JSONB, -- 托管中的发起方赌注
+    defender_stake JSONB,   -- 托管中的应战方赌注
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, declined, expired, finished
+    winner_id INTEGER REFERENCES character_stats(id) ON DELETE SET NULL,
+    log TEXT NOT NULL DEFAULT '', -- 战斗日志
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP
+);
+
+-- 角色装备表，穿戴中的物品从背包中取出保存在这里
+CREATE TABLE IF NOT EXISTS equipment (
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    slot VARCHAR(20) NOT NULL,  -- weapon, armor, accessory, treasure
+    item JSONB NOT NULL,        -- 穿戴中的物品
+    modifiers JSONB,            -- 装备提供的属性加成
+    equipped_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (character_id, slot)
+);
+
+-- 临时增益表，使用丹药等物品获得
+CREATE TABLE IF NOT EXISTS buffs (
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    source VARCHAR(100) NOT NULL,  -- 来源物品
+    modifiers JSONB NOT NULL,      -- 属性加成
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- 配方表，角色掌握的丹方和器方
+CREATE TABLE IF NOT EXISTS recipes (
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    recipe_name VARCHAR(100) NOT NULL,
+    craft_type VARCHAR(20) NOT NULL DEFAULT 'alchemy', -- alchemy 炼丹, refining 炼器
+    ingredients JSONB NOT NULL,   -- 所需材料 [{item_name, quantity}]
+    output JSONB NOT NULL,        -- 成功时的产出物品
+    waste JSONB,                  -- 失败时的废品
+    required_technique VARCHAR(100) NOT NULL DEFAULT '', -- 需要掌握的功法
+    required_realm VARCHAR(20) NOT NULL DEFAULT '',      -- 需要达到的境界
+    required_realm_level INTEGER NOT NULL DEFAULT 0,
+    success_rate INTEGER NOT NULL DEFAULT 50, -- 基础成功率 (0-100)
+    minutes INTEGER NOT NULL DEFAULT 60,      -- 炼制所需时间（分钟）
+    learned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (character_id, recipe_name)
+);
+
+-- 配方名录，由管理员设定，角色只能学习名录中的配方
+CREATE TABLE IF NOT EXISTS recipe_catalog (
+    id SERIAL PRIMARY KEY,
+    recipe_name VARCHAR(100) NOT NULL UNIQUE,
+    craft_type VARCHAR(20) NOT NULL DEFAULT 'alchemy', -- alchemy 炼丹, refining 炼器
+    ingredients JSONB NOT NULL,   -- 所需材料 [{item_name, quantity}]
+    output JSONB NOT NULL,        -- 成功时的产出物品
+    waste JSONB,                  -- 失败时的废品
+    required_technique VARCHAR(100) NOT NULL DEFAULT '', -- 需要掌握的功法
+    required_realm VARCHAR(20) NOT NULL DEFAULT '',      -- 需要达到的境界
+    required_realm_level INTEGER NOT NULL DEFAULT 0,
+    success_rate INTEGER NOT NULL DEFAULT 50, -- 基础成功率 (0-100)
+    minutes INTEGER NOT NULL DEFAULT 60,      -- 炼制所需时间（分钟）
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 炼制记录表，材料在开始时扣除，到期后结算产出
+CREATE TABLE IF NOT EXISTS crafts (
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    recipe_name VARCHAR(100) NOT NULL,
+    recipe JSONB NOT NULL,                          -- 开始炼制时的配方快照
+    furnace_name VARCHAR(100) NOT NULL DEFAULT '',  -- 使用的丹炉或器炉
+    success_rate INTEGER NOT NULL,                  -- 最终成功率 (0-100)
+    status VARCHAR(20) NOT NULL DEFAULT 'ongoing',  -- ongoing, succeeded, failed
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ends_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP,
+    result JSONB                                    -- 炼制产出的物品
+);
+
+-- 掉落表，由管理员按地点和敌人等级设定
+CREATE TABLE IF NOT EXISTS loot_tables (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    location VARCHAR(100) NOT NULL DEFAULT '', -- 地点关键字，为空时适用于任意地点
+    enemy_tier INTEGER NOT NULL DEFAULT 0,     -- 敌人等级，0 表示任意
+    rolls INTEGER NOT NULL DEFAULT 1,          -- 每次抽取的次数
+    entries JSONB NOT NULL,                    -- 掉落项 [{item, weight, min_quantity, max_quantity}]
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 掉落抽取记录表
+CREATE TABLE IF NOT EXISTS loot_rolls (
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    loot_table_id INTEGER REFERENCES loot_tables(id) ON DELETE SET NULL,
+    location VARCHAR(100) NOT NULL DEFAULT '',
+    enemy_tier INTEGER NOT NULL DEFAULT 0,
+    rolled JSONB NOT NULL,                     -- 掷出的物品
+    granted BOOLEAN NOT NULL DEFAULT FALSE,    -- 是否已放入背包
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 物品发放记录表，用于审计各来源实际发放的物品
+CREATE TABLE IF NOT EXISTS item_grants (
+    id SERIAL PRIMARY KEY,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    source VARCHAR(20) NOT NULL,               -- loot, gm, combat, purchase, craft
+    loot_roll_id INTEGER REFERENCES loot_rolls(id) ON DELETE SET NULL,
+    item_name VARCHAR(100) NOT NULL,
+    quality VARCHAR(20) NOT NULL DEFAULT '',
+    quantity INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 商店商品表，价格和库存由管理员设定
+CREATE TABLE IF NOT EXISTS shop_items (
+    id SERIAL PRIMARY KEY,
+    item JSONB NOT NULL,                       -- 商品物品，数量为每份的件数
+    price BIGINT NOT NULL,                     -- 每份的灵石价格
+    stock INTEGER NOT NULL DEFAULT -1,         -- 剩余库存（份），-1 表示不限
+    active BOOLEAN NOT NULL DEFAULT TRUE,      -- 是否上架
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 购买订单表，玩家确认后才扣除灵石
+CREATE TABLE IF NOT EXISTS orders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    character_id INTEGER NOT NULL REFERENCES character_stats(id) ON DELETE CASCADE,
+    lines JSONB NOT NULL,                      -- 订单明细 [{shop_item_id, quantity, item_name, unit_price}]
+    total BIGINT NOT NULL,                     -- 下单时报价的总价
+    items JSONB,                               -- 成交后放入背包的物品
+    balance_before BIGINT,                     -- 成交前的灵石余额
+    balance_after BIGINT,                      -- 成交后的灵石余额
+    message_id BIGINT NOT NULL DEFAULT 0,      -- 触发购买的玩家消息
+    turn TEXT NOT NULL DEFAULT '',             -- 触发购买的玩家发言
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, confirmed, cancelled, expired, failed, refunded
+    result TEXT NOT NULL DEFAULT '',           -- 失败或退款原因
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP,
+    refunded_at TIMESTAMP
+);
+
+-- 灵石兑换码表，由管理员批量生成
+CREATE TABLE IF NOT EXISTS redeem_codes (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    batch VARCHAR(50) NOT NULL DEFAULT '',     -- 批次名
+    amount BIGINT NOT NULL,                    -- 每次兑换获得的灵石
+    max_uses INTEGER NOT NULL DEFAULT 1,       -- 最多可被多少位玩家使用
+    used_count INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP,                      -- 为空表示永不过期
+    created_by BIGINT NOT NULL DEFAULT 0,      -- 创建者的 Telegram ID
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 兑换记录表，每位玩家每个兑换码只能使用一次
+CREATE TABLE IF NOT EXISTS redemptions (
+    id SERIAL PRIMARY KEY,
+    code_id INTEGER NOT NULL REFERENCES redeem_codes(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (code_id, user_id)
+);
+
+-- Telegram Stars 充值表，以 Telegram 的支付ID去重
+CREATE TABLE IF NOT EXISTS star_payments (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    charge_id VARCHAR(255) NOT NULL UNIQUE,   -- telegram_payment_charge_id
+    provider_charge_id VARCHAR(255) NOT NULL DEFAULT '',
+    package_id VARCHAR(50) NOT NULL,
+    stars INTEGER NOT NULL,                    -- 支付的 Stars 数
+    amount BIGINT NOT NULL,                    -- 充值的灵石
+    status VARCHAR(20) NOT NULL DEFAULT 'paid', -- paid, refunded
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    refunded_at TIMESTAMP
+);
+
+-- 模型用量明细表，每轮对话按模型记录一行，便于核对扣费
+CREATE TABLE IF NOT EXISTS usage_records (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    character_id INTEGER REFERENCES character_stats(id) ON DELETE SET NULL,
+    kind VARCHAR(20) NOT NULL,                 -- chat, register, reincarnate, retreat
+    model VARCHAR(100) NOT NULL,
+    input_tokens BIGINT NOT NULL DEFAULT 0,
+    output_tokens BIGINT NOT NULL DEFAULT 0,
+    thinking_tokens BIGINT NOT NULL DEFAULT 0,
+    cached_tokens BIGINT NOT NULL DEFAULT 0,
+    image_tokens BIGINT NOT NULL DEFAULT 0,
+    cost BIGINT NOT NULL,                      -- 扣除的灵石
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 管理员操作审计日志
+CREATE TABLE IF NOT EXISTS admin_audit_logs (
+    id SERIAL PRIMARY KEY,
+    admin_tg_id BIGINT NOT NULL,               -- 执行操作的管理员 Telegram ID
+    action VARCHAR(50) NOT NULL,
+    target_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL, -- 被操作的用户
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 邀请名单，仅邀请模式下名单中的用户可以创建账号，按 Telegram ID 或用户名匹配
+CREATE TABLE IF NOT EXISTS allowlist (
+    id SERIAL PRIMARY KEY,
+    tg_id BIGINT UNIQUE,
+    username VARCHAR(50) UNIQUE,               -- 小写，不含 @
+    added_by BIGINT NOT NULL,                  -- 添加者的 Telegram ID
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (tg_id IS NOT NULL OR username IS NOT NULL)
+);
+
+-- 违规记录表，提示注入和刷屏各记一次，短时间内多次违规自动临时封禁
+CREATE TABLE IF NOT EXISTS abuse_strikes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,                 -- injection, spam
+    content TEXT NOT NULL DEFAULT '',          -- 触发违规的发言
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 公告表，管理员预览确认后立即或定时发送
+CREATE TABLE IF NOT EXISTS broadcasts (
+    id SERIAL PRIMARY KEY,
+    created_by BIGINT NOT NULL,                -- 创建者的 Telegram ID
+    target VARCHAR(20) NOT NULL,               -- all, active, realm, location
+    target_value TEXT NOT NULL DEFAULT '',     -- 活跃天数、境界或地点
+    text TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'draft', -- draft, scheduled, sending, sent, cancelled
+    scheduled_at TIMESTAMP,                    -- 定时发送的时间，为空表示确认后立即发送
+    cursor_user_id INTEGER NOT NULL DEFAULT 0, -- 已经发送到的用户ID，重启后从这里继续
+    sent INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    blocked INTEGER NOT NULL DEFAULT 0,        -- 屏蔽了机器人的用户数
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP
+);
+
+-- 用户表索引，按 @用户名 查找时不区分大小写
+CREATE INDEX IF NOT EXISTS idx_users_username_lower ON users(lower(username));
+
 -- 消息表索引
 CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages(user_id);
 CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
 CREATE INDEX IF NOT EXISTS idx_messages_user_created ON messages(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_messages_character_created ON messages(character_id, created_at);
 
 -- 人物属性表索引
 CREATE INDEX IF NOT EXISTS idx_character_stats_user_id ON character_stats(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_character_stats_name ON character_stats(name);
 CREATE INDEX IF NOT EXISTS idx_character_stats_realm ON character_stats(realm, realm_level);
 CREATE INDEX IF NOT EXISTS idx_character_stats_location ON character_stats(location);
 
 -- 背包表索引
-CREATE INDEX IF NOT EXISTS idx_inventory_user_id ON inventory(user_id);
+CREATE INDEX IF NOT EXISTS idx_inventory_character_id ON inventory(character_id);
 CREATE INDEX IF NOT EXISTS idx_inventory_item_type ON inventory(item_type);
-CREATE INDEX IF NOT EXISTS idx_inventory_user_type ON inventory(user_id, item_type);
+CREATE INDEX IF NOT EXISTS idx_inventory_character_type ON inventory(character_id, item_type);
+CREATE INDEX IF NOT EXISTS idx_inventory_character_name ON inventory(character_id, item_name);
 
 -- 功法表索引
-CREATE INDEX IF NOT EXISTS idx_cultivation_techniques_user_id ON cultivation_techniques(user_id);
+CREATE INDEX IF NOT EXISTS idx_cultivation_techniques_character_id ON cultivation_techniques(character_id);
 CREATE INDEX IF NOT EXISTS idx_cultivation_techniques_type ON cultivation_techniques(technique_type);
 CREATE INDEX IF NOT EXISTS idx_cultivation_techniques_quality ON cultivation_techniques(quality);
 
+-- 闭关记录表索引
+CREATE INDEX IF NOT EXISTS idx_retreats_character_id ON retreats(character_id);
+CREATE INDEX IF NOT EXISTS idx_retreats_status_ends ON retreats(status, ends_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_retreats_character_ongoing ON retreats(character_id) WHERE status = 'ongoing'; -- 每个角色同时只能有一次闭关
+
+-- 玩家切磋表索引
+CREATE INDEX IF NOT EXISTS idx_duels_challenger_id ON duels(challenger_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_duels_defender_id ON duels(defender_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_duels_status_created ON duels(status, created_at);
+
+-- 临时增益表索引
+CREATE INDEX IF NOT EXISTS idx_buffs_character_expires ON buffs(character_id, expires_at);
+
+-- 炼制记录表索引
+CREATE INDEX IF NOT EXISTS idx_crafts_character_status ON crafts(character_id, status);
+CREATE INDEX IF NOT EXISTS idx_crafts_status_ends ON crafts(status, ends_at);
+
+-- 掉落与发放记录表索引
+CREATE INDEX IF NOT EXISTS idx_loot_rolls_character_created ON loot_rolls(character_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_item_grants_created ON item_grants(created_at);
+CREATE INDEX IF NOT EXISTS idx_item_grants_character_created ON item_grants(character_id, created_at);
+
+-- 购买订单表索引
+CREATE INDEX IF NOT EXISTS idx_orders_user_created ON orders(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_orders_status_created ON orders(status, created_at);
+
+-- 兑换码表索引
+CREATE INDEX IF NOT EXISTS idx_redeem_codes_batch ON redeem_codes(batch);
+CREATE INDEX IF NOT EXISTS idx_redemptions_user_created ON redemptions(user_id, created_at);
+
+-- Stars 充值表索引
+CREATE INDEX IF NOT EXISTS idx_star_payments_user_created ON star_payments(user_id, created_at);
+
+-- 模型用量明细表索引
+CREATE INDEX IF NOT EXISTS idx_usage_records_user_created ON usage_records(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_usage_records_created ON usage_records(created_at);
+
+-- 管理员操作审计日志索引
+CREATE INDEX IF NOT EXISTS idx_admin_audit_logs_created ON admin_audit_logs(created_at);
+CREATE INDEX IF NOT EXISTS idx_admin_audit_logs_target_created ON admin_audit_logs(target_user_id, created_at);
+
+-- 违规记录表索引
+CREATE INDEX IF NOT EXISTS idx_abuse_strikes_user_created ON abuse_strikes(user_id, created_at);
+
+-- 公告表索引
+CREATE INDEX IF NOT EXISTS idx_broadcasts_status_scheduled ON broadcasts(status, scheduled_at);